@@ -2,8 +2,12 @@
 package flotilla
 
 import (
+	"errors"
+	"github.com/hashicorp/raft"
 	mdb "github.com/jbooth/gomdb"
+	"io"
 	"net"
+	"time"
 )
 
 // Represents a DB.
@@ -48,10 +52,65 @@ type DB interface {
 	// leader addr, same disclaimer as IsLeader()
 	Leader() net.Addr
 
+	// Reads up to max committed commands from the local raft log, starting at fromIndex,
+	// waiting up to timeout for fromIndex to be applied locally.
+	// Returns the entries and the index to resume reading from.
+	// Returns ErrCompacted if fromIndex has been compacted away into a snapshot.
+	ReadLog(fromIndex uint64, max int, timeout time.Duration) ([]LogEntry, uint64, error)
+
+	// index of the last command applied to our local copy of the database
+	AppliedIndex() uint64
+
+	// index of the last command committed cluster-wide, as of the leader's last contact
+	// if we're a follower.  how far AppliedIndex is behind it is how stale our copy is.
+	CommitIndex() uint64
+
+	// when we last heard from the leader, now if we are leader, zero if never
+	LastContact() time.Time
+
+	// waits up to timeout for index to be applied to our local copy, returns the last applied index
+	WaitApplied(index uint64, timeout time.Duration) uint64
+
+	// index everything committed cluster-wide before the call is at or below, without
+	// appending to the log.  the leader confirms with a quorum it's still leader, or skips
+	// that while its lease holds with Options.LeaseReads.  followers ask the leader.
+	// a Read() once WaitApplied reaches it is linearizable.
+	ReadIndex(timeout time.Duration) (uint64, error)
+
+	// how much of our local copy's memory map is in use
+	MapInfo() (MapInfo, error)
+
+	// grows our local copy's memory map to size bytes.  map size is per node, not replicated.
+	// new txns wait while open ones drain, if they don't within timeout nothing changes
+	// and an error is returned.
+	GrowMap(size uint64, timeout time.Duration) error
+
+	// rewrites our local copy's data file without its free pages.  reads carry on, but
+	// applying writes pauses until the copy is swapped in.  blocks until done.
+	Compact() (CompactStats, error)
+
+	// adds a voting member to the cluster.  a snapshot is taken first so a member starting
+	// empty is sent our current copy rather than replaying the whole log.
+	// only the leader can change membership, others get ErrNotLeader.
+	AddPeer(addr net.Addr) error
+
+	// removes a member from the cluster, ErrNotLeader if we're not leader
+	RemovePeer(addr net.Addr) error
+
+	// connections for a service code from Options.Services, sharing our port with raft.
+	// Dial connects to the same service on another member.  nil if code wasn't asked for.
+	Service(code byte) raft.StreamLayer
+
 	// shuts down this instance
 	Close() error
 }
 
+// returned by membership changes on a node that isn't leader
+var ErrNotLeader = raft.ErrNotLeader
+
+// returned by ReadIndex when the leader didn't answer within the timeout
+var ErrReadIndexTimeout = errors.New("timed out waiting for read index from leader")
+
 // we implement a few standard utility ops on top of the BaseDB
 type DefaultOpsDB interface {
 	DB
@@ -75,6 +134,49 @@ type DefaultOpsDB interface {
 // command names.
 type Command func(args [][]byte, txn *mdb.Txn) ([]byte, error)
 
+// Wraps snapshot streams on their way to and from disk, for instance to encrypt them.
+// Snapshots are shipped to followers as written, so they're wrapped on the wire too.
+type SnapshotCodec interface {
+	// WrapWriter wraps a snapshot being written, Close flushes but doesn't close w
+	WrapWriter(w io.Writer) (io.WriteCloser, error)
+	// WrapReader unwraps a snapshot written through WrapWriter
+	WrapReader(r io.Reader) (io.Reader, error)
+}
+
+// Seals commands before they go in the raft log, for instance to encrypt them.
+// Every member has to be able to open what any of them sealed.
+type CommandCodec interface {
+	// Seal wraps an encoded command before it's logged
+	Seal(cmd []byte) ([]byte, error)
+	// Open unwraps a command sealed with Seal
+	Open(sealed []byte) ([]byte, error)
+}
+
+// Options for NewDBWithOptions, zero values give the defaults
+type Options struct {
+	Codec    SnapshotCodec // wraps snapshots, nil stores them as is
+	Commands CommandCodec  // seals commands in the raft log, nil logs them as is
+	MapSize  uint64        // initial size of the local memory map, 0 for DefaultMapSize
+	// ReadIndex on the leader skips confirming leadership while a quorum has heard from
+	// it within raft's lease timeout, trades a heartbeat round per read for trusting clocks
+	LeaseReads bool
+	// more service codes to accept connections for on our listener, for the caller's own
+	// traffic between members, see DB.Service.  0 and 1 are taken by raft and flotilla.
+	// members that don't serve a code drop connections for it
+	Services []byte
+}
+
+type MapInfo struct {
+	Used uint64 // bytes up to the highest page written, lmdb reuses freed pages below it
+	Size uint64 // bytes mapped, writes fail with MDB_MAP_FULL past this
+}
+
+type CompactStats struct {
+	Before uint64        // disk used by the data file before
+	After  uint64        // and after
+	Pause  time.Duration // how long writes waited for the copy and swap
+}
+
 type Result struct {
 	Response []byte
 	Err      error
@@ -0,0 +1,131 @@
+package flotilla
+
+import (
+	"errors"
+	"github.com/hashicorp/raft"
+	"strconv"
+	"time"
+)
+
+// returned by ReadLog when the requested index has been compacted out of the raft log
+// into a snapshot, consumers need to re-sync from a copy of the data and resume from a later index
+var ErrCompacted = errors.New("requested index has been compacted out of the log")
+
+// a command as it was committed to the raft log
+type LogEntry struct {
+	Index uint64
+	Term  uint64
+	Cmd   string
+	Args  [][]byte
+}
+
+// reads up to max committed commands starting at fromIndex.
+// blocks up to timeout for fromIndex to be applied locally if we haven't got there yet.
+// returns the entries read and the index to resume from, which can be past the last entry
+// returned since raft-internal entries (noops, peer changes) are skipped.
+func (s *server) ReadLog(fromIndex uint64, max int, timeout time.Duration) ([]LogEntry, uint64, error) {
+	if fromIndex == 0 {
+		fromIndex = 1
+	}
+	applied := s.state.waitApplied(fromIndex, timeout)
+	ret := make([]LogEntry, 0)
+	if applied < fromIndex {
+		// nothing new yet
+		return ret, fromIndex, nil
+	}
+	first, err := s.logs.FirstIndex()
+	if err != nil {
+		return nil, fromIndex, err
+	}
+	if first == 0 || fromIndex < first {
+		return nil, fromIndex, ErrCompacted
+	}
+	idx := fromIndex
+	for ; idx <= applied && len(ret) < max; idx++ {
+		l := &raft.Log{}
+		err = s.logs.GetLog(idx, l)
+		if err == raft.ErrLogNotFound {
+			// compacted out from under us
+			return nil, fromIndex, ErrCompacted
+		} else if err != nil {
+			return nil, fromIndex, err
+		}
+		if l.Type != raft.LogCommand {
+			continue
+		}
+		cmd, err := s.state.decodeCommand(l.Data)
+		if err != nil {
+			return nil, fromIndex, err
+		}
+		ret = append(ret, LogEntry{l.Index, l.Term, cmd.Cmd, cmd.Args})
+	}
+	return ret, idx, nil
+}
+
+// returns the last index applied to our local state
+func (s *server) AppliedIndex() uint64 {
+	return s.state.appliedIndex()
+}
+
+// raft only hands out its commit index through Stats
+func (s *server) CommitIndex() uint64 {
+	idx, _ := strconv.ParseUint(s.raft.Stats()["commit_index"], 10, 64)
+	return idx
+}
+
+func (s *server) LastContact() time.Time {
+	if s.IsLeader() {
+		return time.Now()
+	}
+	return s.raft.LastContact()
+}
+
+// raft only hands commands to our state machine, so no-ops and peer changes past the
+// last command we applied count as applied once raft has got to them
+func (s *server) WaitApplied(index uint64, timeout time.Duration) uint64 {
+	deadline := time.Now().Add(timeout)
+	for {
+		applied := s.state.appliedIndex()
+		if applied >= index {
+			return applied
+		}
+		if s.onlyNonCommands(applied, index) {
+			return index
+		}
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return applied
+		}
+		if wait > 10*time.Millisecond {
+			// raft getting to non-commands doesn't wake us
+			wait = 10 * time.Millisecond
+		}
+		s.state.waitApplied(applied+1, wait)
+	}
+}
+
+// true if raft has got to index and nothing after applied up to it is a command.
+// entries up to the last snapshot are in our copy whatever we last applied, we restored it
+// or took it.  gives up past a page of entries, there's bound to be a command in there.
+func (s *server) onlyNonCommands(applied uint64, index uint64) bool {
+	stats := s.raft.Stats()
+	raftApplied, _ := strconv.ParseUint(stats["applied_index"], 10, 64)
+	snapshot, _ := strconv.ParseUint(stats["last_snapshot_index"], 10, 64)
+	if raftApplied < index {
+		return false
+	}
+	from := applied + 1
+	if snapshot >= from {
+		from = snapshot + 1
+	}
+	if index >= from+64 {
+		return false
+	}
+	l := &raft.Log{}
+	for i := from; i <= index; i++ {
+		if err := s.logs.GetLog(i, l); err != nil || l.Type == raft.LogCommand {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package flotilla
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// online compaction.  lmdb never gives freed pages back to the filesystem, so we copy
+// every table into a fresh env and swap the new file in.  Apply is paused for the whole
+// copy rather than replaying what it applied meanwhile, since commands re-run later see a
+// different clock and process state than when they were first applied and the copy could
+// come out different from the data we serve.  reads carry on throughout.
+// the applied index doesn't move across the swap, so raft and the data stay in step.
+
+const compactBatch = 10000 // entries per write txn while copying
+
+var (
+	replayingL = &sync.Mutex{}
+	replaying  = make(map[*mdb.Txn]bool)
+)
+
+// true while txn is replaying a command that was already applied, from the log after a restart.
+// commands with side effects outside the txn, like notifying clients, should skip them.
+func Replaying(txn *mdb.Txn) bool {
+	replayingL.Lock()
+	defer replayingL.Unlock()
+	return replaying[txn]
+}
+
+func setReplaying(txn *mdb.Txn, r bool) {
+	replayingL.Lock()
+	defer replayingL.Unlock()
+	if r {
+		replaying[txn] = true
+	} else {
+		delete(replaying, txn)
+	}
+}
+
+func (f *flotillaState) compact() (CompactStats, error) {
+	stats := CompactStats{}
+	f.applyL.Lock()
+	defer f.applyL.Unlock()
+	pauseStart := time.Now()
+	src := f.env
+	info, err := src.mapInfo()
+	if err != nil {
+		return stats, err
+	}
+	stats.Before = diskUsage(f.dataPath + "/data.mdb")
+	compactPath := f.tempPath + "/compact"
+	os.RemoveAll(compactPath)
+	if err = os.MkdirAll(compactPath, 0755); err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(compactPath)
+	dst, err := newenv(compactPath, info.Size)
+	if err != nil {
+		return stats, err
+	}
+	txn, err := src.readTxn()
+	if err != nil {
+		dst.Close()
+		return stats, err
+	}
+	err = copyTables(txn, dst)
+	txn.Abort()
+	dst.Close()
+	if err != nil {
+		return stats, err
+	}
+	// swap it in, same as Restore
+	f.l.Lock()
+	defer f.l.Unlock()
+	if err = syscall.Unlink(f.dataPath + "/lock.mdb"); err != nil {
+		return stats, err
+	}
+	if err = os.Rename(compactPath+"/data.mdb", f.dataPath+"/data.mdb"); err != nil {
+		return stats, err
+	}
+	// old env closes once the last txn against it does
+	f.env.Close()
+	f.env, err = newenv(f.dataPath, f.mapSize)
+	if err != nil {
+		return stats, err
+	}
+	stats.Pause = time.Since(pauseStart)
+	stats.After = diskUsage(f.dataPath + "/data.mdb")
+	f.lg.Printf("Compacted %d bytes to %d at index %d, paused writes for %s",
+		stats.Before, stats.After, f.appliedIndex(), stats.Pause)
+	return stats, nil
+}
+
+// copies every named table in txn's env into dst.  keys come out of the cursor in order
+// so they're appended, which packs pages full.  tables with duplicate keys aren't supported.
+func copyTables(txn *mdb.Txn, dst *env) error {
+	mainDBI, err := txn.DBIOpen(nil, 0)
+	if err != nil {
+		return err
+	}
+	c, err := txn.CursorOpen(mainDBI)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	k, _, err := c.Get(nil, mdb.FIRST)
+	for err == nil {
+		names = append(names, string(k))
+		k, _, err = c.Get(nil, mdb.NEXT)
+	}
+	c.Close()
+	if err != mdb.NotFound {
+		return err
+	}
+	for _, name := range names {
+		err = copyTable(txn, dst, name)
+		if err != nil {
+			return fmt.Errorf("Error copying table %s : %s", name, err)
+		}
+	}
+	return nil
+}
+
+func copyTable(txn *mdb.Txn, dst *env, name string) error {
+	srcDBI, err := txn.DBIOpen(&name, 0)
+	if err != nil {
+		return err
+	}
+	c, err := txn.CursorOpen(srcDBI)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	k, v, err := c.Get(nil, mdb.FIRST)
+	for {
+		w, err2 := dst.writeTxn()
+		if err2 != nil {
+			return err2
+		}
+		dstDBI, err2 := w.DBIOpen(&name, mdb.CREATE)
+		if err2 != nil {
+			w.Abort()
+			return err2
+		}
+		for n := 0; err == nil && n < compactBatch; n++ {
+			err2 = w.Put(dstDBI, k, v, mdb.APPEND)
+			if err2 != nil {
+				w.Abort()
+				return err2
+			}
+			k, v, err = c.Get(nil, mdb.NEXT)
+		}
+		err2 = w.Commit()
+		if err2 != nil {
+			return err2
+		}
+		if err == mdb.NotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// bytes of disk the file takes, with WRITEMAP it's sized to the whole map but sparse
+func diskUsage(path string) uint64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0
+	}
+	return uint64(st.Blocks) * 512
+}
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	mdb "github.com/jbooth/gomdb"
 	"sync"
+	"time"
 )
 
+// map size used when none is configured
+const DefaultMapSize = 32 * 1024 * 1024 * 1024
+
 // wrapper for mdb env that waits until all outstanding read txns closed
 // before closing env
 type env struct {
@@ -14,9 +18,12 @@ type env struct {
 	numOpen     uint64
 	shouldClose bool
 	closed      bool
+	active      int           // txns and copies open against the map right now
+	resizing    bool          // new txns wait while set
+	resized     chan struct{} // closed when resizing clears
 }
 
-func newenv(filePath string) (*env, error) {
+func newenv(filePath string, mapSize uint64) (*env, error) {
 	e, err := mdb.NewEnv()
 	if err != nil {
 		return nil, err
@@ -25,20 +32,24 @@ func newenv(filePath string) (*env, error) {
 	// TODO make these configurable
 	e.SetMaxReaders(1024)
 	e.SetMaxDBs(1024)
-	e.SetMapSize(32 * 1024 * 1024 * 1024)
+	if mapSize == 0 {
+		mapSize = DefaultMapSize
+	}
+	e.SetMapSize(mapSize)
 	// disable fsync because we are guaranteeing consistency/durability via raft snapshotting and edit logs
 	err = e.Open(filePath, mdb.WRITEMAP|mdb.NOSYNC|mdb.NOTLS, 0766)
 	if err != nil {
 		e.Close()
 		return nil, err
 	}
-	return &env{e, new(sync.Mutex), 0, false, false}, nil
+	return &env{e, new(sync.Mutex), 0, false, false, 0, false, nil}, nil
 }
 
 // opens a read transaction,
 func (e *env) readTxn() (*mdb.Txn, error) {
 	e.l.Lock()
 	defer e.l.Unlock()
+	e.waitResize()
 	if e.shouldClose {
 		// should never happen
 		return nil, fmt.Errorf("Environment is marked as closing, no new txns allowed!")
@@ -48,6 +59,7 @@ func (e *env) readTxn() (*mdb.Txn, error) {
 		return nil, err
 	}
 	e.numOpen++
+	e.track(t)
 	return t, nil
 }
 
@@ -56,6 +68,7 @@ func (e *env) readTxn() (*mdb.Txn, error) {
 func (e *env) writeTxn() (*mdb.Txn, error) {
 	e.l.Lock()
 	defer e.l.Unlock()
+	e.waitResize()
 	if e.shouldClose {
 		// should never happen
 		return nil, fmt.Errorf("Environment is marked as closing, no new txns allowed!")
@@ -64,9 +77,111 @@ func (e *env) writeTxn() (*mdb.Txn, error) {
 	if err != nil {
 		return nil, err
 	}
+	e.track(t)
 	return t, nil
 }
 
+// counts t as active until it's committed or aborted.  must hold e.l
+func (e *env) track(t *mdb.Txn) {
+	e.active++
+	t.OnClose(e.release)
+}
+
+func (e *env) release() {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.active--
+	if e.shouldClose && e.active == 0 && !e.closed {
+		e.e.Close()
+		e.closed = true
+	}
+}
+
+// blocks while a resize is in progress.  must hold e.l, drops it while waiting
+func (e *env) waitResize() {
+	for e.resizing {
+		ch := e.resized
+		e.l.Unlock()
+		<-ch
+		e.l.Lock()
+	}
+}
+
+// keeps the env open and its map size fixed until release, for work outside a txn like copies
+func (e *env) hold() error {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.waitResize()
+	if e.shouldClose {
+		return fmt.Errorf("Environment is marked as closing, no new txns allowed!")
+	}
+	e.active++
+	return nil
+}
+
+// copies the env to fd, caller must hold() it
+func (e *env) copyFd(fd int) error {
+	return e.e.CopyFd(fd)
+}
+
+// lmdb can only change the map size with no txns open in the process, so this stops new
+// txns from starting and waits up to timeout for open ones to finish before resizing.
+// if they don't finish in time the resize is abandoned and txns carry on.
+func (e *env) setMapSize(size uint64, timeout time.Duration) error {
+	e.l.Lock()
+	if e.resizing {
+		e.l.Unlock()
+		return fmt.Errorf("Resize already in progress")
+	}
+	e.resizing = true
+	e.resized = make(chan struct{})
+	e.l.Unlock()
+	defer func() {
+		e.l.Lock()
+		e.resizing = false
+		close(e.resized)
+		e.l.Unlock()
+	}()
+	deadline := time.Now().Add(timeout)
+	for {
+		e.l.Lock()
+		if e.shouldClose {
+			e.l.Unlock()
+			return fmt.Errorf("Environment closed, not resizing")
+		}
+		if e.active == 0 {
+			// still holding e.l so nothing can start
+			err := e.e.SetMapSize(size)
+			e.l.Unlock()
+			return err
+		}
+		active := e.active
+		e.l.Unlock()
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Gave up resizing map, %d txns still open after %s", active, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// bytes of the map in use and the map's size
+func (e *env) mapInfo() (MapInfo, error) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if e.closed {
+		return MapInfo{}, fmt.Errorf("Environment closed")
+	}
+	info, err := e.e.Info()
+	if err != nil {
+		return MapInfo{}, err
+	}
+	stat, err := e.e.Stat()
+	if err != nil {
+		return MapInfo{}, err
+	}
+	return MapInfo{(info.LastPNO + 1) * uint64(stat.PSize), info.MapSize}, nil
+}
+
 // aborts transactionsuppressing any errors, and frees
 func (e *env) CloseTransaction(t *mdb.Txn) error {
 	t.Abort() // ignore error
@@ -87,7 +202,13 @@ func (e *env) Close() error {
 	e.l.Lock()
 	defer e.l.Unlock()
 	e.shouldClose = true
+	if e.closed {
+		return nil
+	}
 	e.e.Sync(1)
-	e.e.Close()
+	if e.active == 0 {
+		e.e.Close()
+		e.closed = true
+	}
 	return nil
 }
@@ -121,7 +121,14 @@ func (r *router) serve() {
 				conn.Close()
 				continue
 			}
-			r.chans[code[0]].conns <- conn
+			service, ok := r.chans[code[0]]
+			if !ok {
+				// a newer member dialing a service we don't run
+				r.lg.Printf("No service for code %d on conn from %s, discarding", code[0], conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			service.conns <- conn
 		case toClose := <-r.closeRequests:
 			close(r.chans[toClose.code].conns)
 			delete(r.chans, toClose.code)
@@ -1,6 +1,7 @@
 package flotilla
 
 import (
+	"io"
 	"log"
 	"net"
 	"os"
@@ -60,6 +61,47 @@ func TestMultiStream(t *testing.T) {
 	}
 }
 
+func TestMultiStreamUnknownCode(t *testing.T) {
+	testLog := log.New(os.Stderr, "TestMultiStreamUnknownCode ", log.LstdFlags)
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:1104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamLayers, err := NewMultiStream(listen, defaultDialer, addr, testLog, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoServer(streamLayers[0], 0, testLog)
+	// a code nobody serves gets hung up on
+	unknown, err := dialWithCode(defaultDialer, 9, "127.0.0.1:1104", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = unknown.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("Expected conn for unknown code to be closed")
+	}
+	// and the router's still up for the rest
+	conn, err := streamLayers[0].Dial("127.0.0.1:1104", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte{5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBytes := make([]byte, 2)
+	_, err = io.ReadFull(conn, respBytes)
+	if err != nil || respBytes[0] != 5 || respBytes[1] != 0 {
+		t.Fatalf("Expected 5,0 after unknown code, got %d,%d err %s", respBytes[0], respBytes[1], err)
+	}
+}
+
 // for every byte sent to us, sends back 2 bytes:  original sent and our code
 func echoServer(l net.Listener, myCode byte, lg *log.Logger) {
 	for {
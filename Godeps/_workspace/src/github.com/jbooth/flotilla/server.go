@@ -53,6 +53,31 @@ func NewDB(
 	dialer func(string, time.Duration) (net.Conn, error),
 	commands map[string]Command,
 	logOut io.Writer) (DB, error) {
+	return NewDBWithCodec(peers, dataDir, listen, dialer, commands, nil, logOut)
+}
+
+// Same as NewDB, but snapshots are passed through codec on their way to and from disk.
+// A nil codec stores them as is.
+func NewDBWithCodec(
+	peers []string,
+	dataDir string,
+	listen net.Listener,
+	dialer func(string, time.Duration) (net.Conn, error),
+	commands map[string]Command,
+	codec SnapshotCodec,
+	logOut io.Writer) (DB, error) {
+	return NewDBWithOptions(peers, dataDir, listen, dialer, commands, Options{Codec: codec}, logOut)
+}
+
+// Same as NewDB with options for snapshots and storage.
+func NewDBWithOptions(
+	peers []string,
+	dataDir string,
+	listen net.Listener,
+	dialer func(string, time.Duration) (net.Conn, error),
+	commands map[string]Command,
+	opts Options,
+	logOut io.Writer) (DB, error) {
 	lg := log.New(logOut, "flotilla", log.LstdFlags)
 	lg.Printf("Starting server with peers %+v, dataDir %s\n", peers, dataDir)
 	raftDir := dataDir + "/raft"
@@ -76,27 +101,44 @@ func NewDB(
 		mdbDir,
 		commandsForStateMachine,
 		listen.Addr().String(),
+		opts.Codec,
+		opts.MapSize,
 		lg,
 	)
 	if err != nil {
 		return nil, err
 	}
-	streamLayers, err := NewMultiStream(listen, dialer, listen.Addr(), lg, dialCodeRaft, dialCodeFlot)
+	state.cmdCodec = opts.Commands
+	codes := []byte{dialCodeRaft, dialCodeFlot}
+	services := make(map[byte]raft.StreamLayer)
+	for _, code := range opts.Services {
+		if code == dialCodeRaft || code == dialCodeFlot {
+			return nil, fmt.Errorf("Service code %d is reserved for flotilla", code)
+		}
+		codes = append(codes, code)
+	}
+	streamLayers, err := NewMultiStream(listen, dialer, listen.Addr(), lg, codes...)
 	if err != nil {
 		return nil, err
 	}
+	for _, code := range opts.Services {
+		services[code] = streamLayers[code]
+	}
 	// start raft server
-	raft, err := newRaft(peers, raftDir, streamLayers[dialCodeRaft], state, logOut)
+	raft, logs, err := newRaft(peers, raftDir, streamLayers[dialCodeRaft], state, logOut)
 	if err != nil {
 		return nil, err
 	}
 	s := &server{
 		raft:       raft,
+		logs:       logs,
 		state:      state,
 		peers:      peers,
 		rpcLayer:   streamLayers[dialCodeFlot],
 		leaderLock: new(sync.Mutex),
 		leaderConn: nil,
+		leaseReads: opts.LeaseReads,
+		services:   services,
 		lg:         log.New(logOut, "flotilla", log.LstdFlags),
 	}
 	// serve followers
@@ -106,26 +148,29 @@ func NewDB(
 
 type server struct {
 	raft       *raft.Raft
+	logs       raft.LogStore
 	state      *flotillaState
 	peers      []string
 	rpcLayer   raft.StreamLayer
 	leaderLock *sync.Mutex
 	leaderConn *connToLeader
+	leaseReads bool
+	services   map[byte]raft.StreamLayer
 	lg         *log.Logger
 }
 
-func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.FSM, logOut io.Writer) (*raft.Raft, error) {
+func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.FSM, logOut io.Writer) (*raft.Raft, raft.LogStore, error) {
 	// Create the MDB store for logs and stable storage, retain up to 8gb
 	store, err := raftmdb.NewMDBStoreWithSize(path, 8*1024*1024*1024)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Create the snapshot store
 	snapshots, err := raft.NewFileSnapshotStore(path, 1, logOut)
 	if err != nil {
 		store.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Create a transport layer
@@ -137,22 +182,22 @@ func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.F
 	for idx, p := range peers {
 		peerAddrs[idx], err = net.ResolveTCPAddr("tcp", p)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 	fmt.Fprintf(logOut, "server.newRaft Setting peer addrs %+v", peerAddrs)
 	raftPeers := raft.NewJSONPeers(path, trans)
 	if err = raftPeers.SetPeers(peerAddrs); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// Ensure local host is always included
 	peerAddrs, err = raftPeers.Peers()
 	if err != nil {
 		store.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	if !raft.PeerContained(peerAddrs, trans.LocalAddr()) {
-		return nil, fmt.Errorf("Localhost %s not included in peers %+v", trans.LocalAddr().String(), peers)
+		return nil, nil, fmt.Errorf("Localhost %s not included in peers %+v", trans.LocalAddr().String(), peers)
 	}
 
 	// Setup the Raft server
@@ -165,7 +210,7 @@ func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.F
 	if err != nil {
 		store.Close()
 		trans.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	// wait until we've identified some valid leader
 	timeout := time.Now().Add(1 * time.Minute)
@@ -177,11 +222,11 @@ func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.F
 		} else {
 			time.Sleep(1 * time.Second)
 			if time.Now().After(timeout) {
-				return nil, fmt.Errorf("Timed out with no leader elected after 1 minute!")
+				return nil, nil, fmt.Errorf("Timed out with no leader elected after 1 minute!")
 			}
 		}
 	}
-	return raft, nil
+	return raft, store, nil
 }
 
 func (s *server) serveFollowers() {
@@ -205,6 +250,45 @@ func (s *server) IsLeader() bool {
 	return s.raft.State() == raft.Leader
 }
 
+func (s *server) MapInfo() (MapInfo, error) {
+	return s.state.mapInfo()
+}
+
+func (s *server) GrowMap(size uint64, timeout time.Duration) error {
+	return s.state.growMap(size, timeout)
+}
+
+func (s *server) Compact() (CompactStats, error) {
+	return s.state.compact()
+}
+
+func (s *server) AddPeer(addr net.Addr) error {
+	if !s.IsLeader() {
+		return ErrNotLeader
+	}
+	// with the log compacted behind the snapshot, raft ships the new peer the snapshot
+	err := s.raft.Snapshot().Error()
+	if err != nil {
+		s.lg.Printf("Couldn't snapshot before adding peer %s, it'll replay the log : %s", addr, err)
+	}
+	err = s.raft.AddPeer(addr).Error()
+	if err == raft.ErrKnownPeer {
+		return nil
+	}
+	return err
+}
+
+func (s *server) RemovePeer(addr net.Addr) error {
+	if !s.IsLeader() {
+		return ErrNotLeader
+	}
+	err := s.raft.RemovePeer(addr).Error()
+	if err == raft.ErrUnknownPeer {
+		return nil
+	}
+	return err
+}
+
 var commandTimeout = 1 * time.Minute
 
 // public API, executes a command on leader, returns chan which will
@@ -213,7 +297,13 @@ func (s *server) Command(cmd string, args [][]byte) <-chan Result {
 
 	if s.IsLeader() {
 		cb := s.state.newCommand()
-		cmdBytes := bytesForCommand(cb.originAddr, cb.reqNo, cmd, args)
+		cmdBytes, err := s.state.proposeCommand(bytesForCommand(cb.originAddr, cb.reqNo, cmd, args))
+		if err != nil {
+			cb.cancel()
+			ret := make(chan Result, 1)
+			ret <- Result{nil, err}
+			return ret
+		}
 		s.raft.Apply(cmdBytes, commandTimeout)
 		return cb.result
 	}
@@ -235,23 +325,9 @@ func (s *server) Command(cmd string, args [][]byte) <-chan Result {
 func (s *server) dispatchToLeader(cmd string, args [][]byte) (*commandCallback, error) {
 	s.leaderLock.Lock()
 	defer s.leaderLock.Unlock()
-	var err error
-	if s.leaderConn == nil || s.Leader() != s.leaderConn.remoteAddr() {
-		// reconnect
-		if s.leaderConn != nil {
-			s.leaderConn.c.Close()
-		}
-		newConn, err := s.rpcLayer.Dial(s.Leader().String(), 1*time.Minute)
-		if err != nil {
-			return nil, fmt.Errorf("Couldn't connect to leader at %s", s.Leader().String())
-		}
-		s.lg.Printf("Connecting to leader %s from follower %s\n", s.Leader().String(), s.rpcLayer.Addr().String())
-		s.leaderConn, err = newConnToLeader(newConn, s.rpcLayer.Addr().String(), s.lg)
-		if err != nil {
-			s.lg.Printf("Got error connecting to leader %s from follower %s : %s", s.Leader().String(), s.rpcLayer.Addr().String(), err)
-			return nil, err
-		}
-		s.lg.Printf("Connected to leader, reported addr %s connected addr %s", s.Leader(), s.leaderConn.remoteAddr())
+	err := s.connectToLeader()
+	if err != nil {
+		return nil, err
 	}
 	s.lg.Printf("Creating new command in dispatchToLeader")
 	cb := s.state.newCommand()
@@ -264,6 +340,57 @@ func (s *server) dispatchToLeader(cmd string, args [][]byte) (*commandCallback,
 	return cb, nil
 }
 
+// (re)connects leaderConn if the leader moved, assumes leaderLock is held
+func (s *server) connectToLeader() error {
+	if s.leaderConn != nil && s.Leader() == s.leaderConn.remoteAddr() {
+		return nil
+	}
+	// reconnect
+	if s.leaderConn != nil {
+		s.leaderConn.c.Close()
+	}
+	newConn, err := s.rpcLayer.Dial(s.Leader().String(), 1*time.Minute)
+	if err != nil {
+		return fmt.Errorf("Couldn't connect to leader at %s", s.Leader().String())
+	}
+	s.lg.Printf("Connecting to leader %s from follower %s\n", s.Leader().String(), s.rpcLayer.Addr().String())
+	s.leaderConn, err = newConnToLeader(newConn, s.rpcLayer.Addr().String(), s.lg)
+	if err != nil {
+		s.lg.Printf("Got error connecting to leader %s from follower %s : %s", s.Leader().String(), s.rpcLayer.Addr().String(), err)
+		return err
+	}
+	s.lg.Printf("Connected to leader, reported addr %s connected addr %s", s.Leader(), s.leaderConn.remoteAddr())
+	return nil
+}
+
+// public API, asks raft for the read index if we're leader, otherwise the leader over leaderConn
+func (s *server) ReadIndex(timeout time.Duration) (uint64, error) {
+	if s.IsLeader() {
+		f := s.raft.ReadIndex(s.leaseReads)
+		if err := f.Error(); err != nil {
+			return 0, err
+		}
+		return f.Index(), nil
+	}
+	s.leaderLock.Lock()
+	err := s.connectToLeader()
+	if err != nil {
+		s.leaderLock.Unlock()
+		return 0, err
+	}
+	cb, err := s.leaderConn.readIndex()
+	s.leaderLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case r := <-cb.result:
+		return r.index, r.err
+	case <-time.After(timeout):
+		return 0, ErrReadIndexTimeout
+	}
+}
+
 func (s *server) Read() (*mdb.Txn, error) {
 	return s.state.ReadTxn()
 }
@@ -273,6 +400,10 @@ func (s *server) Rsync() error {
 	result := <-resultCh
 	return result.Err
 }
+func (s *server) Service(code byte) raft.StreamLayer {
+	return s.services[code]
+}
+
 func (s *server) Close() error {
 	f := s.raft.Shutdown()
 	return f.Error()
@@ -3,8 +3,10 @@ package flotilla
 import (
 	"fmt"
 	mdb "github.com/jbooth/gomdb"
+	"net"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestServer(t *testing.T) {
@@ -102,6 +104,34 @@ func TestServer(t *testing.T) {
 		t.Fatal(err)
 	}
 	fmt.Println("Put to follower succeeded")
+	// follower catches up to the leader's commit
+	commit := leader.CommitIndex()
+	if commit == 0 {
+		t.Fatalf("Expected a commit index on leader after writes")
+	}
+	if applied := notLeaders[1].WaitApplied(commit, 5*time.Second); applied < commit {
+		t.Fatalf("Expected follower to apply up to %d, got %d", commit, applied)
+	}
+	if notLeaders[1].LastContact().IsZero() {
+		t.Fatalf("Expected follower to have heard from leader")
+	}
+	// read index covers the write from the leader and from a follower, without a log entry
+	lastIndex := leader.CommitIndex()
+	for _, db := range []DefaultOpsDB{leader, notLeaders[1]} {
+		idx, err := db.ReadIndex(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx < commit {
+			t.Fatalf("Expected read index of at least %d, got %d", commit, idx)
+		}
+		if applied := db.WaitApplied(idx, 5*time.Second); applied < idx {
+			t.Fatalf("Expected to apply up to read index %d, got %d", idx, applied)
+		}
+	}
+	if leader.CommitIndex() != lastIndex {
+		t.Fatalf("Expected read index not to append to the log, commit index went from %d to %d", lastIndex, leader.CommitIndex())
+	}
 	reader, err = leader.Read()
 	if err != nil {
 		t.Fatal(err)
@@ -148,6 +178,92 @@ func TestServer(t *testing.T) {
 	// execute commands from node 0 (now follower)
 }
 
+func TestAddPeer(t *testing.T) {
+	addrs := []string{"127.0.0.1:1213", "127.0.0.1:1214", "127.0.0.1:1215", "127.0.0.1:1216"}
+	dataDirs := make([]string, 4)
+	for i := range dataDirs {
+		dataDirs[i] = os.TempDir() + fmt.Sprintf("/flot_addpeer_test_%d", i)
+		chkPanic(os.RemoveAll(dataDirs[i]))
+		chkPanic(os.MkdirAll(dataDirs[i], os.FileMode(0777)))
+	}
+	cmds := defaultCommands()
+	// first 3 form the cluster
+	servers := make([]DefaultOpsDB, 4)
+	waitingUp := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(j int) {
+			var err error
+			servers[j], err = NewDefaultDB(addrs[:3], dataDirs[j], addrs[j], cmds)
+			waitingUp <- err
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-waitingUp; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var leader, follower DefaultOpsDB
+	for _, s := range servers[:3] {
+		if s.IsLeader() {
+			leader = s
+		} else {
+			follower = s
+		}
+	}
+	dbName := "test"
+	for i := 0; i < 10; i++ {
+		res := <-leader.Put(dbName, []byte(fmt.Sprintf("key%d", i)), []byte("val"))
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+
+	newAddr, err := net.ResolveTCPAddr("tcp", addrs[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = follower.AddPeer(newAddr); err != ErrNotLeader {
+		t.Fatalf("Expecting ErrNotLeader adding a peer from a follower, got %v", err)
+	}
+	err = leader.AddPeer(newAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new member starts empty and catches up from the leader
+	servers[3], err = NewDefaultDB(addrs, dataDirs[3], addrs[3], cmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		txn, err := servers[3].Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbi, err := txn.DBIOpen(&dbName, 0)
+		var val []byte
+		if err == nil {
+			val, err = txn.Get(dbi, []byte("key9"))
+		}
+		txn.Abort()
+		if string(val) == "val" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("New peer never caught up, last error %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	err = leader.RemovePeer(newAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
 var alwaysReturnsError Command = func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	return nil, fmt.Errorf("LOL error")
 }
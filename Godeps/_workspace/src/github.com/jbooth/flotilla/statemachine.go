@@ -1,14 +1,17 @@
 package flotilla
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/hashicorp/raft"
 	"github.com/jbooth/gomdb"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // finite state machine to interop with raft
@@ -23,12 +26,20 @@ type flotillaState struct {
 	reqnoCtr       uint64
 	dataPath       string
 	tempPath       string
+	codec          SnapshotCodec // wraps snapshots, nil if they're stored as is
+	mapSize        uint64        // for envs opened on restore
 	localCallbacks map[uint64]*commandCallback
 	l              *sync.Mutex // guards callbacks and reqnoCtr
 	lg             *log.Logger
+	applied        uint64        // last raft index applied locally
+	appliedCh      chan struct{} // closed and replaced every time applied moves
+	appliedL       *sync.Mutex   // guards applied and appliedCh
+	applyL         *sync.Mutex   // held while env changes, so compaction can pause it
+	startIndex     uint64        // applied before we last stopped, commands up to it are replays
+	cmdCodec       CommandCodec  // seals commands in the raft log, nil if they're logged as is
 }
 
-func newFlotillaState(dbPath string, commands map[string]Command, addr string, lg *log.Logger) (*flotillaState, error) {
+func newFlotillaState(dbPath string, commands map[string]Command, addr string, codec SnapshotCodec, mapSize uint64, lg *log.Logger) (*flotillaState, error) {
 	lg.Printf("New flotilla state at path %s, listening on %s\n", dbPath, addr)
 	// current data stored here
 	dataPath := dbPath + "/data"
@@ -40,7 +51,11 @@ func newFlotillaState(dbPath string, commands map[string]Command, addr string, l
 	if err := os.MkdirAll(tempPath, 0755); err != nil {
 		return nil, err
 	}
-	env, err := newenv(dataPath)
+	env, err := newenv(dataPath, mapSize)
+	if err != nil {
+		return nil, err
+	}
+	startIndex, err := readApplied(env)
 	if err != nil {
 		return nil, err
 	}
@@ -51,20 +66,33 @@ func newFlotillaState(dbPath string, commands map[string]Command, addr string, l
 		0,
 		dataPath,
 		tempPath,
+		codec,
+		mapSize,
 		make(map[uint64]*commandCallback),
 		new(sync.Mutex),
 		lg,
+		0,
+		make(chan struct{}),
+		new(sync.Mutex),
+		new(sync.Mutex),
+		startIndex,
+		nil,
 	}, nil
 }
 
 // Apply log is invoked once a log entry is commited
 // always returns type Result (no pointer)
 func (f *flotillaState) Apply(l *raft.Log) interface{} {
-	cmd := &commandReq{}
-	err := decodeMsgPack(l.Data, cmd)
-	if err != nil {
-		return Result{nil, err}
+	cmd, err := f.decodeCommand(l.Data)
+	for err != nil {
+		// skipping a committed entry would leave us diverged from the rest of the shard,
+		// so stop here until we can read it, e.g. once the codec's key shows up
+		f.lg.Printf("ERROR can't decode command at index %d, not applying anything past it, retrying in %s : %s", l.Index, decodeRetryInterval, err)
+		time.Sleep(decodeRetryInterval)
+		cmd, err = f.decodeCommand(l.Data)
 	}
+	f.applyL.Lock()
+	defer f.applyL.Unlock()
 	// open write txn
 	txn, err := f.env.writeTxn()
 	if err != nil {
@@ -78,12 +106,32 @@ func (f *flotillaState) Apply(l *raft.Log) interface{} {
 		f.lg.Printf("Received invalid command %s", cmd.Cmd)
 		result.Err = fmt.Errorf("No command registered with name %s", cmd.Cmd)
 	} else {
+		err = putApplied(txn, l.Index)
+		if err != nil {
+			f.lg.Printf("Error recording applied index %d : %s", l.Index, err)
+		}
+		// raft replays the log since the last snapshot when we restart
+		replay := l.Index <= f.startIndex
+		if replay {
+			setReplaying(txn, true)
+		}
+		mine := cmd.Proposer == f.addr
+		if mine {
+			setProposed(txn, true)
+		}
 		result.Response, result.Err = cmdExec(cmd.Args, txn)
+		if replay {
+			setReplaying(txn, false)
+		}
+		if mine {
+			setProposed(txn, false)
+		}
 	}
 	// confirm txn handle closed (our txn wrapper keeps track of state so we don't abort committed txn)
 	txn.Abort()
 	// check for callback
 	f.lg.Printf("Finished command %s with result %s err %s", cmd.Cmd, string(result.Response), result.Err)
+	f.setApplied(l.Index)
 	f.l.Lock()
 	defer f.l.Unlock()
 	cb, ok := f.localCallbacks[cmd.Reqno]
@@ -93,6 +141,177 @@ func (f *flotillaState) Apply(l *raft.Log) interface{} {
 	return result
 }
 
+var decodeRetryInterval = 10 * time.Second
+
+var (
+	proposedL = &sync.Mutex{}
+	proposed  = make(map[*mdb.Txn]bool)
+)
+
+// true while txn is applying a command this node appended to the log as leader.  raft has one
+// leader per term, so exactly one member of the shard sees this for each entry, whoever leads by
+// the time it's applied.  side effects only one member should carry out can check this rather
+// than IsLeader, which can be true on two nodes or on none around an election.
+// if the proposer dies before applying the entry, nobody sees it.
+func ProposedHere(txn *mdb.Txn) bool {
+	proposedL.Lock()
+	defer proposedL.Unlock()
+	return proposed[txn]
+}
+
+func setProposed(txn *mdb.Txn, p bool) {
+	proposedL.Lock()
+	defer proposedL.Unlock()
+	if p {
+		proposed[txn] = true
+	} else {
+		delete(proposed, txn)
+	}
+}
+
+// sealed commands start with a byte msgpack never uses, so entries logged before
+// a codec was configured still decode
+const sealedCommand byte = 0xc1
+
+// seals an encoded command for the raft log, leaves it alone without a codec or if it's sealed already
+func (f *flotillaState) sealCommand(data []byte) ([]byte, error) {
+	if f.cmdCodec == nil || (len(data) > 0 && data[0] == sealedCommand) {
+		return data, nil
+	}
+	sealed, err := f.cmdCodec.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{sealedCommand}, sealed...), nil
+}
+
+// stamps an encoded command with our address as we append it to the log as leader, then seals it
+func (f *flotillaState) proposeCommand(data []byte) ([]byte, error) {
+	cmd, err := f.decodeCommand(data)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Proposer = f.addr
+	b, err := encodeMsgPack(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return f.sealCommand(b.Bytes())
+}
+
+func (f *flotillaState) decodeCommand(data []byte) (*commandReq, error) {
+	if len(data) > 0 && data[0] == sealedCommand {
+		if f.cmdCodec == nil {
+			return nil, fmt.Errorf("Command is sealed but no codec is configured")
+		}
+		var err error
+		data, err = f.cmdCodec.Open(data[1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmd := &commandReq{}
+	err := decodeMsgPack(data, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// the applied index is also kept in its own table, written in the same txn as each command,
+// so after a restart we know which of the commands raft replays we'd already applied
+var (
+	appliedTable = "flotilla.applied"
+	appliedKey   = []byte("applied")
+)
+
+func putApplied(txn *mdb.Txn, index uint64) error {
+	dbi, err := txn.DBIOpen(&appliedTable, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, index)
+	return txn.Put(dbi, appliedKey, val, 0)
+}
+
+// 0 if nothing's been applied
+func readApplied(e *env) (uint64, error) {
+	txn, err := e.readTxn()
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Abort()
+	dbi, err := txn.DBIOpen(&appliedTable, 0)
+	if err == mdb.NotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	val, err := txn.Get(dbi, appliedKey)
+	if err == mdb.NotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+func (f *flotillaState) setApplied(index uint64) {
+	f.appliedL.Lock()
+	defer f.appliedL.Unlock()
+	f.applied = index
+	close(f.appliedCh)
+	f.appliedCh = make(chan struct{})
+}
+
+func (f *flotillaState) appliedIndex() uint64 {
+	f.appliedL.Lock()
+	defer f.appliedL.Unlock()
+	return f.applied
+}
+
+// waits up to timeout for index to be applied locally, returns the last applied index
+func (f *flotillaState) waitApplied(index uint64, timeout time.Duration) uint64 {
+	deadline := time.After(timeout)
+	for {
+		f.appliedL.Lock()
+		applied, ch := f.applied, f.appliedCh
+		f.appliedL.Unlock()
+		if applied >= index {
+			return applied
+		}
+		select {
+		case <-ch:
+		case <-deadline:
+			return applied
+		}
+	}
+}
+
+func (f *flotillaState) mapInfo() (MapInfo, error) {
+	f.l.Lock()
+	e := f.env
+	f.l.Unlock()
+	return e.mapInfo()
+}
+
+func (f *flotillaState) growMap(size uint64, timeout time.Duration) error {
+	f.l.Lock()
+	e := f.env
+	f.l.Unlock()
+	err := e.setMapSize(size, timeout)
+	if err != nil {
+		return err
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	if size > f.mapSize {
+		f.mapSize = size
+	}
+	return nil
+}
+
 func (s *flotillaState) ReadTxn() (*mdb.Txn, error) {
 	// lock to make sure we don't race with Restore()
 	s.l.Lock()
@@ -141,7 +360,16 @@ func (f *flotillaState) Snapshot() (raft.FSMSnapshot, error) {
 	if err != nil {
 		return nil, err
 	}
-	ret := &flotillaSnapshot{r, w, f.env.e, make(chan error, 1)}
+	f.applyL.Lock()
+	e := f.env
+	err = e.hold()
+	f.applyL.Unlock()
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	ret := &flotillaSnapshot{r, w, e, f.codec, make(chan error, 1)}
 	// start snapshot to guarantee it's a snapshot of state as this call is made
 	go ret.pipeCopy()
 	return ret, nil
@@ -150,14 +378,16 @@ func (f *flotillaState) Snapshot() (raft.FSMSnapshot, error) {
 type flotillaSnapshot struct {
 	pipeR   *os.File
 	pipeW   *os.File
-	env     *mdb.Env
+	env     *env
+	codec   SnapshotCodec
 	copyErr chan error
 }
 
 // starts streaming snapshot into one end of pipe
 func (s *flotillaSnapshot) pipeCopy() {
 	defer s.pipeW.Close()
-	s.copyErr <- s.env.CopyFd(int(s.pipeW.Fd())) // buffered chan here
+	defer s.env.release()
+	s.copyErr <- s.env.copyFd(int(s.pipeW.Fd())) // buffered chan here
 }
 
 // Persist should dump all necessary state to the WriteCloser,
@@ -165,7 +395,23 @@ func (s *flotillaSnapshot) pipeCopy() {
 func (s *flotillaSnapshot) Persist(sink raft.SnapshotSink) error {
 	defer sink.Close()
 	defer s.pipeR.Close()
-	_, e1 := io.Copy(sink, s.pipeR)
+	var e1 error
+	if s.codec == nil {
+		_, e1 = io.Copy(sink, s.pipeR)
+	} else {
+		var w io.WriteCloser
+		w, e1 = s.codec.WrapWriter(sink)
+		if e1 == nil {
+			_, e1 = io.Copy(w, s.pipeR)
+			if e1 == nil {
+				e1 = w.Close()
+			}
+		}
+		if e1 != nil {
+			// unblock pipeCopy
+			io.Copy(ioutil.Discard, s.pipeR)
+		}
+	}
 	e2 := <-s.copyErr
 
 	if e2 != nil {
@@ -190,6 +436,21 @@ func (s *flotillaSnapshot) Release() {
 // state.
 // Note, this command is called concurrently with open read txns, so we handle that
 func (f *flotillaState) Restore(in io.ReadCloser) error {
+	return f.restore(in)
+}
+
+// restores from a snapshot taken at index, raft calls this instead of Restore so waits
+// on the applied index see what the snapshot brought in
+func (f *flotillaState) RestoreAt(in io.ReadCloser, index uint64) error {
+	err := f.restore(in)
+	if err != nil {
+		return err
+	}
+	f.setApplied(index)
+	return nil
+}
+
+func (f *flotillaState) restore(in io.ReadCloser) error {
 	// stream to filePath.tmp
 	tempData := f.tempPath + "/data.mdb"
 	_ = os.Remove(tempData)
@@ -198,9 +459,18 @@ func (f *flotillaState) Restore(in io.ReadCloser) error {
 		return err
 	}
 	defer tempFile.Close()
-	if _, err = io.Copy(tempFile, in); err != nil {
+	var r io.Reader = in
+	if f.codec != nil {
+		if r, err = f.codec.WrapReader(in); err != nil {
+			return err
+		}
+	}
+	if _, err = io.Copy(tempFile, r); err != nil {
 		return err
 	}
+	// waits out any compaction in progress
+	f.applyL.Lock()
+	defer f.applyL.Unlock()
 	// unlink existing DB and move new one into place
 	// can't atomically rename directories so have to lock for this
 	f.l.Lock()
@@ -218,6 +488,6 @@ func (f *flotillaState) Restore(in io.ReadCloser) error {
 	// posix holds onto our data until we release FD
 	f.env.Close()
 	// re-initialize env
-	f.env, err = newenv(f.dataPath)
+	f.env, err = newenv(f.dataPath, f.mapSize)
 	return err
 }
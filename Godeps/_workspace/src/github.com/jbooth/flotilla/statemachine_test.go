@@ -1,10 +1,15 @@
 package flotilla
 
 import (
+	"bytes"
 	"fmt"
+	mdb "github.com/jbooth/gomdb"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // initialize state machine with default ops
@@ -23,6 +28,8 @@ func TestStateMachine(t *testing.T) {
 		tempDir,
 		defaultCommands(),
 		"127.0.0.1",
+		nil,
+		0,
 		log.New(os.Stderr, "state machine test", log.LstdFlags),
 	)
 	if err != nil {
@@ -149,6 +156,316 @@ func TestStateMachine(t *testing.T) {
 	}
 }
 
+// restoring a snapshot at an index moves the applied index there and wakes its waiters
+func TestRestoreSetsApplied(t *testing.T) {
+	tempDir := os.TempDir() + "/flotillaRestoreTest"
+	os.RemoveAll(tempDir)
+	state, err := newFlotillaState(
+		tempDir,
+		defaultCommands(),
+		"127.0.0.1",
+		nil,
+		0,
+		log.New(os.Stderr, "restore test", log.LstdFlags),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := logForCommand("", 0, "Put", [][]byte{[]byte("defaultDB"), []byte("foo"), []byte("bar")})
+	l.Index = 7
+	result, _ := state.Apply(l).(Result)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if state.appliedIndex() != 7 {
+		t.Fatal(fmt.Errorf("Expected applied index 7, got %d", state.appliedIndex()))
+	}
+	snapFilePath := os.TempDir() + "/flotillaRestoreTest.Snapshot"
+	_ = os.Remove(snapFilePath)
+	ss, err := state.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapFile, err := os.Create(snapFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ss.Persist(&fileSnapshotSink{snapFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// someone waiting on an index the snapshot covers
+	waited := make(chan uint64)
+	go func() {
+		waited <- state.waitApplied(42, 5*time.Second)
+	}()
+	snapFile, err = os.Open(snapFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.RestoreAt(snapFile, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.appliedIndex() != 42 {
+		t.Fatal(fmt.Errorf("Expected applied index 42 after restore, got %d", state.appliedIndex()))
+	}
+	if applied := <-waited; applied != 42 {
+		t.Fatal(fmt.Errorf("Expected waiter to see 42, got %d", applied))
+	}
+}
+
+// commands raft replays after a restart that we'd already applied are marked as replays
+func TestReplayAfterRestart(t *testing.T) {
+	tempDir := os.TempDir() + "/flotillaReplayTest"
+	os.RemoveAll(tempDir)
+	replays := make(map[string]bool)
+	commands := defaultCommands()
+	commands["Check"] = func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		replays[string(args[0])] = Replaying(txn)
+		return nil, txn.Commit()
+	}
+	open := func() *flotillaState {
+		state, err := newFlotillaState(
+			tempDir,
+			commands,
+			"127.0.0.1",
+			nil,
+			0,
+			log.New(os.Stderr, "replay test", log.LstdFlags),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+	apply := func(state *flotillaState, index uint64, name string) {
+		l := logForCommand("", 0, "Check", [][]byte{[]byte(name)})
+		l.Index = index
+		result, _ := state.Apply(l).(Result)
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	state := open()
+	apply(state, 1, "first")
+	apply(state, 2, "second")
+	if replays["first"] || replays["second"] {
+		t.Fatal(fmt.Errorf("Nothing should replay before a restart, got %+v", replays))
+	}
+	state.env.Close()
+	state = open()
+	defer state.env.Close()
+	apply(state, 1, "first")
+	apply(state, 2, "second")
+	apply(state, 3, "third")
+	if !replays["first"] || !replays["second"] || replays["third"] {
+		t.Fatal(fmt.Errorf("Expected first and second to replay and third not to, got %+v", replays))
+	}
+}
+
+// only the node that appended an entry sees ProposedHere when applying it
+func TestProposedHere(t *testing.T) {
+	tempDir := os.TempDir() + "/flotillaProposedTest"
+	os.RemoveAll(tempDir)
+	proposals := make(map[string]bool)
+	commands := defaultCommands()
+	commands["Check"] = func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		proposals[string(args[0])] = ProposedHere(txn)
+		return nil, txn.Commit()
+	}
+	state, err := newFlotillaState(
+		tempDir,
+		commands,
+		"127.0.0.1",
+		nil,
+		0,
+		log.New(os.Stderr, "proposed test", log.LstdFlags),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.env.Close()
+	propose := func(addr string, name string) []byte {
+		state.addr = addr
+		defer func() { state.addr = "127.0.0.1" }()
+		data, err := state.proposeCommand(logForCommand("", 0, "Check", [][]byte{[]byte(name)}).Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	entries := [][]byte{
+		propose("127.0.0.1", "ours"),
+		propose("127.0.0.2", "theirs"),
+		logForCommand("", 0, "Check", [][]byte{[]byte("unstamped")}).Data,
+	}
+	for i, data := range entries {
+		l := logForCommand("", 0, "", nil)
+		l.Index = uint64(i + 1)
+		l.Data = data
+		result, _ := state.Apply(l).(Result)
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	if !proposals["ours"] || proposals["theirs"] || proposals["unstamped"] {
+		t.Fatal(fmt.Errorf("Expected only ours to be proposed here, got %+v", proposals))
+	}
+}
+
+// fill a small map, confirm open txns hold off a resize, then grow it and keep writing
+func TestGrowMap(t *testing.T) {
+	tempDir := os.TempDir() + "/flotillaGrowTest"
+	os.RemoveAll(tempDir)
+	state, err := newFlotillaState(
+		tempDir,
+		defaultCommands(),
+		"127.0.0.1",
+		nil,
+		1024*1024,
+		log.New(os.Stderr, "grow map test", log.LstdFlags),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := make([]byte, 64*1024)
+	full := false
+	for i := 0; i < 64 && !full; i++ {
+		result, _ := state.Apply(logForCommand("", 0, "Put", [][]byte{[]byte("defaultDB"), []byte(fmt.Sprintf("key%d", i)), val})).(Result)
+		full = result.Err != nil
+	}
+	if !full {
+		t.Fatal(fmt.Errorf("Expected 1MB map to fill up"))
+	}
+	info, err := state.mapInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 1024*1024 || info.Used == 0 {
+		t.Fatal(fmt.Errorf("Unexpected map info %+v", info))
+	}
+
+	read, err := state.ReadTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.growMap(8*1024*1024, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal(fmt.Errorf("Expected resize to give up with a txn open"))
+	}
+	read.Abort()
+	err = state.growMap(8*1024*1024, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = state.mapInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 8*1024*1024 {
+		t.Fatal(fmt.Errorf("Expected 8MB map after growing, got %+v", info))
+	}
+	result, _ := state.Apply(logForCommand("", 0, "Put", [][]byte{[]byte("defaultDB"), []byte("afterGrow"), val})).(Result)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+}
+
+// compact while writes keep coming, confirm the file shrinks and writes waiting on it aren't lost
+func TestCompact(t *testing.T) {
+	tempDir := os.TempDir() + "/flotillaCompactTest"
+	os.RemoveAll(tempDir)
+	state, err := newFlotillaState(
+		tempDir,
+		defaultCommands(),
+		"127.0.0.1",
+		nil,
+		0,
+		log.New(os.Stderr, "compact test", log.LstdFlags),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index uint64
+	apply := func(cmd string, args ...string) {
+		l := logForCommand("", 0, cmd, toByteArgs(args))
+		l.Index = atomic.AddUint64(&index, 1)
+		result, _ := state.Apply(l).(Result)
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+
+	val := string(make([]byte, 1024))
+	for i := 0; i < 4000; i++ {
+		apply("Put", "defaultDB", fmt.Sprintf("key%d", i), val)
+	}
+	for i := 0; i < 3900; i++ {
+		apply("Remove", "defaultDB", fmt.Sprintf("key%d", i))
+	}
+	// a txn from before the swap keeps working after it
+	before, err := state.ReadTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 500; i++ {
+			apply("Put", "defaultDB", fmt.Sprintf("during%d", i), "x")
+		}
+		close(done)
+	}()
+	stats, err := state.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if stats.After >= stats.Before {
+		t.Fatal(fmt.Errorf("Expected compaction to shrink the file, got %+v", stats))
+	}
+	db := "defaultDB"
+	dbi, err := before.DBIOpen(&db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = before.Get(dbi, []byte("key3999")); err != nil {
+		t.Fatal(err)
+	}
+	before.Abort()
+
+	read, err := state.ReadTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer read.Abort()
+	dbi, err = read.DBIOpen(&db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 3900; i < 4000; i++ {
+		if _, err = read.Get(dbi, []byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatal(fmt.Errorf("Lost key%d in compaction: %s", i, err))
+		}
+	}
+	if _, err = read.Get(dbi, []byte("key5")); err != mdb.NotFound {
+		t.Fatal(fmt.Errorf("Expected removed key5 to stay removed, got %v", err))
+	}
+	for i := 0; i < 500; i++ {
+		if _, err = read.Get(dbi, []byte(fmt.Sprintf("during%d", i))); err != nil {
+			t.Fatal(fmt.Errorf("Lost during%d written while compacting: %s", i, err))
+		}
+	}
+}
+
+func toByteArgs(args []string) [][]byte {
+	ret := make([][]byte, len(args))
+	for i, a := range args {
+		ret[i] = []byte(a)
+	}
+	return ret
+}
+
 //func logForCommand(host string, reqno uint64, cmdName string, args [][]byte) *raft.Log {
 //	cmd := &commandReq{}
 //	cmd.Args = args
@@ -179,3 +496,140 @@ func (f *fileSnapshotSink) Cancel() error {
 func (f *fileSnapshotSink) ID() string {
 	return "NOT AN ID"
 }
+
+// flips every byte, enough to tell sealed commands from plain ones
+type xorCodec struct{}
+
+func (x xorCodec) Seal(cmd []byte) ([]byte, error) {
+	ret := make([]byte, len(cmd))
+	for i, b := range cmd {
+		ret[i] = b ^ 0xff
+	}
+	return ret, nil
+}
+
+func (x xorCodec) Open(sealed []byte) ([]byte, error) {
+	return x.Seal(sealed)
+}
+
+// commands are sealed before they're logged, and ones logged before the codec still apply
+func TestSealedCommands(t *testing.T) {
+	tempDir := os.TempDir() + "/flotillaSealedTest"
+	os.RemoveAll(tempDir)
+	state, err := newFlotillaState(
+		tempDir,
+		defaultCommands(),
+		"127.0.0.1",
+		nil,
+		0,
+		log.New(os.Stderr, "sealed command test", log.LstdFlags),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := logForCommand("", 0, "Put", [][]byte{[]byte("defaultDB"), []byte("foo"), []byte("bar")})
+	state.cmdCodec = xorCodec{}
+	sealed, err := state.sealCommand(logForCommand("", 0, "Put", [][]byte{[]byte("defaultDB"), []byte("secret"), []byte("hunter2")}).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed[0] != sealedCommand || bytes.Contains(sealed, []byte("hunter2")) {
+		t.Fatal(fmt.Errorf("Expected sealed command, got %q", sealed))
+	}
+	resealed, err := state.sealCommand(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sealed, resealed) {
+		t.Fatal(fmt.Errorf("Sealing a sealed command changed it"))
+	}
+	for i, data := range [][]byte{plain.Data, sealed} {
+		l := logForCommand("", 0, "", nil)
+		l.Index = uint64(i + 1)
+		l.Data = data
+		result, _ := state.Apply(l).(Result)
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	read, err := state.ReadTxn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer read.Abort()
+	db := "defaultDB"
+	dbi, err := read.DBIOpen(&db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"foo": "bar", "secret": "hunter2"} {
+		val, err := read.Get(dbi, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != expected {
+			t.Fatal(fmt.Errorf("Got '%s', expected '%s' for %s", val, expected, key))
+		}
+	}
+	// no codec, no way to read it
+	state.cmdCodec = nil
+	_, err = state.decodeCommand(sealed)
+	if err == nil {
+		t.Fatal(fmt.Errorf("Expected error decoding sealed command without a codec"))
+	}
+
+	// an entry we can't open holds up apply instead of being skipped
+	origRetry := decodeRetryInterval
+	decodeRetryInterval = 10 * time.Millisecond
+	defer func() { decodeRetryInterval = origRetry }()
+	codec := &missingKeyCodec{l: &sync.Mutex{}}
+	state.cmdCodec = codec
+	l := logForCommand("", 0, "", nil)
+	l.Index = 3
+	l.Data = sealed
+	done := make(chan Result)
+	go func() {
+		result, _ := state.Apply(l).(Result)
+		done <- result
+	}()
+	select {
+	case <-done:
+		t.Fatal(fmt.Errorf("Expected apply to wait for the key"))
+	case <-time.After(100 * time.Millisecond):
+	}
+	if state.appliedIndex() != 2 {
+		t.Fatal(fmt.Errorf("Expected applied index to stay at 2, got %d", state.appliedIndex()))
+	}
+	codec.found()
+	if result := <-done; result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if state.appliedIndex() != 3 {
+		t.Fatal(fmt.Errorf("Expected applied index 3 once the key showed up, got %d", state.appliedIndex()))
+	}
+}
+
+// can't open anything until found is called
+type missingKeyCodec struct {
+	l     *sync.Mutex
+	ready bool
+}
+
+func (m *missingKeyCodec) found() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.ready = true
+}
+
+func (m *missingKeyCodec) Seal(cmd []byte) ([]byte, error) {
+	return xorCodec{}.Seal(cmd)
+}
+
+func (m *missingKeyCodec) Open(sealed []byte) ([]byte, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if !m.ready {
+		return nil, fmt.Errorf("No key")
+	}
+	return xorCodec{}.Open(sealed)
+}
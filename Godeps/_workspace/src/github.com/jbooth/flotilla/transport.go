@@ -2,6 +2,7 @@ package flotilla
 
 import (
 	"bytes"
+	"errors"
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/raft"
 	"log"
@@ -17,7 +18,42 @@ type connToLeader struct {
 	d       *codec.Decoder
 	l       *sync.Mutex
 	lg      *log.Logger
-	pending chan *commandCallback
+	pending chan leaderCallback
+}
+
+// waits on its response from the leader, responses come back in the order requests went out
+type leaderCallback interface {
+	// err is non-nil if we couldn't read a response
+	respond(resp *commandResp, err error)
+}
+
+// a command's result comes from our state machine once it's applied here,
+// we only hear from the leader directly if it couldn't be sent
+func (c *commandCallback) respond(resp *commandResp, err error) {
+	if err != nil {
+		c.cancel()
+		c.result <- Result{nil, err}
+	}
+}
+
+type readIndexResult struct {
+	index uint64
+	err   error
+}
+
+type readIndexCallback struct {
+	result chan readIndexResult
+}
+
+func (r *readIndexCallback) respond(resp *commandResp, err error) {
+	if err == nil && resp.ReadErr != "" {
+		err = errors.New(resp.ReadErr)
+	}
+	if err != nil {
+		r.result <- readIndexResult{0, err}
+	} else {
+		r.result <- readIndexResult{resp.Index, nil}
+	}
 }
 
 // joins the raft leader and sets up infrastructure for
@@ -32,7 +68,7 @@ func newConnToLeader(conn net.Conn, advertiseAddr string, lg *log.Logger) (*conn
 		d:       codec.NewDecoder(conn, h),
 		l:       new(sync.Mutex),
 		lg:      lg,
-		pending: make(chan *commandCallback, 64),
+		pending: make(chan leaderCallback, 64),
 	}
 	join := &joinReq{
 		PeerAddr: advertiseAddr,
@@ -77,6 +113,20 @@ func (c *connToLeader) forwardCommand(cb *commandCallback, cmdName string, args
 	return nil
 }
 
+// asks the leader for a read index, which comes back on the returned callback.
+// requests go over the same stream as commands, as no-op logs that are never applied
+func (c *connToLeader) readIndex() (*readIndexCallback, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	cb := &readIndexCallback{make(chan readIndexResult, 1)}
+	err := c.e.Encode(&raft.Log{Type: raft.LogNoop})
+	if err != nil {
+		return nil, err
+	}
+	c.pending <- cb
+	return cb, nil
+}
+
 func (c *connToLeader) remoteAddr() net.Addr {
 	return c.c.RemoteAddr()
 }
@@ -84,22 +134,22 @@ func (c *connToLeader) remoteAddr() net.Addr {
 func (c *connToLeader) readResponses() {
 	resp := &commandResp{}
 	for cb := range c.pending {
+		*resp = commandResp{}
 		err := c.d.Decode(resp)
 		if err != nil {
-			cb.cancel()
-			cb.result <- Result{nil, err}
+			cb.respond(nil, err)
 			c.lg.Printf("Error reading response: %s, closing and giving err to all pending requests", err)
 			c.c.Close()
 			for {
 				select {
 				case cb1 := <-c.pending:
-					cb1.cancel()
-					cb1.result <- Result{nil, err}
+					cb1.respond(nil, err)
 				default:
 					return
 				}
 			}
 		}
+		cb.respond(resp, nil)
 	}
 	c.lg.Printf("Closing leaderConn to %s", c.c.RemoteAddr().String())
 	c.c.Close()
@@ -193,7 +243,7 @@ func serveFollower(lg *log.Logger, follower net.Conn, leader *server) {
 	// read commands
 	cmdReq := &raft.Log{}
 	err = nil
-	futures := make(chan raft.ApplyFuture, 16)
+	futures := make(chan raft.Future, 16)
 	defer func() {
 		// die
 		follower.Close()
@@ -208,20 +258,45 @@ func serveFollower(lg *log.Logger, follower net.Conn, leader *server) {
 			follower.Close()
 			return
 		}
-		// exec with leader
+		if cmdReq.Type == raft.LogNoop {
+			// read index request, nothing to apply
+			futures <- readIndexReply{leader.raft.ReadIndex(leader.leaseReads)}
+			continue
+		}
+		// exec with leader, followers send commands unsealed
 		lg.Printf("Executing command")
-		future := leader.raft.Apply(cmdReq.Data, 1*time.Minute)
+		data, err := leader.state.proposeCommand(cmdReq.Data)
+		if err != nil {
+			lg.Printf("Error sealing command from node %s : '%s', closing conn", follower.RemoteAddr().String(), err.Error())
+			follower.Close()
+			return
+		}
+		future := leader.raft.Apply(data, 1*time.Minute)
 		futures <- future
 	}
 }
 
+// tells sendResponses a future is for a read index request
+type readIndexReply struct {
+	raft.ReadIndexFuture
+}
+
 // runs alongside serveFollower to send actual responses
-func sendResponses(futures chan raft.ApplyFuture, lg *log.Logger, e *codec.Encoder, conn net.Conn) {
+func sendResponses(futures chan raft.Future, lg *log.Logger, e *codec.Encoder, conn net.Conn) {
 	resp := &commandResp{}
 	for f := range futures {
 		lg.Printf("Sending a response to host %s", conn.RemoteAddr().String())
+		*resp = commandResp{}
 		err := f.Error()
-		resp.Err = err
+		if ri, ok := f.(readIndexReply); ok {
+			// errors don't survive msgpack, send the message
+			resp.Index = ri.Index()
+			if err != nil {
+				resp.ReadErr = err.Error()
+			}
+		} else {
+			resp.Err = err
+		}
 		err = e.Encode(resp)
 		if err != nil {
 			lg.Printf("Error writing response %s to host %s : %s", resp, conn.RemoteAddr().String(), err)
@@ -242,6 +317,7 @@ type joinResp struct {
 type commandReq struct {
 	Reqno      uint64
 	OriginAddr string
+	Proposer   string // the leader that appended it to the log, see ProposedHere
 	Cmd        string
 	Args       [][]byte
 }
@@ -249,7 +325,9 @@ type commandReq struct {
 // commandResp has an error if the leader had a non-command-caused error
 // while applying the command.  can be ErrNotLeader.
 type commandResp struct {
-	Err error
+	Err     error
+	Index   uint64 // for read index requests
+	ReadErr string // why a read index request failed
 }
 
 // Decode reverses the encode operation on a byte slice input
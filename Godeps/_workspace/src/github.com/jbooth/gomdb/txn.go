@@ -38,7 +38,8 @@ const (
 // All database operations require a transaction handle.
 // Transactions may be read-only or read-write.
 type Txn struct {
-	_txn *C.MDB_txn
+	_txn    *C.MDB_txn
+	onClose func()
 }
 
 func (env *Env) BeginTxn(parent *Txn, flags uint) (*Txn, error) {
@@ -57,7 +58,7 @@ func (env *Env) BeginTxn(parent *Txn, flags uint) (*Txn, error) {
 		runtime.UnlockOSThread()
 		return nil, errno(ret)
 	}
-	return &Txn{_txn}, nil
+	return &Txn{_txn, nil}, nil
 }
 
 func (txn *Txn) Commit() error {
@@ -70,6 +71,7 @@ func (txn *Txn) Commit() error {
 		return errno(ret)
 	}
 	txn._txn = nil
+	txn.closed()
 	return nil
 }
 
@@ -78,6 +80,21 @@ func (txn *Txn) Abort() {
 		C.mdb_txn_abort(txn._txn)
 		runtime.UnlockOSThread()
 		txn._txn = nil
+		txn.closed()
+	}
+}
+
+// Registers f to be called once when the transaction is committed or aborted.
+// Replaces any function registered before.
+func (txn *Txn) OnClose(f func()) {
+	txn.onClose = f
+}
+
+func (txn *Txn) closed() {
+	if txn.onClose != nil {
+		f := txn.onClose
+		txn.onClose = nil
+		f()
 	}
 }
 
@@ -24,6 +24,21 @@ type FSM interface {
 	Restore(io.ReadCloser) error
 }
 
+// IndexedRestorer can optionally be implemented by an FSM that needs to know
+// the index of the snapshot it is restored from, to track what it has applied.
+// If implemented, RestoreAt is called instead of Restore.
+type IndexedRestorer interface {
+	RestoreAt(source io.ReadCloser, index uint64) error
+}
+
+// restoreFSM restores fsm from source, a snapshot taken at index
+func restoreFSM(fsm FSM, source io.ReadCloser, index uint64) error {
+	if ir, ok := fsm.(IndexedRestorer); ok {
+		return ir.RestoreAt(source, index)
+	}
+	return fsm.Restore(source)
+}
+
 // FSMSnapshot is returned by an FSM in response to a Snapshot
 // It must be safe to invoke FSMSnapshot methods with concurrent
 // calls to Apply
@@ -17,6 +17,13 @@ type ApplyFuture interface {
 	Response() interface{}
 }
 
+// ReadIndexFuture is used for ReadIndex and returns the commit index
+// reads are linearizable at once the FSM has applied it
+type ReadIndexFuture interface {
+	Future
+	Index() uint64
+}
+
 // errorFuture is used to return a static error
 type errorFuture struct {
 	err error
@@ -30,6 +37,10 @@ func (e errorFuture) Response() interface{} {
 	return nil
 }
 
+func (e errorFuture) Index() uint64 {
+	return 0
+}
+
 // deferError can be embedded to allow a future
 // to provide an error in the future
 type deferError struct {
@@ -119,6 +130,17 @@ type restoreFuture struct {
 	ID string
 }
 
+// readIndexFuture is used for ReadIndex, index is set before responding
+type readIndexFuture struct {
+	deferError
+	lease bool
+	index uint64
+}
+
+func (r *readIndexFuture) Index() uint64 {
+	return r.index
+}
+
 // verifyFuture is used to verify the current node is still
 // the leader. This is to prevent a stale read.
 type verifyFuture struct {
@@ -66,6 +66,8 @@ type leaderState struct {
 	replState map[string]*followerReplication
 	notify    map[*verifyFuture]struct{}
 	stepDown  chan struct{}
+	termStart uint64             // index of the no-op dispatched on election
+	reads     []*readIndexFuture // waiting for termStart to commit
 }
 
 // Raft implements a Raft node.
@@ -144,6 +146,9 @@ type Raft struct {
 	// verifyCh is used to async send verify futures to the main thread
 	// to verify we are still the leader
 	verifyCh chan *verifyFuture
+
+	// readIndexCh is used to async send read index requests to the main thread
+	readIndexCh chan *readIndexFuture
 }
 
 // NewRaft is used to construct a new Raft node. It takes a configuration, as well
@@ -218,6 +223,7 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 		stable:        stable,
 		trans:         trans,
 		verifyCh:      make(chan *verifyFuture, 64),
+		readIndexCh:   make(chan *readIndexFuture, 64),
 	}
 
 	// Initialize as a follower
@@ -338,6 +344,26 @@ func (r *Raft) VerifyLeader() Future {
 	}
 }
 
+// ReadIndex is used for linearizable reads without appending to the log.
+// It returns the commit index once a quorum has confirmed we're still the
+// leader, reads against the FSM are linearizable once it's applied that index.
+// With lease set, the confirmation is skipped if a quorum has heard from us
+// within LeaderLeaseTimeout. That relies on followers not voting while they
+// have a leader, and on clocks not drifting by more than the difference between
+// LeaderLeaseTimeout and HeartbeatTimeout. This must be run on the leader or it
+// will fail.
+func (r *Raft) ReadIndex(lease bool) ReadIndexFuture {
+	metrics.IncrCounter([]string{"raft", "read_index"}, 1)
+	readFuture := &readIndexFuture{lease: lease}
+	readFuture.init()
+	select {
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	case r.readIndexCh <- readFuture:
+		return readFuture
+	}
+}
+
 // AddPeer is used to add a new peer into the cluster. This must be
 // run on the leader or it will fail.
 func (r *Raft) AddPeer(peer net.Addr) Future {
@@ -499,7 +525,7 @@ func (r *Raft) runFSM() {
 
 			// Attempt to restore
 			start := time.Now()
-			if err := r.fsm.Restore(source); err != nil {
+			if err := restoreFSM(r.fsm, source, meta.Index); err != nil {
 				req.respond(fmt.Errorf("failed to restore snapshot %v: %v", req.ID, err))
 				source.Close()
 				continue
@@ -597,6 +623,10 @@ func (r *Raft) runFollower() {
 			// Reject any operations since we are not the leader
 			v.respond(ErrNotLeader)
 
+		case f := <-r.readIndexCh:
+			// Reject any operations since we are not the leader
+			f.respond(ErrNotLeader)
+
 		case p := <-r.peerCh:
 			// Set the peers
 			r.peers = ExcludePeer(p.peers, r.localAddr)
@@ -680,6 +710,10 @@ func (r *Raft) runCandidate() {
 			// Reject any operations since we are not the leader
 			v.respond(ErrNotLeader)
 
+		case f := <-r.readIndexCh:
+			// Reject any operations since we are not the leader
+			f.respond(ErrNotLeader)
+
 		case p := <-r.peerCh:
 			// Set the peers
 			r.peers = ExcludePeer(p.peers, r.localAddr)
@@ -729,6 +763,9 @@ func (r *Raft) runLeader() {
 		for future := range r.leaderState.notify {
 			future.respond(ErrLeadershipLost)
 		}
+		for _, future := range r.leaderState.reads {
+			future.respond(ErrLeadershipLost)
+		}
 
 		// Clear all the state
 		r.leaderState.commitCh = nil
@@ -736,6 +773,7 @@ func (r *Raft) runLeader() {
 		r.leaderState.replState = nil
 		r.leaderState.notify = nil
 		r.leaderState.stepDown = nil
+		r.leaderState.reads = nil
 
 		// If we are stepping down for some reason, no known leader.
 		// We may have stepped down due to an RPC call, which would
@@ -767,6 +805,7 @@ func (r *Raft) runLeader() {
 		},
 	}
 	r.dispatchLogs([]*logFuture{noop})
+	r.leaderState.termStart = noop.log.Index
 
 	// Disable EnableSingleNode after we've been elected leader.
 	// This is to prevent a split brain in the future, if we are removed
@@ -826,6 +865,15 @@ func (r *Raft) leaderLoop() {
 				r.processLogs(idx, commitLog)
 			}
 
+			// Reads waiting on our no-op can go now
+			if len(r.leaderState.reads) > 0 && r.getCommitIndex() >= r.leaderState.termStart {
+				reads := r.leaderState.reads
+				r.leaderState.reads = nil
+				for _, f := range reads {
+					r.readIndex(f)
+				}
+			}
+
 		case v := <-r.verifyCh:
 			if v.quorumSize == 0 {
 				// Just dispatched, start the verification
@@ -844,6 +892,9 @@ func (r *Raft) leaderLoop() {
 				v.respond(nil)
 			}
 
+		case f := <-r.readIndexCh:
+			r.readIndex(f)
+
 		case p := <-r.peerCh:
 			p.respond(ErrLeader)
 
@@ -935,6 +986,40 @@ func (r *Raft) verifyLeader(v *verifyFuture) {
 	}
 }
 
+// readIndex must be called from the main thread for safety. A new leader
+// doesn't know what was committed before its term until its no-op commits,
+// so reads wait for that first.
+func (r *Raft) readIndex(f *readIndexFuture) {
+	if r.getCommitIndex() < r.leaderState.termStart {
+		r.leaderState.reads = append(r.leaderState.reads, f)
+		return
+	}
+	f.index = r.getCommitIndex()
+	if f.lease && r.leaseValid() {
+		f.respond(nil)
+		return
+	}
+	v := &verifyFuture{}
+	v.init()
+	r.verifyLeader(v)
+	go func() {
+		f.respond(v.Error())
+	}()
+}
+
+// leaseValid is used to check if a quorum of nodes has heard from us within
+// the last leader lease interval, like checkLeaderLease without stepping down
+func (r *Raft) leaseValid() bool {
+	contacted := 1
+	now := time.Now()
+	for _, f := range r.leaderState.replState {
+		if now.Sub(f.LastContact()) < r.conf.LeaderLeaseTimeout {
+			contacted++
+		}
+	}
+	return contacted >= r.quorumSize()
+}
+
 // checkLeaderLease is used to check if we can contact a quorum of nodes
 // within the last leader lease interval. If not, we need to step down,
 // as we may have lost connectivity. Returns the maximum duration without
@@ -1735,7 +1820,7 @@ func (r *Raft) restoreSnapshot() error {
 		}
 		defer source.Close()
 
-		if err := r.fsm.Restore(source); err != nil {
+		if err := restoreFSM(r.fsm, source, snapshot.Index); err != nil {
 			r.logger.Printf("[ERR] raft: Failed to restore snapshot %v: %v", snapshot.ID, err)
 			continue
 		}
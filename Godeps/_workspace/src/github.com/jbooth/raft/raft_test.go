@@ -1351,6 +1351,40 @@ func TestRaft_VerifyLeader_Single(t *testing.T) {
 	}
 }
 
+func TestRaft_ReadIndex(t *testing.T) {
+	// Make the cluster
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Get the leader
+	leader := c.Leader()
+
+	// Commit a log
+	future := leader.Apply([]byte("test"), 0)
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	applied := future.(*logFuture).log.Index
+
+	// Both with and without the lease, the read index covers the log
+	for _, lease := range []bool{false, true} {
+		read := leader.ReadIndex(lease)
+		if err := read.Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if read.Index() < applied {
+			t.Fatalf("bad read index %d, lease %v, expected at least %d", read.Index(), lease, applied)
+		}
+	}
+
+	// Followers can't serve a read index
+	for _, f := range c.GetInState(Follower) {
+		if err := f.ReadIndex(false).Error(); err != ErrNotLeader {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
 func TestRaft_VerifyLeader_Fail(t *testing.T) {
 	// Make a cluster
 	conf := inmemConfig()
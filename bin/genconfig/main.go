@@ -11,6 +11,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -123,6 +124,17 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+	} else if strings.ToLower(mode) == "rehash" {
+		// configDir - rehash numSlots
+		// moves every config in configDir to crc16 hashing, see raftis' rehash.go
+		numSlots, err := strconv.Atoi(args[3])
+		if err != nil {
+			panic(err)
+		}
+		err = rehashConfigs(configDir, numSlots)
+		if err != nil {
+			panic(err)
+		}
 	} else {
 		usage(args)
 		return
@@ -135,7 +147,47 @@ func usage(args []string) {
 		first arg is MODE, either "singlenode" or "cluster" or "etcd-cluster"\
 		if singlenode, 2nd arg is output directory, 3rd arg is number of shards.  we'll generate 3 datacenters "dc1,dc2,dc3" and a node in each for each shard \
 		if cluster, 2nd arg is output directory, 3rd arg is a TSV file denoting datacenter,host\
-		if etcd-cluster, 2nd arg is output directory, 3rd arg is an etcd url (used to read cluster configuration).`)
+		if etcd-cluster, 2nd arg is output directory, 3rd arg is an etcd url (used to read cluster configuration).\
+		if rehash, 3rd arg is the number of slots.  every config in the config directory is switched to crc16 hashing.`)
+}
+
+// switches every *.conf in configDir to crc16 hashing over numSlots, and the shards in etcd
+// if the configs use it.  run after REHASH COPY, then restart the nodes.
+func rehashConfigs(configDir string, numSlots int) error {
+	paths, err := filepath.Glob(configDir + "/*.conf")
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("No configs in %s", configDir)
+	}
+	published := make(map[string]bool)
+	for _, path := range paths {
+		cfg, err := config.ReadConfigFile(path)
+		if err != nil {
+			return err
+		}
+		cfg.SlotHash = config.SlotHashCRC16
+		cfg.NumSlots = uint32(numSlots)
+		cfg.Shards = config.RehashShards(cfg.Shards, numSlots)
+		if cfg.Etcd != "" && !published[cfg.Etcd+cfg.EtcdBase] {
+			marshaled, err := json.Marshal(cfg.Shards)
+			if err != nil {
+				return err
+			}
+			_, err = etcd.NewClient([]string{cfg.Etcd}).Set(cfg.EtcdBase+"/shards", string(marshaled), 0)
+			if err != nil {
+				return err
+			}
+			published[cfg.Etcd+cfg.EtcdBase] = true
+		}
+		log.Printf("Rewriting %s for crc16 with %d slots", path, numSlots)
+		err = config.WriteConfigFile(cfg, path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func writeConfigs(cfgs []config.ClusterConfig, configDir string) error {
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/jbooth/raftis"
+	"github.com/jbooth/raftis/config"
+	rlog "github.com/jbooth/raftis/rlog"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// raftisctl [flags] rebalance
+// plans slot moves that even out keys, bytes and ops between shards from the heartbeats in etcd
+// and prints them.  with -execute each move is run with MIGRATESLOT on the shard giving up the
+// slot, one at a time with -pause in between.  with -watch it keeps going, replanning every interval.
+var (
+	etcdUrl   string
+	etcdBase  string
+	tolerance float64
+	maxMoves  int
+	execute   bool
+	pause     time.Duration
+	watch     time.Duration
+)
+
+func init() {
+	flag.StringVar(&etcdUrl, "etcd", "http://127.0.0.1:4001", "etcd url")
+	flag.StringVar(&etcdBase, "base", "/raftis/AWESOME", "etcd base node of the cluster")
+	flag.Float64Var(&tolerance, "tolerance", 0.1, "how far over an even share a shard can be, 0.1 is 10%")
+	flag.IntVar(&maxMoves, "moves", 0, "most slots to move per round, 0 for no limit")
+	flag.BoolVar(&execute, "execute", false, "run the moves instead of just printing them")
+	flag.DurationVar(&pause, "pause", 10*time.Second, "wait between moves when executing")
+	flag.DurationVar(&watch, "watch", 0, "replan this often and keep going, 0 plans once")
+	flag.Parse()
+}
+
+func main() {
+	args := flag.Args()
+	if len(args) != 1 || args[0] != "rebalance" {
+		usage()
+		os.Exit(1)
+	}
+	etcdC := etcd.NewClient([]string{etcdUrl})
+	for {
+		err := rebalance(etcdC)
+		if err != nil {
+			log.Printf("Rebalance failed : %s", err)
+			if watch == 0 {
+				os.Exit(1)
+			}
+		}
+		if watch == 0 {
+			return
+		}
+		time.Sleep(watch)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: raftisctl [flags] rebalance\n")
+	flag.PrintDefaults()
+}
+
+func rebalance(etcdC *etcd.Client) error {
+	shards, loads, err := readLoads(etcdC)
+	if err != nil {
+		return err
+	}
+	moves := config.PlanRebalance(shards, loads, tolerance, maxMoves)
+	printPlan(shards, loads, moves)
+	if !execute || len(moves) == 0 {
+		return nil
+	}
+	for i, m := range moves {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+		log.Printf("Moving %s", m)
+		err = migrate(shards, m)
+		if err != nil {
+			return err
+		}
+		// the source's view of the slots changed, pick it up for the next move
+		shards = config.ApplyMoves(shards, []config.SlotMove{m})
+	}
+	return nil
+}
+
+// the shards record and each shard's load from its hosts' heartbeats
+func readLoads(etcdC *etcd.Client) ([]config.Shard, map[int]config.ShardLoad, error) {
+	resp, err := etcdC.Get(etcdBase+"/shards", false, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	var shards []config.Shard
+	err = json.Unmarshal([]byte(resp.Node.Value), &shards)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error unmarshalling shards from etcd!  resp: %s", resp.Node.Value)
+	}
+	loads := make(map[int]config.ShardLoad)
+	for _, shard := range shards {
+		load := config.ShardLoad{ShardId: shard.ShardId}
+		for _, h := range shard.Hosts {
+			resp, err := etcdC.Get(config.HeartbeatKey(etcdBase, h), false, false)
+			if err != nil {
+				// down, or hasn't beat yet
+				continue
+			}
+			var stats config.StatsInterval
+			err = json.Unmarshal([]byte(resp.Node.Value), &stats)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Bad heartbeat from %s : %s", h.RedisAddr, err)
+			}
+			load.Add(stats)
+		}
+		loads[shard.ShardId] = load
+	}
+	return shards, loads, nil
+}
+
+func printPlan(shards []config.Shard, loads map[int]config.ShardLoad, moves []config.SlotMove) {
+	after := config.ApplyMoves(shards, moves)
+	fmt.Printf("%-6s %-12s %-14s %-10s %s\n", "shard", "keys", "bytes", "ops/s", "slots")
+	for i, shard := range shards {
+		l := loads[shard.ShardId]
+		fmt.Printf("%-6d %-12d %-14d %-10.1f %d -> %d\n", shard.ShardId, l.Keys, l.Bytes, l.Ops, len(shard.Slots), len(after[i].Slots))
+	}
+	if len(moves) == 0 {
+		fmt.Println("balanced, nothing to move")
+		return
+	}
+	for _, m := range moves {
+		fmt.Printf("move %s\n", m)
+	}
+	if !execute {
+		fmt.Println("dry run, pass -execute to move them")
+	}
+}
+
+// runs one move on a host of the source shard and waits for it to finish
+func migrate(shards []config.Shard, m config.SlotMove) error {
+	var hosts []config.Host
+	for _, shard := range shards {
+		if shard.ShardId == m.From {
+			hosts = shard.Hosts
+		}
+	}
+	lg := rlog.New(os.Stderr, "raftisctl ", log.LstdFlags, false)
+	var lastErr error = fmt.Errorf("No hosts for shard %d", m.From)
+	for _, h := range hosts {
+		conn, err := raftis.NewPassThru(h.RedisAddr, lg)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer conn.Close()
+		reply, err := command(conn, "MIGRATESLOT", strconv.Itoa(int(m.Slot)), strconv.Itoa(m.To))
+		if err != nil {
+			return err
+		}
+		if len(reply) == 0 || reply[0] != '+' {
+			return fmt.Errorf("MIGRATESLOT on %s failed : %s", h.RedisAddr, bytes.TrimSpace(reply))
+		}
+		// progress shows up in STATS
+		for {
+			time.Sleep(time.Second)
+			stats, err := command(conn, "STATS")
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(stats, []byte("slot migration: running")) {
+				continue
+			}
+			if i := bytes.Index(stats, []byte("slot migration: failed")); i >= 0 {
+				end := bytes.IndexByte(stats[i:], '\r')
+				if end < 0 {
+					end = len(stats) - i
+				}
+				return fmt.Errorf("Moving %s failed on %s : %s", m, h.RedisAddr, stats[i:i+end])
+			}
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func command(conn *raftis.PassthruConn, cmd string, args ...string) ([]byte, error) {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	resp, err := conn.Command(cmd, bargs)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	_, err = resp.WriteTo(&b)
+	return b.Bytes(), err
+}
@@ -0,0 +1,130 @@
+package raftis
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jbooth/flotilla"
+	redis "github.com/jbooth/raftis/redis"
+	log "github.com/jbooth/raftis/rlog"
+	"io"
+	"strconv"
+	"time"
+)
+
+// how many log entries we read per batch, and how long we wait for new ones before checking the client is still there
+const (
+	cdcBatchSize = 256
+	cdcPollWait  = 1 * time.Second
+)
+
+// CDC <fromIndex>
+// streams every command committed to this node's shard, in raft order, starting at fromIndex.
+// "$" starts after the last command applied locally.  each record is a multi-bulk reply of
+// ["cdc", index, term, db, command, args...], with commands as a client would send them to db.
+// internal ops that don't change what clients can read, like REWRITEVALUES, are left out.
+// ones that do but that a client couldn't send come as "cdc-internal" records instead:
+// EVICT deletes keys, MIGRATEDEL deletes keys that moved to another shard if they still
+// match the sums, TENANTPUT and TENANTDROP change tenants.  like MONITOR, the stream takes over the connection,
+// so consumers should hold one connection per shard and resume from the last index they saw plus one.
+// if fromIndex has been compacted into a snapshot, they get an error and the connection is closed.
+func cdc(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'cdc' command")
+	}
+	var from uint64
+	if string(args[0]) == "$" {
+		from = s.flotilla.AppliedIndex() + 1
+	} else {
+		var err error
+		from, err = strconv.ParseUint(string(args[0]), 10, 64)
+		if err != nil {
+			return redis.NewError(fmt.Sprintf("ERR invalid CDC index %s", string(args[0])))
+		}
+	}
+	return &cdcStream{s.flotilla, c, from, s.lg}
+}
+
+// internal ops that don't change what clients can read
+var cdcSkipped = map[string]bool{
+	"PING":          true,
+	"REWRITEVALUES": true,
+	"USEKEY":        true,
+	"SETSLOT":       true,
+	"CONFIGPUT":     true,
+}
+
+// the record label, db, command and args for a log entry, "" for entries we leave out
+func cdcCommand(e flotilla.LogEntry) (string, int, string, [][]byte) {
+	db, cmd, args := 0, e.Cmd, e.Args
+	switch cmd {
+	case "INDB":
+		if len(args) < 2 {
+			return "cdc-internal", 0, cmd, args
+		}
+		var err error
+		db, err = strconv.Atoi(string(args[0]))
+		if err != nil {
+			return "cdc-internal", 0, cmd, args
+		}
+		cmd, args = string(args[1]), args[2:]
+	case "FLUSHDB":
+		// the db's an arg in the log, a client sends it to the db
+		if len(args) == 1 {
+			if d, err := strconv.Atoi(string(args[0])); err == nil {
+				db, args = d, emptyArgs
+			}
+		}
+	}
+	if cdcSkipped[cmd] {
+		return "", db, cmd, args
+	}
+	if _, ok := writeOps[cmd]; ok || cmd == "FLUSHDB" || cmd == "FLUSHALL" || cmd == "SWAPDB" {
+		return "cdc", db, cmd, args
+	}
+	return "cdc-internal", db, cmd, args
+}
+
+type cdcStream struct {
+	f    flotilla.DB
+	c    *Conn
+	next uint64
+	lg   *log.Logger
+}
+
+func (cs *cdcStream) WriteTo(w io.Writer) (int64, error) {
+	total := int64(0)
+	buf := bufio.NewWriter(w)
+	for !cs.c.isClosed() {
+		entries, next, err := cs.f.ReadLog(cs.next, cdcBatchSize, cdcPollWait)
+		if err != nil {
+			if err == flotilla.ErrCompacted {
+				err = fmt.Errorf("ERR CDC index %d has been compacted, resync from a snapshot and resume from a later index", cs.next)
+			}
+			n, _ := redis.NewError(err.Error()).WriteTo(w)
+			// returning the error closes the connection
+			return total + n, err
+		}
+		for _, e := range entries {
+			label, db, cmd, args := cdcCommand(e)
+			if label == "" {
+				continue
+			}
+			record := make([]interface{}, 0, len(args)+5)
+			record = append(record, label, int(e.Index), int(e.Term), db, cmd)
+			for _, arg := range args {
+				record = append(record, arg)
+			}
+			n, err := redis.NewMultiBulkReply(record...).WriteTo(buf)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		err = buf.Flush()
+		if err != nil {
+			return total, err
+		}
+		cs.next = next
+	}
+	return total, nil
+}
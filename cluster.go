@@ -1,78 +1,135 @@
 package raftis
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/jbooth/raftis/config"
 	log "github.com/jbooth/raftis/rlog"
 	"io"
+	"io/ioutil"
+	"sort"
 	"sync"
-	"sync/atomic"
-	"time"
 )
 
-func NewClusterMember(c *config.ClusterConfig, lg *log.Logger) (*ClusterMember, error) {
+// rpc is flotilla's connections for rpcServiceCode, see rpc.go
+func NewClusterMember(c *config.ClusterConfig, rpc rpcLayer, lg *log.Logger) (*ClusterMember, error) {
 	// just set up hostConns all at once for now
-	slotHosts := make(map[int32][]config.Host)
-	for _, shard := range c.Shards {
-		for _, slot := range shard.Slots {
-			slotHosts[int32(slot)] = shard.Hosts
-		}
-	}
 	hostConns := make(map[string]*hostConn)
 	return &ClusterMember{
 		lg,
 		&sync.RWMutex{},
 		c,
-		slotHosts,
+		buildSlotHosts(c.Shards),
 		hostConns,
+		make(map[string]bool),
+		rpc,
+		make(map[string]bool),
+		make(map[string]*broadcastQueue),
 	}, nil
 
 }
 
-type ClusterMember struct {
-	lg        *log.Logger
-	l         *sync.RWMutex
-	c         *config.ClusterConfig
-	slotHosts map[int32][]config.Host
-	hostConns map[string]*hostConn
+func buildSlotHosts(shards []config.Shard) map[int32][]config.Host {
+	slotHosts := make(map[int32][]config.Host)
+	for _, shard := range shards {
+		for _, slot := range shard.Slots {
+			slotHosts[int32(slot)] = shard.Hosts
+		}
+	}
+	return slotHosts
 }
 
-type hostConn struct {
-	p           *PassthruConn
-	host        string
-	lastErrTime *int64
+// swaps in a new shard layout, assumes the write lock is held
+func (c *ClusterMember) setShards(shards []config.Shard) {
+	c.c.Shards = shards
+	c.slotHosts = buildSlotHosts(shards)
 }
 
-func (h *hostConn) getLastErrTime() int64 {
-	return atomic.LoadInt64(h.lastErrTime)
+// hosts of the shard with id shardId, nil if there's no such shard
+func (c *ClusterMember) ShardHosts(shardId int) []config.Host {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	for _, shard := range c.c.Shards {
+		if shard.ShardId == shardId {
+			return shard.Hosts
+		}
+	}
+	return nil
 }
 
-func (h *hostConn) markErr() {
-	atomic.StoreInt64(h.lastErrTime, time.Now().Unix())
-	h.p.Close()
+// the other hosts in our shard
+func (c *ClusterMember) ShardPeers() []config.Host {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	for _, shard := range c.c.Shards {
+		for _, h := range shard.Hosts {
+			if h.RedisAddr == c.c.Me.RedisAddr {
+				peers := make([]config.Host, 0, len(shard.Hosts)-1)
+				for _, peer := range shard.Hosts {
+					if peer.RedisAddr != c.c.Me.RedisAddr {
+						peers = append(peers, peer)
+					}
+				}
+				return peers
+			}
+		}
+	}
+	return nil
 }
 
-// should hold cluster writelock while calling this to insure visibility
-func (h *hostConn) renew() (err error) {
-	h.p, err = NewPassThru(h.host, h.p.lg)
-	newLastErrTime := int64(0)
-	if err != nil {
-		newLastErrTime = 0
-	} else {
-		newLastErrTime = time.Now().Unix()
+type ClusterMember struct {
+	lg         *log.Logger
+	l          *sync.RWMutex
+	c          *config.ClusterConfig
+	slotHosts  map[int32][]config.Host
+	hostConns  map[string]*hostConn
+	leaders    map[string]bool // RedisAddrs of hosts whose last heartbeat said they lead their shard
+	rpc        rpcLayer
+	rpcHosts   map[string]bool // RedisAddrs of hosts whose last heartbeat said they serve rpc
+	broadcasts map[string]*broadcastQueue
+}
+
+// swaps in the shard leaders and rpc hosts from the latest heartbeats
+func (c *ClusterMember) setLeaders(leaders map[string]bool, rpcHosts map[string]bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.leaders = leaders
+	c.rpcHosts = rpcHosts
+	for host, conn := range c.hostConns {
+		conn.setRPCAddr(c.rpcAddr(host))
 	}
-	atomic.StoreInt64(h.lastErrTime, newLastErrTime)
-	return err
 }
 
-func newHostConn(host string, lg *log.Logger) (*hostConn, error) {
-	p, err := NewPassThru(host, lg)
-	if err != nil {
-		return nil, err
+// host's flotilla address to forward to it over rpc, "" if it doesn't serve rpc.
+// assumes Rlock is held
+func (c *ClusterMember) rpcAddr(host string) string {
+	if c.rpc == nil || !c.rpcHosts[host] {
+		return ""
 	}
-	negOne := int64(-1)
-	atomic.StoreInt64(&negOne, -1)
-	return &hostConn{p, host, &negOne}, nil
+	return c.flotillaAddr(host)
+}
+
+// host's flotilla address from the config, assumes Rlock is held
+func (c *ClusterMember) flotillaAddr(host string) string {
+	for _, shard := range c.c.Shards {
+		for _, h := range shard.Hosts {
+			if h.RedisAddr == host {
+				return h.FlotillaAddr
+			}
+		}
+	}
+	return ""
+}
+
+// the leader out of hosts as of the last heartbeats, false if none of them said so.
+// assumes Rlock is held
+func (c *ClusterMember) leader(hosts []config.Host) (config.Host, bool) {
+	for _, h := range hosts {
+		if c.leaders[h.RedisAddr] {
+			return h, true
+		}
+	}
+	return config.Host{}, false
 }
 
 func (c *ClusterMember) HasKey(cmdName string, args [][]byte) (bool, error) {
@@ -83,14 +140,9 @@ func (c *ClusterMember) HasKey(cmdName string, args [][]byte) (bool, error) {
 	if len(args) == 0 {
 		return false, fmt.Errorf("HasKey Can't handle 0-arg commands other than PING.  Cmd: %s", cmdName)
 	}
-	var key []byte
-	if cmdName == "EVAL" {
-		// first arg is command name, 2nd is key
-		key = args[1]
-	} else {
-		key = args[0]
-	}
-	s := c.slotForKey(key)
+	c.l.RLock()
+	defer c.l.RUnlock()
+	s := c.slotForKey(commandKey(cmdName, args))
 	hosts, ok := c.slotHosts[s]
 	if !ok {
 		return false, fmt.Errorf("No hosts for slot %d", s)
@@ -103,29 +155,255 @@ func (c *ClusterMember) HasKey(cmdName string, args [][]byte) (bool, error) {
 	return false, nil
 }
 
-func (c *ClusterMember) ForwardCommand(cmdName string, args [][]byte) (io.WriterTo, error) {
+// slot of a keyed command, args must not be empty
+func (c *ClusterMember) Slot(cmdName string, args [][]byte) uint32 {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return uint32(c.slotForKey(commandKey(cmdName, args)))
+}
+
+// the key a command is routed by, args must not be empty
+func commandKey(cmdName string, args [][]byte) []byte {
+	if cmdName == "EVAL" {
+		// first arg is command name, 2nd is key
+		return args[1]
+	}
+	return args[0]
+}
+
+// slot of a keyed command and the host a client should send it to, favoring our own group
+func (c *ClusterMember) Owner(cmdName string, args [][]byte) (int32, config.Host, error) {
+	if len(args) == 0 {
+		return 0, config.Host{}, fmt.Errorf("Command %s has no key", cmdName)
+	}
+	c.l.RLock()
+	defer c.l.RUnlock()
+	s := c.slotForKey(commandKey(cmdName, args))
+	hosts, ok := c.slotHosts[s]
+	if !ok || len(hosts) == 0 {
+		return s, config.Host{}, fmt.Errorf("No hosts for slot %d", s)
+	}
+	return s, c.nearest(hosts), nil
+}
+
+// the host out of hosts a client should use, one in our group if there is one.
+// assumes Rlock is held, hosts must not be empty
+func (c *ClusterMember) nearest(hosts []config.Host) config.Host {
+	for _, h := range hosts {
+		if h.Group == c.c.Me.Group {
+			return h
+		}
+	}
+	return hosts[0]
+}
+
+// forwards a keyed command to a host serving its key.  commands on the same stream
+// reach the host in order, see hostpool.go
+func (c *ClusterMember) ForwardCommand(stream uint64, db int, cmdName string, args [][]byte) (io.WriterTo, error) {
 	if len(args) == 0 {
 		return nil, fmt.Errorf("Can't forward command %s, need at least 1 arg for key!", cmdName)
 	}
+	key := args[0]
+	_, isWrite := writeOps[cmdName]
+	return c.forward(forwardReq{stream, db, false, false, cmdName, args}, func() (*hostConn, error) {
+		return c.getConnForKey(key, isWrite)
+	})
+}
+
+// forwards a keyed write so its reply comes back with the owning shard's index token
+// for it, see session.go
+func (c *ClusterMember) ForwardWrite(stream uint64, db int, cmdName string, args [][]byte) (forwardedReply, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Can't forward command %s, need at least 1 arg for key!", cmdName)
+	}
+	key := args[0]
+	return c.forward(forwardReq{stream, db, true, false, cmdName, args}, func() (*hostConn, error) {
+		return c.getConnForKey(key, true)
+	})
+}
+
+// forwards one of internalOps to one of hosts whatever slot its key is in, for ASKED
+// on keys in a slot that's moving between shards
+func (c *ClusterMember) ForwardHosts(stream uint64, hosts []config.Host, cmdName string, args [][]byte) (io.WriterTo, error) {
+	return c.forward(forwardReq{stream, 0, false, true, cmdName, args}, func() (*hostConn, error) {
+		c.l.RLock()
+		defer c.l.RUnlock()
+		desc := fmt.Sprintf("command %s", cmdName)
+		if _, isWrite := writeOps[cmdName]; isWrite {
+			return c.getConnForWrite(hosts, desc)
+		}
+		return c.getConnForHosts(hosts, desc)
+	})
+}
+
+func (c *ClusterMember) forward(req forwardReq, getConn func() (*hostConn, error)) (forwardedReply, error) {
 	for {
-		c.lg.Printf("Forwarding cmd %s, getting conn", cmdName)
-		conn, err := c.getConnForKey(args[0])
+		c.lg.Printf("Forwarding cmd %s, getting conn", req.name)
+		conn, err := getConn()
 		if err != nil {
 			return nil, err
 		}
-		c.lg.Printf("got conn to %s, executing command", conn.p.conn.RemoteAddr().String())
-		fwd, err := conn.p.Command(cmdName, args)
-		if err != nil {
-			conn.markErr()
-			c.lg.Printf("got err %s forwarding command %s  to conn %s", err, cmdName, conn.p.conn.RemoteAddr().String())
-		} else {
+		c.lg.Printf("got conn to %s, executing command", conn.host)
+		fwd, err := conn.Command(req)
+		if err == nil {
 			return fwd, nil
 		}
+		c.lg.Printf("got err %s forwarding command %s  to conn %s", err, req.name, conn.host)
 	}
-	return nil, fmt.Errorf("Couldn't send command")
 }
 
-func (c *ClusterMember) getConnForKey(key []byte) (*hostConn, error) {
+// queues one of internalOps for every other host in the cluster without waiting for replies,
+// used for fire-and-forget traffic like pub/sub fanout.  each host has its own queue, so
+// a slow or down host doesn't hold up the caller or the others, and commands reach each
+// host in call order, so ordering per publisher is kept.
+func (c *ClusterMember) Broadcast(cmdName string, args [][]byte) {
+	c.broadcast(cmdName, args, false)
+}
+
+// like Broadcast, but skips the hosts of our own shard
+func (c *ClusterMember) BroadcastOtherShards(cmdName string, args [][]byte) {
+	c.broadcast(cmdName, args, true)
+}
+
+func (c *ClusterMember) broadcast(cmdName string, args [][]byte, skipMyShard bool) {
+	c.l.RLock()
+	hosts := make([]string, 0)
+	for _, shard := range c.c.Shards {
+		mine := false
+		for _, h := range shard.Hosts {
+			if h.RedisAddr == c.c.Me.RedisAddr {
+				mine = true
+			}
+		}
+		if mine && skipMyShard {
+			continue
+		}
+		for _, h := range shard.Hosts {
+			if h.RedisAddr != c.c.Me.RedisAddr {
+				hosts = append(hosts, h.RedisAddr)
+			}
+		}
+	}
+	c.l.RUnlock()
+	req := forwardReq{0, 0, false, true, cmdName, args}
+	for _, host := range hosts {
+		select {
+		case c.broadcastQueue(host).reqs <- req:
+		default:
+			c.lg.Errorf("Dropping broadcast of %s to host %s, %d already queued", cmdName, host, broadcastQueueSize)
+		}
+	}
+}
+
+// broadcasts queued past this for one host are dropped
+const broadcastQueueSize = 1024
+
+// broadcasts on their way to one host.  one goroutine sends them in order, another drains
+// their replies behind it, each reply gives up after ForwardTimeout
+type broadcastQueue struct {
+	host    string
+	reqs    chan forwardReq
+	replies chan forwardedReply
+}
+
+func (c *ClusterMember) broadcastQueue(host string) *broadcastQueue {
+	c.l.RLock()
+	q, ok := c.broadcasts[host]
+	c.l.RUnlock()
+	if ok {
+		return q
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	q, ok = c.broadcasts[host]
+	if !ok {
+		q = &broadcastQueue{host, make(chan forwardReq, broadcastQueueSize), make(chan forwardedReply, broadcastQueueSize)}
+		c.broadcasts[host] = q
+		go c.sendBroadcasts(q)
+		go c.drainBroadcasts(q)
+	}
+	return q
+}
+
+func (c *ClusterMember) sendBroadcasts(q *broadcastQueue) {
+	for req := range q.reqs {
+		c.l.RLock()
+		conn, err := c.getConnForHost(q.host)
+		c.l.RUnlock()
+		if err != nil {
+			if err != hostMarkedDown {
+				c.lg.Errorf("Error connecting to host %s for broadcast of %s : %s", q.host, req.name, err)
+			}
+			continue
+		}
+		resp, err := conn.Command(req)
+		if err != nil {
+			c.lg.Errorf("Error broadcasting %s to host %s : %s", req.name, q.host, err)
+			continue
+		}
+		q.replies <- resp
+	}
+}
+
+func (c *ClusterMember) drainBroadcasts(q *broadcastQueue) {
+	for resp := range q.replies {
+		_, err := resp.WriteTo(ioutil.Discard)
+		if err != nil {
+			c.lg.Errorf("Error on broadcast reply from host %s : %s", q.host, err)
+		}
+	}
+}
+
+// sends one of internalOps to one host in each of the other shards and waits for all their replies,
+// for commands like FLUSHDB that have to run everywhere.  replies come back as raw redis protocol.
+func (c *ClusterMember) CommandOtherShards(cmdName string, args [][]byte) ([][]byte, error) {
+	c.l.RLock()
+	others := make([][]config.Host, 0)
+	for _, shard := range c.c.Shards {
+		mine := false
+		for _, h := range shard.Hosts {
+			if h.RedisAddr == c.c.Me.RedisAddr {
+				mine = true
+			}
+		}
+		if !mine && len(shard.Hosts) > 0 {
+			others = append(others, shard.Hosts)
+		}
+	}
+	c.l.RUnlock()
+	replies := make([][]byte, 0, len(others))
+	for _, hosts := range others {
+		reply, err := c.CommandHosts(hosts, cmdName, args)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// sends one of internalOps to one of hosts, bypassing slot routing, and waits for the raw reply
+func (c *ClusterMember) CommandHosts(hosts []config.Host, cmdName string, args [][]byte) ([]byte, error) {
+	c.l.RLock()
+	conn, err := c.getConnForHosts(hosts, fmt.Sprintf("command %s", cmdName))
+	c.l.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.Command(forwardReq{0, 0, false, true, cmdName, args})
+	if err != nil {
+		return nil, fmt.Errorf("Error sending %s to %s : %s", cmdName, conn.host, err)
+	}
+	var b bytes.Buffer
+	_, err = resp.WriteTo(&b)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading reply to %s from %s : %s", cmdName, conn.host, err)
+	}
+	return b.Bytes(), nil
+}
+
+// picks a host for key's slot, its shard's leader for writes so they don't take another hop
+func (c *ClusterMember) getConnForKey(key []byte, write bool) (*hostConn, error) {
 	c.l.RLock()
 	defer c.l.RUnlock()
 	slot := c.slotForKey(key)
@@ -134,6 +412,33 @@ func (c *ClusterMember) getConnForKey(key []byte) (*hostConn, error) {
 	if !ok {
 		return nil, fmt.Errorf("No hosts configured for slot %d from key %s", slot, key)
 	}
+	desc := fmt.Sprintf("slot %d, key %s", slot, key)
+	if write {
+		return c.getConnForWrite(hosts, desc)
+	}
+	return c.getConnForHosts(hosts, desc)
+}
+
+// picks the leader out of hosts, writes sent anywhere else get passed on to it by flotilla.
+// leaders are only as fresh as the last heartbeat, a stale one still passes the write on,
+// and if it's down we fall back to any host.  assumes Rlock is held
+func (c *ClusterMember) getConnForWrite(hosts []config.Host, desc string) (*hostConn, error) {
+	leader, ok := c.leader(hosts)
+	if ok && leader.RedisAddr != c.c.Me.RedisAddr {
+		conn, err := c.getConnForHost(leader.RedisAddr)
+		if err == nil {
+			return conn, nil
+		}
+		if err != hostMarkedDown {
+			c.lg.Errorf("Error connecting to leader %s for %s : %s", leader.RedisAddr, desc, err)
+		}
+	}
+	return c.getConnForHosts(hosts, desc)
+}
+
+// picks a host out of hosts, favoring our own group.  assumes Rlock is held,
+// desc describes what we're connecting for in errors
+func (c *ClusterMember) getConnForHosts(hosts []config.Host, desc string) (*hostConn, error) {
 	hostsByGroup := make(map[string]config.Host)
 	for _, host := range hosts {
 		if host.RedisAddr == c.c.Me.RedisAddr {
@@ -152,7 +457,7 @@ func (c *ClusterMember) getConnForKey(key []byte) (*hostConn, error) {
 			return sameGroupConn, nil
 		} else {
 			if err != hostMarkedDown {
-				c.lg.Errorf("Error connecting to host %s for slot %d : %s", sameGroup.RedisAddr, slot, err.Error())
+				c.lg.Errorf("Error connecting to host %s for %s : %s", sameGroup.RedisAddr, desc, err.Error())
 			}
 		}
 	}
@@ -163,11 +468,11 @@ func (c *ClusterMember) getConnForKey(key []byte) (*hostConn, error) {
 			return conn, nil
 		} else {
 			if err != hostMarkedDown {
-				c.lg.Errorf("Error connecting to host %+v for slot %d : %s", h, slot, err)
+				c.lg.Errorf("Error connecting to host %+v for %s : %s", h, desc, err)
 			}
 		}
 	}
-	return nil, fmt.Errorf("Couldn't find any hosts up for slot %d, key %s, hosts are %+v, error from last connect attempt: %s", slot, key, hosts, err)
+	return nil, fmt.Errorf("Couldn't find any hosts up for %s, hosts are %+v, error from last connect attempt: %s", desc, hosts, err)
 
 }
 
@@ -176,68 +481,45 @@ var hostMarkedDown error = fmt.Errorf("Host down")
 // assumes Rlock is held, returns error if this host is marked down
 func (c *ClusterMember) getConnForHost(host string) (*hostConn, error) {
 	conn, ok := c.hostConns[host]
-	if ok {
-		lastErrTime := conn.getLastErrTime()
-		if lastErrTime > 0 {
-			if time.Now().Unix()-lastErrTime > 360 {
-				// if older than 5 minutes renew
-				// switch to writelock
-				c.l.RUnlock()
-				c.l.Lock()
-				defer func() {
-					c.l.Unlock()
-					c.l.RLock()
-				}()
-				// double check after writelock
-				if time.Now().Unix()-conn.getLastErrTime() > 0 {
-					conn.renew()
-				}
-				return conn, nil
-			} else {
-				// if not, return error
-				return nil, hostMarkedDown
-			}
-
-		}
-		return conn, nil
-	} else {
-		// uninialized, initialize this conn
-
-		// switch to writelock
+	if !ok {
+		// uninitialized, switch to writelock to add it
 		c.l.RUnlock()
 		c.l.Lock()
-		defer func() {
-			c.l.Unlock()
-			c.l.RLock()
-		}()
-
-		// instantiate conn
-		newConn, err := newHostConn(host, c.lg)
-		if err != nil {
-			return nil, err
+		conn, ok = c.hostConns[host]
+		if !ok {
+			conn = newHostConn(host, c.rpcAddr(host), c.flotillaAddr(host), c.rpc, c.c, c.lg)
+			c.hostConns[host] = conn
 		}
-		// set and return
-		c.hostConns[host] = newConn
-		return newConn, nil
+		c.l.Unlock()
+		c.l.RLock()
 	}
+	err := conn.acquire()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
 }
 
-func (c *ClusterMember) slotForKey(key []byte) int32 {
-	h := hash(key)
-	if h < 0 {
-		h = -h
+// a line on each host we've forwarded to, sorted by host
+func (c *ClusterMember) ForwardStats() []string {
+	c.l.RLock()
+	hosts := make([]string, 0, len(c.hostConns))
+	for host := range c.hostConns {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	conns := make([]*hostConn, len(hosts))
+	for i, host := range hosts {
+		conns[i] = c.hostConns[host]
+	}
+	c.l.RUnlock()
+	ret := make([]string, len(conns))
+	for i, conn := range conns {
+		ret[i] = conn.String()
 	}
-	ret := h % int32(c.c.NumSlots)
 	return ret
 }
 
-func hash(key []byte) int32 {
-	if key == nil {
-		return 0
-	}
-	sum := int32(0)
-	for i := 0; i < len(key); i++ {
-		sum = (sum * 17) + int32(key[i])
-	}
-	return sum
+func (c *ClusterMember) slotForKey(key []byte) int32 {
+	return int32(config.KeySlot(c.c.SlotHash, c.c.NumSlots, key))
 }
@@ -0,0 +1,256 @@
+package raftis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/jbooth/raftis/config"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redis cluster's view of the cluster, built from config.Shards, so cluster-aware clients
+// can send keys straight to a shard instead of through our passthru connections.
+// any host in a shard serves its keys, writes go through raft to whichever is leader,
+// so the first host of each shard is reported as its master and the rest as replicas.
+//
+// with clusterRedirects set, keys we don't own get -MOVED slot host:port instead of
+// being forwarded:  "aware" only does it for connections that have asked for the layout
+// with CLUSTER SLOTS, SHARDS or NODES, which cluster clients do when they connect,
+// "always" does it for every connection.  commands for dbs other than 0 are always
+// forwarded, redis cluster only has db 0.
+
+const (
+	redirectsOff    = "off"
+	redirectsAware  = "aware"
+	redirectsAlways = "always"
+)
+
+func validRedirects(mode string) error {
+	if mode == "" || mode == redirectsOff || mode == redirectsAware || mode == redirectsAlways {
+		return nil
+	}
+	return fmt.Errorf("Unknown clusterRedirects %s, expected off, aware or always", mode)
+}
+
+// whether a command for a key we don't own should be redirected rather than forwarded
+func (s *Server) redirects(c *Conn, db int) bool {
+	if c == nil || db != 0 {
+		return false
+	}
+	mode := s.clusterConfig().ClusterRedirects
+	return mode == redirectsAlways || (mode == redirectsAware && c.clusterAware)
+}
+
+func isRedirectsConfig(name []byte) bool {
+	return strings.ToLower(string(name)) == "cluster-redirects"
+}
+
+// CONFIG SET cluster-redirects, only affects this node
+func (s *Server) setRedirects(mode string) error {
+	mode = strings.ToLower(mode)
+	if err := validRedirects(mode); err != nil {
+		return fmt.Errorf("ERR %s", err)
+	}
+	s.cluster.l.Lock()
+	defer s.cluster.l.Unlock()
+	s.cluster.c.ClusterRedirects = mode
+	return nil
+}
+
+func (s *Server) moved(name string, args [][]byte) io.WriterTo {
+	slot, host, err := s.cluster.Owner(name, args)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	s.stats.incrNumRedirects()
+	return &redis.ErrorReply{Code: "MOVED", Message: fmt.Sprintf("%d %s", slot, host.RedisAddr)}
+}
+
+// 40 hex chars like a redis node id, stable for as long as the host keeps its address
+func nodeID(h config.Host) string {
+	sum := sha1.Sum([]byte(h.RedisAddr))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitAddr(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+// a shard's slots as sorted start, end pairs, inclusive
+func slotRanges(slots []uint32) [][2]uint32 {
+	sorted := append([]uint32(nil), slots...)
+	sort.Sort(uint32s(sorted))
+	ret := make([][2]uint32, 0)
+	for _, slot := range sorted {
+		if len(ret) > 0 && ret[len(ret)-1][1]+1 == slot {
+			ret[len(ret)-1][1] = slot
+		} else {
+			ret = append(ret, [2]uint32{slot, slot})
+		}
+	}
+	return ret
+}
+
+type uint32s []uint32
+
+func (u uint32s) Len() int           { return len(u) }
+func (u uint32s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint32s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// a copy of the cluster config, the heartbeat swaps shards in under the lock
+func (s *Server) clusterConfig() config.ClusterConfig {
+	s.cluster.l.RLock()
+	defer s.cluster.l.RUnlock()
+	return *s.cluster.c
+}
+
+// CLUSTER SLOTS|SHARDS|NODES|INFO|MYID|KEYSLOT key
+func clusterCmd(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) == 0 {
+		return redis.NewError("ERR wrong number of arguments for 'cluster' command")
+	}
+	sub := strings.ToUpper(string(args[0]))
+	switch sub {
+	case "SLOTS", "SHARDS", "NODES":
+		if c != nil {
+			c.clusterAware = true
+		}
+	}
+	switch sub {
+	case "SLOTS":
+		return clusterSlots(s)
+	case "SHARDS":
+		return clusterShards(s)
+	case "NODES":
+		return clusterNodes(s)
+	case "INFO":
+		return clusterInfo(s)
+	case "MYID":
+		return &redis.BulkReply{Value: []byte(nodeID(s.clusterConfig().Me))}
+	case "KEYSLOT":
+		if len(args) != 2 {
+			return redis.NewError("ERR wrong number of arguments for 'cluster|keyslot' command")
+		}
+		cfg := s.clusterConfig()
+		return &redis.IntegerReply{Number: int(config.KeySlot(cfg.SlotHash, cfg.NumSlots, args[1]))}
+	}
+	return redis.NewError(fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+}
+
+// node as CLUSTER SLOTS lists it, ip port id
+func slotsNode(h config.Host) []interface{} {
+	ip, port := splitAddr(h.RedisAddr)
+	return []interface{}{ip, port, nodeID(h)}
+}
+
+func clusterSlots(s *Server) io.WriterTo {
+	shards := s.clusterConfig().Shards
+	ret := make([]interface{}, 0)
+	for _, shard := range shards {
+		if len(shard.Hosts) == 0 {
+			continue
+		}
+		for _, r := range slotRanges(shard.Slots) {
+			entry := []interface{}{int(r[0]), int(r[1])}
+			for _, h := range shard.Hosts {
+				entry = append(entry, slotsNode(h))
+			}
+			ret = append(ret, entry)
+		}
+	}
+	return redis.NewMultiBulkReply(ret...)
+}
+
+func clusterShards(s *Server) io.WriterTo {
+	shards := s.clusterConfig().Shards
+	ret := make([]interface{}, 0, len(shards))
+	for _, shard := range shards {
+		slots := make([]interface{}, 0)
+		for _, r := range slotRanges(shard.Slots) {
+			slots = append(slots, int(r[0]), int(r[1]))
+		}
+		nodes := make([]interface{}, 0, len(shard.Hosts))
+		for i, h := range shard.Hosts {
+			ip, port := splitAddr(h.RedisAddr)
+			role := "replica"
+			if i == 0 {
+				role = "master"
+			}
+			nodes = append(nodes, []interface{}{
+				"id", nodeID(h),
+				"port", port,
+				"ip", ip,
+				"endpoint", ip,
+				"role", role,
+				"replication-offset", 0,
+				"health", "online",
+			})
+		}
+		ret = append(ret, []interface{}{"slots", slots, "nodes", nodes})
+	}
+	return redis.NewMultiBulkReply(ret...)
+}
+
+// one line per host, same columns as redis:
+// id ip:port@cport flags master ping-sent pong-recv config-epoch link-state slots...
+// cport is the flotilla port
+func clusterNodes(s *Server) io.WriterTo {
+	cfg := s.clusterConfig()
+	shards, me := cfg.Shards, cfg.Me
+	lines := make([]string, 0)
+	for _, shard := range shards {
+		for i, h := range shard.Hosts {
+			_, cport := splitAddr(h.FlotillaAddr)
+			flags := "master"
+			master := "-"
+			if i > 0 {
+				flags = "slave"
+				master = nodeID(shard.Hosts[0])
+			}
+			if h.RedisAddr == me.RedisAddr {
+				flags = "myself," + flags
+			}
+			line := fmt.Sprintf("%s %s@%d %s %s 0 0 %d connected", nodeID(h), h.RedisAddr, cport, flags, master, shard.ShardId)
+			if i == 0 {
+				for _, r := range slotRanges(shard.Slots) {
+					if r[0] == r[1] {
+						line += fmt.Sprintf(" %d", r[0])
+					} else {
+						line += fmt.Sprintf(" %d-%d", r[0], r[1])
+					}
+				}
+			}
+			lines = append(lines, line)
+		}
+	}
+	return &redis.BulkReply{Value: []byte(strings.Join(lines, "\n") + "\n")}
+}
+
+func clusterInfo(s *Server) io.WriterTo {
+	cfg := s.clusterConfig()
+	shards := cfg.Shards
+	assigned := 0
+	nodes := 0
+	for _, shard := range shards {
+		assigned += len(shard.Slots)
+		nodes += len(shard.Hosts)
+	}
+	state := "ok"
+	if assigned < int(cfg.NumSlots) {
+		state = "fail"
+	}
+	info := fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:0\r\ncluster_slots_fail:0\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\n",
+		state, assigned, assigned, nodes, len(shards))
+	return &redis.BulkReply{Value: []byte(info)}
+}
@@ -0,0 +1,68 @@
+package raftis
+
+import (
+	"fmt"
+	"github.com/jbooth/flotilla"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"sync"
+	"time"
+)
+
+// COMPACT rewrites this node's data file without the free pages lmdb keeps after deletes.
+// it runs in the background since it copies the whole shard, progress shows up in STATS.
+type compaction struct {
+	l         *sync.Mutex
+	running   bool
+	startTime int64
+	last      flotilla.CompactStats
+	err       error
+}
+
+func newCompaction() *compaction {
+	return &compaction{l: &sync.Mutex{}}
+}
+
+// COMPACT
+// compacts this node's copy of the shard, other replicas are left alone
+func compact(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 0 {
+		return redis.NewError("ERR wrong number of arguments for 'compact' command")
+	}
+	s.compaction.l.Lock()
+	defer s.compaction.l.Unlock()
+	if s.compaction.running {
+		return redis.NewError("ERR compaction already in progress")
+	}
+	s.compaction.running = true
+	s.compaction.startTime = time.Now().Unix()
+	go s.compaction.run(s)
+	return &redis.StatusReply{Code: "Background compaction started"}
+}
+
+func (p *compaction) run(s *Server) {
+	stats, err := s.flotilla.Compact()
+	if err != nil {
+		s.lg.Errorf("Compaction failed : %s", err)
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.running = false
+	p.last = stats
+	p.err = err
+}
+
+func (p *compaction) String() string {
+	p.l.Lock()
+	defer p.l.Unlock()
+	state := "idle"
+	if p.running {
+		state = "running"
+	} else if p.err != nil {
+		state = "failed: " + p.err.Error()
+	} else if p.startTime != 0 {
+		state = "done"
+	}
+	return fmt.Sprintf("compaction: %s, started %d, %d bytes on disk before, %d after, paused writes for %s",
+		state, p.startTime, p.last.Before, p.last.After, p.last.Pause)
+}
@@ -13,6 +13,40 @@ type ClusterConfig struct {
 	EtcdBase string  `json:"etcdShards"` // etcd base node, like /raftis/myClusterName, no trailing slash
 	Datadir  string  `json:"dataDir"`    // local data directory
 	Shards   []Shard `json:"shards"`     // defines topography of cluster
+	// keyspace notification classes, same syntax as redis' notify-keyspace-events, "" disables
+	NotifyKeyspaceEvents string `json:"notifyKeyspaceEvents"`
+	// values at least this many bytes are stored deflated, 0 disables.  replicas have to agree,
+	// so this only holds until CONFIG SET compress-threshold records a value for the cluster
+	CompressThreshold int `json:"compressThreshold"`
+	// json key file for AES-GCM encryption of values and snapshots at rest, "" disables
+	KeyFile string `json:"keyFile"`
+	// evict keys once they take this many bytes on a shard, 0 disables
+	MaxMemory int64 `json:"maxMemory"`
+	// allkeys-lru, allkeys-lfu, volatile-ttl, volatile-random or noeviction, the default
+	MaxMemoryPolicy string `json:"maxMemoryPolicy"`
+	// initial size of each node's lmdb map in bytes, 0 for flotilla's default of 32GB
+	MapSize uint64 `json:"mapSize"`
+	// percent of the map in use that doubles it, 0 for the default of 80, -1 never grows
+	MapGrowAt int `json:"mapGrowAt"`
+	// largest the map will grow to in bytes, 0 for no limit
+	MapMaxSize uint64 `json:"mapMaxSize"`
+	// how keys map to slots, legacy or crc16 for redis cluster's hashing, "" is legacy
+	SlotHash string `json:"slotHash"`
+	// off, aware or always, when to answer keys we don't own with MOVED instead of forwarding
+	ClusterRedirects string `json:"clusterRedirects"`
+	// hot spare, not in any shard until it takes the place of a dead host
+	Spare bool `json:"spare"`
+	// SYNCMODE reads on a leader that's heard from a quorum within raft's lease skip
+	// confirming it's still leader, faster but trusts clocks to run at about the same rate
+	LeaseReads bool `json:"leaseReads"`
+	// connections kept to each other host for forwarding, 0 for the default of 4
+	ForwardConns int `json:"forwardConns"`
+	// ms to wait connecting to another host or on a forwarded reply, 0 for the default of 15s
+	ForwardTimeoutMs int64 `json:"forwardTimeoutMs"`
+	// ms a host is marked down after a failure, doubling each failure in a row, 0 for 1s
+	ForwardBackoffMs int64 `json:"forwardBackoffMs"`
+	// most ms a host is marked down between probes, 0 for the default of a minute
+	ForwardMaxBackoffMs int64 `json:"forwardMaxBackoffMs"`
 }
 
 func (c *ClusterConfig) MyShard() Shard {
@@ -27,7 +61,12 @@ func (c *ClusterConfig) MyShard() Shard {
 }
 
 func (c *ClusterConfig) HeartbeatKey() string {
-	return c.EtcdBase + "/nodes/" + c.Me.RedisAddr
+	return HeartbeatKey(c.EtcdBase, c.Me)
+}
+
+// where h writes its StatsInterval every few seconds, gone once it stops
+func HeartbeatKey(etcdBase string, h Host) string {
+	return etcdBase + "/nodes/" + h.RedisAddr
 }
 
 type Heartbeat struct {
@@ -41,7 +80,15 @@ type StatsInterval struct {
 	NumReads      uint64 `json:"numReads"`
 	NumWrites     uint64 `json:"numWrites"`
 	NumForwards   uint64 `json:"numForwards"`
+	NumRedirects  uint64 `json:"numRedirects"`  // MOVED replies sent instead of forwarding
+	NumStaleReads uint64 `json:"numStaleReads"` // reads past their MAXSTALENESS that went through the leader
 	DiskSpaceFree uint64 `json:"diskSpaceFree"`
+	MapUsed       uint64 `json:"mapUsed"`
+	MapSize       uint64 `json:"mapSize"`
+	MapWarning    bool   `json:"mapWarning"` // map is filling and needs to grow soon
+	NumKeys       uint64 `json:"numKeys"`    // across all dbs, at the end of the interval
+	Leader        bool   `json:"leader"`     // raft leader of its shard at the end of the interval
+	Rpc           bool   `json:"rpc"`        // takes forwarded commands over flotilla's port
 }
 
 func (s *StatsInterval) String() string {
@@ -59,7 +106,7 @@ func ShardsEqual(ss1 []Shard, ss2 []Shard) bool {
 	}
 	for idx, s1 := range ss1 {
 		s2 := ss2[idx]
-		if s1.ShardId != s2.ShardId {
+		if s1.ShardId != s2.ShardId || len(s1.Slots) != len(s2.Slots) || len(s1.Hosts) != len(s2.Hosts) {
 			return false
 		}
 		for j, slot := range s1.Slots {
@@ -77,9 +124,9 @@ func ShardsEqual(ss1 []Shard, ss2 []Shard) bool {
 }
 
 type Shard struct {
-	ShardId int      `json: "id"`   // invalid if negative
-	Slots   []uint32 `json:"slots"` // which slots this shard owns
-	Hosts   []Host   `json:"hosts"` // which hosts are currently serving this shard
+	ShardId int      `json:"ShardId"` // invalid if negative
+	Slots   []uint32 `json:"slots"`   // which slots this shard owns
+	Hosts   []Host   `json:"hosts"`   // which hosts are currently serving this shard
 }
 
 type Host struct {
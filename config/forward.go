@@ -0,0 +1,46 @@
+package config
+
+import (
+	"time"
+)
+
+const (
+	defaultForwardConns      = 4
+	defaultForwardTimeout    = 15 * time.Second
+	defaultForwardBackoff    = time.Second
+	defaultForwardMaxBackoff = time.Minute
+)
+
+// connections to keep to each host we forward to
+func (c *ClusterConfig) ForwardPoolSize() int {
+	if c.ForwardConns <= 0 {
+		return defaultForwardConns
+	}
+	return c.ForwardConns
+}
+
+// longer than a SYNCMODE read waits on the leader by default, so those don't time out
+func (c *ClusterConfig) ForwardTimeout() time.Duration {
+	if c.ForwardTimeoutMs <= 0 {
+		return defaultForwardTimeout
+	}
+	return time.Duration(c.ForwardTimeoutMs) * time.Millisecond
+}
+
+// how long a host stays marked down after failures in a row
+func (c *ClusterConfig) ForwardBackoff(failures int) time.Duration {
+	backoff, max := defaultForwardBackoff, defaultForwardMaxBackoff
+	if c.ForwardBackoffMs > 0 {
+		backoff = time.Duration(c.ForwardBackoffMs) * time.Millisecond
+	}
+	if c.ForwardMaxBackoffMs > 0 {
+		max = time.Duration(c.ForwardMaxBackoffMs) * time.Millisecond
+	}
+	for i := 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// planning slot moves that even out load between shards, for raftisctl rebalance.
+// load comes from heartbeats, which only report whole shards, so a shard's load is taken
+// to be spread evenly over its slots.  each shard gets a score, its share of the cluster's
+// keys, bytes and ops averaged, and slots move from the heaviest shard to the lightest one
+// until every shard is within tolerance of an even share.
+
+// load on a shard, from its hosts' heartbeats
+type ShardLoad struct {
+	ShardId int     `json:"shardId"`
+	Keys    uint64  `json:"keys"`
+	Bytes   uint64  `json:"bytes"`
+	Ops     float64 `json:"ops"` // reads and writes per second
+}
+
+// adds a host's heartbeat.  replicas hold the same data so keys and bytes are the largest
+// any host reports, reads and writes are spread over hosts so they add up.
+func (l *ShardLoad) Add(stats StatsInterval) {
+	if stats.NumKeys > l.Keys {
+		l.Keys = stats.NumKeys
+	}
+	if stats.MapUsed > l.Bytes {
+		l.Bytes = stats.MapUsed
+	}
+	if stats.EndTime > stats.StartTime {
+		l.Ops += float64(stats.NumReads+stats.NumWrites) / float64(stats.EndTime-stats.StartTime)
+	}
+}
+
+type SlotMove struct {
+	Slot uint32 `json:"slot"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+func (m SlotMove) String() string {
+	return fmt.Sprintf("slot %d from shard %d to shard %d", m.Slot, m.From, m.To)
+}
+
+// PlanRebalance picks slots to move so no shard's score is more than tolerance over an even
+// share, 0.1 allows 10% over.  shards without hosts are left out, shards missing from loads
+// count as idle.  at most maxMoves moves are planned, 0 for no limit.  a slot is only moved
+// once and only if it leaves the two shards closer together, so the plan stays small.
+func PlanRebalance(shards []Shard, loads map[int]ShardLoad, tolerance float64, maxMoves int) []SlotMove {
+	live := make([]Shard, 0, len(shards))
+	for _, shard := range shards {
+		if len(shard.Hosts) > 0 {
+			live = append(live, shard)
+		}
+	}
+	if len(live) < 2 {
+		return nil
+	}
+	score := shardScores(live, loads)
+	slots := make(map[int][]uint32)
+	perSlot := make(map[int]float64)
+	for _, shard := range live {
+		sorted := append([]uint32(nil), shard.Slots...)
+		sort.Sort(slotOrder(sorted))
+		slots[shard.ShardId] = sorted
+		if len(sorted) > 0 {
+			perSlot[shard.ShardId] = score[shard.ShardId] / float64(len(sorted))
+		}
+	}
+	limit := (1 + tolerance) / float64(len(live))
+	moved := make(map[uint32]bool)
+	moves := make([]SlotMove, 0)
+	for maxMoves <= 0 || len(moves) < maxMoves {
+		heavy, light := live[0].ShardId, live[0].ShardId
+		for _, shard := range live {
+			id := shard.ShardId
+			if score[id] > score[heavy] {
+				heavy = id
+			}
+			if score[id] < score[light] {
+				light = id
+			}
+		}
+		if score[heavy] <= limit {
+			break
+		}
+		// highest slot that hasn't moved yet, so both sides keep contiguous ranges
+		from := slots[heavy]
+		i := len(from) - 1
+		for i >= 0 && moved[from[i]] {
+			i--
+		}
+		if i < 0 {
+			break
+		}
+		slot := from[i]
+		w := perSlot[heavy]
+		if score[light]+w >= score[heavy] {
+			// the slot is too big to help
+			break
+		}
+		slots[heavy] = append(from[:i:i], from[i+1:]...)
+		slots[light] = append(slots[light], slot)
+		score[heavy] -= w
+		score[light] += w
+		moved[slot] = true
+		moves = append(moves, SlotMove{slot, heavy, light})
+	}
+	return moves
+}
+
+// each shard's share of the cluster's load, averaged over keys, bytes and ops.
+// falls back to slot counts if nothing's reported any load.
+func shardScores(shards []Shard, loads map[int]ShardLoad) map[int]float64 {
+	var keys, bytes uint64
+	var ops float64
+	for _, shard := range shards {
+		l := loads[shard.ShardId]
+		keys += l.Keys
+		bytes += l.Bytes
+		ops += l.Ops
+	}
+	score := make(map[int]float64)
+	for _, shard := range shards {
+		l := loads[shard.ShardId]
+		sum, dims := 0.0, 0
+		if keys > 0 {
+			sum += float64(l.Keys) / float64(keys)
+			dims++
+		}
+		if bytes > 0 {
+			sum += float64(l.Bytes) / float64(bytes)
+			dims++
+		}
+		if ops > 0 {
+			sum += l.Ops / ops
+			dims++
+		}
+		if dims > 0 {
+			score[shard.ShardId] = sum / float64(dims)
+		}
+	}
+	if keys == 0 && bytes == 0 && ops == 0 {
+		total := 0
+		for _, shard := range shards {
+			total += len(shard.Slots)
+		}
+		for _, shard := range shards {
+			if total > 0 {
+				score[shard.ShardId] = float64(len(shard.Slots)) / float64(total)
+			}
+		}
+	}
+	return score
+}
+
+// applies moves to shards, returning new shards
+func ApplyMoves(shards []Shard, moves []SlotMove) []Shard {
+	ret := make([]Shard, len(shards))
+	for i, shard := range shards {
+		ret[i] = Shard{shard.ShardId, append([]uint32(nil), shard.Slots...), shard.Hosts}
+	}
+	for _, m := range moves {
+		for i := range ret {
+			if ret[i].ShardId == m.From {
+				slots := make([]uint32, 0, len(ret[i].Slots))
+				for _, slot := range ret[i].Slots {
+					if slot != m.Slot {
+						slots = append(slots, slot)
+					}
+				}
+				ret[i].Slots = slots
+			} else if ret[i].ShardId == m.To {
+				ret[i].Slots = append(ret[i].Slots, m.Slot)
+			}
+		}
+	}
+	return ret
+}
+
+type slotOrder []uint32
+
+func (s slotOrder) Len() int           { return len(s) }
+func (s slotOrder) Less(i, j int) bool { return s[i] < s[j] }
+func (s slotOrder) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+)
+
+// how keys map to slots.  legacy is raftis' original hash modulo NumSlots, crc16 is the
+// same as redis cluster:  CRC16 (XMODEM) of the key, or of its {hashtag} if it has one,
+// modulo NumSlots, which should be RedisClusterSlots.  keys sharing a hashtag always land
+// in the same slot, so multi-key commands and transactions can be kept on one shard.
+const (
+	SlotHashLegacy    = "legacy"
+	SlotHashCRC16     = "crc16"
+	RedisClusterSlots = 16384
+)
+
+func ValidSlotHash(slotHash string) error {
+	if slotHash == "" || slotHash == SlotHashLegacy || slotHash == SlotHashCRC16 {
+		return nil
+	}
+	return fmt.Errorf("Unknown slotHash %s, expected %s or %s", slotHash, SlotHashLegacy, SlotHashCRC16)
+}
+
+// slot for key under slotHash, "" is legacy so existing configs keep their layout
+func KeySlot(slotHash string, numSlots uint32, key []byte) uint32 {
+	if slotHash == SlotHashCRC16 {
+		return uint32(CRC16(HashTag(key))) % numSlots
+	}
+	h := legacyHash(key)
+	if h < 0 {
+		h = -h
+	}
+	return uint32(h % int32(numSlots))
+}
+
+func legacyHash(key []byte) int32 {
+	if key == nil {
+		return 0
+	}
+	sum := int32(0)
+	for i := 0; i < len(key); i++ {
+		sum = (sum * 17) + int32(key[i])
+	}
+	return sum
+}
+
+// the part of key that's hashed, same rules as redis cluster:  whatever's between the
+// first { and the next }, unless that's empty, otherwise the whole key
+func HashTag(key []byte) []byte {
+	for i := 0; i < len(key); i++ {
+		if key[i] != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j == i+1 {
+					return key
+				}
+				return key[i+1 : j]
+			}
+		}
+		return key
+	}
+	return key
+}
+
+var crc16Table [256]uint16
+
+func init() {
+	// CRC16-CCITT (XMODEM), polynomial 0x1021, no reflection, 0 initial value
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func CRC16(b []byte) uint16 {
+	crc := uint16(0)
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// copies of shards with numSlots split into contiguous ranges in shard order, like redis
+// cluster hands them out.  REHASH and genconfig's rehash mode both use this, so they agree
+// on where every key goes when moving a cluster to a new slot layout.
+func RehashShards(shards []Shard, numSlots int) []Shard {
+	ret := make([]Shard, len(shards))
+	for i, s := range shards {
+		start := i * numSlots / len(shards)
+		end := (i + 1) * numSlots / len(shards)
+		slots := make([]uint32, 0, end-start)
+		for slot := start; slot < end; slot++ {
+			slots = append(slots, uint32(slot))
+		}
+		ret[i] = Shard{s.ShardId, slots, s.Hosts}
+	}
+	return ret
+}
@@ -0,0 +1,23 @@
+package config
+
+// where a hot spare should go: the first host that's been down for two polls in a row, in
+// a shard that still has a majority up so raft can commit swapping it for the spare.
+// live and suspects are by RedisAddr, suspects are the hosts that were down last poll.
+// returns shard and host indexes, -1, -1 if nothing's dead.
+func PickAbandonedHost(shards []Shard, live map[string]bool, suspects map[string]bool) (int, int) {
+	for si, shard := range shards {
+		up := 0
+		dead := -1
+		for hi, h := range shard.Hosts {
+			if live[h.RedisAddr] {
+				up++
+			} else if dead < 0 && suspects[h.RedisAddr] {
+				dead = hi
+			}
+		}
+		if dead >= 0 && up*2 > len(shard.Hosts) {
+			return si, dead
+		}
+	}
+	return -1, -1
+}
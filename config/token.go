@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// read-your-writes tokens, the raft index of a client's latest write on each shard it's
+// written to, as shard:index[,shard:index...].  a replica has caught up to a token once it's
+// applied the index for its own shard.
+type IndexToken map[int]uint64
+
+func ParseIndexToken(s string) (IndexToken, error) {
+	t := make(IndexToken)
+	if s == "" {
+		return t, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		colon := strings.IndexByte(part, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("ERR bad index token %s, need shard:index[,shard:index...]", s)
+		}
+		shard, err := strconv.Atoi(part[:colon])
+		if err != nil {
+			return nil, fmt.Errorf("ERR bad shard in index token %s", s)
+		}
+		idx, err := strconv.ParseUint(part[colon+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ERR bad index in index token %s", s)
+		}
+		if idx > t[shard] {
+			t[shard] = idx
+		}
+	}
+	return t, nil
+}
+
+// ordered by shard
+func (t IndexToken) String() string {
+	shards := make([]int, 0, len(t))
+	for shard := range t {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	parts := make([]string, len(shards))
+	for i, shard := range shards {
+		parts[i] = strconv.Itoa(shard) + ":" + strconv.FormatUint(t[shard], 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// keeps the highest index for each shard
+func (t IndexToken) Merge(o IndexToken) {
+	for shard, idx := range o {
+		if idx > t[shard] {
+			t[shard] = idx
+		}
+	}
+}
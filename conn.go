@@ -6,15 +6,92 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Conn struct {
 	net.Conn
 	syncRead bool
+	// MAXSTALENESS, how far behind the leader reads can be served from our copy
+	staleness staleness
+	db        int // logical db picked with SELECT
+	// asked for the cluster layout, so understands MOVED
+	clusterAware bool
+	// sent ASKING, the next command may be for a slot we're importing
+	asking bool
+	// CLIENT TRACKINDEX and WAITINDEX, read-your-writes across nodes
+	session *session
+	// keeps the commands we forward for this client in order, see hostpool.go
+	stream uint64
+	// pending responses, drained in order by sendResponses
+	out    chan io.WriterTo
+	outL   *sync.Mutex // guards closing out against pubsub pushes, out is only closed by serveClient
+	closed bool
+	// pub/sub subscriptions, only touched from serveClient's goroutine
+	channels map[string]bool
+	patterns map[string]bool
 }
 
 func NewConn(c net.Conn) *Conn {
-	return &Conn{c, false}
+	return &Conn{
+		Conn:     c,
+		syncRead: false,
+		session:  newSession(),
+		stream:   atomic.AddUint64(&nextStream, 1),
+		db:       0,
+		out:      make(chan io.WriterTo, 32),
+		outL:     &sync.Mutex{},
+		closed:   false,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+// stream 0 is for forwarding without a client
+var nextStream uint64 = 0
+
+func forwardStream(c *Conn) uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.stream
+}
+
+func (conn *Conn) numSubscriptions() int {
+	return len(conn.channels) + len(conn.patterns)
+}
+
+// queues an out-of-band reply, like a pub/sub message, from another goroutine.
+// a subscriber too slow to keep up gets disconnected rather than blocking publishers
+func (conn *Conn) push(w io.WriterTo) {
+	conn.outL.Lock()
+	defer conn.outL.Unlock()
+	if conn.closed {
+		return
+	}
+	select {
+	case conn.out <- w:
+	default:
+		// kills the read loop in serveClient, which cleans up
+		conn.Conn.Close()
+	}
+}
+
+func (conn *Conn) closeOut() {
+	conn.outL.Lock()
+	defer conn.outL.Unlock()
+	if !conn.closed {
+		conn.closed = true
+		close(conn.out)
+	}
+}
+
+// true once the client has gone away, for long-running replies like CDC to notice
+func (conn *Conn) isClosed() bool {
+	conn.outL.Lock()
+	defer conn.outL.Unlock()
+	return conn.closed
 }
 
 type waiter interface {
@@ -22,12 +99,12 @@ type waiter interface {
 }
 
 func (conn *Conn) serveClient(s *Server) (err error) {
-	responses := make(chan io.WriterTo, 32)
 	defer func() {
-		close(responses)
+		s.pubsub.removeConn(conn)
+		conn.closeOut()
 	}()
 	// dispatch response writer
-	go sendResponses(responses, conn, s)
+	go sendResponses(conn.out, conn, s)
 
 	connRead := bufio.NewReader(conn)
 	// read requests
@@ -45,7 +122,7 @@ func (conn *Conn) serveClient(s *Server) (err error) {
 		// dispatch request
 		response := s.doRequest(conn, request)
 		// pass pending response to response writer
-		responses <- response
+		conn.out <- response
 		waiter, ok := response.(waiter)
 		if ok {
 			waiter.waitDone()
@@ -0,0 +1,247 @@
+package raftis
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jbooth/flotilla"
+	mdb "github.com/jbooth/gomdb"
+	"github.com/jbooth/raftis/config"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	ops "github.com/jbooth/raftis/ops"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// logical dbs.  each connection has its own selected db, commands carry it as
+// INDB <db> <command> <args...>, through raft for writes and to other nodes for forwards.
+// db 0 commands go through unwrapped, same as before SELECT existed.
+func init() {
+	// these refer back to writeOps and route, so can't live in the literals
+	internalWriteOps["INDB"] = inDB
+	serverOps["INDB"] = inDBRequest
+}
+
+// raft side of INDB, applies the wrapped write op against db
+func inDB(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if len(args) < 2 {
+		return redis.WrapStatus("ERR wrong number of arguments for 'indb' command"), nil
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	name := string(args[1])
+	op, ok := writeOps[name]
+	if !ok {
+		op, ok = internalWriteOps[name]
+	}
+	if !ok || name == "INDB" {
+		return redis.WrapStatus(fmt.Sprintf("ERR unknown write command %s", name)), nil
+	}
+	prevDB := txn.Select(db)
+	defer txn.Select(prevDB)
+	return op(args[2:], txn)
+}
+
+// INDB db command [args ...]
+// runs a keyed command against db without changing the connection's selected db
+func inDBRequest(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) < 2 {
+		return redis.NewError("ERR wrong number of arguments for 'indb' command")
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return s.route(c, db, strings.ToUpper(string(args[1])), args[2:])
+}
+
+// applies a write op to db through raft
+func (s *Server) command(db int, name string, args [][]byte) <-chan flotilla.Result {
+	if db == 0 {
+		return s.flotilla.Command(name, args)
+	}
+	return s.flotilla.Command("INDB", append([][]byte{[]byte(strconv.Itoa(db)), []byte(name)}, args...))
+}
+
+func parseDB(arg []byte) (int, error) {
+	db, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, fmt.Errorf("ERR invalid DB index")
+	}
+	return db, dbwrap.ValidDB(db)
+}
+
+// SELECT db
+func selectDB(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'select' command")
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	c.db = db
+	return &redis.StatusReply{Code: "OK"}
+}
+
+// runs a *LOCAL command on our shard and one node of every other shard, returns all the replies.
+// not atomic, if one shard fails the others may have already gone through.
+func (s *Server) onEveryShard(local serverOp, cmdName string, args [][]byte) ([][]byte, error) {
+	var b bytes.Buffer
+	_, err := local(args, nil, s).WriteTo(&b)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.cluster.CommandOtherShards(cmdName, args)
+	if err != nil {
+		return nil, err
+	}
+	return append([][]byte{b.Bytes()}, remote...), nil
+}
+
+// runs a *LOCAL command on us and every other replica of our shard, returns all the replies.
+// fails if any of them can't be reached, for checks that have to hold on the whole shard.
+func (s *Server) onEveryReplica(local serverOp, cmdName string, args [][]byte) ([][]byte, error) {
+	var b bytes.Buffer
+	_, err := local(args, nil, s).WriteTo(&b)
+	if err != nil {
+		return nil, err
+	}
+	replies := [][]byte{b.Bytes()}
+	for _, peer := range s.cluster.ShardPeers() {
+		reply, err := s.cluster.CommandHosts([]config.Host{peer}, cmdName, args)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// OK if every shard said OK, otherwise the first complaint
+func allOK(replies [][]byte, err error) io.WriterTo {
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	for _, reply := range replies {
+		if string(reply) != "+OK\r\n" {
+			return redis.NewError(strings.TrimSpace(string(reply[1:])))
+		}
+	}
+	return &redis.StatusReply{Code: "OK"}
+}
+
+// sum of every shard's integer reply, otherwise the first complaint
+func sumInts(replies [][]byte, err error) io.WriterTo {
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	total := 0
+	for _, reply := range replies {
+		if len(reply) < 3 || reply[0] != ':' {
+			return redis.NewError(strings.TrimSpace(string(reply[1:])))
+		}
+		n, err := strconv.Atoi(string(reply[1 : len(reply)-2]))
+		if err != nil {
+			return redis.NewError(err.Error())
+		}
+		total += n
+	}
+	return &redis.IntegerReply{Number: total}
+}
+
+// keys in every db on our shard, for the heartbeat
+func (s *Server) numKeys() (uint64, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Abort()
+	dtxn := dbwrap.NewTxn(txn)
+	total := uint64(0)
+	for db := 0; db < dbwrap.NumDBs; db++ {
+		dtxn.Select(db)
+		dbi, err := dbwrap.GetDBI(dtxn, 0)
+		if err == mdb.NotFound {
+			continue
+		} else if err != nil {
+			return total, err
+		}
+		stat, err := txn.Stat(dbi)
+		if err != nil {
+			return total, err
+		}
+		total += stat.Entries
+	}
+	return total, nil
+}
+
+// FLUSHDB [ASYNC|SYNC]
+// empties the selected db across the whole cluster, always synchronously
+func flushDB(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) > 1 {
+		return redis.NewError("ERR wrong number of arguments for 'flushdb' command")
+	}
+	return allOK(s.onEveryShard(flushDBLocal, "FLUSHDBLOCAL", [][]byte{[]byte(strconv.Itoa(c.db))}))
+}
+
+// FLUSHDBLOCAL db
+func flushDBLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	return pendingWrite{s.flotilla.Command("FLUSHDB", args)}
+}
+
+// FLUSHALL [ASYNC|SYNC]
+func flushAll(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) > 1 {
+		return redis.NewError("ERR wrong number of arguments for 'flushall' command")
+	}
+	return allOK(s.onEveryShard(flushAllLocal, "FLUSHALLLOCAL", emptyArgs))
+}
+
+// FLUSHALLLOCAL
+func flushAllLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	return pendingWrite{s.flotilla.Command("FLUSHALL", emptyArgs)}
+}
+
+// SWAPDB db1 db2
+// swaps on each shard in turn, clients can see it half done while it runs
+func swapDB(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 2 {
+		return redis.NewError("ERR wrong number of arguments for 'swapdb' command")
+	}
+	for _, arg := range args {
+		if _, err := parseDB(arg); err != nil {
+			return redis.NewError(err.Error())
+		}
+	}
+	return allOK(s.onEveryShard(swapDBLocal, "SWAPDBLOCAL", args))
+}
+
+// SWAPDBLOCAL db1 db2
+func swapDBLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	return pendingWrite{s.flotilla.Command("SWAPDB", args)}
+}
+
+// DBSIZE
+// keys in the selected db, summed across shards
+func dbSize(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 0 {
+		return redis.NewError("ERR wrong number of arguments for 'dbsize' command")
+	}
+	return sumInts(s.onEveryShard(dbSizeLocal, "DBSIZELOCAL", [][]byte{[]byte(strconv.Itoa(c.db))}))
+}
+
+// DBSIZELOCAL db
+func dbSizeLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'dbsizelocal' command")
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return pendingRead{ops.DBSIZE, emptyArgs, s, db}
+}
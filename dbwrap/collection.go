@@ -0,0 +1,679 @@
+package dbwrap
+
+import (
+	"bytes"
+	"encoding/binary"
+	mdb "github.com/jbooth/gomdb"
+	"sort"
+)
+
+// hashes, sets and lists start out packed into the value under their key.
+// once one grows past ElementThreshold members it's converted to one LMDB entry per member
+// in the elements table, so writes stop costing O(n) in collection size.
+// element keys use the same row/col layout as ops/hash.go:  4 byte key length, key, then the
+// field (hashes), member (sets) or 8 byte big-endian sequence number (lists).
+// the value under the key keeps its expiration and gets the ELEMENTS flag on its type,
+// with a header of [4 byte count][8 byte list head] in place of the packed members.
+// when the collection is sealed, fields and members in the element key are an HMAC, see sealMember.
+var ElementThreshold = 512
+
+const ELEMENTS uint8 = 0x80
+
+const elementsTable = "elements"
+
+// elements of the db txn works in
+func GetElementsDBI(txn *Txn, dbiFlags uint) (mdb.DBI, error) {
+	return openTable(txn, elementsTable, txn.db, dbiFlags)
+}
+
+// 4 byte key length, key, member
+func PackElementKey(key []byte, member []byte) []byte {
+	ret := make([]byte, 4+len(key)+len(member))
+	binary.LittleEndian.PutUint32(ret, uint32(len(key)))
+	copy(ret[4:], key)
+	copy(ret[4+len(key):], member)
+	return ret
+}
+
+func SplitElementKey(elemKey []byte) ([]byte, []byte) {
+	keyLen := int(binary.LittleEndian.Uint32(elemKey))
+	return elemKey[4 : 4+keyLen], elemKey[4+keyLen:]
+}
+
+// calls forElem on each member stored for key, in order, bailing early on error
+func ForEachElement(c *mdb.Cursor, key []byte, forElem func(member, val []byte) error) error {
+	k, v, err := c.Get(PackElementKey(key, nil), mdb.SET_RANGE)
+	for err == nil {
+		elemKey, member := SplitElementKey(k)
+		if !bytes.Equal(key, elemKey) {
+			// finished this key
+			return nil
+		}
+		err = forElem(member, v)
+		if err != nil {
+			return err
+		}
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err == mdb.NotFound {
+		// ran off the end of the table
+		return nil
+	}
+	return err
+}
+
+// deletes any per-member entries stored for key, no-op for packed or plain values
+func ClearElements(txn *Txn, key []byte) error {
+	_, rawVal, err := GetBytes(txn, key, mdb.CREATE)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, type_ := ParseHeader(rawVal)
+	if type_&ELEMENTS == 0 {
+		return nil
+	}
+	return deleteElements(txn, key)
+}
+
+// element entries are written and deleted through these so tenant usage sees the size change
+func putElement(txn *Txn, edbi mdb.DBI, key []byte, elemKey []byte, val []byte) error {
+	if trackingUsage(txn) {
+		delta := int64(len(elemKey) + len(val))
+		old, err := txn.Get(edbi, elemKey)
+		if err == nil {
+			delta -= int64(len(elemKey) + len(old))
+		} else if err != mdb.NotFound {
+			return err
+		}
+		noteElementBytes(txn, key, delta)
+	}
+	return txn.Put(edbi, elemKey, val, 0)
+}
+
+func delElement(txn *Txn, edbi mdb.DBI, key []byte, elemKey []byte) error {
+	if trackingUsage(txn) {
+		old, err := txn.Get(edbi, elemKey)
+		if err != nil {
+			return err
+		}
+		noteElementBytes(txn, key, -int64(len(elemKey)+len(old)))
+	}
+	return txn.Del(edbi, elemKey, nil)
+}
+
+func deleteElements(txn *Txn, key []byte) error {
+	edbi, err := GetElementsDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	c, err := txn.CursorOpen(edbi)
+	if err != nil {
+		return err
+	}
+	// collect first, deleting under the cursor would move it
+	toDelete := make([][]byte, 0)
+	err = ForEachElement(c, key, func(member, val []byte) error {
+		toDelete = append(toDelete, PackElementKey(key, member))
+		return nil
+	})
+	c.Close()
+	if err != nil {
+		return err
+	}
+	for _, k := range toDelete {
+		err = delElement(txn, edbi, key, k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a hash, set or list, either packed or stored as elements.
+// hashes are field, value pairs when packed, and Len() counts fields.
+type Collection struct {
+	Type      uint8
+	Exp       uint32
+	key       []byte
+	txn       *Txn
+	elements  bool
+	packed    [][]byte // sets and hashes are kept sorted by member or field so replicas stay byte-identical
+	count     uint32   // members when stored as elements
+	head      uint64   // lists stored as elements: sequence number of the first item
+	sealedKey uint32   // key id elements are sealed with, 0 for plain
+}
+
+// loads the collection at key for reading, returns mdb.NotFound if missing or expired
+func GetCollection(txn *Txn, key []byte, type_ uint8) (*Collection, error) {
+	_, rawVal, err := GetBytes(txn, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseCollection(txn, key, rawVal, type_)
+	if err != nil {
+		return nil, err
+	}
+	if Expired(c.Exp) {
+		return nil, mdb.NotFound
+	}
+	return c, nil
+}
+
+// loads the collection at key for a write, returns an empty collection if it's missing.
+// expired collections are cleared out first so a fresh one can take their place.
+func GetCollectionForWrite(txn *Txn, key []byte, type_ uint8) (*Collection, error) {
+	dbi, rawVal, err := GetBytes(txn, key, mdb.CREATE)
+	if err == mdb.NotFound {
+		return newCollection(txn, key, type_), nil
+	} else if err != nil {
+		return nil, err
+	}
+	exp, storedType := ParseHeader(rawVal)
+	if Expired(exp) {
+		Notify(txn, EVENT_EXPIRED, "expired", key)
+		if storedType&ELEMENTS != 0 {
+			err = deleteElements(txn, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = txn.Del(dbi, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		return newCollection(txn, key, type_), nil
+	}
+	return parseCollection(txn, key, rawVal, type_)
+}
+
+func newCollection(txn *Txn, key []byte, type_ uint8) *Collection {
+	return &Collection{type_, 0, key, txn, false, make([][]byte, 0), 0, 0, CurrentKeyID()}
+}
+
+func parseCollection(txn *Txn, key []byte, rawVal []byte, type_ uint8) (*Collection, error) {
+	exp, storedType, val, err := ParseRawValue(rawVal)
+	if err != nil {
+		return nil, err
+	}
+	if storedType&^ELEMENTS != type_ {
+		return nil, WrongType
+	}
+	c := &Collection{type_, exp, key, txn, storedType&ELEMENTS != 0, nil, 0, 0, KeyID(rawVal)}
+	if c.elements {
+		c.count = binary.LittleEndian.Uint32(val[0:4])
+		c.head = binary.BigEndian.Uint64(val[4:12])
+	} else {
+		c.packed = RawArrayToMembers(val)
+		if type_ == SET || type_ == HASH {
+			// values written before encodings were canonical come back in map order
+			c.packed = sortMembers(c.packed, c.step())
+		}
+	}
+	return c, nil
+}
+
+func (c *Collection) Len() int {
+	if c.elements {
+		return int(c.count)
+	}
+	if c.Type == HASH {
+		return len(c.packed) / 2
+	}
+	return len(c.packed)
+}
+
+func (c *Collection) elementsDBI() (mdb.DBI, error) {
+	return GetElementsDBI(c.txn, 0)
+}
+
+// every member in order, hashes come back as field, value pairs
+func (c *Collection) Members() ([][]byte, error) {
+	if !c.elements {
+		return c.packed, nil
+	}
+	edbi, err := c.elementsDBI()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := c.txn.CursorOpen(edbi)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	ret := make([][]byte, 0, c.Len())
+	err = ForEachElement(cursor, c.key, func(member, val []byte) error {
+		if c.Type == LIST {
+			val, err := openElement(c.sealedKey, val)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, val)
+			return nil
+		}
+		member, val, err := openMember(c.sealedKey, member, val)
+		if err != nil {
+			return err
+		}
+		if c.Type == HASH {
+			ret = append(ret, member, val)
+		} else {
+			ret = append(ret, member)
+		}
+		return nil
+	})
+	if err != nil || c.sealedKey == 0 || c.Type == LIST {
+		return ret, err
+	}
+	// sealed members come back in HMAC order
+	return sortMembers(ret, c.step()), nil
+}
+
+// stride through packed, hashes are field, value pairs
+func (c *Collection) step() int {
+	if c.Type == HASH {
+		return 2
+	}
+	return 1
+}
+
+// binary searches packed for member (sets) or field (hashes),
+// returns its position or the position it should be inserted at, and whether it's there
+func (c *Collection) search(member []byte) (int, bool) {
+	step := c.step()
+	n := len(c.packed) / step
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(c.packed[i*step], member) >= 0
+	})
+	return i * step, i < n && bytes.Equal(c.packed[i*step], member)
+}
+
+// inserts a member or field, value pair at pos
+func (c *Collection) insertAt(pos int, vals ...[]byte) {
+	c.packed = append(c.packed, vals...)
+	copy(c.packed[pos+len(vals):], c.packed[pos:])
+	copy(c.packed[pos:], vals)
+}
+
+// hashes and sets: the element key for a field or member
+func (c *Collection) elementKey(member []byte) ([]byte, error) {
+	elemMember, err := elementMember(c.sealedKey, member)
+	if err != nil {
+		return nil, err
+	}
+	return PackElementKey(c.key, elemMember), nil
+}
+
+func (c *Collection) getElement(member []byte) ([]byte, bool, error) {
+	edbi, err := c.elementsDBI()
+	if err != nil {
+		return nil, false, err
+	}
+	elemKey, err := c.elementKey(member)
+	if err != nil {
+		return nil, false, err
+	}
+	val, err := c.txn.Get(edbi, elemKey)
+	if err == mdb.NotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	_, val, err = openMember(c.sealedKey, member, val)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// hashes and sets: writes an element for member, val is nil for sets
+func (c *Collection) putMember(edbi mdb.DBI, member []byte, val []byte) error {
+	elemMember, sealed, err := sealMember(c.sealedKey, member, val)
+	if err != nil {
+		return err
+	}
+	return putElement(c.txn, edbi, c.key, PackElementKey(c.key, elemMember), sealed)
+}
+
+// hashes: value of field, and whether it was set
+func (c *Collection) HGet(field []byte) ([]byte, bool, error) {
+	if c.elements {
+		return c.getElement(field)
+	}
+	idx, found := c.search(field)
+	if !found {
+		return nil, false, nil
+	}
+	return c.packed[idx+1], true, nil
+}
+
+// hashes: sets field to val, returns true if field is new
+func (c *Collection) HSet(field []byte, val []byte) (bool, error) {
+	if c.elements {
+		_, exists, err := c.getElement(field)
+		if err != nil {
+			return false, err
+		}
+		edbi, err := c.elementsDBI()
+		if err != nil {
+			return false, err
+		}
+		err = c.putMember(edbi, field, val)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			c.count++
+		}
+		return !exists, nil
+	}
+	idx, found := c.search(field)
+	if found {
+		c.packed[idx+1] = val
+		return false, nil
+	}
+	c.insertAt(idx, field, val)
+	return true, nil
+}
+
+// hashes and sets: removes field or member, returns true if it was there
+func (c *Collection) Remove(member []byte) (bool, error) {
+	if c.elements {
+		edbi, err := c.elementsDBI()
+		if err != nil {
+			return false, err
+		}
+		elemKey, err := c.elementKey(member)
+		if err != nil {
+			return false, err
+		}
+		err = delElement(c.txn, edbi, c.key, elemKey)
+		if err == mdb.NotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		c.count--
+		return true, nil
+	}
+	idx, found := c.search(member)
+	if !found {
+		return false, nil
+	}
+	c.packed = append(c.packed[:idx], c.packed[idx+c.step():]...)
+	return true, nil
+}
+
+// sets: adds member, returns true if it's new
+func (c *Collection) SAdd(member []byte) (bool, error) {
+	if c.elements {
+		_, exists, err := c.getElement(member)
+		if err != nil || exists {
+			return false, err
+		}
+		edbi, err := c.elementsDBI()
+		if err != nil {
+			return false, err
+		}
+		err = c.putMember(edbi, member, nil)
+		if err != nil {
+			return false, err
+		}
+		c.count++
+		return true, nil
+	}
+	idx, found := c.search(member)
+	if found {
+		return false, nil
+	}
+	c.insertAt(idx, member)
+	return true, nil
+}
+
+func seqBytes(seq uint64) []byte {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, seq)
+	return ret
+}
+
+// lists: appends items to the tail
+func (c *Collection) RPush(items [][]byte) error {
+	if !c.elements {
+		c.packed = append(c.packed, items...)
+		return nil
+	}
+	edbi, err := c.elementsDBI()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		seq := c.head + uint64(c.count)
+		sealed, err := sealElement(c.sealedKey, item)
+		if err != nil {
+			return err
+		}
+		err = putElement(c.txn, edbi, c.key, PackElementKey(c.key, seqBytes(seq)), sealed)
+		if err != nil {
+			return err
+		}
+		c.count++
+	}
+	return nil
+}
+
+// lists: items from start up to but not including end, caller keeps 0 <= start <= end <= Len()
+func (c *Collection) Range(start int, end int) ([][]byte, error) {
+	if !c.elements {
+		return c.packed[start:end], nil
+	}
+	edbi, err := c.elementsDBI()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, 0, end-start)
+	for i := start; i < end; i++ {
+		item, err := c.txn.Get(edbi, PackElementKey(c.key, seqBytes(c.head+uint64(i))))
+		if err != nil {
+			return nil, err
+		}
+		item, err = openElement(c.sealedKey, item)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+// lists: removes and returns items from start up to but not including end
+func (c *Collection) RemoveRange(start int, end int) ([][]byte, error) {
+	removed, err := c.Range(start, end)
+	if err != nil {
+		return nil, err
+	}
+	if !c.elements {
+		removed = append(make([][]byte, 0, len(removed)), removed...)
+		c.packed = append(c.packed[:start], c.packed[end:]...)
+		return removed, nil
+	}
+	edbi, err := c.elementsDBI()
+	if err != nil {
+		return nil, err
+	}
+	n := end - start
+	if start == 0 {
+		// popping off the head, just move it along
+		for i := 0; i < n; i++ {
+			err = delElement(c.txn, edbi, c.key, PackElementKey(c.key, seqBytes(c.head+uint64(i))))
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.head += uint64(n)
+		c.count -= uint32(n)
+		return removed, nil
+	}
+	// shift everything after the hole down, then drop the leftover tail.
+	// items move still sealed, they keep the same key.
+	for i := end; i < int(c.count); i++ {
+		item, err := c.txn.Get(edbi, PackElementKey(c.key, seqBytes(c.head+uint64(i))))
+		if err != nil {
+			return nil, err
+		}
+		err = putElement(c.txn, edbi, c.key, PackElementKey(c.key, seqBytes(c.head+uint64(i-n))), item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := int(c.count) - n; i < int(c.count); i++ {
+		err = delElement(c.txn, edbi, c.key, PackElementKey(c.key, seqBytes(c.head+uint64(i))))
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.count -= uint32(n)
+	return removed, nil
+}
+
+// writes the collection back under its key, converting to elements if it's grown past ElementThreshold.
+// empty collections are deleted, same as redis.
+// elements sealed with anything but the current key are resealed, they always match the value's key id.
+func (c *Collection) Save() error {
+	dbi, err := GetDBI(c.txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	if c.Len() == 0 {
+		err = c.txn.Del(dbi, c.key, nil)
+		if err == mdb.NotFound {
+			return nil
+		}
+		return err
+	}
+	if !c.elements && c.Len() > ElementThreshold {
+		err = c.convertToElements()
+		if err != nil {
+			return err
+		}
+	}
+	if !c.elements {
+		rawVal, err := BuildRawValue(c.Exp, c.Type, BuildRawArray(c.packed))
+		if err != nil {
+			return err
+		}
+		return c.txn.Put(dbi, c.key, rawVal, 0)
+	}
+	if c.sealedKey != CurrentKeyID() {
+		err = c.resealElements()
+		if err != nil {
+			return err
+		}
+	}
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:4], c.count)
+	binary.BigEndian.PutUint64(header[4:12], c.head)
+	rawVal, err := BuildRawValue(c.Exp, c.Type|ELEMENTS, header)
+	if err != nil {
+		return err
+	}
+	return c.txn.Put(dbi, c.key, rawVal, 0)
+}
+
+func (c *Collection) convertToElements() error {
+	_, err := GetElementsDBI(c.txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	packed := c.packed
+	c.elements = true
+	c.sealedKey = CurrentKeyID()
+	c.packed = nil
+	c.count = 0
+	c.head = 0
+	switch c.Type {
+	case HASH:
+		for i := 0; i < len(packed); i += 2 {
+			_, err = c.HSet(packed[i], packed[i+1])
+			if err != nil {
+				return err
+			}
+		}
+	case SET:
+		for _, member := range packed {
+			_, err = c.SAdd(member)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		err = c.RPush(packed)
+	}
+	return err
+}
+
+// rewrites every element under the current key.  fields and members get a new element key,
+// so hashes and sets have their old entries deleted.
+func (c *Collection) resealElements() error {
+	newKey := CurrentKeyID()
+	edbi, err := c.elementsDBI()
+	if err != nil {
+		return err
+	}
+	cursor, err := c.txn.CursorOpen(edbi)
+	if err != nil {
+		return err
+	}
+	// collect first, writing under the cursor would move it
+	elemKeys := make([][]byte, 0, c.Len())
+	members := make([][]byte, 0, c.Len())
+	vals := make([][]byte, 0, c.Len())
+	err = ForEachElement(cursor, c.key, func(member, val []byte) error {
+		elemKeys = append(elemKeys, PackElementKey(c.key, member))
+		var err error
+		if c.Type == LIST {
+			val, err = openElement(c.sealedKey, val)
+		} else {
+			member, val, err = openMember(c.sealedKey, member, val)
+		}
+		if err != nil {
+			return err
+		}
+		// copy out, the put below can move pages under us
+		members = append(members, append([]byte(nil), member...))
+		vals = append(vals, append([]byte(nil), val...))
+		return nil
+	})
+	cursor.Close()
+	if err != nil {
+		return err
+	}
+	if c.Type == LIST {
+		for i, member := range members {
+			sealed, err := sealElement(newKey, vals[i])
+			if err != nil {
+				return err
+			}
+			err = putElement(c.txn, edbi, c.key, PackElementKey(c.key, member), sealed)
+			if err != nil {
+				return err
+			}
+		}
+		c.sealedKey = newKey
+		return nil
+	}
+	for _, elemKey := range elemKeys {
+		err = delElement(c.txn, edbi, c.key, elemKey)
+		if err != nil {
+			return err
+		}
+	}
+	c.sealedKey = newKey
+	for i, member := range members {
+		err = c.putMember(edbi, member, vals[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,527 @@
+package dbwrap
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"io"
+	"os"
+	"sync"
+)
+
+// values are encrypted at rest with AES-GCM when a key file is configured.
+// an encrypted payload is [4 byte key id][12 byte nonce][ciphertext + tag], sealed after compression,
+// and marks the type byte with ENCRYPTED.  keys are looked up by id, so values sealed under an
+// old key stay readable until REWRITEVALUES moves them to the current one.
+// nonces are derived from the plaintext rather than random so every replica writes the same bytes,
+// which means equal values encrypt to equal ciphertexts.  keys are LMDB keys and are not encrypted.
+// hash fields and set members in the elements table are stored as an HMAC, see sealMember.
+const ENCRYPTED uint8 = 0x10
+
+var ErrNoKey = errors.New("Value is encrypted but no key file is configured")
+
+// key file is json, {"current": 1, "keys": {"1": "<hex AES-128, 192 or 256 key>"}}.
+// current is only used until a ROTATEKEYS has picked one, that choice is stored in the db.
+// key id 0 is reserved for unencrypted.
+type keyFile struct {
+	Current uint32            `json:"current"`
+	Keys    map[uint32]string `json:"keys"`
+}
+
+type sealKey struct {
+	aead      cipher.AEAD
+	nonceKey  []byte
+	memberKey []byte
+}
+
+type Keyring struct {
+	l       *sync.RWMutex
+	path    string
+	keys    map[uint32]*sealKey
+	current uint32
+}
+
+var (
+	keyring  *Keyring
+	keyringL = &sync.RWMutex{} // guards keyring, read it through getKeyring
+)
+
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{&sync.RWMutex{}, path, nil, 0}
+	current, err := k.reload()
+	if err != nil {
+		return nil, err
+	}
+	k.current = current
+	return k, nil
+}
+
+// re-reads the key file, returns the current key id it names
+func (k *Keyring) reload() (uint32, error) {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	kf := &keyFile{}
+	err = json.NewDecoder(f).Decode(kf)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing key file %s : %s", k.path, err)
+	}
+	keys := make(map[uint32]*sealKey)
+	for id, hexKey := range kf.Keys {
+		if id == 0 {
+			return 0, fmt.Errorf("Key id 0 is reserved, in key file %s", k.path)
+		}
+		raw, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return 0, fmt.Errorf("Error decoding key %d in %s : %s", id, k.path, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return 0, fmt.Errorf("Bad key %d in %s : %s", id, k.path, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return 0, err
+		}
+		nonceKey := sha256.Sum256(append([]byte("raftis nonce "), raw...))
+		memberKey := sha256.Sum256(append([]byte("raftis member "), raw...))
+		keys[id] = &sealKey{aead, nonceKey[:], memberKey[:]}
+	}
+	if _, ok := keys[kf.Current]; !ok {
+		return 0, fmt.Errorf("Current key %d not found in key file %s", kf.Current, k.path)
+	}
+	k.l.Lock()
+	k.keys = keys
+	k.l.Unlock()
+	return kf.Current, nil
+}
+
+func (k *Keyring) get(id uint32) (*sealKey, error) {
+	k.l.RLock()
+	defer k.l.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("No key with id %d in key file %s", id, k.path)
+	}
+	return key, nil
+}
+
+func (k *Keyring) Current() uint32 {
+	k.l.RLock()
+	defer k.l.RUnlock()
+	return k.current
+}
+
+func (k *Keyring) setCurrent(id uint32) {
+	k.l.Lock()
+	defer k.l.Unlock()
+	k.current = id
+}
+
+// values are sealed with k from now on, nil turns encryption off
+func SetKeyring(k *Keyring) {
+	keyringL.Lock()
+	defer keyringL.Unlock()
+	keyring = k
+}
+
+func getKeyring() *Keyring {
+	keyringL.RLock()
+	defer keyringL.RUnlock()
+	return keyring
+}
+
+// id of the key new values are sealed with, 0 if encryption is off
+func CurrentKeyID() uint32 {
+	k := getKeyring()
+	if k == nil {
+		return 0
+	}
+	return k.Current()
+}
+
+// meta table holds node-independent settings that have to be agreed on through raft
+func GetMetaDBI(txn *Txn, dbiFlags uint) (mdb.DBI, error) {
+	table := "meta"
+	return txn.DBIOpen(&table, dbiFlags)
+}
+
+var currentKeyMeta = []byte("currentKey")
+
+// errors unless key id is in our key file, re-reading it if we don't know id yet
+func CheckKey(id uint32) error {
+	k := getKeyring()
+	if k == nil {
+		return ErrNoKey
+	}
+	return k.load(id)
+}
+
+func (k *Keyring) load(id uint32) error {
+	if _, err := k.get(id); err == nil {
+		return nil
+	}
+	if _, err := k.reload(); err != nil {
+		return err
+	}
+	_, err := k.get(id)
+	return err
+}
+
+// switches new values to key id and records it, applied on every replica through raft.
+// goes through whether or not we have the key so every replica agrees on it,
+// ROTATEKEYS checks the whole shard has it before proposing.  a replica that doesn't
+// fails writes until its key file has it.  we only switch once txn commits through Commit.
+func UseKey(txn *Txn, id uint32) error {
+	dbi, err := GetMetaDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	err = txn.Put(dbi, currentKeyMeta, idBytes, 0)
+	if err != nil {
+		return err
+	}
+	if k := getKeyring(); k != nil {
+		OnCommit(txn, func() {
+			k.setCurrent(id)
+		})
+	}
+	return nil
+}
+
+// picks up the key chosen by the last ROTATEKEYS, call at startup
+func LoadCurrentKey(txn *Txn) error {
+	k := getKeyring()
+	if k == nil {
+		return nil
+	}
+	dbi, err := GetMetaDBI(txn, 0)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	idBytes, err := txn.Get(dbi, currentKeyMeta)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint32(idBytes)
+	if _, err = k.get(id); err != nil {
+		return err
+	}
+	k.setCurrent(id)
+	return nil
+}
+
+// key id a raw stored value was sealed with, 0 if it's not encrypted
+func KeyID(rawVal []byte) uint32 {
+	if rawVal[4]&ENCRYPTED == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(rawVal[6:10])
+}
+
+// whether REWRITEVALUES has anything to do for this value
+func NeedsRewrite(rawVal []byte) bool {
+	return FormatVersion(rawVal) != CURRENT_FORMAT || KeyID(rawVal) != CurrentKeyID()
+}
+
+// [4 byte key id][12 byte nonce][ciphertext]
+func seal(id uint32, plaintext []byte) ([]byte, error) {
+	k := getKeyring()
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	return k.seal(id, plaintext)
+}
+
+func (k *Keyring) seal(id uint32, plaintext []byte) ([]byte, error) {
+	key, err := k.get(id)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key.nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:key.aead.NonceSize()]
+	ret := make([]byte, 4, 4+len(nonce)+len(plaintext)+key.aead.Overhead())
+	binary.BigEndian.PutUint32(ret, id)
+	ret = append(ret, nonce...)
+	return key.aead.Seal(ret, nonce, plaintext, nil), nil
+}
+
+func open(sealed []byte) ([]byte, error) {
+	k := getKeyring()
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	return k.open(sealed)
+}
+
+func (k *Keyring) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < 4 {
+		return nil, fmt.Errorf("Encrypted value too short")
+	}
+	key, err := k.get(binary.BigEndian.Uint32(sealed))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(sealed) < 4+nonceSize {
+		return nil, fmt.Errorf("Encrypted value too short")
+	}
+	plaintext, err := key.aead.Open(nil, sealed[4:4+nonceSize], sealed[4+nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting value: %s", err)
+	}
+	return plaintext, nil
+}
+
+// raft log commands are sealed like values, under the current key.
+// the leader seals what it logs, so its followers need its current key too.
+func (k *Keyring) Seal(cmd []byte) ([]byte, error) {
+	return k.seal(k.Current(), cmd)
+}
+
+// flotilla retries commands it can't open rather than skip them, so pick up keys added to the file since
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) >= 4 {
+		if err := k.load(binary.BigEndian.Uint32(sealed)); err != nil {
+			return nil, err
+		}
+	}
+	return k.open(sealed)
+}
+
+// list items are sealed with their collection's key id, 0 leaves them alone.
+// an empty item has nothing to seal.
+func sealElement(id uint32, val []byte) ([]byte, error) {
+	if id == 0 || len(val) == 0 {
+		return val, nil
+	}
+	return seal(id, val)
+}
+
+func openElement(id uint32, val []byte) ([]byte, error) {
+	if id == 0 || len(val) == 0 {
+		return val, nil
+	}
+	return open(val)
+}
+
+// hash fields and set members are part of the element key, so under a key they're stored as
+// an HMAC of the member, and the member goes in the value sealed as [4 byte member length][member][value].
+// returns what goes in the element key for member
+func elementMember(id uint32, member []byte) ([]byte, error) {
+	if id == 0 {
+		return member, nil
+	}
+	k := getKeyring()
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	key, err := k.get(id)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key.memberKey)
+	mac.Write(member)
+	return mac.Sum(nil), nil
+}
+
+// returns the element key's member and the value to store for member, val
+func sealMember(id uint32, member []byte, val []byte) ([]byte, []byte, error) {
+	elemMember, err := elementMember(id, member)
+	if err != nil || id == 0 {
+		return elemMember, val, err
+	}
+	plaintext := make([]byte, 4, 4+len(member)+len(val))
+	binary.LittleEndian.PutUint32(plaintext, uint32(len(member)))
+	plaintext = append(append(plaintext, member...), val...)
+	sealed, err := seal(id, plaintext)
+	return elemMember, sealed, err
+}
+
+// reverses sealMember, returns the member and its value
+func openMember(id uint32, elemMember []byte, val []byte) ([]byte, []byte, error) {
+	if id == 0 {
+		return elemMember, val, nil
+	}
+	plaintext, err := open(val)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plaintext) < 4 || len(plaintext)-4 < int(binary.LittleEndian.Uint32(plaintext)) {
+		return nil, nil, fmt.Errorf("Encrypted member too short")
+	}
+	memberLen := 4 + int(binary.LittleEndian.Uint32(plaintext))
+	return plaintext[4:memberLen], plaintext[memberLen:], nil
+}
+
+// snapshots are sealed in chunks under a random base nonce,
+// [4 byte key id][12 byte nonce] then [4 byte length][sealed chunk] until a chunk marked last.
+// the chunk counter goes into the nonce and the last marker into the additional data,
+// so chunks can't be reordered or the stream cut short.
+const snapshotChunk = 64 * 1024
+
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	ctr := binary.BigEndian.Uint64(nonce[len(nonce)-8:]) ^ n
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], ctr)
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encrypts a snapshot stream under the current key, Close writes the final chunk
+func (k *Keyring) WrapWriter(w io.Writer) (io.WriteCloser, error) {
+	id := k.Current()
+	key, err := k.get(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, id)
+	_, err = w.Write(append(header, nonce...))
+	if err != nil {
+		return nil, err
+	}
+	return &sealWriter{w, key.aead, nonce, 0, make([]byte, 0, snapshotChunk)}, nil
+}
+
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	buf   []byte
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		toCopy := snapshotChunk - len(s.buf)
+		if toCopy > len(p) {
+			toCopy = len(p)
+		}
+		s.buf = append(s.buf, p[:toCopy]...)
+		p = p[toCopy:]
+		written += toCopy
+		if len(s.buf) == snapshotChunk {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *sealWriter) flush(last bool) error {
+	sealed := s.aead.Seal(make([]byte, 4), chunkNonce(s.nonce, s.n), s.buf, chunkAD(last))
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	s.n++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// writes the final chunk, doesn't close the underlying writer
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+// decrypts a snapshot stream written by WrapWriter, with whichever of our keys it names
+func (k *Keyring) WrapReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 4)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snapshot header: %s", err)
+	}
+	key, err := k.get(binary.BigEndian.Uint32(header))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	_, err = io.ReadFull(br, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snapshot header: %s", err)
+	}
+	return &openReader{br, key.aead, nonce, 0, nil, false}, nil
+}
+
+type openReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	buf   []byte
+	done  bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		err := o.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	lenBytes := make([]byte, 4)
+	_, err := io.ReadFull(o.r, lenBytes)
+	if err != nil {
+		return fmt.Errorf("Snapshot truncated: %s", err)
+	}
+	sealedLen := binary.BigEndian.Uint32(lenBytes)
+	if sealedLen > uint32(snapshotChunk+o.aead.Overhead()) {
+		return fmt.Errorf("Bad snapshot chunk length %d", sealedLen)
+	}
+	sealed := make([]byte, sealedLen)
+	_, err = io.ReadFull(o.r, sealed)
+	if err != nil {
+		return fmt.Errorf("Snapshot truncated: %s", err)
+	}
+	nonce := chunkNonce(o.nonce, o.n)
+	o.n++
+	o.buf, err = o.aead.Open(nil, nonce, sealed, chunkAD(false))
+	if err != nil {
+		o.buf, err = o.aead.Open(nil, nonce, sealed, chunkAD(true))
+		if err != nil {
+			return fmt.Errorf("Error decrypting snapshot: %s", err)
+		}
+		o.done = true
+	}
+	return nil
+}
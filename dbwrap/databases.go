@@ -0,0 +1,129 @@
+package dbwrap
+
+import (
+	"encoding/binary"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// logical databases for SELECT, 0 through NumDBs-1.
+// ops don't take a db, they work in the one their Txn has selected.
+// each logical db maps to a physical pair of tables, physical 0 keeps the original
+// "onlyTable" and "elements" names so data written before SELECT existed stays in db 0.
+// the mapping lives in the meta table so SWAPDB is just an update to it.
+var NumDBs = 16
+
+func ValidDB(db int) error {
+	if db < 0 || db >= NumDBs {
+		return fmt.Errorf("ERR DB index is out of range")
+	}
+	return nil
+}
+
+var dbMapMeta = []byte("dbmap")
+
+// physical table number for each logical db, 4 bytes apiece.
+// read once per Txn, SwapDB keeps the copy up to date
+func getDBMap(txn *Txn) ([]uint32, error) {
+	if txn.dbMap == nil {
+		dbMap, err := readDBMap(txn)
+		if err != nil {
+			return nil, err
+		}
+		txn.dbMap = dbMap
+	}
+	return txn.dbMap, nil
+}
+
+func readDBMap(txn *Txn) ([]uint32, error) {
+	ret := make([]uint32, NumDBs)
+	for i := range ret {
+		ret[i] = uint32(i)
+	}
+	dbi, err := GetMetaDBI(txn, 0)
+	if err == mdb.NotFound {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	stored, err := txn.Get(dbi, dbMapMeta)
+	if err == mdb.NotFound {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(ret) && i*4 < len(stored); i++ {
+		ret[i] = binary.BigEndian.Uint32(stored[i*4:])
+	}
+	return ret, nil
+}
+
+func physicalDB(txn *Txn, db int) (uint32, error) {
+	if err := ValidDB(db); err != nil {
+		return 0, err
+	}
+	dbMap, err := getDBMap(txn)
+	if err != nil {
+		return 0, err
+	}
+	return dbMap[db], nil
+}
+
+func tableName(base string, physical uint32) string {
+	if physical == 0 {
+		return base
+	}
+	return fmt.Sprintf("%s%d", base, physical)
+}
+
+func openTable(txn *Txn, base string, db int, dbiFlags uint) (mdb.DBI, error) {
+	physical, err := physicalDB(txn, db)
+	if err != nil {
+		return 0, err
+	}
+	table := tableName(base, physical)
+	return txn.DBIOpen(&table, dbiFlags)
+}
+
+// empties db's keys and elements
+func FlushDB(txn *Txn, db int) error {
+	for _, base := range []string{mainTable, elementsTable} {
+		dbi, err := openTable(txn, base, db, mdb.CREATE)
+		if err != nil {
+			return err
+		}
+		err = txn.Drop(dbi, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return flushTenantUsage(txn, db)
+}
+
+// exchanges the contents of two logical dbs
+func SwapDB(txn *Txn, a int, b int) error {
+	if err := ValidDB(a); err != nil {
+		return err
+	}
+	if err := ValidDB(b); err != nil {
+		return err
+	}
+	dbMap, err := getDBMap(txn)
+	if err != nil {
+		return err
+	}
+	dbMap[a], dbMap[b] = dbMap[b], dbMap[a]
+	stored := make([]byte, 4*len(dbMap))
+	for i, physical := range dbMap {
+		binary.BigEndian.PutUint32(stored[i*4:], physical)
+	}
+	dbi, err := GetMetaDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	err = txn.Put(dbi, dbMapMeta, stored, 0)
+	if err != nil {
+		return err
+	}
+	return swapTenantUsage(txn, a, b)
+}
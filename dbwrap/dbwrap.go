@@ -15,18 +15,47 @@ const (
 	SORTEDSET
 )
 
+var WrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
 // parse
-func ParseRawValue(rawVal []byte) (uint32, uint8, []byte) {
+// expiration and type without decoding the payload, type keeps its ELEMENTS flag
+func ParseHeader(rawVal []byte) (uint32, uint8) {
 	expiration := binary.LittleEndian.Uint32(rawVal[0:4])
-	type_ := uint8(rawVal[4])
-	val := rawVal[5:]
-	return expiration, type_, val
+	type_ := uint8(rawVal[4]) &^ (VERSIONED | COMPRESSED | ENCRYPTED)
+	return expiration, type_
+}
+
+func ParseRawValue(rawVal []byte) (uint32, uint8, []byte, error) {
+	expiration, type_ := ParseHeader(rawVal)
+	version := FormatVersion(rawVal)
+	payload := rawVal[5:]
+	if version != FORMAT_LEGACY {
+		payload = rawVal[6:]
+	}
+	var err error
+	if rawVal[4]&ENCRYPTED != 0 {
+		payload, err = open(payload)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	if rawVal[4]&COMPRESSED != 0 {
+		payload, err = decompress(payload)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	val, err := decodePayload(version, type_, payload)
+	return expiration, type_, val, err
 }
 
 func parseWithType(rawVal []byte, expectedType uint8) (uint32, []byte, error) {
-	expiration, type_, val := ParseRawValue(rawVal)
+	expiration, type_, val, err := ParseRawValue(rawVal)
+	if err != nil {
+		return 0, nil, err
+	}
 	if type_ != expectedType {
-		return 0, nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return 0, nil, WrongType
 	}
 	return expiration, val, nil
 }
@@ -52,26 +81,44 @@ func ParseSet(rawVal []byte) (uint32, []byte, error) {
 }
 
 // build
-func BuildRawValue(expiration uint32, type_ uint8, val []byte) []byte {
-	rawVal := append(make([]byte, 4), byte(type_))
+// always writes CURRENT_FORMAT, compressing payloads past CompressThreshold
+// and sealing them with the current key when encryption is on
+func BuildRawValue(expiration uint32, type_ uint8, val []byte) ([]byte, error) {
+	flags := VERSIONED
+	if threshold := CompressThreshold(); threshold > 0 && len(val) >= threshold {
+		compressed, ok := compress(val)
+		if ok {
+			val = compressed
+			flags |= COMPRESSED
+		}
+	}
+	if id := CurrentKeyID(); id != 0 {
+		sealed, err := seal(id, val)
+		if err != nil {
+			return nil, err
+		}
+		val = sealed
+		flags |= ENCRYPTED
+	}
+	rawVal := append(make([]byte, 4), byte(type_|flags), CURRENT_FORMAT)
 	rawVal = append(rawVal, val...)
 	binary.LittleEndian.PutUint32(rawVal[0:4], expiration)
-	return rawVal
+	return rawVal, nil
 }
 
-func BuildString(expiration uint32, val []byte) []byte {
+func BuildString(expiration uint32, val []byte) ([]byte, error) {
 	return BuildRawValue(expiration, STRING, val)
 }
 
-func BuildList(expiration uint32, val [][]byte) []byte {
+func BuildList(expiration uint32, val [][]byte) ([]byte, error) {
 	return BuildRawValue(expiration, LIST, BuildRawArray(val))
 }
 
-func BuildSet(expiration uint32, val [][]byte) []byte {
+func BuildSet(expiration uint32, val [][]byte) ([]byte, error) {
 	return BuildRawValue(expiration, SET, BuildRawArray(val))
 }
 
-func BuildHash(expiration uint32, val [][]byte) []byte {
+func BuildHash(expiration uint32, val [][]byte) ([]byte, error) {
 	return BuildRawValue(expiration, HASH, BuildRawArray(val))
 }
 
@@ -83,12 +130,14 @@ func GetNow() uint32 {
 }
 
 // convenience
-func GetDBI(txn *mdb.Txn, dbiFlags uint) (mdb.DBI, error) {
-	table := "onlyTable"
-	return txn.DBIOpen(&table, dbiFlags)
+const mainTable = "onlyTable"
+
+// keys of the db txn works in
+func GetDBI(txn *Txn, dbiFlags uint) (mdb.DBI, error) {
+	return openTable(txn, mainTable, txn.db, dbiFlags)
 }
 
-func GetBytes(txn *mdb.Txn, key []byte, dbiFlags uint) (mdb.DBI, []byte, error) {
+func GetBytes(txn *Txn, key []byte, dbiFlags uint) (mdb.DBI, []byte, error) {
 	dbi, err := GetDBI(txn, dbiFlags)
 	if err != nil {
 		return dbi, nil, err
@@ -100,31 +149,38 @@ func GetBytes(txn *mdb.Txn, key []byte, dbiFlags uint) (mdb.DBI, []byte, error)
 	return dbi, rawVal, nil
 }
 
-func GetRawValue(txn *mdb.Txn, key []byte) (uint32, uint8, []byte, error) {
+func GetRawValue(txn *Txn, key []byte) (uint32, uint8, []byte, error) {
 	_, rawVal, err := GetBytes(txn, key, 0)
 	if err != nil {
 		return 0, 0, nil, err
 	}
-	expiration, type_, val := ParseRawValue(rawVal)
+	expiration, type_, val, err := ParseRawValue(rawVal)
+	if err != nil {
+		return 0, 0, nil, err
+	}
 	if Expired(expiration) {
 		return 0, 0, nil, mdb.NotFound
 	}
 	return expiration, type_, val, nil
 }
 
-func GetRawValueForWrite(txn *mdb.Txn, key []byte) (mdb.DBI, uint32, uint8, []byte, error) {
+func GetRawValueForWrite(txn *Txn, key []byte) (mdb.DBI, uint32, uint8, []byte, error) {
 	dbi, rawVal, err := GetBytes(txn, key, mdb.CREATE)
 	if err != nil {
 		return dbi, 0, 0, nil, err
 	}
-	expiration, type_, val := ParseRawValue(rawVal)
+	expiration, type_, val, err := ParseRawValue(rawVal)
+	if err != nil {
+		return dbi, 0, 0, nil, err
+	}
 	if Expired(expiration) {
+		Notify(txn, EVENT_EXPIRED, "expired", key)
 		return dbi, 0, 0, nil, mdb.NotFound
 	}
 	return dbi, expiration, type_, val, nil
 }
 
-func GetString(txn *mdb.Txn, key []byte) ([]byte, error) {
+func GetString(txn *Txn, key []byte) ([]byte, error) {
 	_, rawVal, err := GetBytes(txn, key, 0)
 	if err != nil {
 		return nil, err
@@ -139,7 +195,7 @@ func GetString(txn *mdb.Txn, key []byte) ([]byte, error) {
 	return val, nil
 }
 
-func GetStringForWrite(txn *mdb.Txn, key []byte) (mdb.DBI, uint32, []byte, error) {
+func GetStringForWrite(txn *Txn, key []byte) (mdb.DBI, uint32, []byte, error) {
 	dbi, rawVal, err := GetBytes(txn, key, mdb.CREATE)
 	if err != nil {
 		return dbi, 0, nil, err
@@ -149,96 +205,7 @@ func GetStringForWrite(txn *mdb.Txn, key []byte) (mdb.DBI, uint32, []byte, error
 		return dbi, 0, nil, err
 	}
 	if Expired(expiration) {
-		return dbi, 0, nil, mdb.NotFound
-	}
-	return dbi, expiration, val, nil
-}
-
-func GetHash(txn *mdb.Txn, key []byte) ([][]byte, error) {
-	_, rawVal, err := GetBytes(txn, key, 0)
-	if err != nil {
-		return nil, err
-	}
-	expiration, val, err := ParseHash(rawVal)
-	if err != nil {
-		return nil, err
-	}
-	if Expired(expiration) {
-		return nil, mdb.NotFound
-	}
-	return val, nil
-}
-
-func GetHashForWrite(txn *mdb.Txn, key []byte) (mdb.DBI, uint32, [][]byte, error) {
-	dbi, rawVal, err := GetBytes(txn, key, mdb.CREATE)
-	if err != nil {
-		return dbi, 0, nil, err
-	}
-	expiration, val, err := ParseHash(rawVal)
-	if err != nil {
-		return dbi, 0, nil, err
-	}
-	if Expired(expiration) {
-		return dbi, 0, nil, mdb.NotFound
-	}
-	return dbi, expiration, val, nil
-}
-
-func GetRawList(txn *mdb.Txn, key []byte) ([]byte, error) {
-	_, rawVal, err := GetBytes(txn, key, 0)
-	if err != nil {
-		return nil, err
-	}
-	expiration, val, err := ParseList(rawVal)
-	if err != nil {
-		return nil, err
-	}
-	if Expired(expiration) {
-		return nil, mdb.NotFound
-	}
-	return val, nil
-}
-
-func GetRawListForWrite(txn *mdb.Txn, key []byte) (mdb.DBI, uint32, []byte, error) {
-	dbi, rawVal, err := GetBytes(txn, key, mdb.CREATE)
-	if err != nil {
-		return dbi, 0, nil, err
-	}
-	expiration, val, err := ParseList(rawVal)
-	if err != nil {
-		return dbi, 0, nil, err
-	}
-	if Expired(expiration) {
-		return dbi, 0, nil, mdb.NotFound
-	}
-	return dbi, expiration, val, nil
-}
-
-func GetRawSet(txn *mdb.Txn, key []byte) ([]byte, error) {
-	_, rawVal, err := GetBytes(txn, key, 0)
-	if err != nil {
-		return nil, err
-	}
-	expiration, val, err := ParseSet(rawVal)
-	if err != nil {
-		return nil, err
-	}
-	if Expired(expiration) {
-		return nil, mdb.NotFound
-	}
-	return val, nil
-}
-
-func GetRawSetForWrite(txn *mdb.Txn, key []byte) (mdb.DBI, uint32, []byte, error) {
-	dbi, rawVal, err := GetBytes(txn, key, mdb.CREATE)
-	if err != nil {
-		return dbi, 0, nil, err
-	}
-	expiration, val, err := ParseSet(rawVal)
-	if err != nil {
-		return dbi, 0, nil, err
-	}
-	if Expired(expiration) {
+		Notify(txn, EVENT_EXPIRED, "expired", key)
 		return dbi, 0, nil, mdb.NotFound
 	}
 	return dbi, expiration, val, nil
@@ -0,0 +1,174 @@
+package dbwrap
+
+import (
+	"encoding/binary"
+	"errors"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// DUMP/RESTORE payloads, for moving keys between shards.  values come out decoded,
+// uncompressed and unsealed, so the shard restoring them can store them its own way:
+// [1 byte dump version][4 byte expiration][1 byte type][raw array of members].
+// strings have one member, hashes are field, value pairs.
+const DUMP_VERSION uint8 = 1
+
+var BadDump = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// key's value from the selected db as a dump payload, mdb.NotFound if it's missing or expired
+func DumpValue(txn *Txn, key []byte) ([]byte, error) {
+	_, rawVal, err := GetBytes(txn, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	exp, type_ := ParseHeader(rawVal)
+	if Expired(exp) {
+		return nil, mdb.NotFound
+	}
+	var members [][]byte
+	if type_ == STRING {
+		_, val, err := ParseString(rawVal)
+		if err != nil {
+			return nil, err
+		}
+		members = [][]byte{val}
+	} else {
+		c, err := parseCollection(txn, key, rawVal, type_&^ELEMENTS)
+		if err != nil {
+			return nil, err
+		}
+		members, err = c.Members()
+		if err != nil {
+			return nil, err
+		}
+	}
+	header := make([]byte, 6)
+	header[0] = DUMP_VERSION
+	binary.LittleEndian.PutUint32(header[1:5], exp)
+	header[5] = type_ &^ ELEMENTS
+	return append(header, BuildRawArray(members)...), nil
+}
+
+// writes a dump payload under key in the selected db, replacing whatever's there
+func RestoreValue(txn *Txn, key []byte, dump []byte) error {
+	exp, type_, members, err := parseDump(dump)
+	if err != nil {
+		return err
+	}
+	dbi, err := GetDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	err = ClearElements(txn, key)
+	if err != nil {
+		return err
+	}
+	err = txn.Del(dbi, key, nil)
+	if err != nil && err != mdb.NotFound {
+		return err
+	}
+	if type_ == STRING {
+		rawVal, err := BuildString(exp, members[0])
+		if err != nil {
+			return err
+		}
+		return txn.Put(dbi, key, rawVal, 0)
+	}
+	c := newCollection(txn, key, type_)
+	c.Exp = exp
+	switch type_ {
+	case HASH:
+		for i := 0; i+1 < len(members); i += 2 {
+			_, err = c.HSet(members[i], members[i+1])
+			if err != nil {
+				return err
+			}
+		}
+	case SET:
+		for _, m := range members {
+			_, err = c.SAdd(m)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		err = c.RPush(members)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Save()
+}
+
+// like RawArrayToMembers, but checks lengths since dumps come from clients
+func parseDump(dump []byte) (uint32, uint8, [][]byte, error) {
+	if len(dump) < 10 || dump[0] != DUMP_VERSION {
+		return 0, 0, nil, BadDump
+	}
+	exp := binary.LittleEndian.Uint32(dump[1:5])
+	type_ := dump[5]
+	n := binary.LittleEndian.Uint32(dump[6:10])
+	rest := dump[10:]
+	members := make([][]byte, 0)
+	for i := uint32(0); i < n; i++ {
+		if len(rest) < 4 {
+			return 0, 0, nil, BadDump
+		}
+		l := binary.LittleEndian.Uint32(rest[:4])
+		rest = rest[4:]
+		if uint32(len(rest)) < l {
+			return 0, 0, nil, BadDump
+		}
+		members = append(members, rest[:l])
+		rest = rest[l:]
+	}
+	if len(rest) != 0 {
+		return 0, 0, nil, BadDump
+	}
+	switch type_ {
+	case STRING:
+		if len(members) != 1 {
+			return 0, 0, nil, BadDump
+		}
+	case HASH:
+		if len(members)%2 != 0 {
+			return 0, 0, nil, BadDump
+		}
+	case LIST, SET:
+	default:
+		return 0, 0, nil, BadDump
+	}
+	return exp, type_, members, nil
+}
+
+// up to n keys from the selected db starting at from, in order, and where to carry on
+// from next time, nil once the end's been reached.  expired keys are included.
+func ScanKeys(txn *Txn, from []byte, n int) ([][]byte, []byte, error) {
+	ret := make([][]byte, 0, n)
+	dbi, err := GetDBI(txn, 0)
+	if err == mdb.NotFound {
+		return ret, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+	var k []byte
+	if len(from) > 0 {
+		k, _, err = c.Get(from, mdb.SET_RANGE)
+	} else {
+		k, _, err = c.Get(nil, mdb.FIRST)
+	}
+	for err == nil && len(ret) < n {
+		ret = append(ret, append([]byte(nil), k...))
+		k, _, err = c.Get(nil, mdb.NEXT)
+	}
+	if err == mdb.NotFound {
+		return ret, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return ret, append([]byte(nil), k...), nil
+}
@@ -0,0 +1,70 @@
+package dbwrap
+
+// keyspace event classes, same letters as redis' notify-keyspace-events
+const (
+	EVENT_GENERIC = byte('g')
+	EVENT_STRING  = byte('$')
+	EVENT_LIST    = byte('l')
+	EVENT_SET     = byte('s')
+	EVENT_HASH    = byte('h')
+	EVENT_ZSET    = byte('z')
+	EVENT_EXPIRED = byte('x')
+	EVENT_EVICTED = byte('e')
+)
+
+// a change to a key raised by a write op while it's being applied
+type KeyEvent struct {
+	Class byte   // one of the EVENT_ classes
+	Event string // "set", "del", "rpush", "expired" ...
+	Key   []byte
+	DB    int // logical db the key is in
+}
+
+// events raised against a txn, only handed out if the txn was committed via Commit
+type eventLog struct {
+	events    []KeyEvent
+	committed bool
+}
+
+// starts collecting events raised against txn, TakeEvents hands them over
+func CollectEvents(txn *Txn) {
+	txn.events = &eventLog{make([]KeyEvent, 0), false}
+}
+
+// stops collecting for txn and returns its events, or nil if it never committed
+func TakeEvents(txn *Txn) []KeyEvent {
+	log := txn.events
+	txn.events = nil
+	if log == nil || !log.committed {
+		return nil
+	}
+	return log.events
+}
+
+// records an event against txn, no-op unless someone is collecting for it
+func Notify(txn *Txn, class byte, event string, key []byte) {
+	if txn.events == nil {
+		return
+	}
+	txn.events.events = append(txn.events.events, KeyEvent{class, event, key, txn.db})
+}
+
+// commits txn, marks its events as deliverable and runs its OnCommit hooks
+func Commit(txn *Txn) error {
+	err := finishUsage(txn)
+	if err != nil {
+		return err
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	if txn.events != nil {
+		txn.events.committed = true
+	}
+	for _, f := range txn.commit {
+		f()
+	}
+	txn.commit = nil
+	return nil
+}
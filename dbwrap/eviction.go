@@ -0,0 +1,84 @@
+package dbwrap
+
+import (
+	mdb "github.com/jbooth/gomdb"
+)
+
+// bytes of pages held by keys and elements across all logical dbs.
+// freed pages go back to lmdb's freelist rather than the filesystem, so this is
+// what eviction measures against instead of the size of the data file.
+func UsedBytes(txn *Txn) (int64, error) {
+	prevDB := txn.DB()
+	defer txn.Select(prevDB)
+	total := int64(0)
+	for db := 0; db < NumDBs; db++ {
+		txn.Select(db)
+		for _, open := range []func(*Txn, uint) (mdb.DBI, error){GetDBI, GetElementsDBI} {
+			dbi, err := open(txn, 0)
+			if err == mdb.NotFound {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			stat, err := txn.Stat(dbi)
+			if err != nil {
+				return 0, err
+			}
+			total += int64((stat.BranchPages + stat.LeafPages + stat.OverflowPages) * uint64(stat.PSize))
+		}
+	}
+	return total, nil
+}
+
+// a key picked by SampleKeys with its expiration, 0 if it has none
+type SampledKey struct {
+	Key []byte
+	Exp uint32
+}
+
+// up to n keys from the selected db starting at from, wrapping around to the first key,
+// and where to start next time.  callers sweep through the db a window at a time, random
+// seeks would mostly land on keys after gaps in the keyspace.
+func SampleKeys(txn *Txn, from []byte, n int) ([]SampledKey, []byte, error) {
+	ret := make([]SampledKey, 0, n)
+	dbi, err := GetDBI(txn, 0)
+	if err == mdb.NotFound {
+		return ret, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+	var k, v []byte
+	if len(from) > 0 {
+		k, v, err = c.Get(from, mdb.SET_RANGE)
+	} else {
+		err = mdb.NotFound
+	}
+	wrapped := false
+	for len(ret) < n {
+		if err == mdb.NotFound {
+			if wrapped {
+				// fewer than n keys in the db
+				return ret, nil, nil
+			}
+			wrapped = true
+			k, v, err = c.Get(nil, mdb.FIRST)
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		exp, _ := ParseHeader(v)
+		ret = append(ret, SampledKey{append([]byte(nil), k...), exp})
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err == mdb.NotFound {
+		return ret, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return ret, append([]byte(nil), k...), nil
+}
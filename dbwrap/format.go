@@ -0,0 +1,111 @@
+package dbwrap
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// values carry a format version so encodings can change without breaking data already on disk,
+// [4 byte expiration][1 byte type | flags][1 byte format version][payload].
+// values written before versioning are [4 byte expiration][1 byte type][payload], they don't have
+// the VERSIONED bit and decode as FORMAT_LEGACY.  the REWRITEVALUES op upgrades them in place.
+// COMPRESSED marks a payload that was deflated after encoding.
+const (
+	VERSIONED  uint8 = 0x40
+	COMPRESSED uint8 = 0x20
+
+	FORMAT_LEGACY  uint8 = 0
+	FORMAT_V1      uint8 = 1
+	CURRENT_FORMAT uint8 = FORMAT_V1
+)
+
+// turns a payload stored at some format version back into the payload ops work with
+type Decoder func(type_ uint8, payload []byte) ([]byte, error)
+
+var decoders = map[uint8]Decoder{
+	FORMAT_LEGACY: decodeIdentity,
+	FORMAT_V1:     decodeIdentity,
+}
+
+// registers a decoder for a new format version, call from init()
+func RegisterDecoder(version uint8, d Decoder) {
+	decoders[version] = d
+}
+
+func decodeIdentity(type_ uint8, payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+// format version of a raw stored value
+func FormatVersion(rawVal []byte) uint8 {
+	if rawVal[4]&VERSIONED == 0 {
+		return FORMAT_LEGACY
+	}
+	return rawVal[5]
+}
+
+func decodePayload(version uint8, type_ uint8, payload []byte) ([]byte, error) {
+	decoder, ok := decoders[version]
+	if !ok {
+		return nil, fmt.Errorf("Unknown value format version %d, was this written by a newer raftis?", version)
+	}
+	return decoder(type_, payload)
+}
+
+// payloads at least this many bytes get compressed, 0 disables.
+// has to match across a shard's replicas so they write identical bytes, so it's a replicated
+// setting the server applies as it commits, see SetCompressThreshold.
+var compressThreshold int64
+
+func SetCompressThreshold(n int) {
+	atomic.StoreInt64(&compressThreshold, int64(n))
+}
+
+func CompressThreshold() int {
+	return int(atomic.LoadInt64(&compressThreshold))
+}
+
+var (
+	compressedRawBytes    uint64 // payload bytes we compressed
+	compressedStoredBytes uint64 // what they took up after compression
+)
+
+// deflates val, returns false if that didn't save anything
+func compress(val []byte) ([]byte, bool) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestSpeed)
+	if err != nil {
+		return nil, false
+	}
+	_, err = w.Write(val)
+	if err != nil {
+		return nil, false
+	}
+	err = w.Close()
+	if err != nil || b.Len() >= len(val) {
+		return nil, false
+	}
+	atomic.AddUint64(&compressedRawBytes, uint64(len(val)))
+	atomic.AddUint64(&compressedStoredBytes, uint64(b.Len()))
+	return b.Bytes(), true
+}
+
+func decompress(val []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(val))
+	defer r.Close()
+	ret, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing value: %s", err)
+	}
+	return ret, nil
+}
+
+// bytes of payload compressed on this node since it started, and how many bytes they came to.
+// a per-node counter of compress calls, restarts, rewrites and deletes make it drift from
+// what's actually stored
+func CompressionStats() (uint64, uint64) {
+	return atomic.LoadUint64(&compressedRawBytes), atomic.LoadUint64(&compressedStoredBytes)
+}
@@ -1,7 +1,9 @@
 package dbwrap
 
 import (
+	"bytes"
 	"encoding/binary"
+	"sort"
 )
 
 // Members		[][]byte
@@ -76,13 +78,14 @@ func MembersToMap(members [][]byte) map[string]string {
 	return m
 }
 
+// field, value pairs sorted by field, so every replica encodes the same map the same way
 func MapToMembers(m map[string]string) [][]byte {
 	members := make([][]byte, 0)
 	for k, v := range m {
 		members = append(members, []byte(k))
 		members = append(members, []byte(v))
 	}
-	return members
+	return sortMembers(members, 2)
 }
 
 func MembersToSet(members [][]byte) (map[string]struct{}, int) {
@@ -97,10 +100,39 @@ func AddMembersToSet(set map[string]struct{}, newMembers [][]byte) (map[string]s
 	return set, len(set) - originalLength
 }
 
+// sorted, so every replica encodes the same set the same way
 func SetToMembers(s map[string]struct{}) [][]byte {
 	members := make([][]byte, 0)
 	for k, _ := range s {
 		members = append(members, []byte(k))
 	}
+	return sortMembers(members, 1)
+}
+
+// sorts members in place, step 2 sorts hash field, value pairs by field
+func sortMembers(members [][]byte, step int) [][]byte {
+	sorter := memberSorter{members, step}
+	if !sort.IsSorted(sorter) {
+		sort.Sort(sorter)
+	}
 	return members
 }
+
+type memberSorter struct {
+	members [][]byte
+	step    int
+}
+
+func (m memberSorter) Len() int {
+	return len(m.members) / m.step
+}
+
+func (m memberSorter) Less(i, j int) bool {
+	return bytes.Compare(m.members[i*m.step], m.members[j*m.step]) < 0
+}
+
+func (m memberSorter) Swap(i, j int) {
+	for k := 0; k < m.step; k++ {
+		m.members[i*m.step+k], m.members[j*m.step+k] = m.members[j*m.step+k], m.members[i*m.step+k]
+	}
+}
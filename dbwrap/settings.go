@@ -0,0 +1,48 @@
+package dbwrap
+
+import (
+	"bytes"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// CONFIG SET parameters every replica of a shard runs with the same value of.  they're set
+// through raft and kept in the meta table, the server applies them as they commit.
+var settingMetaPrefix = []byte("setting:")
+
+func settingMetaKey(name string) []byte {
+	return append(append([]byte{}, settingMetaPrefix...), name...)
+}
+
+// records a setting, applied on every replica through raft
+func PutSetting(txn *Txn, name string, val []byte) error {
+	dbi, err := GetMetaDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	return txn.Put(dbi, settingMetaKey(name), val, 0)
+}
+
+// every setting that's been set, by name
+func GetSettings(txn *Txn) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+	dbi, err := GetMetaDBI(txn, 0)
+	if err == mdb.NotFound {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	k, v, err := c.Get(settingMetaPrefix, mdb.SET_RANGE)
+	for err == nil && bytes.HasPrefix(k, settingMetaPrefix) {
+		ret[string(k[len(settingMetaPrefix):])] = append([]byte{}, v...)
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err != nil && err != mdb.NotFound {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,117 @@
+package dbwrap
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	mdb "github.com/jbooth/gomdb"
+	"sync"
+)
+
+// slots being migrated between shards.  states are set through raft on each side so every
+// replica of a shard agrees, kept in the meta table, and mirrored in memory for routing.
+// a shard with a slot MIGRATING serves the keys it still has and sends the rest to the
+// target, a shard with a slot IMPORTING serves keys it's asked for by the source.
+const (
+	SLOT_STABLE = iota
+	SLOT_MIGRATING
+	SLOT_IMPORTING
+)
+
+type SlotState struct {
+	State uint8 `json:"state"`
+	Shard int   `json:"shard"` // target when migrating, source when importing
+}
+
+var (
+	slotStatesL = &sync.RWMutex{}
+	slotStates  = make(map[uint32]SlotState)
+)
+
+var slotMetaPrefix = []byte("slot:")
+
+func slotMetaKey(slot uint32) []byte {
+	ret := make([]byte, len(slotMetaPrefix)+4)
+	copy(ret, slotMetaPrefix)
+	binary.BigEndian.PutUint32(ret[len(slotMetaPrefix):], slot)
+	return ret
+}
+
+// records slot's state, applied on every replica through raft.  stable slots aren't stored.
+func SetSlotState(txn *Txn, slot uint32, st SlotState) error {
+	dbi, err := GetMetaDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	if st.State == SLOT_STABLE {
+		err = txn.Del(dbi, slotMetaKey(slot), nil)
+		if err != nil && err != mdb.NotFound {
+			return err
+		}
+	} else {
+		val, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		err = txn.Put(dbi, slotMetaKey(slot), val, 0)
+		if err != nil {
+			return err
+		}
+	}
+	slotStatesL.Lock()
+	defer slotStatesL.Unlock()
+	if st.State == SLOT_STABLE {
+		delete(slotStates, slot)
+	} else {
+		slotStates[slot] = st
+	}
+	return nil
+}
+
+// slot's state as of the last apply, stable if it isn't moving
+func GetSlotState(slot uint32) SlotState {
+	slotStatesL.RLock()
+	defer slotStatesL.RUnlock()
+	return slotStates[slot]
+}
+
+func SlotStates() map[uint32]SlotState {
+	slotStatesL.RLock()
+	defer slotStatesL.RUnlock()
+	ret := make(map[uint32]SlotState)
+	for slot, st := range slotStates {
+		ret[slot] = st
+	}
+	return ret
+}
+
+// picks up slot states from the meta table, call at startup and after restoring a snapshot
+func LoadSlotStates(txn *Txn) error {
+	loaded := make(map[uint32]SlotState)
+	dbi, err := GetMetaDBI(txn, 0)
+	if err != nil && err != mdb.NotFound {
+		return err
+	}
+	if err == nil {
+		c, err := txn.CursorOpen(dbi)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		k, v, err := c.Get(slotMetaPrefix, mdb.SET_RANGE)
+		for err == nil && len(k) == len(slotMetaPrefix)+4 && string(k[:len(slotMetaPrefix)]) == string(slotMetaPrefix) {
+			var st SlotState
+			if err = json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+			loaded[binary.BigEndian.Uint32(k[len(slotMetaPrefix):])] = st
+			k, v, err = c.Get(nil, mdb.NEXT)
+		}
+		if err != nil && err != mdb.NotFound {
+			return err
+		}
+	}
+	slotStatesL.Lock()
+	defer slotStatesL.Unlock()
+	slotStates = loaded
+	return nil
+}
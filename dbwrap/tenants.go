@@ -0,0 +1,504 @@
+package dbwrap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// tenants share a cluster, each owning the keys that start with its prefix (longest prefix wins).
+// definitions and usage live in replicated tables, so every replica of a shard agrees on them
+// and they survive failover.  usage is per shard and per logical db, it's updated in the same
+// txn as the write that changed it:  write ops are bracketed by TrackUsage, which notes the size
+// of the tenant keys they're about to touch, and Commit adds up the difference before committing.
+// element entries report their own size changes as they're written.
+type Tenant struct {
+	Name     string `json:"name"`
+	Prefix   string `json:"prefix"`
+	MaxKeys  int64  `json:"maxKeys"`  // 0 for unlimited
+	MaxBytes int64  `json:"maxBytes"` // keys, values and elements, 0 for unlimited
+	MaxOps   int64  `json:"maxOps"`   // ops per second on each node, 0 for unlimited
+}
+
+type TenantUsage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+func GetTenantsDBI(txn *Txn, dbiFlags uint) (mdb.DBI, error) {
+	table := "tenants"
+	return txn.DBIOpen(&table, dbiFlags)
+}
+
+// prefix -> tenant name, so a write can find its tenant without reading every definition.
+// rebuilt from the tenants table whenever ownership moves.
+func GetTenantPrefixesDBI(txn *Txn, dbiFlags uint) (mdb.DBI, error) {
+	table := "tenantPrefixes"
+	return txn.DBIOpen(&table, dbiFlags)
+}
+
+// tenant name -> [8 byte keys][8 byte bytes] for each logical db
+func GetTenantUsageDBI(txn *Txn, dbiFlags uint) (mdb.DBI, error) {
+	table := "tenantUsage"
+	return txn.DBIOpen(&table, dbiFlags)
+}
+
+func GetTenant(txn *Txn, name string) (*Tenant, error) {
+	dbi, err := GetTenantsDBI(txn, 0)
+	if err != nil {
+		return nil, err
+	}
+	val, err := txn.Get(dbi, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	t := &Tenant{}
+	err = json.Unmarshal(val, t)
+	return t, err
+}
+
+// all tenants, in name order
+func ListTenants(txn *Txn) ([]*Tenant, error) {
+	ret := make([]*Tenant, 0)
+	dbi, err := GetTenantsDBI(txn, 0)
+	if err == mdb.NotFound {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_, v, err := c.Get(nil, mdb.FIRST)
+	for err == nil {
+		t := &Tenant{}
+		err = json.Unmarshal(v, t)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, t)
+		_, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err != mdb.NotFound {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// the tenant owning key, nil if nobody does
+func TenantForKey(tenants []*Tenant, key []byte) *Tenant {
+	var ret *Tenant = nil
+	for _, t := range tenants {
+		if bytes.HasPrefix(key, []byte(t.Prefix)) && (ret == nil || len(t.Prefix) > len(ret.Prefix)) {
+			ret = t
+		}
+	}
+	return ret
+}
+
+// the name of the tenant owning key, using the prefix index.  nil if nobody does.
+func tenantNameForKey(c *mdb.Cursor, key []byte) ([]byte, error) {
+	probe := key
+	for len(probe) > 0 {
+		// last prefix <= probe
+		k, name, err := c.Get(probe, mdb.SET_RANGE)
+		if err == nil && bytes.Equal(k, probe) {
+			return name, nil
+		} else if err == nil {
+			k, name, err = c.Get(nil, mdb.PREV)
+		} else if err == mdb.NotFound {
+			k, name, err = c.Get(nil, mdb.LAST)
+		}
+		if err == mdb.NotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(key, k) {
+			return name, nil
+		}
+		// nothing between k and probe is in the index, so any longer match would have
+		// to share more of probe than k does
+		n := 0
+		for n < len(k) && k[n] == probe[n] {
+			n++
+		}
+		probe = probe[:n]
+	}
+	return nil, nil
+}
+
+// creates or updates a tenant.  a new tenant's usage is counted from whatever keys
+// already have its prefix, and the keys it takes over stop counting against other tenants.
+func PutTenant(txn *Txn, t *Tenant) error {
+	tenants, err := ListTenants(txn)
+	if err != nil {
+		return err
+	}
+	existing := false
+	for _, other := range tenants {
+		if other.Name == t.Name {
+			existing = true
+			if other.Prefix != t.Prefix {
+				return fmt.Errorf("ERR can't change the prefix of tenant %s", t.Name)
+			}
+		} else if other.Prefix == t.Prefix {
+			return fmt.Errorf("ERR prefix %s already belongs to tenant %s", t.Prefix, other.Name)
+		}
+	}
+	dbi, err := GetTenantsDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	err = txn.Put(dbi, []byte(t.Name), val, 0)
+	if err != nil {
+		return err
+	}
+	if existing {
+		return nil
+	}
+	return recountTenants(txn)
+}
+
+func DeleteTenant(txn *Txn, name string) error {
+	dbi, err := GetTenantsDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	err = txn.Del(dbi, []byte(name), nil)
+	if err != nil {
+		return err
+	}
+	// its keys may fall to a tenant with a shorter prefix
+	return recountTenants(txn)
+}
+
+// rebuilds the prefix index and every tenant's usage from scratch by walking their keys,
+// used when ownership moves
+func recountTenants(txn *Txn) error {
+	tenants, err := ListTenants(txn)
+	if err != nil {
+		return err
+	}
+	pdbi, err := GetTenantPrefixesDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	err = txn.Drop(pdbi, 0)
+	if err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		err = txn.Put(pdbi, []byte(t.Prefix), []byte(t.Name), 0)
+		if err != nil {
+			return err
+		}
+	}
+	udbi, err := GetTenantUsageDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	err = txn.Drop(udbi, 0)
+	if err != nil {
+		return err
+	}
+	prevDB := txn.DB()
+	defer txn.Select(prevDB)
+	for db := 0; db < NumDBs; db++ {
+		txn.Select(db)
+		for _, t := range tenants {
+			err = recountTenant(txn, tenants, t, db)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func recountTenant(txn *Txn, tenants []*Tenant, t *Tenant, db int) error {
+	dbi, err := GetDBI(txn, 0)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	usage := TenantUsage{}
+	k, v, err := c.Get([]byte(t.Prefix), mdb.SET_RANGE)
+	for err == nil && bytes.HasPrefix(k, []byte(t.Prefix)) {
+		if TenantForKey(tenants, k) == t {
+			usage.Keys++
+			usage.Bytes += int64(len(k) + len(v))
+			elemBytes, err := elementBytes(txn, k, v)
+			if err != nil {
+				return err
+			}
+			usage.Bytes += elemBytes
+		}
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err != nil && err != mdb.NotFound {
+		return err
+	}
+	return addTenantUsage(txn, t.Name, db, usage)
+}
+
+// bytes stored in the elements table for key
+func elementBytes(txn *Txn, key []byte, rawVal []byte) (int64, error) {
+	_, type_ := ParseHeader(rawVal)
+	if type_&ELEMENTS == 0 {
+		return 0, nil
+	}
+	edbi, err := GetElementsDBI(txn, 0)
+	if err != nil {
+		return 0, err
+	}
+	c, err := txn.CursorOpen(edbi)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	total := int64(0)
+	err = ForEachElement(c, key, func(member, val []byte) error {
+		total += int64(4 + len(key) + len(member) + len(val))
+		return nil
+	})
+	return total, err
+}
+
+func getUsageRecord(txn *Txn, name string) ([]byte, error) {
+	record := make([]byte, 16*NumDBs)
+	dbi, err := GetTenantUsageDBI(txn, 0)
+	if err == mdb.NotFound {
+		return record, nil
+	} else if err != nil {
+		return nil, err
+	}
+	stored, err := txn.Get(dbi, []byte(name))
+	if err == mdb.NotFound {
+		return record, nil
+	} else if err != nil {
+		return nil, err
+	}
+	copy(record, stored)
+	return record, nil
+}
+
+func putUsageRecord(txn *Txn, name string, record []byte) error {
+	dbi, err := GetTenantUsageDBI(txn, mdb.CREATE)
+	if err != nil {
+		return err
+	}
+	return txn.Put(dbi, []byte(name), record, 0)
+}
+
+func addTenantUsage(txn *Txn, name string, db int, delta TenantUsage) error {
+	record, err := getUsageRecord(txn, name)
+	if err != nil {
+		return err
+	}
+	keys := int64(binary.BigEndian.Uint64(record[db*16:])) + delta.Keys
+	stored := int64(binary.BigEndian.Uint64(record[db*16+8:])) + delta.Bytes
+	binary.BigEndian.PutUint64(record[db*16:], uint64(keys))
+	binary.BigEndian.PutUint64(record[db*16+8:], uint64(stored))
+	return putUsageRecord(txn, name, record)
+}
+
+// a tenant's usage on this shard, across all dbs
+func GetTenantUsage(txn *Txn, name string) (TenantUsage, error) {
+	ret := TenantUsage{}
+	record, err := getUsageRecord(txn, name)
+	if err != nil {
+		return ret, err
+	}
+	for db := 0; db < NumDBs; db++ {
+		ret.Keys += int64(binary.BigEndian.Uint64(record[db*16:]))
+		ret.Bytes += int64(binary.BigEndian.Uint64(record[db*16+8:]))
+	}
+	return ret, nil
+}
+
+// zeroes every tenant's usage in db, for FLUSHDB
+func flushTenantUsage(txn *Txn, db int) error {
+	return updateUsageRecords(txn, func(record []byte) {
+		copy(record[db*16:db*16+16], make([]byte, 16))
+	})
+}
+
+// swaps every tenant's usage between two dbs, for SWAPDB
+func swapTenantUsage(txn *Txn, a int, b int) error {
+	return updateUsageRecords(txn, func(record []byte) {
+		tmp := append([]byte(nil), record[a*16:a*16+16]...)
+		copy(record[a*16:a*16+16], record[b*16:b*16+16])
+		copy(record[b*16:b*16+16], tmp)
+	})
+}
+
+// every tenant has a usage record once recountTenants has run, so walk those
+func updateUsageRecords(txn *Txn, update func(record []byte)) error {
+	dbi, err := GetTenantUsageDBI(txn, 0)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return err
+	}
+	names := make([][]byte, 0)
+	k, _, err := c.Get(nil, mdb.FIRST)
+	for err == nil {
+		names = append(names, k)
+		k, _, err = c.Get(nil, mdb.NEXT)
+	}
+	c.Close()
+	if err != mdb.NotFound {
+		return err
+	}
+	for _, name := range names {
+		record, err := getUsageRecord(txn, string(name))
+		if err != nil {
+			return err
+		}
+		update(record)
+		err = putUsageRecord(txn, string(name), record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a write txn's tenant keys and how big they were before the op ran
+type usageTracker struct {
+	db   int
+	keys map[string]*trackedKey
+}
+
+type trackedKey struct {
+	tenant   *Tenant
+	existed  bool
+	size     int64 // key and value before the op
+	elements int64 // change in element bytes reported during the op
+}
+
+// notes the size of any tenant keys among keys before a write op touches them,
+// Commit then records how their usage changed.
+func TrackUsage(txn *Txn, keys [][]byte) error {
+	dbi, err := GetTenantPrefixesDBI(txn, 0)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	tracker := &usageTracker{txn.db, make(map[string]*trackedKey)}
+	tenants := make(map[string]*Tenant)
+	for _, key := range keys {
+		name, err := tenantNameForKey(c, key)
+		if err != nil {
+			return err
+		}
+		if name == nil {
+			continue
+		}
+		t, ok := tenants[string(name)]
+		if !ok {
+			t, err = GetTenant(txn, string(name))
+			if err != nil {
+				return err
+			}
+			tenants[string(name)] = t
+		}
+		existed, size, err := storedSize(txn, key)
+		if err != nil {
+			return err
+		}
+		tracker.keys[string(key)] = &trackedKey{t, existed, size, 0}
+	}
+	if len(tracker.keys) == 0 {
+		return nil
+	}
+	txn.usage = tracker
+	return nil
+}
+
+// size of key and its value in the selected db, not counting elements
+func storedSize(txn *Txn, key []byte) (bool, int64, error) {
+	_, rawVal, err := GetBytes(txn, key, mdb.CREATE)
+	if err == mdb.NotFound {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	return true, int64(len(key) + len(rawVal)), nil
+}
+
+// called as element entries are written or deleted
+func noteElementBytes(txn *Txn, key []byte, delta int64) {
+	if txn.usage == nil {
+		return
+	}
+	tk, ok := txn.usage.keys[string(key)]
+	if ok {
+		tk.elements += delta
+	}
+}
+
+// whether anyone cares about element sizes for this txn, saves a lookup per element write
+func trackingUsage(txn *Txn) bool {
+	return txn.usage != nil
+}
+
+// adds up usage changes for the tracked keys, called by Commit
+func finishUsage(txn *Txn) error {
+	tracker := txn.usage
+	if tracker == nil {
+		return nil
+	}
+	prevDB := txn.Select(tracker.db)
+	defer txn.Select(prevDB)
+	deltas := make(map[string]TenantUsage)
+	for key, tk := range tracker.keys {
+		exists, size, err := storedSize(txn, []byte(key))
+		if err != nil {
+			return err
+		}
+		delta := deltas[tk.tenant.Name]
+		if exists && !tk.existed {
+			delta.Keys++
+		} else if !exists && tk.existed {
+			delta.Keys--
+		}
+		delta.Bytes += size - tk.size + tk.elements
+		deltas[tk.tenant.Name] = delta
+	}
+	for name, delta := range deltas {
+		if delta.Keys == 0 && delta.Bytes == 0 {
+			continue
+		}
+		err := addTenantUsage(txn, name, tracker.db, delta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package dbwrap
+
+import (
+	mdb "github.com/jbooth/gomdb"
+)
+
+// a txn with what the op running in it needs alongside:  the logical db it works in, the
+// events it raises, the tenant usage it's tracking and anything to do once it commits.  every command and read gets its own,
+// so none of this is shared between ops or has to be looked up by txn.
+type Txn struct {
+	*mdb.Txn
+	db     int
+	dbMap  []uint32      // physical table for each logical db, read from meta on first use
+	events *eventLog     // nil unless someone's collecting
+	usage  *usageTracker // nil unless someone's tracking
+	commit []func()      // run by Commit after the txn commits
+}
+
+// wraps txn working in db 0
+func NewTxn(txn *mdb.Txn) *Txn {
+	return &Txn{txn, 0, nil, nil, nil, nil}
+}
+
+// wraps txn working in db
+func NewTxnInDB(txn *mdb.Txn, db int) *Txn {
+	return &Txn{txn, db, nil, nil, nil, nil}
+}
+
+// the logical db ops against txn work in
+func (t *Txn) DB() int {
+	return t.db
+}
+
+// runs f once txn has committed through Commit, for process state that has to match what's stored
+func OnCommit(txn *Txn, f func()) {
+	txn.commit = append(txn.commit, f)
+}
+
+// switches the logical db ops against txn work in, returns the one it was in
+func (t *Txn) Select(db int) int {
+	prev := t.db
+	t.db = db
+	return prev
+}
@@ -0,0 +1,357 @@
+package raftis
+
+import (
+	"fmt"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	log "github.com/jbooth/raftis/rlog"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxmemory-style eviction for cache clusters.  once the shard's keys take more than
+// maxMemory bytes of lmdb pages, the leader samples keys, picks victims by policy and
+// proposes EVICT for them through raft, so every replica drops the same keys.  maxmemory
+// and the policy are replicated settings, see settings.go, so a new leader evicts the same way.
+// access times and counts are kept in memory on each node and only the leader's are
+// used, so reads served by followers don't count towards keeping a key.  keys the leader
+// has no access data for, after it takes over or once it's forgotten them, aren't taken
+// as the coldest, they rank in the middle of the ones it does know about.
+
+const (
+	evictInterval = time.Second
+	evictRounds   = 16 // most EVICTs proposed per interval
+	evictBatch    = 32 // keys per EVICT
+	evictSamples  = 64 // keys looked at in each db per EVICT
+	maxTracked    = 1 << 20
+	// lfu counters, same scheme as redis
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+var evictionPolicies = map[string]bool{
+	"noeviction":      true,
+	"allkeys-lru":     true,
+	"allkeys-lfu":     true,
+	"volatile-ttl":    true,
+	"volatile-random": true,
+}
+
+type evictor struct {
+	l        *sync.Mutex
+	policy   string
+	maxBytes int64 // 0 disables
+	access   map[accessKey]*accessInfo
+	rnd      *rand.Rand
+	sweep    map[int][]byte // where each db's next sample starts
+	used     int64          // as of the last check
+	evicted  uint64
+	lg       *log.Logger
+}
+
+type accessKey struct {
+	db  int
+	key string
+}
+
+type accessInfo struct {
+	last  time.Time
+	count uint8 // logarithmic, see touch
+}
+
+func newEvictor(maxBytes int64, policy string, lg *log.Logger) (*evictor, error) {
+	if policy == "" {
+		policy = "noeviction"
+	}
+	if !evictionPolicies[policy] {
+		return nil, fmt.Errorf("Unknown maxMemoryPolicy %s", policy)
+	}
+	return &evictor{&sync.Mutex{}, policy, maxBytes, make(map[accessKey]*accessInfo), rand.New(rand.NewSource(time.Now().UnixNano())), make(map[int][]byte), 0, 0, lg}, nil
+}
+
+func (e *evictor) tracksAccess() bool {
+	return e.policy == "allkeys-lru" || e.policy == "allkeys-lfu"
+}
+
+// records an access to key, called by route for reads and writes we serve
+func (e *evictor) touch(db int, key []byte) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if key == nil || e.maxBytes == 0 || !e.tracksAccess() {
+		return
+	}
+	now := time.Now()
+	k := accessKey{db, string(key)}
+	info, ok := e.access[k]
+	if !ok {
+		if len(e.access) >= maxTracked {
+			e.forgetSome()
+		}
+		info = &accessInfo{now, lfuInitVal}
+		e.access[k] = info
+	}
+	info.count = e.decayedCount(info, now)
+	// harder to bump the higher it gets, so 255 takes around a million hits
+	base := int(info.count) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if info.count < 255 && e.rnd.Float64() < 1.0/float64(base*lfuLogFactor+1) {
+		info.count++
+	}
+	info.last = now
+}
+
+// drops a sixteenth of the tracked keys, whichever the map hands us first.
+// forgotten keys are unknown again, see pickVictims.
+func (e *evictor) forgetSome() {
+	toDrop := len(e.access) / 16
+	for k := range e.access {
+		if toDrop <= 0 {
+			return
+		}
+		delete(e.access, k)
+		toDrop--
+	}
+}
+
+// count less one per lfuDecayTime since the last access
+func (e *evictor) decayedCount(info *accessInfo, now time.Time) uint8 {
+	periods := int64(now.Sub(info.last) / lfuDecayTime)
+	if periods >= int64(info.count) {
+		return 0
+	}
+	return info.count - uint8(periods)
+}
+
+// checks usage every evictInterval and evicts while we're leader and over the limit
+func (e *evictor) run(s *Server) {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		e.l.Lock()
+		disabled := e.maxBytes == 0 || e.policy == "noeviction"
+		e.l.Unlock()
+		if disabled || !s.flotilla.IsLeader() {
+			continue
+		}
+		err := e.evict(s)
+		if err != nil {
+			e.lg.Errorf("Error evicting keys : %s", err)
+		}
+	}
+}
+
+func (e *evictor) evict(s *Server) error {
+	for i := 0; i < evictRounds; i++ {
+		over, err := e.overLimit(s)
+		if err != nil || !over {
+			return err
+		}
+		victims, err := e.pickVictims(s)
+		if err != nil {
+			return err
+		}
+		if len(victims) == 0 {
+			// volatile policies with nothing expiring, writes will fail until keys go away
+			return nil
+		}
+		for db, keys := range victims {
+			resp := <-s.command(db, "EVICT", keys)
+			if resp.Err != nil {
+				return resp.Err
+			}
+			if len(resp.Response) == 0 || resp.Response[0] != ':' {
+				return fmt.Errorf("EVICT failed : %s", strings.TrimSpace(string(resp.Response)))
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(string(resp.Response[1:])))
+			if err != nil {
+				return err
+			}
+			e.l.Lock()
+			e.evicted += uint64(n)
+			for _, key := range keys {
+				delete(e.access, accessKey{db, string(key)})
+			}
+			e.l.Unlock()
+		}
+	}
+	return nil
+}
+
+func (e *evictor) overLimit(s *Server) (bool, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return false, err
+	}
+	used, err := dbwrap.UsedBytes(dbwrap.NewTxn(txn))
+	txn.Abort()
+	if err != nil {
+		return false, err
+	}
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.used = used
+	return e.maxBytes > 0 && used > e.maxBytes, nil
+}
+
+type evictCandidate struct {
+	db    int
+	key   []byte
+	score float64 // lowest goes first
+}
+
+// looks at the next window of every db and returns up to evictBatch of the best candidates, by db.
+// like redis' sampling it's approximate, the best key in the shard may not be in any window.
+func (e *evictor) pickVictims(s *Server) (map[int][][]byte, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Abort()
+	dtxn := dbwrap.NewTxn(txn)
+	e.l.Lock()
+	defer e.l.Unlock()
+	now := time.Now()
+	seen := make(map[accessKey]bool)
+	candidates := make([]evictCandidate, 0)
+	unknown := make([]evictCandidate, 0)
+	for db := 0; db < dbwrap.NumDBs; db++ {
+		dtxn.Select(db)
+		sampled, next, err := dbwrap.SampleKeys(dtxn, e.sweep[db], evictSamples)
+		if err != nil {
+			return nil, err
+		}
+		e.sweep[db] = next
+		for _, sk := range sampled {
+			k := accessKey{db, string(sk.Key)}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			score, known, ok := e.score(k, sk.Exp, now)
+			if !ok {
+				continue
+			}
+			if known {
+				candidates = append(candidates, evictCandidate{db, sk.Key, score})
+			} else {
+				unknown = append(unknown, evictCandidate{db, sk.Key, 0})
+			}
+		}
+	}
+	sort.Sort(byScore(candidates))
+	if len(unknown) > 0 {
+		// could be hot or cold, so they go in the middle in random order
+		middle := 0.0
+		if len(candidates) > 0 {
+			middle = candidates[len(candidates)/2].score
+		}
+		for _, i := range e.rnd.Perm(len(unknown)) {
+			c := unknown[i]
+			c.score = middle
+			candidates = append(candidates, c)
+		}
+		sort.Stable(byScore(candidates))
+	}
+	if len(candidates) > evictBatch {
+		candidates = candidates[:evictBatch]
+	}
+	ret := make(map[int][][]byte)
+	for _, c := range candidates {
+		ret[c.db] = append(ret[c.db], c.key)
+	}
+	return ret, nil
+}
+
+// how keen we are to keep a key, whether we know, and false if the policy can't evict it.
+// must hold e.l
+func (e *evictor) score(k accessKey, exp uint32, now time.Time) (float64, bool, bool) {
+	switch e.policy {
+	case "allkeys-lru":
+		info, ok := e.access[k]
+		if !ok {
+			return 0, false, true
+		}
+		return float64(info.last.UnixNano()), true, true
+	case "allkeys-lfu":
+		info, ok := e.access[k]
+		if !ok {
+			return 0, false, true
+		}
+		// ties go to the least recently used
+		return float64(e.decayedCount(info, now))*1e12 + float64(info.last.Unix()), true, true
+	case "volatile-ttl":
+		return float64(exp), true, exp != 0
+	case "volatile-random":
+		return e.rnd.Float64(), true, exp != 0
+	}
+	return 0, false, false
+}
+
+type byScore []evictCandidate
+
+func (b byScore) Len() int           { return len(b) }
+func (b byScore) Less(i, j int) bool { return b[i].score < b[j].score }
+func (b byScore) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func isEvictionConfig(name []byte) bool {
+	n := strings.ToLower(string(name))
+	return n == "maxmemory" || n == "maxmemory-policy"
+}
+
+// CONFIG GET for maxmemory and maxmemory-policy
+func (e *evictor) getConfig(name []byte) [][]byte {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if strings.ToLower(string(name)) == "maxmemory" {
+		return [][]byte{[]byte("maxmemory"), []byte(strconv.FormatInt(e.maxBytes, 10))}
+	}
+	return [][]byte{[]byte("maxmemory-policy"), []byte(e.policy)}
+}
+
+// complains if val isn't a valid maxmemory or maxmemory-policy
+func checkEvictionConfig(name []byte, val []byte) error {
+	if strings.ToLower(string(name)) == "maxmemory" {
+		maxBytes, err := strconv.ParseInt(string(val), 10, 64)
+		if err != nil || maxBytes < 0 {
+			return fmt.Errorf("ERR invalid maxmemory %s", val)
+		}
+		return nil
+	}
+	if !evictionPolicies[strings.ToLower(string(val))] {
+		return fmt.Errorf("ERR invalid maxmemory-policy %s", val)
+	}
+	return nil
+}
+
+// maxmemory and maxmemory-policy as a replicated CONFIG SET commits, see settings.go
+func (e *evictor) setConfig(name []byte, val []byte) error {
+	err := checkEvictionConfig(name, val)
+	if err != nil {
+		return err
+	}
+	e.l.Lock()
+	defer e.l.Unlock()
+	if strings.ToLower(string(name)) == "maxmemory" {
+		e.maxBytes, _ = strconv.ParseInt(string(val), 10, 64)
+		return nil
+	}
+	policy := strings.ToLower(string(val))
+	if policy != e.policy {
+		e.access = make(map[accessKey]*accessInfo)
+	}
+	e.policy = policy
+	return nil
+}
+
+func (e *evictor) String() string {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return fmt.Sprintf("eviction: policy %s, max %d bytes, used %d bytes, evicted %d keys, tracking %d keys",
+		e.policy, e.maxBytes, e.used, e.evicted, len(e.access))
+}
@@ -0,0 +1,379 @@
+package raftis
+
+import (
+	"fmt"
+	"github.com/jbooth/raftis/config"
+	log "github.com/jbooth/raftis/rlog"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connections to another host we forward to behind a circuit breaker.  hosts that serve
+// rpc get a single rpc connection, see rpc.go, others a pool of pipelined PassthruConns
+// to their redis port.
+//   up       on the redis port,
+//            each stream, a client connection or stream 0 for our own traffic, sticks to
+//            one of forwardConns conns so its commands reach the host in the order it sent
+//            them.  conns are dialed as streams first need them, and while a conn's pipeline
+//            is full commands on it wait for a reply to make room
+//   down     after a failure nothing goes to the host until its backoff is up, the backoff
+//            doubles with each failure in a row from forwardBackoffMs to forwardMaxBackoffMs
+//   probing  once the backoff's up, the next caller dials a single probe conn while the rest
+//            still see the host down.  if it connects the host's up, if not it's down again
+// failures are dials, writes and replies that error or time out on the remote host's side,
+// a client hanging up mid reply doesn't count against the host.
+
+// a command on its way to another host
+type forwardReq struct {
+	stream   uint64 // keeps a client's commands in order over the redis port
+	db       int
+	indexed  bool // the reply comes back with the host's index token, see session.go
+	internal bool // one of internalOps, which only go over rpc
+	name     string
+	args     [][]byte
+}
+
+// the command to send over the redis port, which has no room for metadata
+func (r forwardReq) passthru() (string, [][]byte) {
+	if r.indexed {
+		return "WITHINDEX", append([][]byte{[]byte(strconv.Itoa(r.db)), []byte(r.name)}, r.args...)
+	}
+	if r.db != 0 {
+		return "INDB", append([][]byte{[]byte(strconv.Itoa(r.db)), []byte(r.name)}, r.args...)
+	}
+	return r.name, r.args
+}
+
+// a reply on its way back from another host, WriteTo forwards it to our client
+type forwardedReply interface {
+	io.WriterTo
+	// for an indexed request, also returns the token that came with the reply
+	WriteIndexedTo(w io.Writer) (int64, string, error)
+}
+
+type hostState int
+
+const (
+	hostUp hostState = iota
+	hostDown
+	hostProbing
+)
+
+func (s hostState) String() string {
+	switch s {
+	case hostUp:
+		return "up"
+	case hostDown:
+		return "down"
+	}
+	return "probing"
+}
+
+// counters for one host we forward to, since we started
+type hostStats struct {
+	sent        uint64
+	replies     uint64
+	errors      uint64
+	timeouts    uint64
+	replyMicros uint64 // across all replies
+	timesDown   uint64
+	waits       uint64 // commands that waited for room in a pipeline
+}
+
+type hostConn struct {
+	host      string
+	c         *config.ClusterConfig
+	lg        *log.Logger
+	l         *sync.Mutex
+	room      *sync.Cond      // on l, signalled as replies finish and conns come and go
+	conns     []*PassthruConn // forwardConns of them, nil until a stream needs one
+	dialing   []bool
+	state     hostState
+	failures  int // in a row
+	downUntil time.Time
+	stats     *hostStats
+	rpc       rpcLayer
+	rpcAddr   string // host's flotilla address if it serves rpc, "" to use its redis port
+	rpcConn   *rpcConn
+	flotilla  string // host's flotilla address, for internal commands whatever rpcAddr says
+}
+
+func newHostConn(host string, rpcAddr string, flotillaAddr string, rpc rpcLayer, c *config.ClusterConfig, lg *log.Logger) *hostConn {
+	l := new(sync.Mutex)
+	size := c.ForwardPoolSize()
+	return &hostConn{host, c, lg, l, sync.NewCond(l), make([]*PassthruConn, size), make([]bool, size), hostUp, 0, time.Time{}, new(hostStats), rpc, rpcAddr, nil, flotillaAddr}
+}
+
+// switches between rpc and the redis port as the host's heartbeats say
+func (h *hostConn) setRPCAddr(addr string) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	if addr == h.rpcAddr {
+		return
+	}
+	h.rpcAddr = addr
+	if h.rpcConn != nil {
+		h.rpcConn.Close()
+		h.rpcConn = nil
+	}
+}
+
+func (h *hostConn) dialRPC(addr string) (*rpcConn, error) {
+	return dialRPC(h.rpc, addr, h.c.ForwardTimeout(), h.observe, h.lg)
+}
+
+func (h *hostConn) dial() (*PassthruConn, error) {
+	return dialPassThru(h.host, h.c.ForwardTimeout(), h.observe, h.lg)
+}
+
+// nil if commands can go to the host now, hostMarkedDown if it's down.  dials the probe
+// if it's time for one, or a first conn if we don't have one open
+func (h *hostConn) acquire() error {
+	h.l.Lock()
+	if h.state == hostUp && h.prune() > 0 {
+		h.l.Unlock()
+		return nil
+	}
+	if h.state == hostProbing || (h.state == hostDown && time.Now().Before(h.downUntil)) {
+		h.l.Unlock()
+		return hostMarkedDown
+	}
+	if h.state == hostDown {
+		h.state = hostProbing
+	}
+	rpcAddr := h.rpcAddr
+	h.l.Unlock()
+
+	var p *PassthruConn
+	var r *rpcConn
+	var err error
+	if rpcAddr != "" {
+		r, err = h.dialRPC(rpcAddr)
+	} else {
+		p, err = h.dial()
+	}
+	h.l.Lock()
+	defer h.l.Unlock()
+	if err != nil {
+		h.failed(err)
+		return err
+	}
+	if h.state != hostUp {
+		h.lg.Printf("Host %s is back up", h.host)
+	}
+	h.state = hostUp
+	h.failures = 0
+	h.room.Broadcast()
+	if r != nil {
+		if h.rpcConn == nil || h.rpcConn.Closed() {
+			h.rpcConn = r
+		} else {
+			r.Close()
+		}
+		return nil
+	}
+	for i, conn := range h.conns {
+		if conn == nil && !h.dialing[i] {
+			h.conns[i] = p
+			return nil
+		}
+	}
+	// streams dialed all of them while we were
+	p.Close()
+	return nil
+}
+
+// sends a command over rpc, or on its stream's conn to the redis port
+func (h *hostConn) Command(req forwardReq) (forwardedReply, error) {
+	h.l.Lock()
+	rpcAddr := h.rpcAddr
+	h.l.Unlock()
+	if rpcAddr != "" {
+		return h.rpcCommand(rpcAddr, req)
+	}
+	if req.internal {
+		// before its first heartbeat says it serves rpc, or a host too old to take it
+		if h.rpc == nil || h.flotilla == "" {
+			return nil, fmt.Errorf("Can't send %s to %s, no rpc to it", req.name, h.host)
+		}
+		return h.rpcCommand(h.flotilla, req)
+	}
+	cmd, args := req.passthru()
+	for {
+		p, err := h.pick(req.stream)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.Command(cmd, args)
+		if err == errPipelineFull {
+			// someone else on the conn took the room
+			continue
+		}
+		atomic.AddUint64(&h.stats.sent, 1)
+		if err != nil {
+			h.l.Lock()
+			h.failed(err)
+			h.l.Unlock()
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+func (h *hostConn) rpcCommand(addr string, req forwardReq) (forwardedReply, error) {
+	h.l.Lock()
+	if h.state != hostUp {
+		h.l.Unlock()
+		return nil, hostMarkedDown
+	}
+	r := h.rpcConn
+	h.l.Unlock()
+	if r == nil || r.Closed() {
+		fresh, err := h.dialRPC(addr)
+		h.l.Lock()
+		if err != nil {
+			h.failed(err)
+			h.l.Unlock()
+			return nil, err
+		}
+		if h.rpcConn == nil || h.rpcConn.Closed() {
+			h.rpcConn = fresh
+		} else {
+			// someone else dialed first
+			fresh.Close()
+		}
+		r = h.rpcConn
+		h.l.Unlock()
+	}
+	call, err := r.Command(req, h.c.ForwardTimeout())
+	atomic.AddUint64(&h.stats.sent, 1)
+	if err != nil {
+		h.l.Lock()
+		h.failed(err)
+		h.l.Unlock()
+		return nil, err
+	}
+	return call, nil
+}
+
+// stream's conn, dialing it if it isn't open and waiting for it to have room if it's full
+func (h *hostConn) pick(stream uint64) (*PassthruConn, error) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	i := int(stream % uint64(len(h.conns)))
+	waited := false
+	for {
+		if h.state != hostUp {
+			return nil, hostMarkedDown
+		}
+		p := h.conns[i]
+		if p != nil && p.Closed() {
+			h.conns[i] = nil
+			p = nil
+		}
+		if p == nil && !h.dialing[i] {
+			h.dialing[i] = true
+			h.l.Unlock()
+			p, err := h.dial()
+			h.l.Lock()
+			h.dialing[i] = false
+			h.room.Broadcast()
+			if err != nil {
+				h.failed(err)
+				return nil, err
+			}
+			h.conns[i] = p
+			return p, nil
+		}
+		if p != nil && p.InFlight() < passthruDepth {
+			return p, nil
+		}
+		if p != nil && !waited {
+			atomic.AddUint64(&h.stats.waits, 1)
+			waited = true
+		}
+		h.room.Wait()
+	}
+}
+
+// called by our conns as each reply's done
+func (h *hostConn) observe(took time.Duration, err error) {
+	atomic.AddUint64(&h.stats.replies, 1)
+	atomic.AddUint64(&h.stats.replyMicros, uint64(took/time.Microsecond))
+	if err != nil {
+		h.l.Lock()
+		h.failed(err)
+		h.l.Unlock()
+	}
+	h.room.Broadcast()
+}
+
+// marks the host down after a failure, assumes h.l is held
+func (h *hostConn) failed(err error) {
+	defer h.room.Broadcast()
+	atomic.AddUint64(&h.stats.errors, 1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		atomic.AddUint64(&h.stats.timeouts, 1)
+	}
+	if h.state == hostDown {
+		// a straggler from before it went down
+		return
+	}
+	h.failures++
+	backoff := h.c.ForwardBackoff(h.failures)
+	h.state = hostDown
+	h.downUntil = time.Now().Add(backoff)
+	atomic.AddUint64(&h.stats.timesDown, 1)
+	h.lg.Errorf("Marking %s down for %s after %d failures in a row : %s", h.host, backoff, h.failures, err)
+}
+
+// clears out conns that have closed and returns how many are open, assumes h.l is held
+func (h *hostConn) prune() int {
+	open := 0
+	if h.rpcConn != nil && h.rpcConn.Closed() {
+		h.rpcConn = nil
+	} else if h.rpcConn != nil {
+		open++
+	}
+	for i, p := range h.conns {
+		if p != nil && p.Closed() {
+			h.conns[i] = nil
+		} else if p != nil {
+			open++
+		}
+	}
+	return open
+}
+
+func (h *hostConn) String() string {
+	h.l.Lock()
+	transport := "redis port"
+	if h.rpcAddr != "" {
+		transport = "rpc to " + h.rpcAddr
+	}
+	state, conns, inFlight := h.state, 0, 0
+	if h.rpcConn != nil {
+		conns++
+		inFlight += h.rpcConn.InFlight()
+	}
+	for _, p := range h.conns {
+		if p != nil {
+			conns++
+			inFlight += p.InFlight()
+		}
+	}
+	h.l.Unlock()
+	replies := atomic.LoadUint64(&h.stats.replies)
+	avg := uint64(0)
+	if replies > 0 {
+		avg = atomic.LoadUint64(&h.stats.replyMicros) / replies
+	}
+	return fmt.Sprintf("forwarding to %s over %s: %s, %d conns, %d in flight, %d sent, %d replies, avg reply %dus, %d errors, %d timeouts, %d waited for room, down %d times",
+		h.host, transport, state, conns, inFlight, atomic.LoadUint64(&h.stats.sent), replies, avg,
+		atomic.LoadUint64(&h.stats.errors), atomic.LoadUint64(&h.stats.timeouts),
+		atomic.LoadUint64(&h.stats.waits), atomic.LoadUint64(&h.stats.timesDown))
+}
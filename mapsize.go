@@ -0,0 +1,126 @@
+package raftis
+
+import (
+	"fmt"
+	"github.com/jbooth/flotilla"
+	"github.com/jbooth/raftis/config"
+	log "github.com/jbooth/raftis/rlog"
+	"sync"
+	"time"
+)
+
+// grows this node's lmdb map before it fills.  a full map fails every write on the
+// shard, and a replica that fails where the leader succeeded has diverged, so we
+// warn once usage gets within mapWarnMargin of the grow threshold and double the map
+// when it crosses it.  map size is local to each node, nothing goes through raft.
+
+const (
+	mapCheckInterval = time.Second
+	mapResizeTimeout = 5 * time.Second // for open txns to drain
+	defaultMapGrowAt = 80
+	mapWarnMargin    = 10
+)
+
+type mapGrower struct {
+	l       *sync.Mutex
+	growAt  int    // percent, negative never grows
+	maxSize uint64 // 0 for no limit
+	info    flotilla.MapInfo
+	warning bool
+	grows   int
+	lastErr error
+	lg      *log.Logger
+}
+
+func newMapGrower(growAt int, maxSize uint64, lg *log.Logger) *mapGrower {
+	if growAt == 0 {
+		growAt = defaultMapGrowAt
+	}
+	return &mapGrower{&sync.Mutex{}, growAt, maxSize, flotilla.MapInfo{}, false, 0, nil, lg}
+}
+
+func (m *mapGrower) run(f flotilla.DB) {
+	ticker := time.NewTicker(mapCheckInterval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		err := m.check(f)
+		m.l.Lock()
+		m.lastErr = err
+		m.l.Unlock()
+		if err != nil {
+			m.lg.Errorf("Error checking map size : %s", err)
+		}
+	}
+}
+
+func (m *mapGrower) check(f flotilla.DB) error {
+	info, err := f.MapInfo()
+	if err != nil {
+		return err
+	}
+	pct := percentUsed(info)
+	threshold := m.growAt
+	if threshold < 0 {
+		// not growing, still warn before it's full
+		threshold = 100
+	}
+	warning := pct >= threshold-mapWarnMargin
+	m.l.Lock()
+	wasWarning := m.warning
+	m.info = info
+	m.warning = warning
+	m.l.Unlock()
+	if warning && !wasWarning {
+		m.lg.Errorf("WARNING lmdb map %d%% full, %d of %d bytes", pct, info.Used, info.Size)
+	}
+	if m.growAt < 0 || pct < m.growAt {
+		return nil
+	}
+	newSize := info.Size * 2
+	if m.maxSize > 0 && newSize > m.maxSize {
+		newSize = m.maxSize
+	}
+	if newSize <= info.Size {
+		return fmt.Errorf("lmdb map %d%% full and already at its max size of %d bytes", pct, m.maxSize)
+	}
+	m.lg.Printf("Growing lmdb map from %d to %d bytes, %d%% full", info.Size, newSize, pct)
+	err = f.GrowMap(newSize, mapResizeTimeout)
+	if err != nil {
+		return err
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.grows++
+	m.info.Size = newSize
+	m.warning = percentUsed(m.info) >= threshold-mapWarnMargin
+	return nil
+}
+
+func percentUsed(info flotilla.MapInfo) int {
+	if info.Size == 0 {
+		return 0
+	}
+	return int(info.Used * 100 / info.Size)
+}
+
+// adds map usage to a heartbeat
+func (m *mapGrower) fill(stats *config.StatsInterval) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	stats.MapUsed = m.info.Used
+	stats.MapSize = m.info.Size
+	stats.MapWarning = m.warning
+}
+
+func (m *mapGrower) String() string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	state := "ok"
+	if m.lastErr != nil {
+		state = "error: " + m.lastErr.Error()
+	} else if m.warning {
+		state = "WARNING filling up"
+	}
+	return fmt.Sprintf("map: %s, used %d of %d bytes (%d%%), grows at %d%%, max %d bytes, grown %d times",
+		state, m.info.Used, m.info.Size, percentUsed(m.info), m.growAt, m.maxSize, m.grows)
+}
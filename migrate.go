@@ -0,0 +1,513 @@
+package raftis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"github.com/jbooth/raftis/config"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	ops "github.com/jbooth/raftis/ops"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// moving a slot to another shard while both keep serving it, like redis cluster resharding.
+//  1. the target marks the slot IMPORTING and we mark it MIGRATING, each through its own raft.
+//  2. keys in the slot are dumped, restored on the target and deleted here in batches.
+//     a key is only deleted if it still dumps the same, keys written meanwhile go again next pass.
+//     passes repeat until we don't have any keys in the slot.
+//  3. the slot moves to the target in etcd's shards record with a compare and swap,
+//     every node is told to reread it, and once stale nodes have had a heartbeat to catch up
+//     both sides mark the slot stable.
+// while it's moving we serve the keys we still have and send the rest to the target,
+// with -ASK slot host for clients that take redirects and forwarded in ASKED otherwise.
+// the target only serves a slot it's importing for ASKED, or after ASKING like redis,
+// anything else for it still comes to us.
+
+const migratePasses = 100 // gives up if keys keep getting written faster than they're moved
+
+type slotMigration struct {
+	l         *sync.Mutex
+	running   bool
+	slot      uint32
+	target    int
+	startTime int64
+	copied    int
+	passes    int
+	err       error
+}
+
+func newSlotMigration() *slotMigration {
+	return &slotMigration{l: &sync.Mutex{}}
+}
+
+func init() {
+	// these refer back to route, so can't live in the literals
+	internalOps["ASKED"] = asked
+	serverOps["MIGRATESLOT"] = migrateSlot
+}
+
+// MIGRATESLOT slot shardId
+// moves slot from the shard that owns it to shardId in the background, progress shows up in STATS
+func migrateSlot(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 2 {
+		return redis.NewError("ERR wrong number of arguments for 'migrateslot' command")
+	}
+	slot, err := strconv.ParseUint(string(args[0]), 10, 32)
+	if err != nil {
+		return redis.NewError("ERR invalid slot " + string(args[0]))
+	}
+	target, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return redis.NewError("ERR invalid shard " + string(args[1]))
+	}
+	cfg := s.clusterConfig()
+	if uint32(slot) >= cfg.NumSlots {
+		return redis.NewError(fmt.Sprintf("ERR slot %d out of range, cluster has %d slots", slot, cfg.NumSlots))
+	}
+	var source config.Shard
+	found := false
+	for _, shard := range cfg.Shards {
+		for _, sl := range shard.Slots {
+			if sl == uint32(slot) {
+				source, found = shard, true
+			}
+		}
+	}
+	if !found {
+		return redis.NewError(fmt.Sprintf("ERR slot %d isn't assigned to a shard", slot))
+	}
+	if source.ShardId == target {
+		return redis.NewError(fmt.Sprintf("ERR slot %d is already on shard %d", slot, target))
+	}
+	targetHosts := s.cluster.ShardHosts(target)
+	if len(targetHosts) == 0 {
+		return redis.NewError(fmt.Sprintf("ERR no hosts for shard %d", target))
+	}
+	mine := false
+	for _, h := range source.Hosts {
+		if h.RedisAddr == cfg.Me.RedisAddr {
+			mine = true
+		}
+	}
+	if !mine {
+		// the source shard runs it
+		fwd, err := s.cluster.ForwardHosts(forwardStream(c), source.Hosts, "MIGRATESLOT", args)
+		if err != nil {
+			return redis.NewError(fmt.Sprintf("Error forwarding command: %s", err.Error()))
+		}
+		return fwd
+	}
+	m := s.migration
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.running {
+		return redis.NewError(fmt.Sprintf("ERR already migrating slot %d", m.slot))
+	}
+	m.running = true
+	m.slot = uint32(slot)
+	m.target = target
+	m.startTime = time.Now().Unix()
+	m.copied = 0
+	m.passes = 0
+	m.err = nil
+	go m.run(s, source.ShardId, targetHosts)
+	return &redis.StatusReply{Code: "Slot migration started"}
+}
+
+func (m *slotMigration) run(s *Server, source int, targetHosts []config.Host) {
+	err := s.migrate(m, source, targetHosts)
+	if err != nil {
+		s.lg.Errorf("Migrating slot %d to shard %d failed : %s", m.slot, m.target, err)
+	} else {
+		s.lg.Printf("Migrated slot %d to shard %d", m.slot, m.target)
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.running = false
+	m.err = err
+}
+
+func (m *slotMigration) progress(copied int, passes int) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.copied += copied
+	m.passes = passes
+}
+
+func (m *slotMigration) String() string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	state := "idle"
+	if m.running {
+		state = "running"
+	} else if m.err != nil {
+		state = "failed: " + m.err.Error()
+	} else if m.startTime != 0 {
+		state = "done"
+	}
+	return fmt.Sprintf("slot migration: %s, slot %d to shard %d, started %d, copied %d keys in %d passes",
+		state, m.slot, m.target, m.startTime, m.copied, m.passes)
+}
+
+func (s *Server) migrate(m *slotMigration, source int, targetHosts []config.Host) error {
+	slot, target := m.slot, m.target
+	// target first, so it takes what we send it once we're migrating
+	err := s.setSlotOn(targetHosts, slot, "IMPORTING", source)
+	if err != nil {
+		return err
+	}
+	err = s.setSlot(slot, "MIGRATING", target)
+	if err != nil {
+		return err
+	}
+	for pass := 1; ; pass++ {
+		if pass > migratePasses {
+			return fmt.Errorf("slot %d still has keys after %d passes, try again when it's quieter", slot, migratePasses)
+		}
+		found, err := s.migratePass(m, pass, targetHosts)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			break
+		}
+	}
+	err = s.flipSlot(slot, source, target)
+	if err != nil {
+		return err
+	}
+	s.cluster.Broadcast("REFRESHSHARDS", emptyArgs)
+	err = s.refreshShards()
+	if err != nil {
+		return err
+	}
+	// nodes that missed the broadcast still send us the slot until their next heartbeat,
+	// MIGRATING sends it on with ASKED so the target takes it without knowing it owns it yet
+	time.Sleep(2 * heartbeatInterval)
+	err = s.setSlotOn(targetHosts, slot, "STABLE", source)
+	if err != nil {
+		return err
+	}
+	return s.setSlot(slot, "STABLE", target)
+}
+
+// sets slot's state on our shard through raft
+func (s *Server) setSlot(slot uint32, state string, shard int) error {
+	resp := <-s.flotilla.Command("SETSLOT", slotArgs(slot, state, shard))
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if string(resp.Response) != "+OK\r\n" {
+		return fmt.Errorf("SETSLOT failed : %s", strings.TrimSpace(string(resp.Response)))
+	}
+	return nil
+}
+
+// sets slot's state on the shard hosts belong to
+func (s *Server) setSlotOn(hosts []config.Host, slot uint32, state string, shard int) error {
+	reply, err := s.cluster.CommandHosts(hosts, "SETSLOTLOCAL", slotArgs(slot, state, shard))
+	if err != nil {
+		return err
+	}
+	if string(reply) != "+OK\r\n" {
+		return fmt.Errorf("SETSLOTLOCAL failed : %s", strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+func slotArgs(slot uint32, state string, shard int) [][]byte {
+	return [][]byte{[]byte(strconv.Itoa(int(slot))), []byte(state), []byte(strconv.Itoa(shard))}
+}
+
+// copies every key we have in the slot to the target and deletes the ones that didn't change
+// meanwhile, returns how many keys were found
+func (s *Server) migratePass(m *slotMigration, pass int, targetHosts []config.Host) (int, error) {
+	cfg := s.clusterConfig()
+	found := 0
+	for db := 0; db < dbwrap.NumDBs; db++ {
+		var from []byte
+		for {
+			batches, next, err := s.dumpForeignKeys(db, from, func(key []byte) int {
+				if config.KeySlot(cfg.SlotHash, cfg.NumSlots, key) == m.slot {
+					return 0
+				}
+				return -1
+			})
+			if err != nil {
+				return found, err
+			}
+			if batch := batches[0]; len(batch) > 0 {
+				err = s.moveKeys(db, batch, targetHosts)
+				if err != nil {
+					return found, err
+				}
+				found += len(batch) / 2
+				m.progress(len(batch)/2, pass)
+			}
+			if next == nil {
+				break
+			}
+			from = next
+		}
+	}
+	m.progress(0, pass)
+	return found, nil
+}
+
+// restores key, dump pairs on the target then deletes them here if they haven't changed
+func (s *Server) moveKeys(db int, batch [][]byte, targetHosts []config.Host) error {
+	dbArg := []byte(strconv.Itoa(db))
+	reply, err := s.cluster.CommandHosts(targetHosts, "RESTORELOCAL", append([][]byte{dbArg}, batch...))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 || reply[0] != ':' {
+		return fmt.Errorf("RESTORELOCAL failed : %s", strings.TrimSpace(string(reply)))
+	}
+	sums := make(map[string][]byte)
+	delArgs := make([][]byte, 0, len(batch))
+	for i := 0; i < len(batch); i += 2 {
+		sum := ops.DumpSum(batch[i+1])
+		sums[string(batch[i])] = sum
+		delArgs = append(delArgs, batch[i], sum)
+	}
+	resp := <-s.command(db, "MIGRATEDEL", delArgs)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	gone, err := parseBulkArray(resp.Response)
+	if err != nil {
+		return fmt.Errorf("MIGRATEDEL failed : %s", strings.TrimSpace(string(resp.Response)))
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+	// deleted here after we dumped them, the copies on the target go too unless they've
+	// been written there since
+	goneArgs := [][]byte{dbArg}
+	for _, key := range gone {
+		goneArgs = append(goneArgs, key, sums[string(key)])
+	}
+	reply, err = s.cluster.CommandHosts(targetHosts, "MIGRATEDELLOCAL", goneArgs)
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 || reply[0] != '*' {
+		return fmt.Errorf("MIGRATEDEL on target failed : %s", strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// moves slot from source to target in etcd's shards record, fails if it changed since we read it
+func (s *Server) flipSlot(slot uint32, source int, target int) error {
+	etcdBase := s.clusterConfig().EtcdBase
+	confResp, err := s.etcdC.Get(etcdBase+"/shards", false, false)
+	if err != nil {
+		return err
+	}
+	var shards []config.Shard
+	err = json.Unmarshal([]byte(confResp.Node.Value), &shards)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling shards from etcd!  resp: %s", confResp.Node.Value)
+	}
+	removed, added := false, false
+	for i, shard := range shards {
+		if shard.ShardId == source {
+			slots := make([]uint32, 0, len(shard.Slots))
+			for _, sl := range shard.Slots {
+				if sl == slot {
+					removed = true
+				} else {
+					slots = append(slots, sl)
+				}
+			}
+			shards[i].Slots = slots
+		} else if shard.ShardId == target {
+			shards[i].Slots = append(shard.Slots, slot)
+			added = true
+		}
+	}
+	if !removed || !added {
+		return fmt.Errorf("slot %d isn't on shard %d or shard %d is gone in etcd", slot, source, target)
+	}
+	newShards, err := json.Marshal(shards)
+	if err != nil {
+		return err
+	}
+	_, err = s.etcdC.CompareAndSwap(etcdBase+"/shards", string(newShards), 0, confResp.Node.Value, confResp.Node.ModifiedIndex)
+	return err
+}
+
+// elements of an array of bulk strings, like MIGRATEDEL's reply
+func parseBulkArray(reply []byte) ([][]byte, error) {
+	r := bufio.NewReader(bytes.NewReader(reply))
+	line, err := r.ReadString('\n')
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("Expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil || line[0] != '$' {
+			return nil, fmt.Errorf("Expected a bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			ret = append(ret, nil)
+			continue
+		}
+		val := make([]byte, size+2)
+		if _, err = io.ReadFull(r, val); err != nil {
+			return nil, err
+		}
+		ret = append(ret, val[:size])
+	}
+	return ret, nil
+}
+
+// where a command for a key in a slot that's moving goes.  returns a redirect or forward if it
+// should be served by the other shard, otherwise whether to serve it here.
+func (s *Server) migrating(c *Conn, db int, name string, args [][]byte, hasKey bool) (io.WriterTo, bool) {
+	asking := c != nil && c.asking
+	if c != nil {
+		c.asking = false
+	}
+	if len(args) == 0 {
+		return nil, hasKey
+	}
+	slot := s.cluster.Slot(name, args)
+	st := dbwrap.GetSlotState(slot)
+	switch {
+	case st.State == dbwrap.SLOT_MIGRATING && hasKey:
+		// keys we haven't moved yet are still ours
+		exists, err := s.hasLocalKey(db, commandKey(name, args))
+		if err != nil {
+			return redis.NewError(err.Error()), false
+		}
+		if !exists {
+			return s.ask(c, db, slot, st.Shard, name, args), false
+		}
+	case st.State == dbwrap.SLOT_MIGRATING:
+		// moved off already, the target may not know it owns it yet
+		return s.ask(c, db, slot, st.Shard, name, args), false
+	case st.State == dbwrap.SLOT_IMPORTING && asking:
+		return nil, true
+	}
+	return nil, hasKey
+}
+
+// sends a command on to the shard a slot is moving to or from, -ASK for clients that take redirects
+func (s *Server) ask(c *Conn, db int, slot uint32, shard int, name string, args [][]byte) io.WriterTo {
+	hosts := s.cluster.ShardHosts(shard)
+	if len(hosts) == 0 {
+		return redis.NewError(fmt.Sprintf("No hosts for shard %d", shard))
+	}
+	if s.redirects(c, db) {
+		s.cluster.l.RLock()
+		host := s.cluster.nearest(hosts)
+		s.cluster.l.RUnlock()
+		s.stats.incrNumRedirects()
+		return &redis.ErrorReply{Code: "ASK", Message: fmt.Sprintf("%d %s", slot, host.RedisAddr)}
+	}
+	s.stats.incrNumForwards()
+	fwd, err := s.cluster.ForwardHosts(forwardStream(c), hosts, "ASKED", append([][]byte{[]byte(strconv.Itoa(db)), []byte(name)}, args...))
+	if err != nil {
+		return redis.NewError(fmt.Sprintf("Error forwarding command: %s", err.Error()))
+	}
+	return fwd
+}
+
+// picks up slot states from the meta table at startup, after that they change as SETSLOT applies
+func (s *Server) loadSlotStates() error {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return err
+	}
+	defer txn.Abort()
+	return dbwrap.LoadSlotStates(dbwrap.NewTxn(txn))
+}
+
+func (s *Server) hasLocalKey(db int, key []byte) (bool, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return false, err
+	}
+	defer txn.Abort()
+	_, _, _, err = dbwrap.GetRawValue(dbwrap.NewTxnInDB(txn, db), key)
+	if err == mdb.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ASKED db command [args ...]
+// a command the other side of a slot migration sent on, served here if we're importing the slot
+func asked(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) < 3 {
+		return redis.NewError("ERR wrong number of arguments for 'asked' command")
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	name := strings.ToUpper(string(args[1]))
+	if dbwrap.GetSlotState(s.cluster.Slot(name, args[2:])).State == dbwrap.SLOT_IMPORTING {
+		return s.serve(c, db, name, args[2:])
+	}
+	return s.route(c, db, name, args[2:])
+}
+
+// ASKING
+// the next command is for a slot we're importing, redis cluster clients send it before
+// following -ASK
+func asking(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 0 {
+		return redis.NewError("ERR wrong number of arguments for 'asking' command")
+	}
+	c.asking = true
+	return &redis.StatusReply{Code: "OK"}
+}
+
+// SETSLOTLOCAL slot MIGRATING|IMPORTING|STABLE shard
+// sets slot's state on our shard, sent by the shard running the migration
+func setSlotLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	return pendingWrite{s.flotilla.Command("SETSLOT", args)}
+}
+
+// MIGRATEDELLOCAL db key sum [key sum ...]
+// deletes the copies of keys the shard running a migration deleted after dumping them,
+// sent to the target
+func migrateDelLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'migratedellocal' command")
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return pendingWrite{s.command(db, "MIGRATEDEL", args[1:])}
+}
+
+// REFRESHSHARDS
+// rereads the shards record from etcd now instead of at the next heartbeat
+func refreshShardsCmd(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	err := s.refreshShards()
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return &redis.StatusReply{Code: "OK"}
+}
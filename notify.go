@@ -0,0 +1,170 @@
+package raftis
+
+import (
+	"fmt"
+	"github.com/jbooth/flotilla"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	log "github.com/jbooth/raftis/rlog"
+	"strings"
+	"sync"
+)
+
+// parsed form of a notify-keyspace-events string like "KEA" or "Kx"
+type notifyFlags struct {
+	keyspace bool          // K, publish to __keyspace@<db>__:<key>
+	keyevent bool          // E, publish to __keyevent@<db>__:<event>
+	classes  map[byte]bool // which dbwrap.EVENT_ classes to publish
+}
+
+func (f notifyFlags) enabled() bool {
+	return (f.keyspace || f.keyevent) && len(f.classes) > 0
+}
+
+func parseNotifyFlags(flags string) (notifyFlags, error) {
+	ret := notifyFlags{false, false, make(map[byte]bool)}
+	for i := 0; i < len(flags); i++ {
+		switch flags[i] {
+		case 'K':
+			ret.keyspace = true
+		case 'E':
+			ret.keyevent = true
+		case 'A':
+			for _, c := range []byte("g$lshzxe") {
+				ret.classes[c] = true
+			}
+		case 'g', '$', 'l', 's', 'h', 'z', 'x', 'e':
+			ret.classes[flags[i]] = true
+		default:
+			return ret, fmt.Errorf("Invalid notify-keyspace-events flag '%c' in %s", flags[i], flags)
+		}
+	}
+	return ret, nil
+}
+
+func (f notifyFlags) String() string {
+	ret := ""
+	if f.keyspace {
+		ret += "K"
+	}
+	if f.keyevent {
+		ret += "E"
+	}
+	for _, c := range []byte("g$lshzxe") {
+		if f.classes[c] {
+			ret += string(c)
+		}
+	}
+	return ret
+}
+
+// publishes keyspace notifications for write ops once they've committed.
+// every replica applies every command for its shard, so each node publishes events to its own
+// subscribers from its own apply, and only the node that proposed the entry as leader forwards
+// them to nodes in other shards.  that's decided by the log entry rather than who leads when it's
+// published, so it holds across an election.  each subscriber hears about an event at most once,
+// from the node it's connected to.  other shards miss it if the proposer dies before applying it,
+// and anyone misses it if the queue below is full.
+type keyspaceNotifier struct {
+	l       *sync.RWMutex
+	flags   notifyFlags
+	pending chan pendingEvents
+	lg      *log.Logger
+}
+
+// events from one write op, and whether we proposed it so should tell the other shards
+type pendingEvents struct {
+	events    []dbwrap.KeyEvent
+	broadcast bool
+}
+
+func newKeyspaceNotifier(flags string, lg *log.Logger) (*keyspaceNotifier, error) {
+	parsed, err := parseNotifyFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	return &keyspaceNotifier{
+		&sync.RWMutex{},
+		parsed,
+		make(chan pendingEvents, 1024),
+		lg,
+	}, nil
+}
+
+func (k *keyspaceNotifier) getFlags() notifyFlags {
+	k.l.RLock()
+	defer k.l.RUnlock()
+	return k.flags
+}
+
+func (k *keyspaceNotifier) setFlags(flags string) error {
+	parsed, err := parseNotifyFlags(flags)
+	if err != nil {
+		return err
+	}
+	k.l.Lock()
+	defer k.l.Unlock()
+	k.flags = parsed
+	return nil
+}
+
+// wraps each write op so events it raises get queued for publishing after a successful commit
+func (k *keyspaceNotifier) wrapOps(ops map[string]writeOp) map[string]writeOp {
+	ret := make(map[string]writeOp)
+	for name, op := range ops {
+		ret[name] = k.wrap(op)
+	}
+	return ret
+}
+
+func (k *keyspaceNotifier) wrap(op writeOp) writeOp {
+	return func(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+		if !k.getFlags().enabled() || flotilla.Replaying(txn.Txn) {
+			// replays after a restart were notified the first time round
+			return op(args, txn)
+		}
+		dbwrap.CollectEvents(txn)
+		resp, err := op(args, txn)
+		events := dbwrap.TakeEvents(txn)
+		if err == nil && len(events) > 0 {
+			// never block the apply loop on slow subscribers
+			select {
+			case k.pending <- pendingEvents{events, flotilla.ProposedHere(txn.Txn)}:
+			default:
+				k.lg.Errorf("Keyspace notification queue full, dropping %d events", len(events))
+			}
+		}
+		return resp, err
+	}
+}
+
+// publishes queued events, runs for the life of the server
+func (k *keyspaceNotifier) serve(s *Server) {
+	for p := range k.pending {
+		flags := k.getFlags()
+		for _, e := range p.events {
+			if !flags.classes[e.Class] {
+				continue
+			}
+			if flags.keyspace {
+				channel := append([]byte(fmt.Sprintf("__keyspace@%d__:", e.DB)), e.Key...)
+				k.deliver(s, channel, []byte(e.Event), p.broadcast)
+			}
+			if flags.keyevent {
+				channel := []byte(fmt.Sprintf("__keyevent@%d__:%s", e.DB, e.Event))
+				k.deliver(s, channel, e.Key, p.broadcast)
+			}
+		}
+	}
+}
+
+func (k *keyspaceNotifier) deliver(s *Server, channel []byte, message []byte, broadcast bool) {
+	s.pubsub.publish(channel, message)
+	if broadcast {
+		s.cluster.BroadcastOtherShards("PUBLISHLOCAL", [][]byte{channel, message})
+	}
+}
+
+// CONFIG GET/SET notify-keyspace-events
+func isNotifyConfig(name []byte) bool {
+	return strings.ToLower(string(name)) == "notify-keyspace-events"
+}
@@ -0,0 +1,50 @@
+package ops
+
+import (
+	"bytes"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"testing"
+)
+
+func rawValue(t *testing.T, env *mdb.Env, key string) []byte {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	_, val, err := dbwrap.GetBytes(dbwrap.NewTxn(txn), []byte(key), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	// same members, different insertion order, same bytes
+	doWrite(t, env, SADD, "set1", "c", "a")
+	doWrite(t, env, SADD, "set1", "b")
+	doWrite(t, env, SADD, "set2", "b", "c", "a")
+	if !bytes.Equal(rawValue(t, env, "set1"), rawValue(t, env, "set2")) {
+		t.Fatalf("Sets with the same members encoded differently")
+	}
+	expected := "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"
+	if resp := doRead(t, env, SMEMBERS, "set1"); resp != expected {
+		t.Fatalf("Expecting sorted members %q, got %q", expected, resp)
+	}
+
+	doWrite(t, env, HMSET, "hash1", "z", "1", "x", "2")
+	doWrite(t, env, HSET, "hash1", "y", "3")
+	doWrite(t, env, HMSET, "hash2", "y", "3", "z", "1", "x", "2")
+	if !bytes.Equal(rawValue(t, env, "hash1"), rawValue(t, env, "hash2")) {
+		t.Fatalf("Hashes with the same fields encoded differently")
+	}
+	doWrite(t, env, HDEL, "hash1", "y")
+	doWrite(t, env, HMSET, "hash3", "x", "2", "z", "1")
+	if !bytes.Equal(rawValue(t, env, "hash1"), rawValue(t, env, "hash3")) {
+		t.Fatalf("Hashes with the same fields encoded differently after HDEL")
+	}
+}
@@ -0,0 +1,41 @@
+package ops
+
+import (
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"strings"
+	"testing"
+)
+
+func TestCompressedValues(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+	defer dbwrap.SetCompressThreshold(dbwrap.CompressThreshold())
+	dbwrap.SetCompressThreshold(64)
+
+	big := strings.Repeat("abcdefgh", 100)
+	doWrite(t, env, SET, "big", big)
+	doWrite(t, env, SET, "small", "tiny")
+
+	raw := rawValue(t, env, "big")
+	if raw[4]&dbwrap.COMPRESSED == 0 {
+		t.Fatalf("Expecting big value to be stored compressed")
+	}
+	if len(raw) >= len(big) {
+		t.Fatalf("Compressed value is %d bytes, original %d", len(raw), len(big))
+	}
+	if rawValue(t, env, "small")[4]&dbwrap.COMPRESSED != 0 {
+		t.Fatalf("Expecting small value to be stored uncompressed")
+	}
+	if resp := doRead(t, env, GET, "big"); resp != "$800\r\n"+big+"\r\n" {
+		t.Fatalf("Expecting original value back, got %q", resp)
+	}
+	if resp := doRead(t, env, GET, "small"); resp != "$4\r\ntiny\r\n" {
+		t.Fatalf("Expecting tiny, got %q", resp)
+	}
+
+	// still readable with compression turned off
+	dbwrap.SetCompressThreshold(0)
+	if resp := doRead(t, env, GET, "big"); resp != "$800\r\n"+big+"\r\n" {
+		t.Fatalf("Expecting original value back with compression off, got %q", resp)
+	}
+}
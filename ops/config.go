@@ -0,0 +1,20 @@
+package ops
+
+import (
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"strings"
+)
+
+// args: name value
+// records a CONFIG SET every replica runs with, the server checks it before proposing
+func CONFIGPUT(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 2, "configput"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err := dbwrap.PutSetting(txn, strings.ToLower(string(args[0])), args[1])
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
@@ -0,0 +1,44 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"testing"
+)
+
+func settings(t *testing.T, env *mdb.Env) map[string][]byte {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	ret, err := dbwrap.GetSettings(dbwrap.NewTxn(txn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestConfigPut(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	if len(settings(t, env)) != 0 {
+		t.Fatalf("Expecting no settings to start with, got %+v", settings(t, env))
+	}
+	if resp := doWrite(t, env, CONFIGPUT, "Notify-Keyspace-Events", "KEA"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from CONFIGPUT, got %q", resp)
+	}
+	doWrite(t, env, CONFIGPUT, "maxmemory", "100")
+	doWrite(t, env, CONFIGPUT, "maxmemory", "200")
+	// keys and other meta entries aren't settings
+	doWrite(t, env, SET, "setting:foo", "bar")
+	doWrite(t, env, TENANTPUT, `{"name":"a","prefix":"a:"}`)
+	got := settings(t, env)
+	if len(got) != 2 || string(got["notify-keyspace-events"]) != "KEA" || string(got["maxmemory"]) != "200" {
+		t.Fatalf("Expecting notify-keyspace-events KEA and maxmemory 200, got %+v", got)
+	}
+	if resp := doWrite(t, env, CONFIGPUT, "maxmemory"); resp == "+OK\r\n" {
+		t.Fatalf("Expecting CONFIGPUT to want a value")
+	}
+}
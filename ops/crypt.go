@@ -0,0 +1,29 @@
+package ops
+
+import (
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"strconv"
+)
+
+// args: keyId
+// seals new values with keyId from now on, every replica has to have it in its key file.
+// existing values move over as REWRITEVALUES gets to them.
+// applies the same everywhere, a replica missing the key just complains.
+func USEKEY(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 1, "usekey"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	id, err := strconv.ParseUint(string(args[0]), 10, 32)
+	if err != nil || id == 0 {
+		return redis.WrapStatus("ERR invalid key id " + string(args[0])), nil
+	}
+	err = dbwrap.UseKey(txn, uint32(id))
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	if err = dbwrap.CheckKey(uint32(id)); err != nil {
+		errorf("Switched to key %d but can't seal with it, writes will fail until the key file has it : %s", id, err)
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
@@ -0,0 +1,285 @@
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func writeKeyFile(t *testing.T, path string, contents string) {
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// members and values of key's entries in the elements table, as stored
+func elementEntries(t *testing.T, env *mdb.Env, key string) ([][]byte, [][]byte) {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	edbi, err := dbwrap.GetElementsDBI(dbwrap.NewTxn(txn), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := txn.CursorOpen(edbi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	members := make([][]byte, 0)
+	vals := make([][]byte, 0)
+	err = dbwrap.ForEachElement(c, []byte(key), func(member, val []byte) error {
+		members = append(members, append([]byte(nil), member...))
+		vals = append(vals, append([]byte(nil), val...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return members, vals
+}
+
+func TestEncryptedValues(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+	keyFile := "/tmp/raftisElementsTest/keys.json"
+	writeKeyFile(t, keyFile, fmt.Sprintf(`{"current": 1, "keys": {"1": "%s"}}`, testKey1))
+	keys, err := dbwrap.LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbwrap.SetKeyring(keys)
+	defer dbwrap.SetKeyring(nil)
+
+	doWrite(t, env, SET, "secret", "hunter2")
+	raw := rawValue(t, env, "secret")
+	if raw[4]&dbwrap.ENCRYPTED == 0 || dbwrap.KeyID(raw) != 1 {
+		t.Fatalf("Expecting value sealed with key 1, got header %x", raw[:10])
+	}
+	if bytes.Contains(raw, []byte("hunter2")) {
+		t.Fatalf("Plaintext found in stored value")
+	}
+	if resp := doRead(t, env, GET, "secret"); resp != "$7\r\nhunter2\r\n" {
+		t.Fatalf("Expecting hunter2, got %q", resp)
+	}
+
+	// same value, same bytes, so replicas stay identical
+	doWrite(t, env, SET, "secret2", "hunter2")
+	if !bytes.Equal(raw, rawValue(t, env, "secret2")) {
+		t.Fatalf("Same value sealed differently")
+	}
+
+	// large hash, values live in the elements table
+	args := []string{"bighash"}
+	for i := 0; i < dbwrap.ElementThreshold+10; i++ {
+		args = append(args, fmt.Sprintf("f%d", i), fmt.Sprintf("hidden%d", i))
+	}
+	doWrite(t, env, HMSET, args...)
+	members, vals := elementEntries(t, env, "bighash")
+	for i, val := range vals {
+		if bytes.Contains(val, []byte("hidden")) {
+			t.Fatalf("Plaintext found in element value")
+		}
+		if len(members[i]) != 32 {
+			t.Fatalf("Expecting HMAC of field in element key, got %q", members[i])
+		}
+	}
+	if resp := doRead(t, env, HGET, "bighash", "f7"); resp != "$7\r\nhidden7\r\n" {
+		t.Fatalf("Expecting hidden7, got %q", resp)
+	}
+
+	// large set, members are sealed in the value and come back in order
+	args = []string{"bigset"}
+	for i := 0; i < dbwrap.ElementThreshold+10; i++ {
+		args = append(args, fmt.Sprintf("member%04d", i))
+	}
+	doWrite(t, env, SADD, args...)
+	members, vals = elementEntries(t, env, "bigset")
+	for i, member := range members {
+		if bytes.Contains(member, []byte("member")) || bytes.Contains(vals[i], []byte("member")) {
+			t.Fatalf("Plaintext found in set element")
+		}
+	}
+	if resp := doWrite(t, env, SADD, "bigset", "member0007"); resp != intReply(0) {
+		t.Fatalf("Expecting member0007 to already be there, got %q", resp)
+	}
+	expected, err := redis.ReplyToString(&redis.ArrayReply{toArgs(args[1:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := doRead(t, env, SMEMBERS, "bigset"); resp != expected {
+		t.Fatalf("Expecting members in order, got %q", resp)
+	}
+
+	// rotate to key 2, old values stay readable until rewritten
+	writeKeyFile(t, keyFile, fmt.Sprintf(`{"current": 1, "keys": {"1": "%s", "2": "%s"}}`, testKey1, testKey2))
+	if err := dbwrap.CheckKey(3); err == nil || !strings.Contains(err.Error(), "No key with id 3") {
+		t.Fatalf("Expecting missing key error, got %v", err)
+	}
+	// the switch only happens if the txn commits
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbwrap.UseKey(dbwrap.NewTxn(txn), 2)
+	txn.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbwrap.CurrentKeyID() != 1 {
+		t.Fatalf("Expecting key 1 after an aborted USEKEY, got %d", dbwrap.CurrentKeyID())
+	}
+	// a missing key still applies, writes fail with an error reply until it shows up
+	if resp := doWrite(t, env, USEKEY, "3"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from USEKEY with a missing key, got %q", resp)
+	}
+	if resp := doWrite(t, env, SET, "secret3", "hunter3"); !strings.Contains(resp, "No key with id 3") {
+		t.Fatalf("Expecting missing key error from SET, got %q", resp)
+	}
+	if resp := doWrite(t, env, USEKEY, "2"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from USEKEY, got %q", resp)
+	}
+	if !dbwrap.NeedsRewrite(rawValue(t, env, "secret")) {
+		t.Fatalf("Expecting value under key 1 to need a rewrite")
+	}
+	if resp := doRead(t, env, GET, "secret"); resp != "$7\r\nhunter2\r\n" {
+		t.Fatalf("Expecting hunter2 under old key, got %q", resp)
+	}
+	if resp := doWrite(t, env, REWRITEVALUES, "secret", "bighash", "bigset"); resp != intReply(3) {
+		t.Fatalf("Expecting 3 values rewritten, got %q", resp)
+	}
+	if id := dbwrap.KeyID(rawValue(t, env, "secret")); id != 2 {
+		t.Fatalf("Expecting key 2 after rewrite, got %d", id)
+	}
+	if id := dbwrap.KeyID(rawValue(t, env, "bighash")); id != 2 {
+		t.Fatalf("Expecting key 2 on hash after rewrite, got %d", id)
+	}
+	_, vals = elementEntries(t, env, "bighash")
+	for _, val := range vals {
+		if len(val) < 4 || val[3] != 2 {
+			t.Fatalf("Expecting element resealed with key 2, got %x", val)
+		}
+	}
+	if resp := doRead(t, env, HGET, "bighash", "f7"); resp != "$7\r\nhidden7\r\n" {
+		t.Fatalf("Expecting hidden7 after rotation, got %q", resp)
+	}
+	// members get new element keys under the new key, the old ones are gone
+	if n := numElements(t, env, "bigset"); n != dbwrap.ElementThreshold+10 {
+		t.Fatalf("Expecting %d set elements after rotation, got %d", dbwrap.ElementThreshold+10, n)
+	}
+	if resp := doRead(t, env, SMEMBERS, "bigset"); resp != expected {
+		t.Fatalf("Expecting members in order after rotation, got %q", resp)
+	}
+
+	// the choice of key survives a restart
+	writeKeyFile(t, keyFile, fmt.Sprintf(`{"current": 1, "keys": {"1": "%s", "2": "%s"}}`, testKey1, testKey2))
+	keys, err = dbwrap.LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbwrap.SetKeyring(keys)
+	txn, err = env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbwrap.LoadCurrentKey(dbwrap.NewTxn(txn))
+	txn.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbwrap.CurrentKeyID() != 2 {
+		t.Fatalf("Expecting key 2 after reload, got %d", dbwrap.CurrentKeyID())
+	}
+}
+
+func TestEncryptedSnapshotStream(t *testing.T) {
+	keyFile := os.TempDir() + "/raftisSnapshotKeys.json"
+	writeKeyFile(t, keyFile, fmt.Sprintf(`{"current": 1, "keys": {"1": "%s"}}`, testKey1))
+	defer os.Remove(keyFile)
+	keys, err := dbwrap.LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a few chunks' worth with a partial one on the end
+	data := bytes.Repeat([]byte("snapshot data "), 20000)
+	var sealed bytes.Buffer
+	w, err := keys.WrapWriter(&sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Bytes(), []byte("snapshot data")) {
+		t.Fatalf("Plaintext found in sealed snapshot")
+	}
+	r, err := keys.WrapReader(bytes.NewReader(sealed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, opened) {
+		t.Fatalf("Snapshot didn't round trip, got %d bytes expected %d", len(opened), len(data))
+	}
+
+	// cut off after the first chunk
+	r, err = keys.WrapReader(bytes.NewReader(sealed.Bytes()[:16+4+64*1024+16]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err == nil {
+		t.Fatalf("Expecting error reading truncated snapshot")
+	}
+}
+
+func TestSealedLogCommands(t *testing.T) {
+	keyFile := os.TempDir() + "/raftisCommandKeys.json"
+	writeKeyFile(t, keyFile, fmt.Sprintf(`{"current": 1, "keys": {"1": "%s"}}`, testKey1))
+	defer os.Remove(keyFile)
+	keys, err := dbwrap.LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := []byte("SET secret hunter2")
+	sealed, err := keys.Seal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("hunter2")) {
+		t.Fatalf("Plaintext found in sealed command")
+	}
+	opened, err := keys.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cmd, opened) {
+		t.Fatalf("Command didn't round trip, got %q", opened)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err = keys.Open(sealed); err == nil {
+		t.Fatalf("Expecting error opening a tampered command")
+	}
+}
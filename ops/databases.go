@@ -0,0 +1,68 @@
+package ops
+
+import (
+	"errors"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"strconv"
+)
+
+func parseDB(arg []byte) (int, error) {
+	db, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, errors.New("ERR invalid DB index")
+	}
+	return db, dbwrap.ValidDB(db)
+}
+
+// args: db
+// empties one logical db on this shard
+func FLUSHDB(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 1, "flushdb"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err = dbwrap.FlushDB(txn, db)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
+
+// args: none
+// empties every logical db on this shard
+func FLUSHALL(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 0, "flushall"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	for db := 0; db < dbwrap.NumDBs; db++ {
+		err := dbwrap.FlushDB(txn, db)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
+
+// args: db1 db2
+func SWAPDB(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 2, "swapdb"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	a, err := parseDB(args[0])
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	b, err := parseDB(args[1])
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err = dbwrap.SwapDB(txn, a, b)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
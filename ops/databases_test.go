@@ -0,0 +1,91 @@
+package ops
+
+import (
+	"bytes"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"io"
+	"testing"
+)
+
+// like doWrite and doRead, against a logical db
+func doWriteIn(t *testing.T, env *mdb.Env, db int, op func([][]byte, *dbwrap.Txn) ([]byte, error), args ...string) string {
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	resp, err := op(toArgs(args), dbwrap.NewTxnInDB(txn, db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp)
+}
+
+func doReadIn(t *testing.T, env *mdb.Env, db int, op func([][]byte, *dbwrap.Txn, io.Writer) (int64, error), args ...string) string {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	var b bytes.Buffer
+	_, err = op(toArgs(args), dbwrap.NewTxnInDB(txn, db), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestLogicalDBs(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	doWrite(t, env, SET, "k", "in0")
+	doWriteIn(t, env, 3, SET, "k", "in3")
+	doWriteIn(t, env, 3, SET, "k2", "also3")
+	if resp := doRead(t, env, GET, "k"); resp != "$3\r\nin0\r\n" {
+		t.Fatalf("Expecting in0 from db 0, got %q", resp)
+	}
+	if resp := doReadIn(t, env, 3, GET, "k"); resp != "$3\r\nin3\r\n" {
+		t.Fatalf("Expecting in3 from db 3, got %q", resp)
+	}
+	if resp := doReadIn(t, env, 0, DBSIZE); resp != intReply(1) {
+		t.Fatalf("Expecting 1 key in db 0, got %q", resp)
+	}
+	if resp := doReadIn(t, env, 3, DBSIZE); resp != intReply(2) {
+		t.Fatalf("Expecting 2 keys in db 3, got %q", resp)
+	}
+	if resp := doReadIn(t, env, 5, DBSIZE); resp != intReply(0) {
+		t.Fatalf("Expecting empty db 5, got %q", resp)
+	}
+
+	if resp := doWrite(t, env, SWAPDB, "0", "3"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from SWAPDB, got %q", resp)
+	}
+	if resp := doRead(t, env, GET, "k"); resp != "$3\r\nin3\r\n" {
+		t.Fatalf("Expecting in3 in db 0 after swap, got %q", resp)
+	}
+	if resp := doReadIn(t, env, 3, GET, "k"); resp != "$3\r\nin0\r\n" {
+		t.Fatalf("Expecting in0 in db 3 after swap, got %q", resp)
+	}
+
+	if resp := doWrite(t, env, FLUSHDB, "0"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from FLUSHDB, got %q", resp)
+	}
+	if resp := doRead(t, env, GET, "k"); resp != "$-1\r\n" {
+		t.Fatalf("Expecting k gone from flushed db, got %q", resp)
+	}
+	if resp := doReadIn(t, env, 3, GET, "k"); resp != "$3\r\nin0\r\n" {
+		t.Fatalf("Expecting db 3 untouched by FLUSHDB 0, got %q", resp)
+	}
+
+	if resp := doWrite(t, env, FLUSHDB, "16"); resp == "+OK\r\n" {
+		t.Fatalf("Expecting out of range db to fail")
+	}
+	if resp := doWrite(t, env, FLUSHALL); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from FLUSHALL, got %q", resp)
+	}
+	if resp := doReadIn(t, env, 3, DBSIZE); resp != intReply(0) {
+		t.Fatalf("Expecting db 3 empty after FLUSHALL, got %q", resp)
+	}
+}
@@ -0,0 +1,81 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// args: key
+// key's value as a payload RESTORE takes, it carries the key's expiration
+func DUMP(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
+	if err := checkExactArgs(args, 1, "dump"); err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
+	}
+
+	debugf("DUMP %s", args[0])
+
+	dump, err := dbwrap.DumpValue(txn, args[0])
+	if err == mdb.NotFound {
+		return redis.NilReply.WriteTo(w)
+	} else if err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
+	}
+	return (&redis.BulkReply{dump}).WriteTo(w)
+}
+
+// args: key ttl serialized [REPLACE]
+// ttl is in milliseconds like redis, 0 keeps the expiration from the dump
+func RESTORE(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if len(args) != 3 && len(args) != 4 {
+		return redis.WrapStatus(wrongArgsNumberError("restore").Error()), nil
+	}
+	key := args[0]
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || ttl < 0 {
+		return redis.WrapStatus("ERR Invalid TTL value, must be >= 0"), nil
+	}
+	replace := false
+	if len(args) == 4 {
+		if strings.ToUpper(string(args[3])) != "REPLACE" {
+			return redis.WrapStatus("ERR syntax error"), nil
+		}
+		replace = true
+	}
+
+	debugf("RESTORE %s", key)
+
+	if !replace {
+		_, _, _, _, err = dbwrap.GetRawValueForWrite(txn, key)
+		if err == nil {
+			return redis.WrapStatus("BUSYKEY Target key name already exists."), nil
+		} else if err != mdb.NotFound {
+			return redis.WrapStatus(err.Error()), nil
+		}
+	}
+	err = dbwrap.RestoreValue(txn, key, args[2])
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	if ttl > 0 {
+		dbi, _, type_, val, err := dbwrap.GetRawValueForWrite(txn, key)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		// round up so it doesn't expire early
+		exp := dbwrap.GetNow() + uint32((ttl+999)/1000)
+		rawVal, err := dbwrap.BuildRawValue(exp, type_, val)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		err = txn.Put(dbi, key, rawVal, 0)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+	}
+	dbwrap.Notify(txn, dbwrap.EVENT_GENERIC, "restore", key)
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
@@ -0,0 +1,86 @@
+package ops
+
+import (
+	"fmt"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"strings"
+	"testing"
+)
+
+// the payload out of a DUMP reply, "" for nil
+func dumpOf(t *testing.T, resp string) string {
+	if resp == "$-1\r\n" {
+		return ""
+	}
+	header := strings.Index(resp, "\r\n")
+	if !strings.HasPrefix(resp, "$") || header < 0 {
+		t.Fatalf("Expecting a bulk reply from DUMP, got %q", resp)
+	}
+	return resp[header+2 : len(resp)-2]
+}
+
+func TestDumpRestore(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+	origThreshold := dbwrap.ElementThreshold
+	dbwrap.ElementThreshold = 4
+	defer func() { dbwrap.ElementThreshold = origThreshold }()
+
+	doWrite(t, env, SET, "str", "hello")
+	doWrite(t, env, EXPIRE, "str", "1000")
+	for i := 0; i < 10; i++ {
+		doWrite(t, env, HSET, "bighash", fmt.Sprintf("f%d", i), fmt.Sprintf("v%d", i))
+		doWrite(t, env, RPUSH, "biglist", fmt.Sprintf("i%d", i))
+	}
+	doWrite(t, env, SADD, "smallset", "a", "b")
+
+	dumps := make(map[string]string)
+	for _, key := range []string{"str", "bighash", "biglist", "smallset"} {
+		dumps[key] = dumpOf(t, doRead(t, env, DUMP, key))
+	}
+	if dump := dumpOf(t, doRead(t, env, DUMP, "missing")); dump != "" {
+		t.Fatalf("Expecting nil dumping a missing key, got %q", dump)
+	}
+
+	// won't clobber without REPLACE
+	if resp := doWrite(t, env, RESTORE, "str", "0", dumps["str"]); !strings.HasPrefix(resp, "+BUSYKEY") {
+		t.Fatalf("Expecting BUSYKEY, got %q", resp)
+	}
+	for key, dump := range dumps {
+		if resp := doWrite(t, env, RESTORE, "copy:"+key, "0", dump); resp != "+OK\r\n" {
+			t.Fatalf("Expecting OK restoring %s, got %q", key, resp)
+		}
+	}
+	if resp := doRead(t, env, GET, "copy:str"); resp != "$5\r\nhello\r\n" {
+		t.Fatalf("Expecting hello, got %q", resp)
+	}
+	if resp := doRead(t, env, TTL, "copy:str"); resp == intReply(-1) {
+		t.Fatalf("Expecting the expiration to come along with the dump")
+	}
+	if resp := doRead(t, env, HGET, "copy:bighash", "f7"); resp != "$2\r\nv7\r\n" {
+		t.Fatalf("Expecting v7, got %q", resp)
+	}
+	if n := numElements(t, env, "copy:bighash"); n != 10 {
+		t.Fatalf("Expecting 10 elements stored for copy:bighash, got %d", n)
+	}
+	if resp, orig := doRead(t, env, LRANGE, "copy:biglist", "0", "-1"), doRead(t, env, LRANGE, "biglist", "0", "-1"); resp != orig {
+		t.Fatalf("Expecting the same list back, got %q for %q", resp, orig)
+	}
+	if resp := doRead(t, env, SCARD, "copy:smallset"); resp != intReply(2) {
+		t.Fatalf("Expecting scard 2, got %q", resp)
+	}
+
+	// REPLACE swaps types and drops the old elements, a ttl overrides the dump's
+	if resp := doWrite(t, env, RESTORE, "copy:bighash", "5000", dumps["str"], "REPLACE"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK, got %q", resp)
+	}
+	if resp := doRead(t, env, TTL, "copy:bighash"); resp != intReply(5) {
+		t.Fatalf("Expecting ttl 5, got %q", resp)
+	}
+	if n := numElements(t, env, "copy:bighash"); n != 0 {
+		t.Fatalf("Expecting copy:bighash's elements gone, got %d", n)
+	}
+	if resp := doWrite(t, env, RESTORE, "bad", "0", "garbage"); resp != "+"+dbwrap.BadDump.Error()+"\r\n" {
+		t.Fatalf("Expecting a bad payload error, got %q", resp)
+	}
+}
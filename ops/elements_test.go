@@ -0,0 +1,161 @@
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"os"
+	"testing"
+)
+
+func elementsTestEnv(t *testing.T) *mdb.Env {
+	dbPath := "/tmp/raftisElementsTest"
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+	env, err := mdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.SetMaxDBs(mdb.DBI(64))
+	err = env.Open(dbPath, 0, uint(0755))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// runs a write op in its own txn, returns its reply
+func doWrite(t *testing.T, env *mdb.Env, op func([][]byte, *dbwrap.Txn) ([]byte, error), args ...string) string {
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	resp, err := op(toArgs(args), dbwrap.NewTxn(txn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp)
+}
+
+// runs a read op in its own txn, returns what it wrote
+func doRead(t *testing.T, env *mdb.Env, op func([][]byte, *dbwrap.Txn, io.Writer) (int64, error), args ...string) string {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	var b bytes.Buffer
+	_, err = op(toArgs(args), dbwrap.NewTxn(txn), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func toArgs(args []string) [][]byte {
+	ret := make([][]byte, len(args))
+	for i, a := range args {
+		ret[i] = []byte(a)
+	}
+	return ret
+}
+
+func numElements(t *testing.T, env *mdb.Env, key string) int {
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	edbi, err := dbwrap.GetElementsDBI(dbwrap.NewTxn(txn), mdb.CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := txn.CursorOpen(edbi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	n := 0
+	dbwrap.ForEachElement(c, []byte(key), func(member, val []byte) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+func intReply(i int) string {
+	s, _ := redis.ReplyToString(&redis.IntegerReply{i})
+	return s
+}
+
+func TestLargeCollections(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+	origThreshold := dbwrap.ElementThreshold
+	dbwrap.ElementThreshold = 4
+	defer func() { dbwrap.ElementThreshold = origThreshold }()
+
+	// sets
+	for i := 0; i < 10; i++ {
+		doWrite(t, env, SADD, "bigset", fmt.Sprintf("m%d", i))
+	}
+	if resp := doWrite(t, env, SADD, "bigset", "m3", "m10"); resp != intReply(1) {
+		t.Fatalf("Expecting 1 new member, got %q", resp)
+	}
+	if resp := doRead(t, env, SCARD, "bigset"); resp != intReply(11) {
+		t.Fatalf("Expecting scard 11, got %q", resp)
+	}
+	if n := numElements(t, env, "bigset"); n != 11 {
+		t.Fatalf("Expecting 11 elements stored for bigset, got %d", n)
+	}
+
+	// hashes
+	for i := 0; i < 10; i++ {
+		doWrite(t, env, HSET, "bighash", fmt.Sprintf("f%d", i), fmt.Sprintf("v%d", i))
+	}
+	if resp := doRead(t, env, HGET, "bighash", "f7"); resp != "$2\r\nv7\r\n" {
+		t.Fatalf("Expecting v7, got %q", resp)
+	}
+	doWrite(t, env, HINCRBY, "bighash", "count", "5")
+	if resp := doRead(t, env, HGET, "bighash", "count"); resp != "$1\r\n5\r\n" {
+		t.Fatalf("Expecting 5, got %q", resp)
+	}
+	if resp := doWrite(t, env, HDEL, "bighash", "f1", "f2", "nope"); resp != intReply(2) {
+		t.Fatalf("Expecting 2 fields deleted, got %q", resp)
+	}
+	if n := numElements(t, env, "bighash"); n != 9 {
+		t.Fatalf("Expecting 9 elements stored for bighash, got %d", n)
+	}
+
+	// lists
+	for i := 0; i < 10; i++ {
+		doWrite(t, env, RPUSH, "biglist", fmt.Sprintf("i%d", i))
+	}
+	if resp := doRead(t, env, LLEN, "biglist"); resp != intReply(10) {
+		t.Fatalf("Expecting llen 10, got %q", resp)
+	}
+	// pop off the head, then out of the middle
+	doWrite(t, env, LPOPRANGE, "biglist", "0", "1")
+	doWrite(t, env, LPOPRANGE, "biglist", "2", "3")
+	expected := "*6\r\n$2\r\ni2\r\n$2\r\ni3\r\n$2\r\ni6\r\n$2\r\ni7\r\n$2\r\ni8\r\n$2\r\ni9\r\n"
+	if resp := doRead(t, env, LRANGE, "biglist", "0", "100"); resp != expected {
+		t.Fatalf("Expecting %q, got %q", expected, resp)
+	}
+	if n := numElements(t, env, "biglist"); n != 6 {
+		t.Fatalf("Expecting 6 elements stored for biglist, got %d", n)
+	}
+
+	// DEL and SET clean up after themselves
+	doWrite(t, env, DEL, "bigset")
+	if n := numElements(t, env, "bigset"); n != 0 {
+		t.Fatalf("Expecting no elements left for bigset, got %d", n)
+	}
+	doWrite(t, env, SET, "bighash", "now a string")
+	if n := numElements(t, env, "bighash"); n != 0 {
+		t.Fatalf("Expecting no elements left for bighash, got %d", n)
+	}
+}
@@ -0,0 +1,43 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+)
+
+// args: key [key ...]
+// deletes keys picked by the leader's eviction policy, like DEL but notifies "evicted"
+func EVICT(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkAtLeastArgs(args, 1, "evict"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+
+	debugf("EVICT %d keys", len(args))
+
+	dbi, err := dbwrap.GetDBI(txn, mdb.CREATE)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	evicted := 0
+	for _, key := range args {
+		_, err := txn.Get(dbi, key)
+		if err == mdb.NotFound {
+			// deleted since it was picked
+			continue
+		} else if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		err = dbwrap.ClearElements(txn, key)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		err = txn.Del(dbi, key, nil)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		evicted++
+		dbwrap.Notify(txn, dbwrap.EVENT_EVICTED, "evicted", key)
+	}
+	return redis.WrapInt(evicted), dbwrap.Commit(txn)
+}
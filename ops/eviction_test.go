@@ -0,0 +1,84 @@
+package ops
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"testing"
+)
+
+func usedBytes(t *testing.T, env *mdb.Env) int64 {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	used, err := dbwrap.UsedBytes(dbwrap.NewTxn(txn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return used
+}
+
+func TestEvict(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	empty := usedBytes(t, env)
+	for i := 0; i < 500; i++ {
+		doWrite(t, env, SET, fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i))
+	}
+	doWrite(t, env, EXPIRE, "key7", "1000")
+	args := []string{"bighash"}
+	for i := 0; i < dbwrap.ElementThreshold+10; i++ {
+		args = append(args, fmt.Sprintf("f%d", i), fmt.Sprintf("v%d", i))
+	}
+	doWrite(t, env, HMSET, args...)
+	if used := usedBytes(t, env); used <= empty {
+		t.Fatalf("Expecting used bytes to grow, got %d from %d", used, empty)
+	}
+
+	// samples sweep the whole db and carry expirations
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	distinct := make(map[string]bool)
+	var from []byte
+	for i := 0; i < 10; i++ {
+		var sampled []dbwrap.SampledKey
+		sampled, from, err = dbwrap.SampleKeys(dbwrap.NewTxn(txn), from, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sampled) != 64 {
+			t.Fatalf("Expecting 64 samples, got %d", len(sampled))
+		}
+		for _, sk := range sampled {
+			distinct[string(sk.Key)] = true
+			if (string(sk.Key) == "key7") != (sk.Exp != 0) {
+				t.Fatalf("Expecting only key7 to have an expiration, got %s with %d", sk.Key, sk.Exp)
+			}
+		}
+	}
+	txn.Abort()
+	if len(distinct) != 501 {
+		t.Fatalf("Expecting every key sampled after wrapping around, got %d distinct", len(distinct))
+	}
+
+	if resp := doWrite(t, env, EVICT, "key1", "bighash", "missing"); resp != intReply(2) {
+		t.Fatalf("Expecting 2 keys evicted, got %q", resp)
+	}
+	if resp := doRead(t, env, GET, "key1"); resp != "$-1\r\n" {
+		t.Fatalf("Expecting key1 gone, got %q", resp)
+	}
+	if resp := doRead(t, env, HGET, "bighash", "f3"); resp != "$-1\r\n" {
+		t.Fatalf("Expecting bighash gone, got %q", resp)
+	}
+	if _, vals := elementEntries(t, env, "bighash"); len(vals) != 0 {
+		t.Fatalf("Expecting bighash's elements evicted with it")
+	}
+	if resp := doRead(t, env, GET, "key2"); resp != "$4\r\nval2\r\n" {
+		t.Fatalf("Expecting key2 untouched, got %q", resp)
+	}
+}
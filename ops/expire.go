@@ -9,7 +9,7 @@ import (
 )
 
 // args are key, seconds
-func EXPIRE(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func EXPIRE(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 2, "expire"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -31,12 +31,17 @@ func EXPIRE(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	}
 
 	exp := dbwrap.GetNow() + uint32(secondsInt)
-	err = txn.Put(dbi, key, dbwrap.BuildRawValue(exp, type_, val), 0)
-	return redis.WrapInt(1), txn.Commit()
+	rawVal, err := dbwrap.BuildRawValue(exp, type_, val)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err = txn.Put(dbi, key, rawVal, 0)
+	dbwrap.Notify(txn, dbwrap.EVENT_GENERIC, "expire", key)
+	return redis.WrapInt(1), dbwrap.Commit(txn)
 }
 
 // args: key
-func TTL(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func TTL(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "ttl"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
@@ -0,0 +1,63 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+)
+
+// args: key1 [key2 ...]
+// rewrites each value still stored in an older format version in dbwrap.CURRENT_FORMAT,
+// or sealed with anything but the current key, returns how many were rewritten.
+// issued in batches by the online format upgrade and key rotation.
+func REWRITEVALUES(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkAtLeastArgs(args, 1, "rewritevalues"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+
+	dbi, err := dbwrap.GetDBI(txn, mdb.CREATE)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	rewritten := 0
+	for _, key := range args {
+		rawVal, err := txn.Get(dbi, key)
+		if err == mdb.NotFound {
+			// deleted since the batch was picked
+			continue
+		} else if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		if !dbwrap.NeedsRewrite(rawVal) {
+			continue
+		}
+		_, type_ := dbwrap.ParseHeader(rawVal)
+		if type_&dbwrap.ELEMENTS != 0 {
+			// element values get resealed along with the header
+			c, err := dbwrap.GetCollectionForWrite(txn, key, type_&^dbwrap.ELEMENTS)
+			if err != nil {
+				return redis.WrapStatus(err.Error()), nil
+			}
+			err = c.Save()
+			if err != nil {
+				return redis.WrapStatus(err.Error()), nil
+			}
+			rewritten++
+			continue
+		}
+		exp, type_, val, err := dbwrap.ParseRawValue(rawVal)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		rawVal, err = dbwrap.BuildRawValue(exp, type_, val)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		err = txn.Put(dbi, key, rawVal, 0)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		rewritten++
+	}
+	return redis.WrapInt(rewritten), dbwrap.Commit(txn)
+}
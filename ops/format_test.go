@@ -0,0 +1,59 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"testing"
+)
+
+func TestRewriteLegacyValues(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	// values as they were written before format versions, [exp][type][payload]
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbi, err := dbwrap.GetDBI(dbwrap.NewTxn(txn), mdb.CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyString := append([]byte{0, 0, 0, 0, dbwrap.STRING}, []byte("oldval")...)
+	legacySet := append([]byte{0, 0, 0, 0, dbwrap.SET}, dbwrap.BuildRawArray(toArgs([]string{"b", "a"}))...)
+	txn.Put(dbi, []byte("legacystr"), legacyString, 0)
+	txn.Put(dbi, []byte("legacyset"), legacySet, 0)
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// old values still read fine
+	if resp := doRead(t, env, GET, "legacystr"); resp != "$6\r\noldval\r\n" {
+		t.Fatalf("Expecting oldval, got %q", resp)
+	}
+	if resp := doRead(t, env, SCARD, "legacyset"); resp != intReply(2) {
+		t.Fatalf("Expecting scard 2, got %q", resp)
+	}
+
+	if resp := doWrite(t, env, REWRITEVALUES, "legacystr", "legacyset", "missing"); resp != intReply(2) {
+		t.Fatalf("Expecting 2 values rewritten, got %q", resp)
+	}
+	for _, key := range []string{"legacystr", "legacyset"} {
+		if v := dbwrap.FormatVersion(rawValue(t, env, key)); v != dbwrap.CURRENT_FORMAT {
+			t.Fatalf("Expecting %s at format %d, got %d", key, dbwrap.CURRENT_FORMAT, v)
+		}
+	}
+	if resp := doRead(t, env, GET, "legacystr"); resp != "$6\r\noldval\r\n" {
+		t.Fatalf("Expecting oldval after rewrite, got %q", resp)
+	}
+	expected := "*2\r\n$1\r\na\r\n$1\r\nb\r\n"
+	if resp := doRead(t, env, SMEMBERS, "legacyset"); resp != expected {
+		t.Fatalf("Expecting %q after rewrite, got %q", expected, resp)
+	}
+
+	// already current, nothing to do
+	if resp := doWrite(t, env, REWRITEVALUES, "legacystr"); resp != intReply(0) {
+		t.Fatalf("Expecting nothing rewritten, got %q", resp)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
 )
 
 // db format
@@ -237,19 +238,13 @@ type rowColKey struct {
 }
 
 // packs a rowKey and colKey into a single []byte for an mdb key
+// same layout dbwrap uses for the members of large collections
 func packRowColKey(in rowColKey) []byte {
-	keyLen := 4 + len(in.rowKey) + 4 + len(in.colKey)
-	mdbKey := make([]byte, keyLen)
-	binary.LittleEndian.PutUint32(mdbKey, uint32(len(in.rowKey)))
-	copy(mdbKey[4:], in.rowKey)
-	copy(mdbKey[4+len(in.rowKey):], in.colKey)
-	return mdbKey
+	return dbwrap.PackElementKey(in.rowKey, in.colKey)
 }
 
 func splitRowColKey(mdbKey []byte) rowColKey {
-	rowKeySize := int(binary.LittleEndian.Uint32(mdbKey))
-	rowKey := mdbKey[4 : 4+rowKeySize]
-	colKey := mdbKey[4+rowKeySize:]
+	rowKey, colKey := dbwrap.SplitElementKey(mdbKey)
 	return rowColKey{rowKey, colKey}
 }
 
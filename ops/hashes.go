@@ -1,7 +1,6 @@
 package ops
 
 import (
-	"bytes"
 	"fmt"
 	mdb "github.com/jbooth/gomdb"
 	dbwrap "github.com/jbooth/raftis/dbwrap"
@@ -12,7 +11,7 @@ import (
 
 // READS
 // args: key field
-func HGET(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func HGET(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 2, "hget"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
@@ -20,46 +19,43 @@ func HGET(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 	key := args[0]
 	field := args[1]
 	println("HGET " + string(key) + " " + string(field))
-	val, err := dbwrap.GetHash(txn, key)
+	hash, err := dbwrap.GetCollection(txn, key, dbwrap.HASH)
 	if err == mdb.NotFound {
-		val = make([][]byte, 0)
+		return redis.NilReply.WriteTo(w)
 	} else if err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
-	var fieldValue []byte = nil
-	for i := 0; i < len(val); i += 2 {
-		if bytes.Equal(field, val[i]) {
-			fieldValue = val[i+1]
-			break
-		}
+	fieldValue, _, err := hash.HGet(field)
+	if err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
 	}
 	resp := &redis.BulkReply{fieldValue}
 	return resp.WriteTo(w)
 }
 
 // args: key field [field ...]
-func HMGET(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func HMGET(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkAtLeastArgs(args, 2, "hmget"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
 	key := args[0]
 	fields := args[1:]
 	fmt.Printf("HMGET %s %s \n", string(key), fields)
-	val, err := dbwrap.GetHash(txn, key)
+	ret := make([][]byte, 0)
+	hash, err := dbwrap.GetCollection(txn, key, dbwrap.HASH)
 	if err == mdb.NotFound {
-		val = make([][]byte, 0)
+		for _ = range fields {
+			ret = append(ret, nil)
+		}
 	} else if err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
-	}
-	mapVal := dbwrap.MembersToMap(val)
-	ret := make([][]byte, 0)
-	var fieldValue string
-	var exists bool
-	for _, f := range fields {
-		if fieldValue, exists = mapVal[string(f)]; !exists {
-			ret = append(ret, nil)
-		} else {
-			ret = append(ret, []byte(fieldValue))
+	} else {
+		for _, f := range fields {
+			fieldValue, _, err := hash.HGet(f)
+			if err != nil {
+				return redis.NewError(err.Error()).WriteTo(w)
+			}
+			ret = append(ret, fieldValue)
 		}
 	}
 	resp := &redis.ArrayReply{ret}
@@ -67,17 +63,23 @@ func HMGET(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 }
 
 // args: key
-func HGETALL(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func HGETALL(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "hgetall"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
 	key := args[0]
 	println("HGETALL " + string(key))
-	val, err := dbwrap.GetHash(txn, key)
+	var val [][]byte
+	hash, err := dbwrap.GetCollection(txn, key, dbwrap.HASH)
 	if err == mdb.NotFound {
 		val = make([][]byte, 0)
 	} else if err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
+	} else {
+		val, err = hash.Members()
+		if err != nil {
+			return redis.NewError(err.Error()).WriteTo(w)
+		}
 	}
 	resp := &redis.ArrayReply{val}
 	return resp.WriteTo(w)
@@ -85,41 +87,39 @@ func HGETALL(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 
 // WRITES
 // args: key field value
-func HSET(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func HSET(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 3, "hset"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
 
 	key := args[0]
-	field := string(args[1])
-	value := string(args[2])
-	fmt.Printf("HSET %s %s %s \n", string(key), field, value)
+	field := args[1]
+	value := args[2]
+	fmt.Printf("HSET %s %s %s \n", string(key), string(field), string(value))
 
-	dbi, exp, val, err := dbwrap.GetHashForWrite(txn, key)
-	if err == mdb.NotFound {
-		val = make([][]byte, 0)
-		exp = 0
-	} else if err != nil {
+	hash, err := dbwrap.GetCollectionForWrite(txn, key, dbwrap.HASH)
+	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-
-	mapVal := dbwrap.MembersToMap(val)
-	ret := 1
-	if _, exists := mapVal[field]; exists {
-		ret = 0
+	added, err := hash.HSet(field, value)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	ret := 0
+	if added {
+		ret = 1
 	}
-	mapVal[field] = value
-	newVal := dbwrap.MapToMembers(mapVal)
 
-	err = txn.Put(dbi, key, dbwrap.BuildHash(exp, newVal), 0)
+	err = hash.Save()
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	return redis.WrapInt(ret), txn.Commit()
+	dbwrap.Notify(txn, dbwrap.EVENT_HASH, "hset", key)
+	return redis.WrapInt(ret), dbwrap.Commit(txn)
 }
 
 // args: key field value [field value ...]
-func HMSET(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func HMSET(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkOddArgs(args, 3, "hmset"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -128,72 +128,70 @@ func HMSET(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	newFields := args[1:]
 	fmt.Printf("HMSET %s %s \n", string(key), newFields)
 
-	dbi, exp, val, err := dbwrap.GetHashForWrite(txn, key)
-	if err == mdb.NotFound {
-		val = make([][]byte, 0)
-		exp = 0
-	} else if err != nil {
+	hash, err := dbwrap.GetCollectionForWrite(txn, key, dbwrap.HASH)
+	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-
-	mapVal := dbwrap.MembersToMap(val)
 	for i := 0; i < len(newFields); i += 2 {
-		mapVal[string(newFields[i])] = string(newFields[i+1])
+		_, err = hash.HSet(newFields[i], newFields[i+1])
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
 	}
-	newVal := dbwrap.MapToMembers(mapVal)
 
-	err = txn.Put(dbi, key, dbwrap.BuildHash(exp, newVal), 0)
+	err = hash.Save()
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	return redis.WrapStatus("OK"), txn.Commit()
+	dbwrap.Notify(txn, dbwrap.EVENT_HASH, "hset", key)
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
 }
 
 // args: key field increment
-func HINCRBY(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func HINCRBY(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 3, "hincrby"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
 
 	key := args[0]
-	field := string(args[1])
+	field := args[1]
 	increment, err := strconv.Atoi(string(args[2]))
 
-	fmt.Printf("HINCRBY %s %s %s \n", string(key), field, increment)
+	fmt.Printf("HINCRBY %s %s %s \n", string(key), string(field), increment)
 
-	dbi, exp, val, err := dbwrap.GetHashForWrite(txn, key)
-	if err == mdb.NotFound {
-		val = make([][]byte, 0)
-		exp = 0
-	} else if err != nil {
+	hash, err := dbwrap.GetCollectionForWrite(txn, key, dbwrap.HASH)
+	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-
-	mapVal := dbwrap.MembersToMap(val)
-	var currentValue string
-	var exists bool
-	if currentValue, exists = mapVal[field]; !exists {
-		currentValue = "0"
+	currentValue, exists, err := hash.HGet(field)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	if !exists {
+		currentValue = []byte("0")
 	}
 
-	currentValueInt, err := strconv.Atoi(currentValue)
+	currentValueInt, err := strconv.Atoi(string(currentValue))
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
 
 	newValueInt := currentValueInt + increment
-	mapVal[field] = strconv.Itoa(newValueInt)
+	_, err = hash.HSet(field, []byte(strconv.Itoa(newValueInt)))
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
 
-	newVal := dbwrap.MapToMembers(mapVal)
-	err = txn.Put(dbi, key, dbwrap.BuildHash(exp, newVal), 0)
+	err = hash.Save()
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	return redis.WrapInt(newValueInt), txn.Commit()
+	dbwrap.Notify(txn, dbwrap.EVENT_HASH, "hincrby", key)
+	return redis.WrapInt(newValueInt), dbwrap.Commit(txn)
 }
 
 // args: key field [field ...]
-func HDEL(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func HDEL(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkAtLeastArgs(args, 2, "hdel"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -202,29 +200,27 @@ func HDEL(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	fields := args[1:]
 	fmt.Printf("HDEL %s %s \n", string(key), fields)
 
-	dbi, exp, val, err := dbwrap.GetHashForWrite(txn, key)
-	if err == mdb.NotFound {
-		val = make([][]byte, 0)
-		exp = 0
-	} else if err != nil {
+	hash, err := dbwrap.GetCollectionForWrite(txn, key, dbwrap.HASH)
+	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
 
-	mapVal := dbwrap.MembersToMap(val)
 	deleted := 0
-	for i := 0; i < len(fields); i++ {
-		f := string(fields[i])
-		if _, exists := mapVal[f]; exists {
-			delete(mapVal, f)
+	for _, f := range fields {
+		removed, err := hash.Remove(f)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		if removed {
 			deleted++
 		}
 	}
 	if deleted > 0 {
-		newVal := dbwrap.MapToMembers(mapVal)
-		err = txn.Put(dbi, key, dbwrap.BuildHash(exp, newVal), 0)
+		err = hash.Save()
 		if err != nil {
 			return redis.WrapStatus(err.Error()), nil
 		}
+		dbwrap.Notify(txn, dbwrap.EVENT_HASH, "hdel", key)
 	}
-	return redis.WrapInt(deleted), txn.Commit()
+	return redis.WrapInt(deleted), dbwrap.Commit(txn)
 }
@@ -3,19 +3,19 @@ package ops
 import (
 	"bytes"
 	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
 	redis "github.com/jbooth/raftis/redis"
 )
 
 // args: key1, [key2 ...]
-func DEL(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func DEL(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkAtLeastArgs(args, 1, "del"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
 
-	table := "onlyTable"
 	println("DEL ", bytes.Join(args, []byte(" ")))
 
-	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
+	dbi, err := dbwrap.GetDBI(txn, mdb.CREATE)
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -23,14 +23,19 @@ func DEL(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	for _, key := range args {
 		_, err := txn.Get(dbi, key)
 		if err == nil {
-			err := txn.Del(dbi, key, nil)
+			err := dbwrap.ClearElements(txn, key)
+			if err != nil {
+				return redis.WrapStatus(err.Error()), nil
+			}
+			err = txn.Del(dbi, key, nil)
 			deleted++
 			if err != nil {
 				return redis.WrapStatus(err.Error()), nil
 			}
+			dbwrap.Notify(txn, dbwrap.EVENT_GENERIC, "del", key)
 		} else if err != mdb.NotFound {
 			return redis.WrapStatus(err.Error()), nil
 		}
 	}
-	return redis.WrapInt(deleted), txn.Commit()
+	return redis.WrapInt(deleted), dbwrap.Commit(txn)
 }
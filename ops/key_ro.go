@@ -2,20 +2,20 @@ package ops
 
 import (
 	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
 	redis "github.com/jbooth/raftis/redis"
 	"io"
 )
 
 // args: key
-func EXISTS(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func EXISTS(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "exists"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
 
 	key := args[0]
-	table := "onlyTable"
 	println("EXISTS " + string(key))
-	dbi, err := txn.DBIOpen(&table, 0)
+	dbi, err := dbwrap.GetDBI(txn, 0)
 	if err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
@@ -34,3 +34,23 @@ func EXISTS(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 	// write result
 	return resp.WriteTo(w)
 }
+
+// args: none
+// keys in the selected db on this shard, expired ones included until they're cleaned up
+func DBSIZE(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
+	if err := checkExactArgs(args, 0, "dbsize"); err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
+	}
+	dbi, err := dbwrap.GetDBI(txn, 0)
+	if err == mdb.NotFound {
+		// nothing's been written to it
+		return (&redis.IntegerReply{0}).WriteTo(w)
+	} else if err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
+	}
+	stat, err := txn.Stat(dbi)
+	if err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
+	}
+	return (&redis.IntegerReply{int(stat.Entries)}).WriteTo(w)
+}
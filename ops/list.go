@@ -2,17 +2,12 @@ package ops
 
 import (
 	"bytes"
-	mdb "github.com/jbooth/gomdb"
 	dbwrap "github.com/jbooth/raftis/dbwrap"
 	redis "github.com/jbooth/raftis/redis"
 )
 
-func BuildList(expiration uint32, length uint32, membersList []byte) []byte {
-	return dbwrap.BuildRawValue(expiration, dbwrap.LIST, dbwrap.BuildRawArray0(length, membersList))
-}
-
 // args: key string1, [string2 ...]
-func RPUSH(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func RPUSH(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkAtLeastArgs(args, 2, "rpush"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -21,33 +16,27 @@ func RPUSH(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	newMembers := args[1:]
 	println("RPUSH", string(key), string(bytes.Join(newMembers, []byte(" "))))
 
-	newMembersLength := uint32(len(newMembers))
-	var listValue []byte
-	var newLength uint32
-	dbi, expiration, rawList, err := dbwrap.GetRawListForWrite(txn, key)
-	if err == mdb.NotFound {
-		newLength = newMembersLength
-		listValue = dbwrap.BuildList(0, newMembers)
-	} else if err != nil {
+	list, err := dbwrap.GetCollectionForWrite(txn, key, dbwrap.LIST)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err = list.RPush(newMembers)
+	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
-	} else {
-		currentLength, currentMembersArray := dbwrap.ExtractLength(rawList)
-		newLength = currentLength + newMembersLength
-		listValue = BuildList(expiration, newLength,
-			dbwrap.AppendMembersToMembersArray(currentMembersArray, newMembers))
 	}
-	err = txn.Put(dbi, key, listValue, 0)
+	err = list.Save()
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	return redis.WrapInt(int(newLength)), txn.Commit()
+	dbwrap.Notify(txn, dbwrap.EVENT_LIST, "rpush", key)
+	return redis.WrapInt(list.Len()), dbwrap.Commit(txn)
 }
 
 //=============================================================
 //custom commands supported via EVAL
 
 // args: key start end
-func LPOPRANGE(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func LPOPRANGE(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 3, "lpoprange"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -64,34 +53,35 @@ func LPOPRANGE(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	}
 
 	if start > end || start < 0 {
-		return redis.WrapArray(nil), txn.Commit()
+		return redis.WrapArray(nil), dbwrap.Commit(txn)
 	}
 
-	dbi, expiration, rawList, err := dbwrap.GetRawListForWrite(txn, key)
-	if err == mdb.NotFound {
-		return redis.WrapArray(nil), txn.Commit()
-	} else if err != nil {
+	list, err := dbwrap.GetCollectionForWrite(txn, key, dbwrap.LIST)
+	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
+	}
+	length := list.Len()
+	if length == 0 {
+		return redis.WrapArray(nil), dbwrap.Commit(txn)
+	}
+	if end >= length {
+		end = length
 	} else {
-		length, membersList := dbwrap.ExtractLength(rawList)
-		members := dbwrap.MembersArrayToMembers(length, membersList)
-		if end > int(length) {
-			end = int(length)
-		} else {
-			end++
-		}
-		membersRange := make([][]byte, end-start)
-		copy(membersRange, members[start:end])
-
-		newMembers := append(members[:start], members[end:]...)
-
-		listValue := dbwrap.BuildList(expiration, newMembers)
-
-		err = txn.Put(dbi, key, listValue, 0)
-
+		end++
+	}
+	if start > end {
+		start = end
+	}
+	membersRange, err := list.RemoveRange(start, end)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	if len(membersRange) > 0 {
+		err = list.Save()
 		if err != nil {
 			return redis.WrapStatus(err.Error()), nil
 		}
-		return redis.WrapArray(membersRange), txn.Commit()
+		dbwrap.Notify(txn, dbwrap.EVENT_LIST, "lpop", key)
 	}
+	return redis.WrapArray(membersRange), dbwrap.Commit(txn)
 }
@@ -9,14 +9,14 @@ import (
 )
 
 // args: key
-func LLEN(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func LLEN(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "llen"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
 
 	key := args[0]
 	println("LLEN", string(key))
-	rawList, err := dbwrap.GetRawList(txn, key)
+	list, err := dbwrap.GetCollection(txn, key, dbwrap.LIST)
 	var resp redis.ReplyWriter
 	if err == mdb.NotFound {
 		// Redis returns 0 for non-existing key
@@ -25,9 +25,7 @@ func LLEN(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 		// write error
 		resp = redis.NewError(err.Error())
 	} else {
-		length, _ := dbwrap.ExtractLength(rawList)
-		// Redis returns 1 for existing key
-		resp = &redis.IntegerReply{int(length)}
+		resp = &redis.IntegerReply{list.Len()}
 	}
 	// write result
 	return resp.WriteTo(w)
@@ -39,7 +37,7 @@ func toIntArg(raw []byte) (int, error) {
 }
 
 // args: key start end
-func LRANGE(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func LRANGE(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 3, "lrange"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
@@ -60,7 +58,7 @@ func LRANGE(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 		return redis.NilArrayReply.WriteTo(w)
 	}
 
-	rawList, err := dbwrap.GetRawList(txn, key)
+	list, err := dbwrap.GetCollection(txn, key, dbwrap.LIST)
 	if err == mdb.NotFound {
 		// Redis returns 0 for non-existing key
 		return redis.NilArrayReply.WriteTo(w)
@@ -68,15 +66,21 @@ func LRANGE(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 		// write error
 		resp = redis.NewError(err.Error())
 	} else {
-		length, membersList := dbwrap.ExtractLength(rawList)
-		members := dbwrap.MembersArrayToMembers(length, membersList)
-		if end > int(length) {
-			end = int(length)
+		length := list.Len()
+		if end >= length {
+			end = length
 		} else {
 			end++
 		}
-		membersRange := members[start:end]
-		resp = &redis.ArrayReply{membersRange}
+		if start > end {
+			start = end
+		}
+		membersRange, err := list.Range(start, end)
+		if err != nil {
+			resp = redis.NewError(err.Error())
+		} else {
+			resp = &redis.ArrayReply{membersRange}
+		}
 	}
 	// write result
 	return resp.WriteTo(w)
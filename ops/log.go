@@ -0,0 +1,24 @@
+package ops
+
+import (
+	log "github.com/jbooth/raftis/rlog"
+)
+
+// logging for ops, quiet until the server hands us its logger
+var lg *log.Logger
+
+func SetLogger(l *log.Logger) {
+	lg = l
+}
+
+func debugf(format string, v ...interface{}) {
+	if lg != nil {
+		lg.Printf(format, v...)
+	}
+}
+
+func errorf(format string, v ...interface{}) {
+	if lg != nil {
+		lg.Errorf(format, v...)
+	}
+}
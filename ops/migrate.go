@@ -0,0 +1,90 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/sha1"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"strconv"
+	"strings"
+)
+
+var slotStateNames = map[string]uint8{
+	"STABLE":    dbwrap.SLOT_STABLE,
+	"MIGRATING": dbwrap.SLOT_MIGRATING,
+	"IMPORTING": dbwrap.SLOT_IMPORTING,
+}
+
+// args: slot MIGRATING|IMPORTING|STABLE shard
+func SETSLOT(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 3, "setslot"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	slot, err := strconv.ParseUint(string(args[0]), 10, 32)
+	if err != nil {
+		return redis.WrapStatus("ERR invalid slot " + string(args[0])), nil
+	}
+	state, ok := slotStateNames[strings.ToUpper(string(args[1]))]
+	if !ok {
+		return redis.WrapStatus("ERR invalid slot state " + string(args[1])), nil
+	}
+	shard, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return redis.WrapStatus("ERR invalid shard " + string(args[2])), nil
+	}
+
+	debugf("SETSLOT %s %s %s", args[0], args[1], args[2])
+
+	err = dbwrap.SetSlotState(txn, uint32(slot), dbwrap.SlotState{State: state, Shard: shard})
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
+
+// checksum MIGRATEDEL compares against, of a DUMP payload
+func DumpSum(dump []byte) []byte {
+	sum := sha1.Sum(dump)
+	return sum[:]
+}
+
+// args: key sum [key sum ...]
+// deletes each key if it still dumps to sum, so a write since it was copied to another
+// shard isn't lost.  replies with the keys that were already gone, changed keys are left.
+func MIGRATEDEL(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return redis.WrapStatus(wrongArgsNumberError("migratedel").Error()), nil
+	}
+
+	debugf("MIGRATEDEL %d keys", len(args)/2)
+
+	dbi, err := dbwrap.GetDBI(txn, mdb.CREATE)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	gone := make([][]byte, 0)
+	for i := 0; i < len(args); i += 2 {
+		key := args[i]
+		dump, err := dbwrap.DumpValue(txn, key)
+		if err == mdb.NotFound {
+			gone = append(gone, key)
+			continue
+		} else if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		if !bytes.Equal(DumpSum(dump), args[i+1]) {
+			continue
+		}
+		err = dbwrap.ClearElements(txn, key)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		err = txn.Del(dbi, key, nil)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		dbwrap.Notify(txn, dbwrap.EVENT_GENERIC, "del", key)
+	}
+	return redis.WrapArray(gone), dbwrap.Commit(txn)
+}
@@ -0,0 +1,76 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"testing"
+)
+
+// MIGRATEDEL's checksum for key as it is now
+func sumOf(t *testing.T, env *mdb.Env, key string) string {
+	return string(DumpSum([]byte(dumpOf(t, doRead(t, env, DUMP, key)))))
+}
+
+func TestSetSlot(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	if resp := doWrite(t, env, SETSLOT, "12", "migrating", "3"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK, got %q", resp)
+	}
+	doWrite(t, env, SETSLOT, "40", "IMPORTING", "1")
+	if st := dbwrap.GetSlotState(12); st != (dbwrap.SlotState{dbwrap.SLOT_MIGRATING, 3}) {
+		t.Fatalf("Expecting slot 12 migrating to 3, got %+v", st)
+	}
+	if resp := doWrite(t, env, SETSLOT, "12", "LEAVING", "3"); resp != "+ERR invalid slot state LEAVING\r\n" {
+		t.Fatalf("Expecting a bad state error, got %q", resp)
+	}
+
+	// a restarted node gets them back from the meta table
+	doWrite(t, env, SETSLOT, "40", "STABLE", "1")
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	err = dbwrap.LoadSlotStates(dbwrap.NewTxn(txn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := dbwrap.SlotStates()
+	if len(states) != 1 || states[12].State != dbwrap.SLOT_MIGRATING {
+		t.Fatalf("Expecting only slot 12 migrating after a reload, got %+v", states)
+	}
+	doWrite(t, env, SETSLOT, "12", "STABLE", "3")
+}
+
+func TestMigrateDel(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	doWrite(t, env, SET, "same", "a")
+	doWrite(t, env, SET, "changed", "a")
+	doWrite(t, env, SET, "gone", "a")
+	sums := map[string]string{}
+	for _, key := range []string{"same", "changed", "gone"} {
+		sums[key] = sumOf(t, env, key)
+	}
+	// written and deleted after being copied
+	doWrite(t, env, SET, "changed", "b")
+	doWrite(t, env, DEL, "gone")
+
+	resp := doWrite(t, env, MIGRATEDEL, "same", sums["same"], "changed", sums["changed"], "gone", sums["gone"])
+	if resp != string(redis.WrapArray([][]byte{[]byte("gone")})) {
+		t.Fatalf("Expecting only gone to be reported missing, got %q", resp)
+	}
+	if resp := doRead(t, env, EXISTS, "same"); resp != intReply(0) {
+		t.Fatalf("Expecting same deleted, got %q", resp)
+	}
+	if resp := doRead(t, env, GET, "changed"); resp != "$1\r\nb\r\n" {
+		t.Fatalf("Expecting changed left alone, got %q", resp)
+	}
+	if resp := doWrite(t, env, MIGRATEDEL, "same"); resp != "+"+wrongArgsNumberError("migratedel").Error()+"\r\n" {
+		t.Fatalf("Expecting a wrong args error, got %q", resp)
+	}
+}
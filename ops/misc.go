@@ -4,18 +4,18 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
 	redis "github.com/jbooth/raftis/redis"
 	"strings"
 )
 
-type EvalCommand func(args [][]byte, txn *mdb.Txn) ([]byte, error)
+type EvalCommand func(args [][]byte, txn *dbwrap.Txn) ([]byte, error)
 
 var supportedCommands = map[string]EvalCommand{
 	"LPOPRANGE": LPOPRANGE,
 }
 
-func EVAL(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func EVAL(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 
 	println("EVAL", string(bytes.Join(args, []byte(" "))))
 
@@ -8,13 +8,13 @@ import (
 )
 
 // args: key
-func SCARD(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func SCARD(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "scard"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
 	key := args[0]
 	println("SCARD", string(key))
-	rawSet, err := dbwrap.GetRawSet(txn, key)
+	set, err := dbwrap.GetCollection(txn, key, dbwrap.SET)
 	var resp redis.ReplyWriter
 	if err == mdb.NotFound {
 		// Redis returns 0 for non-existing key
@@ -23,16 +23,14 @@ func SCARD(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 		// write error
 		resp = redis.NewError(err.Error())
 	} else {
-		length, _ := dbwrap.ExtractLength(rawSet)
-		// Redis returns 1 for existing key
-		resp = &redis.IntegerReply{int(length)}
+		resp = &redis.IntegerReply{set.Len()}
 	}
 	// write result
 	return resp.WriteTo(w)
 }
 
 // args: key
-func SMEMBERS(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func SMEMBERS(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "smembers"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
@@ -42,7 +40,7 @@ func SMEMBERS(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 
 	var resp redis.ReplyWriter
 
-	rawSet, err := dbwrap.GetRawSet(txn, key)
+	set, err := dbwrap.GetCollection(txn, key, dbwrap.SET)
 	if err == mdb.NotFound {
 		// Redis returns 0 for non-existing key
 		return redis.NilArrayReply.WriteTo(w)
@@ -50,8 +48,12 @@ func SMEMBERS(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 		// write error
 		resp = redis.NewError(err.Error())
 	} else {
-		members := dbwrap.RawArrayToMembers(rawSet)
-		resp = &redis.ArrayReply{members}
+		members, err := set.Members()
+		if err != nil {
+			resp = redis.NewError(err.Error())
+		} else {
+			resp = &redis.ArrayReply{members}
+		}
 	}
 	// write result
 	return resp.WriteTo(w)
@@ -9,7 +9,7 @@ import (
 )
 
 // args are key, val
-func SET(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func SET(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 2, "set"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -20,15 +20,25 @@ func SET(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = txn.Put(dbi, key, dbwrap.BuildString(0, val), 0)
+	// SET overwrites any type, don't leave a big collection's members behind
+	err = dbwrap.ClearElements(txn, key)
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	return redis.WrapStatus("OK"), txn.Commit()
+	rawVal, err := dbwrap.BuildString(0, val)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err = txn.Put(dbi, key, rawVal, 0)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	dbwrap.Notify(txn, dbwrap.EVENT_STRING, "set", key)
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
 }
 
 // args are key, newVal, returns oldVal
-func GETSET(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func GETSET(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 2, "getset"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -39,15 +49,20 @@ func GETSET(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	err = txn.Put(dbi, key, dbwrap.BuildString(0, newVal), 0)
+	rawVal, err := dbwrap.BuildString(0, newVal)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err = txn.Put(dbi, key, rawVal, 0)
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	return redis.WrapString(oldVal), txn.Commit()
+	dbwrap.Notify(txn, dbwrap.EVENT_STRING, "set", key)
+	return redis.WrapString(oldVal), dbwrap.Commit(txn)
 }
 
 // args are key, val
-func SETNX(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func SETNX(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 2, "setnx"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -56,11 +71,16 @@ func SETNX(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	newVal := args[1]
 	dbi, _, _, err := dbwrap.GetStringForWrite(txn, key)
 	if err == mdb.NotFound {
-		err = txn.Put(dbi, key, dbwrap.BuildString(0, newVal), 0)
+		rawVal, err := dbwrap.BuildString(0, newVal)
 		if err != nil {
 			return redis.WrapStatus(err.Error()), nil
 		}
-		return redis.WrapInt(1), txn.Commit() //success
+		err = txn.Put(dbi, key, rawVal, 0)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		dbwrap.Notify(txn, dbwrap.EVENT_STRING, "set", key)
+		return redis.WrapInt(1), dbwrap.Commit(txn) //success
 	}
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
@@ -70,7 +90,7 @@ func SETNX(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 
 // args are key, val
 // return value is int of new val length
-func APPEND(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func APPEND(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 2, "append"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -86,14 +106,19 @@ func APPEND(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 	} else {
 		newVal = append(oldVal, appendVal...)
 	}
-	err = txn.Put(dbi, key, dbwrap.BuildString(exp, newVal), 0)
+	rawVal, err := dbwrap.BuildString(exp, newVal)
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
-	return redis.WrapInt(len(newVal)), txn.Commit() //success
+	err = txn.Put(dbi, key, rawVal, 0)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	dbwrap.Notify(txn, dbwrap.EVENT_STRING, "append", key)
+	return redis.WrapInt(len(newVal)), dbwrap.Commit(txn) //success
 }
 
-func Counter(key []byte, increment int, txn *mdb.Txn) ([]byte, error) {
+func Counter(key []byte, increment int, txn *dbwrap.Txn) ([]byte, error) {
 	dbi, exp, currentValue, err := dbwrap.GetStringForWrite(txn, key)
 	if err == mdb.NotFound {
 		currentValue = []byte("0")
@@ -108,16 +133,21 @@ func Counter(key []byte, increment int, txn *mdb.Txn) ([]byte, error) {
 
 	newValueInt := currentValueInt + increment
 	newValue := []byte(strconv.Itoa(newValueInt))
-	err = txn.Put(dbi, key, dbwrap.BuildString(exp, newValue), 0)
+	rawVal, err := dbwrap.BuildString(exp, newValue)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err = txn.Put(dbi, key, rawVal, 0)
 	if err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
 
-	return redis.WrapInt(newValueInt), txn.Commit()
+	dbwrap.Notify(txn, dbwrap.EVENT_STRING, "incrby", key)
+	return redis.WrapInt(newValueInt), dbwrap.Commit(txn)
 }
 
 // args: key
-func INCR(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func INCR(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 1, "incr"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -126,7 +156,7 @@ func INCR(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 }
 
 // agrs: key
-func DECR(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func DECR(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 1, "decr"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -135,7 +165,7 @@ func DECR(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 }
 
 // args: key delta
-func INCRBY(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func INCRBY(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 2, "incrby"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -149,7 +179,7 @@ func INCRBY(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 }
 
 // args: key delta
-func DECRBY(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+func DECRBY(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 	if err := checkExactArgs(args, 2, "decrby"); err != nil {
 		return redis.WrapStatus(err.Error()), nil
 	}
@@ -8,7 +8,7 @@ import (
 )
 
 // args: key
-func GET(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func GET(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "get"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
@@ -27,7 +27,7 @@ func GET(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
 }
 
 // args: key
-func STRLEN(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error) {
+func STRLEN(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error) {
 	if err := checkExactArgs(args, 1, "strlen"); err != nil {
 		return redis.NewError(err.Error()).WriteTo(w)
 	}
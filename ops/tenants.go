@@ -0,0 +1,44 @@
+package ops
+
+import (
+	"encoding/json"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+)
+
+// args: tenantJson
+// creates or updates a tenant, see dbwrap.Tenant
+func TENANTPUT(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 1, "tenantput"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	t := &dbwrap.Tenant{}
+	err := json.Unmarshal(args[0], t)
+	if err != nil {
+		return redis.WrapStatus("ERR bad tenant definition: " + err.Error()), nil
+	}
+	if t.Name == "" || t.Prefix == "" {
+		return redis.WrapStatus("ERR tenants need a name and a prefix"), nil
+	}
+	err = dbwrap.PutTenant(txn, t)
+	if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
+
+// args: name
+// removes a tenant, its keys stay put
+func TENANTDROP(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+	if err := checkExactArgs(args, 1, "tenantdrop"); err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	err := dbwrap.DeleteTenant(txn, string(args[0]))
+	if err == mdb.NotFound {
+		return redis.WrapStatus("ERR no such tenant " + string(args[0])), nil
+	} else if err != nil {
+		return redis.WrapStatus(err.Error()), nil
+	}
+	return redis.WrapStatus("OK"), dbwrap.Commit(txn)
+}
@@ -0,0 +1,121 @@
+package ops
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"testing"
+)
+
+// like doWrite, tracking tenant usage for the op's first key the way the server does
+func doTrackedWrite(t *testing.T, env *mdb.Env, op func([][]byte, *dbwrap.Txn) ([]byte, error), args ...string) string {
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	tracked := dbwrap.NewTxn(txn)
+	err = dbwrap.TrackUsage(tracked, toArgs(args[:1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := op(toArgs(args), tracked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp)
+}
+
+func tenantUsage(t *testing.T, env *mdb.Env, name string) dbwrap.TenantUsage {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	usage, err := dbwrap.GetTenantUsage(dbwrap.NewTxn(txn), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage
+}
+
+func TestTenantUsage(t *testing.T) {
+	env := elementsTestEnv(t)
+	defer env.Close()
+
+	doWrite(t, env, SET, "a:before", "12345")
+	doWrite(t, env, SET, "b:other", "12345")
+	if resp := doWrite(t, env, TENANTPUT, `{"name":"a","prefix":"a:","maxKeys":10}`); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from TENANTPUT, got %q", resp)
+	}
+	if resp := doWrite(t, env, TENANTPUT, `{"name":"a2","prefix":"a:"}`); resp == "+OK\r\n" {
+		t.Fatalf("Expecting duplicate prefix to fail")
+	}
+	// existing keys are counted on creation
+	before := tenantUsage(t, env, "a")
+	if before.Keys != 1 || before.Bytes <= 0 {
+		t.Fatalf("Expecting 1 key counted on creation, got %+v", before)
+	}
+
+	doTrackedWrite(t, env, SET, "a:newkey", "12345")
+	usage := tenantUsage(t, env, "a")
+	if usage.Keys != 2 || usage.Bytes != 2*before.Bytes {
+		t.Fatalf("Expecting 2 keys of the same size, got %+v after %+v", usage, before)
+	}
+	// keys outside the tenant don't count
+	doTrackedWrite(t, env, SET, "b:more", "12345")
+	if tenantUsage(t, env, "a") != usage {
+		t.Fatalf("Expecting usage unchanged by a key outside the tenant")
+	}
+
+	// elements count too
+	args := []string{"a:bighash"}
+	for i := 0; i < dbwrap.ElementThreshold+10; i++ {
+		args = append(args, fmt.Sprintf("f%d", i), fmt.Sprintf("v%d", i))
+	}
+	doTrackedWrite(t, env, HMSET, args...)
+	withHash := tenantUsage(t, env, "a")
+	if withHash.Keys != 3 || withHash.Bytes-usage.Bytes < int64(dbwrap.ElementThreshold*4) {
+		t.Fatalf("Expecting large hash's elements counted, got %+v after %+v", withHash, usage)
+	}
+	doTrackedWrite(t, env, DEL, "a:bighash")
+	if tenantUsage(t, env, "a") != usage {
+		t.Fatalf("Expecting DEL to give back everything, got %+v expected %+v", tenantUsage(t, env, "a"), usage)
+	}
+
+	// a recount agrees with the tracked numbers
+	doWrite(t, env, TENANTPUT, `{"name":"aa","prefix":"a:b"}`)
+	doWrite(t, env, TENANTDROP, "aa")
+	if tenantUsage(t, env, "a") != usage {
+		t.Fatalf("Expecting recount to match, got %+v expected %+v", tenantUsage(t, env, "a"), usage)
+	}
+
+	// longest prefix wins, keys sorting past a longer prefix still find the shorter one
+	doWrite(t, env, TENANTPUT, `{"name":"ax","prefix":"a:x"}`)
+	doTrackedWrite(t, env, SET, "a:xy", "12345")
+	if got := tenantUsage(t, env, "ax"); got.Keys != 1 {
+		t.Fatalf("Expecting a:xy counted for ax, got %+v", got)
+	}
+	doTrackedWrite(t, env, SET, "a:y", "12345")
+	if got := tenantUsage(t, env, "a"); got.Keys != usage.Keys+1 {
+		t.Fatalf("Expecting a:y counted for a, got %+v after %+v", got, usage)
+	}
+	doTrackedWrite(t, env, SET, "b:z", "12345")
+	if got := tenantUsage(t, env, "a"); got.Keys != usage.Keys+1 {
+		t.Fatalf("Expecting b:z not counted, got %+v", got)
+	}
+	doWrite(t, env, TENANTDROP, "ax")
+	if got := tenantUsage(t, env, "a"); got.Keys != usage.Keys+2 {
+		t.Fatalf("Expecting a to take over a:xy, got %+v", got)
+	}
+
+	if resp := doWrite(t, env, FLUSHDB, "0"); resp != "+OK\r\n" {
+		t.Fatalf("Expecting OK from FLUSHDB, got %q", resp)
+	}
+	if usage := tenantUsage(t, env, "a"); usage.Keys != 0 || usage.Bytes != 0 {
+		t.Fatalf("Expecting no usage after FLUSHDB, got %+v", usage)
+	}
+	if resp := doWrite(t, env, TENANTDROP, "nobody"); resp == "+OK\r\n" {
+		t.Fatalf("Expecting drop of unknown tenant to fail")
+	}
+}
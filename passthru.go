@@ -7,45 +7,77 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// commands one conn will have in flight before we try another
+const passthruDepth = 128
+
+var errPipelineFull = fmt.Errorf("Too many commands in flight")
+
 func NewPassThru(remoteHost string, lg *log.Logger) (*PassthruConn, error) {
-	conn, err := net.Dial("tcp", remoteHost)
+	return dialPassThru(remoteHost, defaultPassthruTimeout, nil, lg)
+}
+
+const defaultPassthruTimeout = 15 * time.Second
+
+// timeout is for connecting, writing each command and reading each reply.  observe, if not
+// nil, is called as each reply's done with how long it took since we sent the command and
+// the error reading it from remoteHost if there was one
+func dialPassThru(remoteHost string, timeout time.Duration, observe func(time.Duration, error), lg *log.Logger) (*PassthruConn, error) {
+	conn, err := net.DialTimeout("tcp", remoteHost, timeout)
 	if err != nil {
 		return nil, err
 	}
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	// go for sync mode
 	_, err = conn.Write([]byte("*1\r\n$8\r\nSYNCMODE\r\n"))
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("Error writing SYNCMODE establishing conn to %s", remoteHost)
 	}
 	in := bufio.NewReader(conn)
 	line, err := in.ReadString('\n')
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("Error writing reading SYNCMODE resp while establishing conn to %s", remoteHost)
 	}
 	if line != "+OK\r\n" {
+		conn.Close()
 		return nil, fmt.Errorf("Bad response when switching to SYNCMODE on conn to %s : %s", remoteHost, line)
 	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	ret := &PassthruConn{
-		make(chan *PassthruResp),
+		make(chan *PassthruResp, passthruDepth),
 		conn,
 		in,
 		bufio.NewWriter(conn),
 		new(sync.Mutex),
 		lg,
 		false,
+		timeout,
+		new(int32),
+		observe,
 	}
 	go ret.routeResponses()
 	return ret, nil
 }
 
 // threadsafe single conn multiplexer
-// doCommand writes the request over the wire and returns a chan which
-// will yield a single response of []byte,error (naively scanned until first '\n')
-// does not support multiline responses yet
+// Command writes the request over the wire and returns a PassthruResp which forwards
+// the reply once the replies to the commands ahead of it are done.  up to passthruDepth
+// commands can be in flight at once
 type PassthruConn struct {
 	pendingResp chan *PassthruResp
 	conn        net.Conn
@@ -54,6 +86,9 @@ type PassthruConn struct {
 	l           *sync.Mutex
 	lg          *log.Logger
 	closed      bool
+	timeout     time.Duration
+	inFlight    *int32
+	observe     func(time.Duration, error)
 }
 
 var crlf = []byte{byte('\r'), byte('\n')}
@@ -64,8 +99,11 @@ func (p *PassthruConn) Command(cmd string, args [][]byte) (*PassthruResp, error)
 	if p.closed {
 		return nil, fmt.Errorf("Connection closed!")
 	}
+	if atomic.LoadInt32(p.inFlight) >= passthruDepth {
+		return nil, errPipelineFull
+	}
 
-	err := p.conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	err := p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
 	if err != nil {
 		p.closeInternal()
 		return nil, fmt.Errorf("Error setting write deadline in Command %s to %s", cmd, p.conn.RemoteAddr().String())
@@ -81,52 +119,54 @@ func (p *PassthruConn) Command(cmd string, args [][]byte) (*PassthruResp, error)
 		return nil, fmt.Errorf("Error unsetting write deadline after successful Command %s to %s", cmd, p.conn.RemoteAddr().String())
 	}
 
-	// flush command, register receive chan
+	// register the response, there's always room in pendingResp for what's in flight
+	resp := &PassthruResp{make(chan error, 1), make(chan error, 1), p, p.lg, cmd, args, time.Now()}
+	atomic.AddInt32(p.inFlight, 1)
+	p.pendingResp <- resp
+	return resp, nil
+}
 
-	ready := make(chan error)
-	done := make(chan error)
-	resp := &PassthruResp{ready, done, p, p.lg, cmd, args}
-	err = sendCatch(p.pendingResp, resp)
-	return resp, err
+// commands sent that we haven't finished forwarding the reply to
+func (p *PassthruConn) InFlight() int {
+	return int(atomic.LoadInt32(p.inFlight))
 }
 
-func sendCatch(s chan *PassthruResp, p *PassthruResp) (err error) {
-	defer func() {
-		if x := recover(); x != nil {
-			err = fmt.Errorf("%v", x)
-		}
-	}()
-	err = nil
-	s <- p
-	return
+func (p *PassthruConn) Closed() bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.closed
 }
 
 func (p *PassthruConn) routeResponses() {
-	defer p.Close()
-	var err error = nil
+	defer func() {
+		p.Close()
+		// fail whatever was still waiting its turn
+		for resp := range p.pendingResp {
+			atomic.AddInt32(p.inFlight, -1)
+			resp.ready <- fmt.Errorf("Connection to %s closed before reply", p.conn.RemoteAddr().String())
+		}
+	}()
 	// we iterate in a loop, signaling ready on one chan then blocking till done on the other
 	// actual pipelining of responses is done by the goroutine invoking WriteTo() on PassthruResp to send to the actual client,
 	for resp := range p.pendingResp {
-		p.lg.Printf("Processing command")
-		// set read timeout for response
-		err = p.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		if err != nil {
-			p.lg.Printf("Error setting read deadline in readResponses from p.conn %s", p.conn.RemoteAddr().String())
-			return
-		}
 		//signal ready
-		p.lg.Printf("Signalling ready to respond to command")
-		resp.ready <- err
+		resp.ready <- nil
 		// wait done
-		err = <-resp.done
-		if err != nil {
-			p.lg.Printf("Error processing cmd in conn to %s", p.conn.RemoteAddr().String())
+		err := <-resp.done
+		atomic.AddInt32(p.inFlight, -1)
+		if _, ok := err.(clientErr); ok {
+			// our client went away mid reply, the rest of it is still on the wire
+			if p.observe != nil {
+				p.observe(time.Since(resp.sent), nil)
+			}
+			p.lg.Printf("Error forwarding reply from %s to client : %s", p.conn.RemoteAddr().String(), err)
 			return
 		}
-		// unset read deadline
-		err = p.conn.SetReadDeadline(time.Time{})
+		if p.observe != nil {
+			p.observe(time.Since(resp.sent), err)
+		}
 		if err != nil {
-			p.lg.Printf("Error setting read deadline in readResponses from p.conn %s", p.conn.RemoteAddr().String())
+			p.lg.Printf("Error processing cmd in conn to %s : %s", p.conn.RemoteAddr().String(), err)
 			return
 		}
 	}
@@ -230,25 +270,99 @@ type PassthruResp struct {
 	lg       *log.Logger
 	origCmd  string   // for debug
 	origArgs [][]byte // for debug
+	sent     time.Time
 }
 
-// Forwards a remote command to a client.
-func (p *PassthruResp) WriteTo(w io.Writer) (int64, error) {
-	// wait till our turn
+// an error writing a forwarded reply to our client, not the remote host's fault
+type clientErr struct {
+	error
+}
+
+// tags errors writing to w as clientErrs
+type clientWriter struct {
+	w io.Writer
+}
+
+func (c clientWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, clientErr{err}
+	}
+	return n, nil
+}
+
+// waits for our turn to read the reply, then gives the reader up to the timeout for it
+func (p *PassthruResp) start() error {
 	err := <-p.ready
+	if err == nil {
+		err = p.p.conn.SetReadDeadline(time.Now().Add(p.p.timeout))
+	}
 	if err != nil {
 		p.lg.Printf("passthru ERR! %s\n", err)
 		p.done <- err
+	}
+	return err
+}
+
+// Forwards a remote command to a client.
+func (p *PassthruResp) WriteTo(w io.Writer) (int64, error) {
+	// wait till our turn
+	err := p.start()
+	if err != nil {
 		return 0, err
 	}
 
 	// forward it along
-	written, err := forwardResponse(p.p.bufIn, w)
+	written, err := forwardResponse(p.p.bufIn, clientWriter{w})
 	// signal done
 	p.done <- err
 	return int64(written), err
 }
 
+// for a WITHINDEX reply, forwards the reply it wraps and returns the token that came with it.
+// a node that doesn't know WITHINDEX answers with a plain error, which is forwarded as is
+func (p *PassthruResp) WriteIndexedTo(w io.Writer) (int64, string, error) {
+	// wait till our turn
+	err := p.start()
+	if err != nil {
+		return 0, "", err
+	}
+	written, token, err := forwardIndexed(p.p.bufIn, clientWriter{w})
+	// signal done
+	p.done <- err
+	return int64(written), token, err
+}
+
+func forwardIndexed(in *bufio.Reader, out io.Writer) (int, string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	if line != "*2\r\n" {
+		written, err := out.Write([]byte(line))
+		return written, "", err
+	}
+	written, err := forwardResponse(in, out)
+	if err != nil {
+		return written, "", err
+	}
+	// token as a bulk string
+	line, err = in.ReadString('\n')
+	if err != nil {
+		return written, "", err
+	}
+	if line[0] != '$' {
+		return written, "", fmt.Errorf("Expected a bulk string token, got %q", line)
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || length < 0 {
+		return written, "", err
+	}
+	token := make([]byte, length+2)
+	_, err = io.ReadFull(in, token)
+	return written, string(token[:length]), err
+}
+
 func forwardResponse(in *bufio.Reader, out io.Writer) (int, error) {
 	// read first byte
 	respType, err := in.ReadByte()
@@ -0,0 +1,270 @@
+package raftis
+
+import (
+	"fmt"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// node-local registry of pub/sub subscribers
+// PUBLISH delivers to our subscribers here and fans out to every other node over
+// the passthru connections, messages are fire-and-forget and never touch raft
+type PubSub struct {
+	l        *sync.RWMutex
+	channels map[string]map[*Conn]bool
+	patterns map[string]map[*Conn]bool
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		&sync.RWMutex{},
+		make(map[string]map[*Conn]bool),
+		make(map[string]map[*Conn]bool),
+	}
+}
+
+func (p *PubSub) subscribe(c *Conn, channel string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	addSubscriber(p.channels, channel, c)
+}
+
+func (p *PubSub) unsubscribe(c *Conn, channel string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	removeSubscriber(p.channels, channel, c)
+}
+
+func (p *PubSub) psubscribe(c *Conn, pattern string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	addSubscriber(p.patterns, pattern, c)
+}
+
+func (p *PubSub) punsubscribe(c *Conn, pattern string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	removeSubscriber(p.patterns, pattern, c)
+}
+
+// drops every subscription held by c, called when the client goes away
+func (p *PubSub) removeConn(c *Conn) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	for ch, _ := range c.channels {
+		removeSubscriber(p.channels, ch, c)
+	}
+	for pat, _ := range c.patterns {
+		removeSubscriber(p.patterns, pat, c)
+	}
+}
+
+func addSubscriber(m map[string]map[*Conn]bool, name string, c *Conn) {
+	subs, ok := m[name]
+	if !ok {
+		subs = make(map[*Conn]bool)
+		m[name] = subs
+	}
+	subs[c] = true
+}
+
+func removeSubscriber(m map[string]map[*Conn]bool, name string, c *Conn) {
+	subs, ok := m[name]
+	if !ok {
+		return
+	}
+	delete(subs, c)
+	if len(subs) == 0 {
+		delete(m, name)
+	}
+}
+
+// delivers message to local subscribers, returns number of clients that received it
+func (p *PubSub) publish(channel []byte, message []byte) int {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	received := 0
+	for c, _ := range p.channels[string(channel)] {
+		c.push(&redis.ArrayReply{Value: [][]byte{[]byte("message"), channel, message}})
+		received++
+	}
+	for pattern, subs := range p.patterns {
+		if !redis.GlobMatch([]byte(pattern), channel) {
+			continue
+		}
+		for c, _ := range subs {
+			c.push(&redis.ArrayReply{Value: [][]byte{[]byte("pmessage"), []byte(pattern), channel, message}})
+			received++
+		}
+	}
+	return received
+}
+
+// active channel names, filtered by pattern if non-nil
+func (p *PubSub) channelNames(pattern []byte) [][]byte {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	names := make([]string, 0, len(p.channels))
+	for ch, _ := range p.channels {
+		if pattern == nil || redis.GlobMatch(pattern, []byte(ch)) {
+			names = append(names, ch)
+		}
+	}
+	sort.Strings(names)
+	ret := make([][]byte, len(names))
+	for i, n := range names {
+		ret[i] = []byte(n)
+	}
+	return ret
+}
+
+func (p *PubSub) numSub(channel []byte) int {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return len(p.channels[string(channel)])
+}
+
+func (p *PubSub) numPat() int {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return len(p.patterns)
+}
+
+// commands a client may still issue once it has subscriptions
+var pubsubModeOps = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+func pubsubModeReply(r *redis.Request) io.WriterTo {
+	if r.Name == "PING" {
+		return redis.NewMultiBulkReply([]byte("pong"), nil)
+	}
+	return redis.NewError(fmt.Sprintf("only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context, got %s", r.Name))
+}
+
+// args: channel [channel ...]
+func subscribe(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) == 0 {
+		return redis.NewError("ERR wrong number of arguments for 'subscribe' command")
+	}
+	ret := make(redis.MultiReply, len(args))
+	for i, ch := range args {
+		if !c.channels[string(ch)] {
+			c.channels[string(ch)] = true
+			s.pubsub.subscribe(c, string(ch))
+		}
+		ret[i] = redis.NewMultiBulkReply([]byte("subscribe"), ch, c.numSubscriptions())
+	}
+	return ret
+}
+
+// args: [channel ...], unsubscribes from all channels if none given
+func unsubscribe(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) == 0 {
+		for ch, _ := range c.channels {
+			args = append(args, []byte(ch))
+		}
+		if len(args) == 0 {
+			return redis.NewMultiBulkReply([]byte("unsubscribe"), nil, c.numSubscriptions())
+		}
+	}
+	ret := make(redis.MultiReply, len(args))
+	for i, ch := range args {
+		if c.channels[string(ch)] {
+			delete(c.channels, string(ch))
+			s.pubsub.unsubscribe(c, string(ch))
+		}
+		ret[i] = redis.NewMultiBulkReply([]byte("unsubscribe"), ch, c.numSubscriptions())
+	}
+	return ret
+}
+
+// args: pattern [pattern ...]
+func psubscribe(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) == 0 {
+		return redis.NewError("ERR wrong number of arguments for 'psubscribe' command")
+	}
+	ret := make(redis.MultiReply, len(args))
+	for i, pat := range args {
+		if !c.patterns[string(pat)] {
+			c.patterns[string(pat)] = true
+			s.pubsub.psubscribe(c, string(pat))
+		}
+		ret[i] = redis.NewMultiBulkReply([]byte("psubscribe"), pat, c.numSubscriptions())
+	}
+	return ret
+}
+
+// args: [pattern ...], unsubscribes from all patterns if none given
+func punsubscribe(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) == 0 {
+		for pat, _ := range c.patterns {
+			args = append(args, []byte(pat))
+		}
+		if len(args) == 0 {
+			return redis.NewMultiBulkReply([]byte("punsubscribe"), nil, c.numSubscriptions())
+		}
+	}
+	ret := make(redis.MultiReply, len(args))
+	for i, pat := range args {
+		if c.patterns[string(pat)] {
+			delete(c.patterns, string(pat))
+			s.pubsub.punsubscribe(c, string(pat))
+		}
+		ret[i] = redis.NewMultiBulkReply([]byte("punsubscribe"), pat, c.numSubscriptions())
+	}
+	return ret
+}
+
+// args: channel message
+// returns the number of clients on this node that got the message, like redis cluster
+func publish(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 2 {
+		return redis.NewError("ERR wrong number of arguments for 'publish' command")
+	}
+	received := s.pubsub.publish(args[0], args[1])
+	s.cluster.Broadcast("PUBLISHLOCAL", args)
+	return &redis.IntegerReply{Number: received}
+}
+
+// internal, sent by other nodes fanning out a PUBLISH
+// args: channel message
+func publishLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 2 {
+		return redis.NewError("ERR wrong number of arguments for 'publishlocal' command")
+	}
+	return &redis.IntegerReply{Number: s.pubsub.publish(args[0], args[1])}
+}
+
+// args: CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+// answers for subscribers on this node only, same as redis cluster
+func pubsubInfo(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) == 0 {
+		return redis.NewError("ERR wrong number of arguments for 'pubsub' command")
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "CHANNELS":
+		var pattern []byte = nil
+		if len(args) > 1 {
+			pattern = args[1]
+		}
+		return &redis.ArrayReply{Value: s.pubsub.channelNames(pattern)}
+	case "NUMSUB":
+		values := make([]interface{}, 0, 2*(len(args)-1))
+		for _, ch := range args[1:] {
+			values = append(values, ch, s.pubsub.numSub(ch))
+		}
+		return redis.NewMultiBulkReply(values...)
+	case "NUMPAT":
+		return &redis.IntegerReply{Number: s.pubsub.numPat()}
+	}
+	return redis.NewError(fmt.Sprintf("Unrecognized PUBSUB subcommand %s", string(args[0])))
+}
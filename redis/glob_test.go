@@ -0,0 +1,39 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		matches bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"news.*", "news.tech", true},
+		{"news.*", "news.", true},
+		{"news.*", "sports.tech", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, c := range cases {
+		if GlobMatch([]byte(c.pattern), []byte(c.str)) != c.matches {
+			t.Fatalf("Expected GlobMatch(%s, %s) == %t", c.pattern, c.str, c.matches)
+		}
+	}
+}
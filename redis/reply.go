@@ -53,6 +53,9 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 			}
 		}
 		return wrote64, nil
+	case []interface{}:
+		// nested arrays, like CLUSTER SLOTS
+		return writeMultiBytes(v, w)
 	case string:
 		return writeBytes([]byte(v), w)
 	case []byte:
@@ -133,6 +136,26 @@ func MultiBulkFromMap(m map[string]interface{}) *MultiBulkReply {
 	return &MultiBulkReply{values: values}
 }
 
+// values may be []byte, string, int, nil or []interface{} for a nested array
+func NewMultiBulkReply(values ...interface{}) *MultiBulkReply {
+	return &MultiBulkReply{values: values}
+}
+
+// writes several replies back to back, for commands like SUBSCRIBE a b c which answer once per argument
+type MultiReply []ReplyWriter
+
+func (r MultiReply) WriteTo(w io.Writer) (int64, error) {
+	total := int64(0)
+	for _, reply := range r {
+		n, err := reply.WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 func writeMultiBytes(values []interface{}, w io.Writer) (int64, error) {
 	if values == nil {
 		return 0, errors.New("Nil in multi bulk replies are not ok")
@@ -0,0 +1,17 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestNestedMultiBulk(t *testing.T) {
+	r := NewMultiBulkReply(0, 5460, []interface{}{"127.0.0.1", 6379, []byte("abc")})
+	s, err := ReplyToString(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "*3\r\n:0\r\n:5460\r\n*3\r\n$9\r\n127.0.0.1\r\n:6379\r\n$3\r\nabc\r\n"
+	if s != expected {
+		t.Fatalf("Expected %q, got %q", expected, s)
+	}
+}
@@ -0,0 +1,237 @@
+package raftis
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jbooth/flotilla"
+	mdb "github.com/jbooth/gomdb"
+	"github.com/jbooth/raftis/config"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// moving an existing cluster to a new slot layout, usually legacy hashing to crc16 with
+// 16384 slots.  shards keep their hosts and get contiguous slot ranges, see config.RehashShards.
+//  1. REHASH COPY crc16 16384 copies every key to the shard that owns it under the new layout.
+//     it can be run again to pick up writes made since, stop writes before the last run.
+//  2. genconfig <configDir> - rehash 16384 rewrites the node configs and the shards in etcd,
+//     then restart every node.
+//  3. REHASH PURGE crc16 16384 deletes the keys each shard no longer owns.
+// until the restart reads and writes go where they always did, so nothing's lost if it's abandoned.
+
+const rehashBatch = 100 // keys dumped per read txn and restored per RESTORELOCAL
+
+// REHASH COPY|PURGE slotHash numSlots
+func rehash(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 3 {
+		return redis.NewError("ERR wrong number of arguments for 'rehash' command")
+	}
+	sub := strings.ToUpper(string(args[0]))
+	if sub != "COPY" && sub != "PURGE" {
+		return redis.NewError("ERR REHASH takes COPY or PURGE")
+	}
+	if _, _, err := parseLayout(args[1:]); err != nil {
+		return redis.NewError(err.Error())
+	}
+	return sumInts(s.onEveryShard(rehashLocal, "REHASHLOCAL", append([][]byte{[]byte(sub)}, args[1:]...)))
+}
+
+func parseLayout(args [][]byte) (string, uint32, error) {
+	slotHash := strings.ToLower(string(args[0]))
+	if err := config.ValidSlotHash(slotHash); err != nil {
+		return "", 0, fmt.Errorf("ERR %s", err)
+	}
+	numSlots, err := strconv.ParseUint(string(args[1]), 10, 32)
+	if err != nil || numSlots == 0 {
+		return "", 0, fmt.Errorf("ERR invalid number of slots %s", args[1])
+	}
+	return slotHash, uint32(numSlots), nil
+}
+
+// REHASHLOCAL COPY|PURGE slotHash numSlots
+// runs one step on our shard, replies with the number of keys copied or purged
+func rehashLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 3 {
+		return redis.NewError("ERR wrong number of arguments for 'rehashlocal' command")
+	}
+	slotHash, numSlots, err := parseLayout(args[1:])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	s.cluster.l.RLock()
+	current := s.cluster.c.SlotHash
+	if current == "" {
+		current = config.SlotHashLegacy
+	}
+	switched := current == slotHash && s.cluster.c.NumSlots == numSlots
+	shards := config.RehashShards(s.cluster.c.Shards, int(numSlots))
+	me := s.cluster.c.Me.RedisAddr
+	s.cluster.l.RUnlock()
+	var n int
+	if strings.ToUpper(string(args[0])) == "COPY" {
+		if switched {
+			return redis.NewError(fmt.Sprintf("ERR already using %s with %d slots", slotHash, numSlots))
+		}
+		n, err = s.rehashCopy(slotHash, numSlots, shards, me)
+	} else {
+		// purging under the old layout would delete everything we just copied in
+		if !switched {
+			return redis.NewError(fmt.Sprintf("ERR not using %s with %d slots yet, update configs and restart first", slotHash, numSlots))
+		}
+		n, err = s.rehashPurge()
+	}
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return &redis.IntegerReply{Number: n}
+}
+
+// copies every key we hold that belongs to another shard under the new layout over to it
+func (s *Server) rehashCopy(slotHash string, numSlots uint32, shards []config.Shard, me string) (int, error) {
+	owners := make(map[uint32]int)
+	for i, shard := range shards {
+		for _, slot := range shard.Slots {
+			owners[slot] = i
+		}
+	}
+	copied := 0
+	for db := 0; db < dbwrap.NumDBs; db++ {
+		var from []byte
+		for {
+			batches, next, err := s.dumpForeignKeys(db, from, func(key []byte) int {
+				shard := owners[config.KeySlot(slotHash, numSlots, key)]
+				for _, h := range shards[shard].Hosts {
+					if h.RedisAddr == me {
+						return -1
+					}
+				}
+				return shard
+			})
+			if err != nil {
+				return copied, err
+			}
+			for shard, batch := range batches {
+				reply, err := s.cluster.CommandHosts(shards[shard].Hosts, "RESTORELOCAL", append([][]byte{[]byte(strconv.Itoa(db))}, batch...))
+				if err != nil {
+					return copied, err
+				}
+				if len(reply) == 0 || reply[0] != ':' {
+					return copied, fmt.Errorf("RESTORELOCAL on shard %d failed : %s", shards[shard].ShardId, strings.TrimSpace(string(reply)))
+				}
+				copied += len(batch) / 2
+			}
+			if next == nil {
+				break
+			}
+			from = next
+		}
+	}
+	s.lg.Printf("Rehash copied %d keys to other shards", copied)
+	return copied, nil
+}
+
+// dumps the keys in the next window of db that owner says go elsewhere, as key, dump pairs
+// by the index of the shard they go to.  owner returns -1 for keys that stay.
+func (s *Server) dumpForeignKeys(db int, from []byte, owner func(key []byte) int) (map[int][][]byte, []byte, error) {
+	rtxn, err := s.flotilla.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rtxn.Abort()
+	txn := dbwrap.NewTxnInDB(rtxn, db)
+	keys, next, err := dbwrap.ScanKeys(txn, from, rehashBatch)
+	if err != nil {
+		return nil, nil, err
+	}
+	batches := make(map[int][][]byte)
+	for _, key := range keys {
+		shard := owner(key)
+		if shard < 0 {
+			continue
+		}
+		dump, err := dbwrap.DumpValue(txn, key)
+		if err == mdb.NotFound {
+			// expired
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		batches[shard] = append(batches[shard], key, dump)
+	}
+	return batches, next, nil
+}
+
+// deletes every key we hold that the current layout puts on another shard
+func (s *Server) rehashPurge() (int, error) {
+	purged := 0
+	for db := 0; db < dbwrap.NumDBs; db++ {
+		var from []byte
+		for {
+			txn, err := s.flotilla.Read()
+			if err != nil {
+				return purged, err
+			}
+			keys, next, err := dbwrap.ScanKeys(dbwrap.NewTxnInDB(txn, db), from, rehashBatch)
+			txn.Abort()
+			if err != nil {
+				return purged, err
+			}
+			foreign := make([][]byte, 0)
+			for _, key := range keys {
+				mine, err := s.cluster.HasKey("DEL", [][]byte{key})
+				if err != nil {
+					return purged, err
+				}
+				if !mine {
+					foreign = append(foreign, key)
+				}
+			}
+			if len(foreign) > 0 {
+				resp := <-s.command(db, "DEL", foreign)
+				if resp.Err != nil {
+					return purged, resp.Err
+				}
+				if len(resp.Response) == 0 || resp.Response[0] != ':' {
+					return purged, fmt.Errorf("DEL failed : %s", strings.TrimSpace(string(resp.Response)))
+				}
+				purged += len(foreign)
+			}
+			if next == nil {
+				break
+			}
+			from = next
+		}
+	}
+	s.lg.Printf("Rehash purged %d keys owned by other shards", purged)
+	return purged, nil
+}
+
+// RESTORELOCAL db key dump [key dump ...]
+// restores keys copied over by REHASH on our shard, whatever the current layout says.
+// replies with the number restored.
+func restoreLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'restorelocal' command")
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	pending := make([]<-chan flotilla.Result, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		pending = append(pending, s.command(db, "RESTORE", [][]byte{args[i], []byte("0"), args[i+1], []byte("REPLACE")}))
+	}
+	for _, p := range pending {
+		resp := <-p
+		if resp.Err != nil {
+			return redis.NewError(resp.Err.Error())
+		}
+		if !bytes.Equal(resp.Response, []byte("+OK\r\n")) {
+			return redis.NewError(strings.TrimPrefix(strings.TrimSpace(string(resp.Response)), "+"))
+		}
+	}
+	return &redis.IntegerReply{Number: len(pending)}
+}
@@ -33,7 +33,6 @@ func (l *Logger) Errorf(format string, v ...interface{}) {
 }
 
 func (l *Logger) Printf(format string, v ...interface{}) {
-	log.Printf(format, v)
 	if debug {
 		l.WrappedLogger.Printf(format, v...)
 	}
@@ -0,0 +1,302 @@
+package raftis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	redis "github.com/jbooth/raftis/redis"
+	log "github.com/jbooth/raftis/rlog"
+	"github.com/jbooth/raftis/rpc"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// forwarding between nodes over flotilla's port instead of our public redis port.
+// flotilla hands us the connections that open with rpcServiceCode, and dials it for us.
+// we keep one connection to each host we forward to.  requests carry an id, a deadline,
+// a trace id and their db, see the rpc package for the frames.  the host runs requests in
+// the order they arrive, like commands on a client connection, so a stream's writes land in
+// order, and sends each reply back as soon as it's ready whatever order that's in.
+// hosts say they serve rpc in their heartbeats, forwarding to hosts that don't yet goes
+// over their redis port as before, see hostpool.go.  internalOps, our half of cluster-wide
+// commands, are only served here and always go over rpc.
+
+const rpcServiceCode byte = 2
+
+// flotilla's connections for rpcServiceCode
+type rpcLayer interface {
+	net.Listener
+	Dial(address string, timeout time.Duration) (net.Conn, error)
+}
+
+func (s *Server) serveRPC(l rpcLayer) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lg.Printf("Stopped serving rpc : %s", err)
+			return
+		}
+		go s.serveRPCConn(conn)
+	}
+}
+
+func (s *Server) serveRPCConn(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	out := &rpcOut{bufio.NewWriter(conn), new(sync.Mutex)}
+	// stands in for the client connections the commands came from.  forwarded reads
+	// see every committed write, like they did over SYNCMODE
+	c := NewConn(conn)
+	c.syncRead = true
+	for {
+		req, err := rpc.ReadRequest(in)
+		if err != nil {
+			if err != io.EOF {
+				s.lg.Errorf("Error reading rpc request from %s : %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		s.lg.Printf("rpc trace %x: %s for db %d from %s", req.Trace, req.Name, req.Db, conn.RemoteAddr())
+		reply, local := s.dispatchRPC(c, req)
+		go s.respondRPC(out, req, reply, local)
+	}
+}
+
+// runs a forwarded command, in the order they came in.  returns whether it ran here, for
+// the index token of an indexed write
+func (s *Server) dispatchRPC(c *Conn, req *rpc.Request) (io.WriterTo, bool) {
+	if req.Deadline != 0 && time.Now().UnixNano() > req.Deadline {
+		return redis.NewError(fmt.Sprintf("ERR forwarded %s arrived past its deadline", req.Name)), false
+	}
+	serverOp, ok := internalOps[req.Name]
+	if !ok {
+		serverOp, ok = serverOps[req.Name]
+	}
+	if ok {
+		return serverOp(req.Args, c, s), false
+	}
+	local := false
+	if req.Flags&rpc.FlagIndexed != 0 {
+		local, _ = s.cluster.HasKey(req.Name, req.Args)
+	}
+	return s.route(c, req.Db, req.Name, req.Args), local
+}
+
+type rpcOut struct {
+	w *bufio.Writer
+	l *sync.Mutex
+}
+
+// waits for the reply and sends it back
+func (s *Server) respondRPC(out *rpcOut, req *rpc.Request, reply io.WriterTo, local bool) {
+	var b bytes.Buffer
+	_, err := reply.WriteTo(&b)
+	if err != nil {
+		b.Reset()
+		redis.NewError(err.Error()).WriteTo(&b)
+	}
+	token := ""
+	if local {
+		token = s.indexToken().String()
+	}
+	out.l.Lock()
+	defer out.l.Unlock()
+	err = rpc.WriteResponse(out.w, &rpc.Response{Id: req.Id, Token: token, Reply: b.Bytes()})
+	if err == nil {
+		err = out.w.Flush()
+	}
+	if err != nil {
+		s.lg.Errorf("Error sending rpc reply for trace %x : %s", req.Trace, err)
+	}
+}
+
+// one connection to another host's rpc service, shared by everything we forward to it
+type rpcConn struct {
+	conn    net.Conn
+	out     *bufio.Writer
+	l       *sync.Mutex // guards out and everything below
+	pending map[uint64]*rpcCall
+	nextId  uint64
+	closed  bool
+	observe func(time.Duration, error)
+	lg      *log.Logger
+}
+
+// observe is called as each call finishes, like for a PassthruConn
+func dialRPC(l rpcLayer, addr string, timeout time.Duration, observe func(time.Duration, error), lg *log.Logger) (*rpcConn, error) {
+	conn, err := l.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	r := &rpcConn{conn, bufio.NewWriter(conn), new(sync.Mutex), make(map[uint64]*rpcCall), 0, false, observe, lg}
+	go r.readResponses()
+	return r, nil
+}
+
+func (r *rpcConn) Command(req forwardReq, timeout time.Duration) (*rpcCall, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.closed {
+		return nil, fmt.Errorf("Connection closed!")
+	}
+	r.nextId++
+	now := time.Now()
+	call := &rpcCall{r, r.nextId, uint64(rand.Int63()), now, now.Add(timeout), make(chan rpcResult, 1)}
+	flags := byte(0)
+	if req.indexed {
+		flags |= rpc.FlagIndexed
+	}
+	r.lg.Printf("Forwarding %s to %s over rpc, trace %x", req.name, r.conn.RemoteAddr(), call.trace)
+	err := r.conn.SetWriteDeadline(call.deadline)
+	if err == nil {
+		err = rpc.WriteRequest(r.out, &rpc.Request{
+			Id:       call.id,
+			Deadline: call.deadline.UnixNano(),
+			Trace:    call.trace,
+			Db:       req.db,
+			Flags:    flags,
+			Name:     req.name,
+			Args:     req.args,
+		})
+	}
+	if err == nil {
+		err = r.out.Flush()
+	}
+	if err != nil {
+		r.closeInternal(err)
+		return nil, err
+	}
+	r.pending[call.id] = call
+	return call, nil
+}
+
+func (r *rpcConn) readResponses() {
+	in := bufio.NewReader(r.conn)
+	for {
+		resp, err := rpc.ReadResponse(in)
+		if err != nil {
+			r.l.Lock()
+			waiting := len(r.pending) > 0 && !r.closed
+			r.closeInternal(fmt.Errorf("Connection to %s lost : %s", r.conn.RemoteAddr(), err))
+			r.l.Unlock()
+			if waiting {
+				// an idle conn going away isn't the host's fault, we'll just dial again
+				r.observe(0, err)
+			}
+			return
+		}
+		r.l.Lock()
+		call, ok := r.pending[resp.Id]
+		delete(r.pending, resp.Id)
+		r.l.Unlock()
+		if !ok {
+			// gave up waiting on it
+			continue
+		}
+		r.observe(time.Since(call.sent), nil)
+		call.done <- rpcResult{resp, nil}
+	}
+}
+
+// calls waiting on replies
+func (r *rpcConn) InFlight() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return len(r.pending)
+}
+
+func (r *rpcConn) Closed() bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.closed
+}
+
+func (r *rpcConn) Close() {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.closeInternal(fmt.Errorf("Connection closed!"))
+}
+
+// fails everything waiting, assumes r.l is held
+func (r *rpcConn) closeInternal(err error) {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.conn.Close()
+	for id, call := range r.pending {
+		delete(r.pending, id)
+		call.done <- rpcResult{nil, err}
+	}
+}
+
+// gives up on a call past its deadline, false if its reply beat us to it
+func (r *rpcConn) abandon(call *rpcCall) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	_, ok := r.pending[call.id]
+	delete(r.pending, call.id)
+	return ok
+}
+
+type rpcResult struct {
+	resp *rpc.Response
+	err  error
+}
+
+// a command forwarded over rpc, WriteTo waits for its reply and sends it to our client
+type rpcCall struct {
+	r        *rpcConn
+	id       uint64
+	trace    uint64
+	sent     time.Time
+	deadline time.Time
+	done     chan rpcResult
+}
+
+// net.Error so it counts as a timeout against the host
+type rpcTimeout struct {
+	trace uint64
+}
+
+func (e rpcTimeout) Error() string {
+	return fmt.Sprintf("Timed out waiting on forwarded command, trace %x", e.trace)
+}
+func (e rpcTimeout) Timeout() bool   { return true }
+func (e rpcTimeout) Temporary() bool { return true }
+
+func (c *rpcCall) wait() rpcResult {
+	timer := time.NewTimer(c.deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case res := <-c.done:
+		return res
+	case <-timer.C:
+		if !c.r.abandon(c) {
+			// the reply or an error's on its way
+			return <-c.done
+		}
+		err := rpcTimeout{c.trace}
+		c.r.observe(time.Since(c.sent), err)
+		return rpcResult{nil, err}
+	}
+}
+
+func (c *rpcCall) WriteTo(w io.Writer) (int64, error) {
+	n, _, err := c.WriteIndexedTo(w)
+	return n, err
+}
+
+// our client gets an error reply if the host never answered, their connection's still good
+func (c *rpcCall) WriteIndexedTo(w io.Writer) (int64, string, error) {
+	res := c.wait()
+	if res.err != nil {
+		n, err := redis.NewError(fmt.Sprintf("Error forwarding command: %s", res.err)).WriteTo(w)
+		return n, "", err
+	}
+	n, err := w.Write(res.resp.Reply)
+	return int64(n), res.resp.Token, err
+}
@@ -0,0 +1,220 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// frames for forwarding commands between raftis nodes.  every frame starts with a 4 byte
+// big endian length of the rest of it.
+//   request   id, deadline, trace (8 bytes each), db (4 bytes), flags (1 byte),
+//             name, arg count as a uvarint, then each arg.
+//   response  id (8 bytes), token, then the reply in redis protocol to the end of the frame.
+// names, args and tokens are a uvarint length and then their bytes.  a response carries the
+// id of the request it answers, responses can come back in any order.
+
+// largest frame either side will read, redis' own limit on a bulk string is 512MB
+const MaxFrame = 1 << 30
+
+const (
+	// the reply to a write comes back with the host's index token for it, see config.IndexToken
+	FlagIndexed byte = 1 << iota
+)
+
+var ErrShortFrame = errors.New("rpc frame ended early")
+
+type Request struct {
+	Id       uint64
+	Deadline int64  // unix nanoseconds the sender stops waiting at, 0 for none
+	Trace    uint64 // logged on both ends to follow a command across nodes
+	Db       int
+	Flags    byte
+	Name     string
+	Args     [][]byte
+}
+
+type Response struct {
+	Id    uint64
+	Token string // "" unless the request was FlagIndexed and the command ran on the host
+	Reply []byte // redis protocol, as the host would send it to a client
+}
+
+func WriteRequest(w io.Writer, req *Request) error {
+	size := 8 + 8 + 8 + 4 + 1 + binary.MaxVarintLen64 + len(req.Name) + binary.MaxVarintLen64
+	for _, arg := range req.Args {
+		size += binary.MaxVarintLen64 + len(arg)
+	}
+	b := make([]byte, 4, 4+size)
+	b = appendUint64(b, req.Id)
+	b = appendUint64(b, uint64(req.Deadline))
+	b = appendUint64(b, req.Trace)
+	b = append(b, byte(req.Db>>24), byte(req.Db>>16), byte(req.Db>>8), byte(req.Db))
+	b = append(b, req.Flags)
+	b = appendBytes(b, []byte(req.Name))
+	b = appendUvarint(b, uint64(len(req.Args)))
+	for _, arg := range req.Args {
+		b = appendBytes(b, arg)
+	}
+	return writeFrame(w, b)
+}
+
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	f, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{}
+	req.Id = f.uint64()
+	req.Deadline = int64(f.uint64())
+	req.Trace = f.uint64()
+	req.Db = int(int32(f.uint32()))
+	req.Flags = f.byte()
+	req.Name = string(f.bytes())
+	n := f.uvarint()
+	if n > uint64(len(f.b)) {
+		// every arg takes at least a byte
+		return nil, ErrShortFrame
+	}
+	req.Args = make([][]byte, n)
+	for i := range req.Args {
+		req.Args[i] = f.bytes()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return req, nil
+}
+
+func WriteResponse(w io.Writer, resp *Response) error {
+	b := make([]byte, 4, 4+8+binary.MaxVarintLen64+len(resp.Token)+len(resp.Reply))
+	b = appendUint64(b, resp.Id)
+	b = appendBytes(b, []byte(resp.Token))
+	b = append(b, resp.Reply...)
+	return writeFrame(w, b)
+}
+
+func ReadResponse(r *bufio.Reader) (*Response, error) {
+	f, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	resp := &Response{}
+	resp.Id = f.uint64()
+	resp.Token = string(f.bytes())
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp.Reply = f.b
+	return resp, nil
+}
+
+// fills in the length at the start of b and writes it
+func writeFrame(w io.Writer, b []byte) error {
+	n := len(b) - 4
+	if n > MaxFrame {
+		return fmt.Errorf("rpc frame of %d bytes is over the limit of %d", n, MaxFrame)
+	}
+	binary.BigEndian.PutUint32(b, uint32(n))
+	_, err := w.Write(b)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (*frame, error) {
+	var length [4]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > MaxFrame {
+		return nil, fmt.Errorf("rpc frame of %d bytes is over the limit of %d", n, MaxFrame)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &frame{b, nil}, nil
+}
+
+// reads fields off the front of a frame, after the first error they all come back zero
+type frame struct {
+	b   []byte
+	err error
+}
+
+func (f *frame) next(n int) []byte {
+	if f.err != nil || n > len(f.b) {
+		f.err = ErrShortFrame
+		return nil
+	}
+	ret := f.b[:n]
+	f.b = f.b[n:]
+	return ret
+}
+
+func (f *frame) uint64() uint64 {
+	b := f.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (f *frame) uint32() uint32 {
+	b := f.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (f *frame) byte() byte {
+	b := f.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (f *frame) uvarint() uint64 {
+	if f.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(f.b)
+	if n <= 0 {
+		f.err = ErrShortFrame
+		return 0
+	}
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *frame) bytes() []byte {
+	n := f.uvarint()
+	if n > uint64(len(f.b)) {
+		f.err = ErrShortFrame
+		return nil
+	}
+	return f.next(int(n))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	return append(appendUvarint(b, uint64(len(v))), v...)
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	req := &Request{7, 1234567890123, 0xdeadbeef, 12, FlagIndexed, "SET", [][]byte{[]byte("key"), []byte{}, []byte("val")}}
+	var b bytes.Buffer
+	err := WriteRequest(&b, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteRequest(&b, &Request{8, 0, 0, 0, 0, "PING", nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&b)
+	got, err := ReadRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != 7 || got.Deadline != 1234567890123 || got.Trace != 0xdeadbeef || got.Db != 12 || got.Flags != FlagIndexed || got.Name != "SET" {
+		t.Fatalf("Expected %+v, got %+v", req, got)
+	}
+	if len(got.Args) != 3 || string(got.Args[0]) != "key" || len(got.Args[1]) != 0 || string(got.Args[2]) != "val" {
+		t.Fatalf("Expected args key, empty, val, got %q", got.Args)
+	}
+	got, err = ReadRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != 8 || got.Name != "PING" || len(got.Args) != 0 {
+		t.Fatalf("Expected PING with id 8, got %+v", got)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteResponse(&b, &Response{3, "0:17,2:40", []byte("+OK\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteResponse(&b, &Response{2, "", []byte("$3\r\nbar\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&b)
+	got, err := ReadResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != 3 || got.Token != "0:17,2:40" || string(got.Reply) != "+OK\r\n" {
+		t.Fatalf("Expected id 3 with token and +OK, got %+v", got)
+	}
+	got, err = ReadResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != 2 || got.Token != "" || string(got.Reply) != "$3\r\nbar\r\n" {
+		t.Fatalf("Expected id 2 with bulk bar, got %+v", got)
+	}
+}
+
+func TestBadFrames(t *testing.T) {
+	var b bytes.Buffer
+	WriteRequest(&b, &Request{1, 0, 0, 0, 0, "GET", [][]byte{[]byte("key")}})
+	whole := b.Bytes()
+	// cut off mid frame
+	_, err := ReadRequest(bufio.NewReader(bytes.NewReader(whole[:len(whole)-2])))
+	if err == nil {
+		t.Fatalf("Expected an error reading a truncated frame")
+	}
+	// length says there's less than the fields need
+	short := append([]byte{0, 0, 0, 10}, whole[4:14]...)
+	_, err = ReadRequest(bufio.NewReader(bytes.NewReader(short)))
+	if err != ErrShortFrame {
+		t.Fatalf("Expected ErrShortFrame, got %v", err)
+	}
+	// more args than bytes to hold them
+	b.Reset()
+	WriteRequest(&b, &Request{1, 0, 0, 0, 0, "GET", nil})
+	lying := b.Bytes()
+	lying[len(lying)-1] = 100
+	_, err = ReadRequest(bufio.NewReader(bytes.NewReader(lying)))
+	if err != ErrShortFrame {
+		t.Fatalf("Expected ErrShortFrame, got %v", err)
+	}
+	// over the limit
+	_, err = ReadResponse(bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})))
+	if err == nil {
+		t.Fatalf("Expected an error reading an oversized frame")
+	}
+}
@@ -8,26 +8,34 @@ import (
 	"github.com/jbooth/flotilla"
 	mdb "github.com/jbooth/gomdb"
 	config "github.com/jbooth/raftis/config"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
 	ops "github.com/jbooth/raftis/ops"
 	redis "github.com/jbooth/raftis/redis"
 	log "github.com/jbooth/raftis/rlog"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// applied through raft, each command runs against its own dbwrap.Txn, see raftCommands
+type writeOp func(args [][]byte, txn *dbwrap.Txn) ([]byte, error)
+
 // writes a valid redis protocol response to the supplied Writer, returning bytes written, err
-type readOp func(args [][]byte, txn *mdb.Txn, w io.Writer) (int64, error)
+type readOp func(args [][]byte, txn *dbwrap.Txn, w io.Writer) (int64, error)
 type serverOp func(args [][]byte, c *Conn, s *Server) io.WriterTo
 
 var emptyBytes = make([]byte, 0)
 var emptyArgs = make([][]byte, 0)
 
+// stats are collected, the heartbeat written and the shards record reread this often
+const heartbeatInterval = 5 * time.Second
+
 var (
-	writeOps = map[string]flotilla.Command{
+	writeOps = map[string]writeOp{
 		"SET":    ops.SET,
 		"GETSET": ops.GETSET,
 		"SETNX":  ops.SETNX,
@@ -62,13 +70,37 @@ var (
 		//EXPIREAT
 		// pseudo lua scripting :)
 		"EVAL": ops.EVAL,
+		// moving keys between shards
+		"RESTORE": ops.RESTORE,
 		// noop is for sync requests
-		"PING": func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		"PING": func(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
 			txn.Abort()
 			return []byte("+PONG\r\n"), nil
 		},
 	}
 
+	// raft commands only we propose, clients can't reach them through route
+	internalWriteOps = map[string]writeOp{
+		// online format upgrade
+		"REWRITEVALUES": ops.REWRITEVALUES,
+		// encryption at rest
+		"USEKEY": ops.USEKEY,
+		// dbs, INDB is registered in databases.go
+		"FLUSHDB":  ops.FLUSHDB,
+		"FLUSHALL": ops.FLUSHALL,
+		"SWAPDB":   ops.SWAPDB,
+		// tenants
+		"TENANTPUT":  ops.TENANTPUT,
+		"TENANTDROP": ops.TENANTDROP,
+		// proposed by the leader's evictor
+		"EVICT": ops.EVICT,
+		// moving keys between shards
+		"SETSLOT":    ops.SETSLOT,
+		"MIGRATEDEL": ops.MIGRATEDEL,
+		// replicated CONFIG SET, see settings.go
+		"CONFIGPUT": ops.CONFIGPUT,
+	}
+
 	readOps = map[string]readOp{
 		"GET":    ops.GET,
 		"STRLEN": ops.STRLEN,
@@ -93,24 +125,89 @@ var (
 		// SRANDMEMBER
 		// ttl
 		"TTL": ops.TTL,
+		// dbs
+		"DBSIZE": ops.DBSIZE,
+		// moving keys between shards
+		"DUMP": ops.DUMP,
 	}
 
 	serverOps = map[string]serverOp{
-		"CONFIG":     handleConfig,
-		"SYNCMODE":   dosync,
-		"NOSYNCMODE": donosync,
-		"FATAL":      fatal,
-		"STATS":      stats,
+		"CONFIG":       handleConfig,
+		"SYNCMODE":     dosync,
+		"NOSYNCMODE":   donosync,
+		"MAXSTALENESS": maxStaleness,
+		"FATAL":        fatal,
+		"STATS":        stats,
+		"CLUSTER":      clusterCmd,
+		// pub/sub
+		"SUBSCRIBE":    subscribe,
+		"UNSUBSCRIBE":  unsubscribe,
+		"PSUBSCRIBE":   psubscribe,
+		"PUNSUBSCRIBE": punsubscribe,
+		"PUBLISH":      publish,
+		"PUBSUB":       pubsubInfo,
+		// change data capture
+		"CDC": cdc,
+		// on-disk format
+		"UPGRADEFORMAT": upgradeFormat,
+		"ROTATEKEYS":    rotateKeys,
+		"COMPACT":       compact,
+		// logical dbs, INDB is registered in databases.go
+		"SELECT":   selectDB,
+		"FLUSHDB":  flushDB,
+		"FLUSHALL": flushAll,
+		"SWAPDB":   swapDB,
+		"DBSIZE":   dbSize,
+		// tenants
+		"TENANT": tenant,
+		// slot layout migration
+		"REHASH": rehash,
+		// live slot migration, MIGRATESLOT is registered in migrate.go
+		"ASKING": asking,
+	}
+
+	// what other nodes send us to carry out their half of a cluster-wide command.  only
+	// served over rpc, see rpc.go, so clients can't skip the cluster-wide half
+	internalOps = map[string]serverOp{
+		"CONFIGSETLOCAL": configSetLocal,
+		"KEYCHECKLOCAL":  keyCheckLocal,
+		// pub/sub
+		"PUBLISHLOCAL": publishLocal,
+		// logical dbs
+		"FLUSHDBLOCAL":  flushDBLocal,
+		"FLUSHALLLOCAL": flushAllLocal,
+		"SWAPDBLOCAL":   swapDBLocal,
+		"DBSIZELOCAL":   dbSizeLocal,
+		// tenants
+		"TENANTPUTLOCAL":   tenantPutLocal,
+		"TENANTDROPLOCAL":  tenantDropLocal,
+		"TENANTUSAGELOCAL": tenantUsageLocal,
+		// slot layout migration
+		"REHASHLOCAL":  rehashLocal,
+		"RESTORELOCAL": restoreLocal,
+		// live slot migration, ASKED is registered in migrate.go
+		"SETSLOTLOCAL":    setSlotLocal,
+		"MIGRATEDELLOCAL": migrateDelLocal,
+		"REFRESHSHARDS":   refreshShardsCmd,
 	}
 )
 
 type Server struct {
-	cluster  *ClusterMember
-	etcdC    *etcd.Client
-	flotilla flotilla.DB
-	redis    *net.TCPListener
-	lg       *log.Logger
-	stats    *StatsCounter
+	cluster    *ClusterMember
+	etcdC      *etcd.Client
+	flotilla   flotilla.DB
+	redis      *net.TCPListener
+	lg         *log.Logger
+	stats      *StatsCounter
+	pubsub     *PubSub
+	keyspace   *keyspaceNotifier
+	upgrade    *formatUpgrade
+	tenants    *tenantLimiter
+	evictor    *evictor
+	mapSize    *mapGrower
+	compaction *compaction
+	migration  *slotMigration
+	settings   *replicatedConfig
 }
 
 func NewServer(c *config.ClusterConfig,
@@ -121,8 +218,17 @@ func NewServer(c *config.ClusterConfig,
 		fmt.Sprintf("Raftis %s:\t", c.Me.RedisAddr),
 		log.LstdFlags,
 		debugLogging)
+	ops.SetLogger(lg)
 	etcdClient := etcd.NewClient([]string{c.Etcd})
 	//etcd.SetLogger(lg.WrappedLogger.Logger)
+	if c.Spare {
+		lg.Printf("Spare, waiting for a dead host to replace")
+		var err error
+		c, err = claimAbandonedHost(etcdClient, c, lg)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// find our replicaset
 	var ours []config.Host = nil
@@ -144,10 +250,40 @@ func NewServer(c *config.ClusterConfig,
 		flotillaPeers[idx] = h.FlotillaAddr
 	}
 
+	if err := config.ValidSlotHash(c.SlotHash); err != nil {
+		return nil, err
+	}
+	if err := validRedirects(c.ClusterRedirects); err != nil {
+		return nil, err
+	}
 	flotillaListen, err := net.Listen("tcp", c.Me.FlotillaAddr)
 	if err != nil {
 		return nil, err
 	}
+	keyspace, err := newKeyspaceNotifier(c.NotifyKeyspaceEvents, lg)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := newEvictor(c.MaxMemory, c.MaxMemoryPolicy, lg)
+	if err != nil {
+		return nil, err
+	}
+	settings := &replicatedConfig{keyspace, ev, lg}
+	writes := allWriteOps()
+	writes["CONFIGPUT"] = settings.wrapPut(writes["CONFIGPUT"])
+	// until CONFIG SET compress-threshold records one for the cluster, see settings.go
+	dbwrap.SetCompressThreshold(c.CompressThreshold)
+	var snapshotCodec flotilla.SnapshotCodec = nil
+	var commandCodec flotilla.CommandCodec = nil
+	if c.KeyFile != "" {
+		keys, err := dbwrap.LoadKeyring(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		dbwrap.SetKeyring(keys)
+		snapshotCodec = keys
+		commandCodec = keys
+	}
 	// start flotilla
 	dialer := &dialer{
 		&net.Dialer{
@@ -157,16 +293,36 @@ func NewServer(c *config.ClusterConfig,
 			KeepAlive: 100 * time.Second * 86400,
 		},
 	}
-	f, err := flotilla.NewDB(
+	f, err := flotilla.NewDBWithOptions(
 		flotillaPeers,
 		c.Datadir,
-		flotillaListen, dialer.Dial, writeOps, lg.WrappedLogger.Logger)
+		flotillaListen, dialer.Dial, raftCommands(keyspace.wrapOps(wrapTenantOps(writes))),
+		flotilla.Options{
+			Codec:      snapshotCodec,
+			Commands:   commandCodec,
+			MapSize:    c.MapSize,
+			LeaseReads: c.LeaseReads,
+			Services:   []byte{rpcServiceCode},
+		},
+		lg.Writer())
 
 	if err != nil {
 		return nil, err
 	}
+	if c.KeyFile != "" {
+		// pick up the key from the last rotation
+		txn, err := f.Read()
+		if err != nil {
+			return nil, err
+		}
+		err = dbwrap.LoadCurrentKey(dbwrap.NewTxn(txn))
+		txn.Abort()
+		if err != nil {
+			return nil, err
+		}
+	}
 	// connect to cluster
-	cl, err := NewClusterMember(c, lg)
+	cl, err := NewClusterMember(c, f.Service(rpcServiceCode), lg)
 	if err != nil {
 		return nil, fmt.Errorf("Err connecting to cluster %s", err)
 	}
@@ -179,67 +335,70 @@ func NewServer(c *config.ClusterConfig,
 	}
 	redisListen, err := net.ListenTCP("tcp4", redisAddr)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't bind  to redisAddr %s", c.Me.RedisAddr, err)
+		return nil, fmt.Errorf("Couldn't bind to redisAddr %s : %s", c.Me.RedisAddr, err)
 	}
 	stats := &StatsCounter{
 		currInterval:    NewStatsInterval(),
 		l:               &sync.Mutex{},
-		ticker:          time.NewTicker(5 * time.Second), // every 5 seconds
+		ticker:          time.NewTicker(heartbeatInterval),
 		diskTotal:       totalDiskSpace(),
 		serverStartTime: time.Now().Unix(),
 	}
-	s := &Server{cl, etcdClient, f, redisListen, lg, stats}
+	s := &Server{cl, etcdClient, f, redisListen, lg, stats, NewPubSub(), keyspace, newFormatUpgrade(), newTenantLimiter(), ev, newMapGrower(c.MapGrowAt, c.MapMaxSize, lg), newCompaction(), newSlotMigration(), settings}
+	go keyspace.serve(s)
+	go s.serveRPC(f.Service(rpcServiceCode))
+	go ev.run(s)
+	go s.mapSize.run(f)
+	err = s.tenants.refresh(s)
+	if err != nil {
+		lg.Errorf("Error loading tenants : %s", err)
+	}
+	err = s.loadSlotStates()
+	if err != nil {
+		return nil, err
+	}
+	err = s.loadSettings()
+	if err != nil {
+		return nil, err
+	}
 	// update heartbeats and config
 	go func() {
 		for _ = range stats.ticker.C {
 			// get stats
 			collected := stats.collectInterval()
 			// get config
-			s.cluster.l.RLock()
-			etcdBase := s.cluster.c.EtcdBase
-			prevConfig := s.cluster.c
-			s.cluster.l.RUnlock()
-			confResp, err := s.etcdC.Get(etcdBase+"/shards", false, false)
+			err := s.refreshShards()
 			if err != nil {
-				panic("Lost contact with etcd in heartbeat!")
-			}
-			var shards []config.Shard
-			err = json.Unmarshal([]byte(confResp.Node.Value), &shards)
-			if err != nil {
-				panic(fmt.Errorf("Error unmarshalling shards from etcd!  resp: %s", confResp.Node.Value))
-			}
-			// update config if necessary
-			if !config.ShardsEqual(shards, prevConfig.Shards) {
-				s.cluster.l.Lock()
-				s.cluster.c.Shards = shards
-				myShard := s.cluster.c.MyShard()
-				newPeers := make(map[string]bool)
-				for _, h := range myShard.Hosts {
-					newPeers[h.FlotillaAddr] = true
-				}
-				for _, h := range prevConfig.MyShard().Hosts {
-					_, stillHere := newPeers[h.FlotillaAddr]
-					if !stillHere {
-						addr, err := net.ResolveTCPAddr("tcp", h.FlotillaAddr)
-						if err != nil {
-							panic(err)
-						}
-						err = s.flotilla.RemovePeer(addr)
-						if err != nil {
-							lg.Printf("Error removing peer %s : %s\n", h.FlotillaAddr, err)
-						}
-					}
-				}
-
-				s.cluster.l.Unlock()
+				panic(err)
 			}
 
 			// update heartbeat
+			s.mapSize.fill(collected)
+			collected.NumKeys, err = s.numKeys()
+			if err != nil {
+				lg.Errorf("Error counting keys : %s", err)
+			}
+			collected.Leader = s.flotilla.IsLeader()
+			collected.Rpc = true
 			heartBeatVal, err := json.Marshal(collected)
 			if err != nil {
 				panic(err)
 			}
 			s.etcdC.Set(c.HeartbeatKey(), string(heartBeatVal), 30) // TTL of 30, with updates every 5
+			err = s.refreshLeaders()
+			if err != nil {
+				lg.Errorf("Error reading shard leaders : %s", err)
+			}
+			// tenant quotas count usage on the other shards
+			err = s.tenants.refresh(s)
+			if err != nil {
+				lg.Errorf("Error refreshing tenant usage : %s", err)
+			}
+			// picks up settings that came in with a snapshot
+			err = s.loadSettings()
+			if err != nil {
+				lg.Errorf("Error loading settings : %s", err)
+			}
 			//lg.Printf("Collected stats interval %s on %s", collected.String(), t.String())
 		}
 	}()
@@ -247,64 +406,117 @@ func NewServer(c *config.ClusterConfig,
 	return s, nil
 }
 
-func (s *Server) joinAbandonedShard(etcdC *etcd.Client, origConfig *config.ClusterConfig) *config.ClusterConfig {
-	for {
-		// pull newest shards
-		confResp, err := s.etcdC.Get(origConfig.EtcdBase+"/shards", false, false)
-		if err != nil {
-			panic("Lost contact with etcd in heartbeat!")
+// picks up the shards record from etcd, new slot owners start getting our forwards
+// and hosts joining or leaving our shard are added or dropped as raft peers
+func (s *Server) refreshShards() error {
+	s.cluster.l.RLock()
+	etcdBase := s.cluster.c.EtcdBase
+	prevConfig := *s.cluster.c
+	s.cluster.l.RUnlock()
+	confResp, err := s.etcdC.Get(etcdBase+"/shards", false, false)
+	if err != nil {
+		return fmt.Errorf("Lost contact with etcd in heartbeat!")
+	}
+	var shards []config.Shard
+	err = json.Unmarshal([]byte(confResp.Node.Value), &shards)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling shards from etcd!  resp: %s", confResp.Node.Value)
+	}
+	// update config if necessary
+	if config.ShardsEqual(shards, prevConfig.Shards) {
+		return nil
+	}
+	s.cluster.l.Lock()
+	s.cluster.setShards(shards)
+	myShard := s.cluster.c.MyShard()
+	s.cluster.l.Unlock()
+	// the leader changes raft membership to match, it's ErrNotLeader everywhere else
+	prevPeers := make(map[string]bool)
+	for _, h := range prevConfig.MyShard().Hosts {
+		prevPeers[h.FlotillaAddr] = true
+	}
+	newPeers := make(map[string]bool)
+	for _, h := range myShard.Hosts {
+		newPeers[h.FlotillaAddr] = true
+	}
+	added := make([]string, 0)
+	for peer := range newPeers {
+		if !prevPeers[peer] {
+			added = append(added, peer)
+		}
+	}
+	removed := make([]string, 0)
+	for peer := range prevPeers {
+		if !newPeers[peer] {
+			removed = append(removed, peer)
 		}
-		var shards []config.Shard
-		err = json.Unmarshal([]byte(confResp.Node.Value), &shards)
-		// iterate nodes and see if any down
-		downShardIdx := -1
-		downHostIdx := -1
-		for si, s := range shards {
-			for hi, h := range s.Hosts {
-				node := origConfig.EtcdBase + "/nodes/" + h.FlotillaAddr + "/heartbeat"
-				_, err := etcdC.Get(node, false, false)
-				if err != nil {
-					v, ok := err.(*etcd.EtcdError)
-					if ok && v.Message == "Key not found" {
-						// node is down, try to take its place
-						downShardIdx = si
-						downHostIdx = hi
-						goto joinCluster
-					}
-				}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		// adding snapshots first, which can take a while, keep heartbeating meanwhile
+		go s.changePeers(added, removed)
+	}
+	return nil
+}
 
-			}
+// picks up which host leads each shard and which hosts serve rpc from their heartbeats,
+// forwarded writes go straight to leaders
+func (s *Server) refreshLeaders() error {
+	s.cluster.l.RLock()
+	nodes := s.cluster.c.EtcdBase + "/nodes"
+	s.cluster.l.RUnlock()
+	resp, err := s.etcdC.Get(nodes, false, true)
+	if err != nil {
+		return err
+	}
+	leaders := make(map[string]bool)
+	rpcHosts := make(map[string]bool)
+	for _, n := range resp.Node.Nodes {
+		var stats config.StatsInterval
+		if json.Unmarshal([]byte(n.Value), &stats) != nil {
+			continue
 		}
-	joinCluster:
-		if downHostIdx > 0 {
-			newDownShard := shards[downShardIdx]
-			origConfig.Me.Group = newDownShard.Hosts[downHostIdx].Group
-			newDownShard.Hosts[downHostIdx] = origConfig.Me
-			newShards := shards
-			newShards[downShardIdx] = newDownShard
-			newShardsBytes, err := json.Marshal(newShards)
-			if err != nil {
-				panic(err)
-			}
-			etcdC.CompareAndSwap(origConfig.EtcdBase+"/shards", string(newShardsBytes), 0, confResp.Node.Value, confResp.EtcdIndex)
-			if err != nil {
-				origConfig.Shards = newShards
-				return origConfig
-			}
+		host := strings.TrimPrefix(n.Key, nodes+"/")
+		if stats.Leader {
+			leaders[host] = true
+		}
+		if stats.Rpc {
+			rpcHosts[host] = true
 		}
-		// sleep 10s before relooping to give etcd a break
-		time.Sleep(10 * time.Second)
-
 	}
-	// pull newest shards and update config
-	// wait on nodes until a shard is dead
-
-	// generate config with us in place
-
-	// get and try to set
+	s.cluster.setLeaders(leaders, rpcHosts)
 	return nil
 }
 
+func (s *Server) changePeers(added []string, removed []string) {
+	// removing first keeps a majority up when a spare replaces a dead host
+	for _, peer := range removed {
+		addr, err := net.ResolveTCPAddr("tcp", peer)
+		if err != nil {
+			s.lg.Errorf("Error resolving removed peer %s : %s", peer, err)
+			continue
+		}
+		err = s.flotilla.RemovePeer(addr)
+		if err == nil {
+			s.lg.Printf("Removed peer %s", peer)
+		} else if err != flotilla.ErrNotLeader {
+			s.lg.Errorf("Error removing peer %s : %s", peer, err)
+		}
+	}
+	for _, peer := range added {
+		addr, err := net.ResolveTCPAddr("tcp", peer)
+		if err != nil {
+			s.lg.Errorf("Error resolving new peer %s : %s", peer, err)
+			continue
+		}
+		err = s.flotilla.AddPeer(addr)
+		if err == nil {
+			s.lg.Printf("Added peer %s", peer)
+		} else if err != flotilla.ErrNotLeader {
+			s.lg.Errorf("Error adding peer %s : %s", peer, err)
+		}
+	}
+}
+
 func (s *Server) Serve() (err error) {
 	defer func(s *Server) {
 		s.redis.Close()
@@ -335,45 +547,119 @@ func (d *dialer) Dial(address string, timeout time.Duration) (net.Conn, error) {
 var get []byte = []byte("GET")
 
 func (s *Server) doRequest(c *Conn, r *redis.Request) io.WriterTo {
+	if c.numSubscriptions() > 0 && (!pubsubModeOps[r.Name] || r.Name == "PING") {
+		return pubsubModeReply(r)
+	}
 	serverOp, ok := serverOps[r.Name]
 	if ok {
 		return serverOp(r.Args, c, s)
 	}
-	hasKey, err := s.cluster.HasKey(r.Name, r.Args)
+	return s.route(c, c.db, r.Name, r.Args)
+}
+
+// runs a keyed command against logical db, forwarding it if the key lives on another shard
+func (s *Server) route(c *Conn, db int, name string, args [][]byte) io.WriterTo {
+	hasKey, err := s.cluster.HasKey(name, args)
 	if err != nil {
 		keyStr := "NONE"
-		if r.Args != nil && len(r.Args) > 0 {
-			keyStr = string(r.Args[0])
+		if args != nil && len(args) > 0 {
+			keyStr = string(args[0])
 		}
 		s.lg.Errorf("error checking key status for key %s : %s", keyStr, err)
 		return redis.NewError(fmt.Sprintf("error checking key status for key %s : %s", keyStr, err))
 	}
+	redirect, hasKey := s.migrating(c, db, name, args, hasKey)
+	if redirect != nil {
+		return redirect
+	}
 	if !hasKey {
+		if s.redirects(c, db) {
+			// cluster client, let it go there itself
+			return s.moved(name, args)
+		}
 		// we don't have key locally, forward to correct node
 		s.stats.incrNumForwards()
-		fwd, err := s.cluster.ForwardCommand(r.Name, r.Args)
+		if _, isWrite := writeOps[name]; isWrite && c != nil && c.session.tracking() {
+			// comes back with the index to add to the session
+			fwd, err := s.cluster.ForwardWrite(forwardStream(c), db, name, args)
+			if err != nil {
+				return redis.NewError(fmt.Sprintf("Error forwarding command: %s", err.Error()))
+			}
+			return pendingForwardedWrite{fwd, c.session}
+		}
+		fwd, err := s.cluster.ForwardCommand(forwardStream(c), db, name, args)
 		if err != nil {
 			return redis.NewError(fmt.Sprintf("Error forwarding command: %s", err.Error()))
 		}
 		return fwd
 	}
-	// have the key locally, apply command or execute read
-	_, ok = writeOps[r.Name]
+	return s.serve(c, db, name, args)
+}
+
+// runs a command for a key we have locally
+func (s *Server) serve(c *Conn, db int, name string, args [][]byte) io.WriterTo {
+	// check quotas before proposing
+	err := s.tenants.check(s, db, name, args)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	s.evictor.touch(db, tenantKey(name, args))
+	// apply command or execute read
+	_, ok := writeOps[name]
 	if ok {
 		s.stats.incrNumWrites()
-		return pendingWrite{s.flotilla.Command(r.Name, r.Args)}
+		w := pendingWrite{s.command(db, name, args)}
+		if c != nil && c.session.tracking() {
+			return pendingTrackedWrite{w, s, c.session}
+		}
+		return w
 	}
-	readOp, ok := readOps[r.Name]
+	readOp, ok := readOps[name]
 	if ok {
 		s.stats.incrNumReads()
-		r := pendingRead{readOp, r.Args, s}
-		if c.syncRead {
-			return pendingSyncRead{s.flotilla.Command("PING", emptyArgs), r}
-		} else {
-			return r
+		r := pendingRead{readOp, args, s, db}
+		if c != nil && c.syncRead {
+			return pendingSyncRead{s.linearize(), r}
+		}
+		var next io.WriterTo = r
+		if c != nil && c.staleness.bounded() {
+			next = pendingBoundedRead{c.staleness, r}
+		}
+		if c != nil && c.session.waiting() {
+			if idx := c.session.waitIndex(s.myShardId()); idx > s.flotilla.AppliedIndex() {
+				return pendingIndexRead{idx, r, next}
+			}
 		}
+		return next
+	}
+	return redis.NewError(fmt.Sprintf("Unknown command %s", name))
+}
+
+// client writes and our internal ones, everything raft applies
+func allWriteOps() map[string]writeOp {
+	ret := make(map[string]writeOp)
+	for name, op := range writeOps {
+		ret[name] = op
+	}
+	for name, op := range internalWriteOps {
+		ret[name] = op
+	}
+	return ret
+}
+
+// what flotilla applies, every command gets a fresh dbwrap.Txn in db 0
+func raftCommands(ops map[string]writeOp) map[string]flotilla.Command {
+	ret := make(map[string]flotilla.Command)
+	for name, op := range ops {
+		ret[name] = raftCommand(op)
+	}
+	return ret
+}
+
+func raftCommand(op writeOp) flotilla.Command {
+	return func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		return op(args, dbwrap.NewTxn(txn))
 	}
-	return redis.NewError(fmt.Sprintf("Unknown command %s", r.Name))
 }
 
 type pendingWrite struct {
@@ -398,10 +684,11 @@ type pendingRead struct {
 	op   readOp
 	args [][]byte
 	s    *Server
+	db   int
 }
 
 func (p pendingRead) WriteTxnTo(t *mdb.Txn, w io.Writer) (int64, error) {
-	return p.op(p.args, t, w)
+	return p.op(p.args, dbwrap.NewTxnInDB(t, p.db), w)
 }
 func (p pendingRead) WriteTo(w io.Writer) (int64, error) {
 	txn, err := p.s.flotilla.Read()
@@ -412,25 +699,48 @@ func (p pendingRead) WriteTo(w io.Writer) (int64, error) {
 	return p.WriteTxnTo(txn, w)
 }
 
+const syncReadTimeout = 10 * time.Second
+
+// a read that sees everything committed cluster-wide before it arrived
 type pendingSyncRead struct {
-	noop <-chan flotilla.Result
-	r    pendingRead
+	synced <-chan error
+	r      pendingRead
+}
+
+// starts waiting for our copy to have everything committed so far.  asks the leader
+// for its read index rather than writing a no-op through the log, so reads don't cost fsyncs
+func (s *Server) linearize() <-chan error {
+	ret := make(chan error, 1)
+	go func() {
+		idx, err := s.flotilla.ReadIndex(syncReadTimeout)
+		if err == nil && s.flotilla.WaitApplied(idx, syncReadTimeout) < idx {
+			err = fmt.Errorf("Timed out catching up to read index %d", idx)
+		}
+		ret <- err
+	}()
+	return ret
 }
 
 func (p pendingSyncRead) WriteTxnTo(t *mdb.Txn, w io.Writer) (int64, error) {
-	// wait for no-op to sync
-	noopResp := <-p.noop
-	if noopResp.Err != nil {
-		return redis.NewError(noopResp.Err.Error()).WriteTo(w)
+	// wait to sync
+	err := <-p.synced
+	if err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
+	}
+	// the connection's txn can be older than what we waited for
+	t.Reset()
+	err = t.Renew()
+	if err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
 	}
 	// handle as normal read
 	return p.r.WriteTxnTo(t, w)
 }
 func (p pendingSyncRead) WriteTo(w io.Writer) (int64, error) {
-	// wait for no-op to sync
-	noopResp := <-p.noop
-	if noopResp.Err != nil {
-		return redis.NewError(noopResp.Err.Error()).WriteTo(w)
+	// wait to sync
+	err := <-p.synced
+	if err != nil {
+		return redis.NewError(err.Error()).WriteTo(w)
 	}
 	// handle as normal read
 	return p.r.WriteTo(w)
@@ -455,9 +765,37 @@ func handleConfig(args [][]byte, c *Conn, s *Server) io.WriterTo {
 				ret = append(ret, []byte("cluster"))
 				ret = append(ret, buf.Bytes())
 			}
-			resp = &redis.ArrayReply{ret}
+			if isNotifyConfig(args[1]) {
+				ret = append(ret, []byte("notify-keyspace-events"))
+				ret = append(ret, []byte(s.keyspace.getFlags().String()))
+			}
+			if isEvictionConfig(args[1]) {
+				ret = append(ret, s.evictor.getConfig(args[1])...)
+			}
+			if isCompressConfig(args[1]) {
+				ret = append(ret, []byte("compress-threshold"), []byte(strconv.Itoa(dbwrap.CompressThreshold())))
+			}
+			if isRedirectsConfig(args[1]) {
+				ret = append(ret, []byte("cluster-redirects"), []byte(s.clusterConfig().ClusterRedirects))
+			}
+			resp = &redis.ArrayReply{Value: ret}
 		}
 		return resp
+	} else if len(args) > 0 && strings.ToUpper(string(args[0])) == "SET" {
+		if len(args) != 3 {
+			return redis.NewError("ERR Wrong number of arguments for CONFIG SET")
+		}
+		if isReplicatedConfig(args[1]) {
+			return s.setReplicatedConfig(args[1], args[2])
+		}
+		if isRedirectsConfig(args[1]) {
+			err := s.setRedirects(string(args[2]))
+			if err != nil {
+				return redis.NewError(err.Error())
+			}
+			return &redis.StatusReply{Code: "OK"}
+		}
+		return redis.NewError(fmt.Sprintf("Unsupported CONFIG parameter %s", string(args[1])))
 	} else {
 		return redis.NewError(fmt.Sprintf("Unrecognized CONFIG command %+v", args))
 	}
@@ -465,12 +803,12 @@ func handleConfig(args [][]byte, c *Conn, s *Server) io.WriterTo {
 
 func dosync(args [][]byte, c *Conn, s *Server) io.WriterTo {
 	c.syncRead = true
-	return &redis.StatusReply{"OK"}
+	return &redis.StatusReply{Code: "OK"}
 }
 
 func donosync(args [][]byte, c *Conn, s *Server) io.WriterTo {
 	c.syncRead = false
-	return &redis.StatusReply{"OK"}
+	return &redis.StatusReply{Code: "OK"}
 }
 
 func fatal(args [][]byte, c *Conn, s *Server) io.WriterTo {
@@ -485,5 +823,21 @@ func stats(args [][]byte, c *Conn, s *Server) io.WriterTo {
 	ret = append(ret, []byte(fmt.Sprintf("server start time: %d", s.stats.serverStartTime)))
 	ret = append(ret, []byte(fmt.Sprintf("total disk space: %d bytes", s.stats.diskTotal)))
 	ret = append(ret, []byte(fmt.Sprintf("current interval:\n %s", s.stats.currInterval.String())))
-	return &redis.ArrayReply{ret}
+	ret = append(ret, []byte(s.upgrade.String()))
+	rawBytes, storedBytes := dbwrap.CompressionStats()
+	ratio := 1.0
+	if storedBytes > 0 {
+		ratio = float64(rawBytes) / float64(storedBytes)
+	}
+	// counts what this node compressed as it applied writes, not what's stored
+	ret = append(ret, []byte(fmt.Sprintf("compression: threshold %d bytes, this node compressed %d bytes into %d since it started, ratio %.2f",
+		dbwrap.CompressThreshold(), rawBytes, storedBytes, ratio)))
+	ret = append(ret, []byte(s.evictor.String()))
+	ret = append(ret, []byte(s.mapSize.String()))
+	ret = append(ret, []byte(s.compaction.String()))
+	ret = append(ret, []byte(s.migration.String()))
+	for _, line := range s.cluster.ForwardStats() {
+		ret = append(ret, []byte(line))
+	}
+	return &redis.ArrayReply{Value: ret}
 }
@@ -0,0 +1,235 @@
+package raftis
+
+import (
+	"fmt"
+	"github.com/jbooth/raftis/config"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// read-your-writes across nodes.
+//   CLIENT TRACKINDEX ON|OFF  start or stop collecting the raft index of this connection's writes
+//   WRITEINDEX                the token for this connection's writes so far, see config.IndexToken
+//   WAITINDEX <token>         reads on this connection wait for our copy to catch up to token,
+//                             "" stops waiting
+// a client hands the token from WRITEINDEX on one node to WAITINDEX on another.  tracked
+// connections wait on their own writes as well.  writes we forward go as WITHINDEX so the
+// owning shard sends its index back with the reply.  reads we forward go over SYNCMODE
+// connections, so they see every committed write anyway.  a read that can't catch up within
+// indexWait goes through the leader like a SYNCMODE read.
+
+const indexWait = time.Second
+
+func init() {
+	// WITHINDEX refers back to route, so can't live in the literals
+	serverOps["CLIENT"] = client
+	serverOps["WRITEINDEX"] = writeIndex
+	serverOps["WAITINDEX"] = waitIndex
+	serverOps["WITHINDEX"] = withIndex
+}
+
+type session struct {
+	l      *sync.Mutex
+	track  bool
+	writes config.IndexToken
+	wait   config.IndexToken
+}
+
+func newSession() *session {
+	return &session{new(sync.Mutex), false, make(config.IndexToken), make(config.IndexToken)}
+}
+
+func (s *session) tracking() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.track
+}
+
+func (s *session) addWrite(t config.IndexToken) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.writes.Merge(t)
+}
+
+// whether reads might have to wait, so they don't look up our shard for nothing
+func (s *session) waiting() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return len(s.wait) > 0 || (s.track && len(s.writes) > 0)
+}
+
+// index reads from shard have to wait for, 0 if none
+func (s *session) waitIndex(shard int) uint64 {
+	s.l.Lock()
+	defer s.l.Unlock()
+	idx := s.wait[shard]
+	if s.track && s.writes[shard] > idx {
+		idx = s.writes[shard]
+	}
+	return idx
+}
+
+// CLIENT TRACKINDEX ON|OFF
+func client(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if c == nil {
+		return redis.NewError("ERR CLIENT is per connection")
+	}
+	if len(args) != 2 || strings.ToUpper(string(args[0])) != "TRACKINDEX" {
+		return redis.NewError("ERR only CLIENT TRACKINDEX ON|OFF is supported")
+	}
+	on := strings.ToUpper(string(args[1]))
+	if on != "ON" && on != "OFF" {
+		return redis.NewError("ERR CLIENT TRACKINDEX takes ON or OFF")
+	}
+	c.session.l.Lock()
+	defer c.session.l.Unlock()
+	c.session.track = on == "ON"
+	if !c.session.track {
+		c.session.writes = make(config.IndexToken)
+	}
+	return &redis.StatusReply{Code: "OK"}
+}
+
+// WRITEINDEX, read once the replies before it are out so it covers writes pipelined ahead of it
+func writeIndex(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if c == nil {
+		return redis.NewError("ERR WRITEINDEX is per connection")
+	}
+	if !c.session.tracking() {
+		return redis.NewError("ERR CLIENT TRACKINDEX is off")
+	}
+	return sessionToken{c.session}
+}
+
+type sessionToken struct {
+	sess *session
+}
+
+func (t sessionToken) WriteTo(w io.Writer) (int64, error) {
+	t.sess.l.Lock()
+	token := t.sess.writes.String()
+	t.sess.l.Unlock()
+	return (&redis.BulkReply{Value: []byte(token)}).WriteTo(w)
+}
+
+// WAITINDEX token
+func waitIndex(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if c == nil {
+		return redis.NewError("ERR WAITINDEX is per connection")
+	}
+	if len(args) != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'waitindex' command")
+	}
+	t, err := config.ParseIndexToken(string(args[0]))
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	c.session.l.Lock()
+	defer c.session.l.Unlock()
+	c.session.wait = t
+	return &redis.StatusReply{Code: "OK"}
+}
+
+// WITHINDEX db command [args ...]
+// runs a write we've been forwarded and replies with a 2 element array of its reply and our
+// token for it, "" if the key isn't ours and it went elsewhere
+func withIndex(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) < 3 {
+		return redis.NewError("ERR wrong number of arguments for 'withindex' command")
+	}
+	db, err := parseDB(args[0])
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	name := strings.ToUpper(string(args[1]))
+	if _, ok := writeOps[name]; !ok {
+		return redis.NewError(fmt.Sprintf("ERR WITHINDEX is for writes, not %s", name))
+	}
+	local, _ := s.cluster.HasKey(name, args[2:])
+	return indexedReply{s.route(c, db, name, args[2:]), s, local}
+}
+
+type indexedReply struct {
+	reply io.WriterTo
+	s     *Server
+	local bool
+}
+
+func (r indexedReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("*2\r\n"))
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := r.reply.WriteTo(w)
+	m += int64(n)
+	if err != nil {
+		return m, err
+	}
+	token := ""
+	if r.local {
+		token = r.s.indexToken().String()
+	}
+	k, err := (&redis.BulkReply{Value: []byte(token)}).WriteTo(w)
+	return m + k, err
+}
+
+// our shard's token for everything we've applied so far.  write results only come back
+// once they're applied here, so it covers them
+func (s *Server) indexToken() config.IndexToken {
+	return config.IndexToken{s.myShardId(): s.flotilla.AppliedIndex()}
+}
+
+func (s *Server) myShardId() int {
+	s.cluster.l.RLock()
+	defer s.cluster.l.RUnlock()
+	return s.cluster.c.MyShard().ShardId
+}
+
+// a write on a tracked connection, adds its index to the session once it's done
+type pendingTrackedWrite struct {
+	w    io.WriterTo
+	s    *Server
+	sess *session
+}
+
+func (p pendingTrackedWrite) WriteTo(w io.Writer) (int64, error) {
+	n, err := p.w.WriteTo(w)
+	p.sess.addWrite(p.s.indexToken())
+	return n, err
+}
+
+// a forwarded write on a tracked connection, sent as WITHINDEX
+type pendingForwardedWrite struct {
+	fwd  forwardedReply
+	sess *session
+}
+
+func (p pendingForwardedWrite) WriteTo(w io.Writer) (int64, error) {
+	n, token, err := p.fwd.WriteIndexedTo(w)
+	if err != nil {
+		return n, err
+	}
+	t, err := config.ParseIndexToken(token)
+	if err == nil {
+		p.sess.addWrite(t)
+	}
+	return n, nil
+}
+
+// a read that has to wait for our copy to reach idx first
+type pendingIndexRead struct {
+	idx uint64
+	r   pendingRead
+	// what to do once we're caught up, r itself or a bounded read
+	next io.WriterTo
+}
+
+func (p pendingIndexRead) WriteTo(w io.Writer) (int64, error) {
+	if p.r.s.flotilla.WaitApplied(p.idx, indexWait) >= p.idx {
+		return p.next.WriteTo(w)
+	}
+	return pendingSyncRead{p.r.s.linearize(), p.r}.WriteTo(w)
+}
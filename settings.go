@@ -0,0 +1,130 @@
+package raftis
+
+import (
+	"fmt"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	log "github.com/jbooth/raftis/rlog"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CONFIG SET parameters every node runs with the same value of, so what a replica does as it
+// applies commands doesn't depend on which node it is.  CONFIG SET proposes CONFIGPUT on every
+// shard and each replica applies it to itself as it commits.  replicas reload the lot from the
+// meta table at startup and every heartbeat, which covers snapshot installs, so once one's
+// been set it wins over each node's config file.
+type replicatedConfig struct {
+	keyspace *keyspaceNotifier
+	evictor  *evictor
+	lg       *log.Logger
+}
+
+func isReplicatedConfig(name []byte) bool {
+	return isNotifyConfig(name) || isEvictionConfig(name) || isCompressConfig(name)
+}
+
+// compression changes the bytes every replica writes, so it has to change everywhere at the same point in the log
+func isCompressConfig(name []byte) bool {
+	return strings.ToLower(string(name)) == "compress-threshold"
+}
+
+func parseCompressThreshold(val []byte) (int, error) {
+	threshold, err := strconv.Atoi(string(val))
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("ERR invalid compress-threshold %s", val)
+	}
+	return threshold, nil
+}
+
+// complains about val before it's proposed, and before it's applied in case it got proposed anyway
+func (r *replicatedConfig) check(name []byte, val []byte) error {
+	if isNotifyConfig(name) {
+		_, err := parseNotifyFlags(string(val))
+		return err
+	}
+	if isEvictionConfig(name) {
+		return checkEvictionConfig(name, val)
+	}
+	if isCompressConfig(name) {
+		_, err := parseCompressThreshold(val)
+		return err
+	}
+	return fmt.Errorf("Unsupported CONFIG parameter %s", string(name))
+}
+
+func (r *replicatedConfig) apply(name []byte, val []byte) error {
+	if isNotifyConfig(name) {
+		return r.keyspace.setFlags(string(val))
+	}
+	if isEvictionConfig(name) {
+		return r.evictor.setConfig(name, val)
+	}
+	if isCompressConfig(name) {
+		threshold, err := parseCompressThreshold(val)
+		if err != nil {
+			return err
+		}
+		dbwrap.SetCompressThreshold(threshold)
+		return nil
+	}
+	return fmt.Errorf("Unsupported CONFIG parameter %s", string(name))
+}
+
+// CONFIGPUT as raft applies it, the setting takes effect on this node as it commits
+func (r *replicatedConfig) wrapPut(op writeOp) writeOp {
+	return func(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+		if len(args) == 2 {
+			if err := r.check(args[0], args[1]); err != nil {
+				msg := err.Error()
+				if !strings.HasPrefix(msg, "ERR") {
+					msg = "ERR " + msg
+				}
+				return redis.WrapStatus(msg), nil
+			}
+		}
+		resp, err := op(args, txn)
+		if err == nil && string(resp) == "+OK\r\n" {
+			if err := r.apply(args[0], args[1]); err != nil {
+				r.lg.Errorf("Error applying CONFIG %s %s : %s", string(args[0]), string(args[1]), err)
+			}
+		}
+		return resp, err
+	}
+}
+
+// applies what's in the meta table, at startup and every heartbeat
+func (s *Server) loadSettings() error {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return err
+	}
+	settings, err := dbwrap.GetSettings(dbwrap.NewTxn(txn))
+	txn.Abort()
+	if err != nil {
+		return err
+	}
+	for name, val := range settings {
+		err = s.settings.apply([]byte(name), val)
+		if err != nil {
+			s.lg.Errorf("Error applying CONFIG %s %s : %s", name, string(val), err)
+		}
+	}
+	return nil
+}
+
+// CONFIG SET for a replicated parameter, on every shard
+func (s *Server) setReplicatedConfig(name []byte, val []byte) io.WriterTo {
+	err := s.settings.check(name, val)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return allOK(s.onEveryShard(configSetLocal, "CONFIGSETLOCAL", [][]byte{[]byte(strings.ToLower(string(name))), val}))
+}
+
+// CONFIGSETLOCAL name value
+// sets a replicated parameter on our shard, sent by the node running CONFIG SET
+func configSetLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	return pendingWrite{s.flotilla.Command("CONFIGPUT", args)}
+}
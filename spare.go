@@ -0,0 +1,98 @@
+package raftis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	config "github.com/jbooth/raftis/config"
+	log "github.com/jbooth/raftis/rlog"
+	"time"
+)
+
+// hot spares, started with spare set in their config and not in any shard.
+// a spare watches the heartbeats in etcd and takes the place of the first host that's
+// been gone for two polls, swapping itself in for it in the shards record with a
+// compare and swap so two spares can't take the same place.  the shard's raft leader
+// sees the change on its next heartbeat, removes the dead host's peer and adds ours
+// with a snapshot to catch us up, see refreshShards.
+
+const sparePoll = 10 * time.Second
+
+// blocks until c.Me has a place in the shards record, returning the config to start with
+func claimAbandonedHost(etcdC *etcd.Client, c *config.ClusterConfig, lg *log.Logger) (*config.ClusterConfig, error) {
+	suspects := make(map[string]bool)
+	for {
+		confResp, err := etcdC.Get(c.EtcdBase+"/shards", false, false)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading shards from etcd : %s", err)
+		}
+		var shards []config.Shard
+		err = json.Unmarshal([]byte(confResp.Node.Value), &shards)
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshalling shards from etcd!  resp: %s", confResp.Node.Value)
+		}
+		// restarted after we'd already claimed a place
+		for _, shard := range shards {
+			for _, h := range shard.Hosts {
+				if h.RedisAddr == c.Me.RedisAddr && h.FlotillaAddr == c.Me.FlotillaAddr {
+					ret := *c
+					ret.Me = h
+					ret.Shards = shards
+					return &ret, nil
+				}
+			}
+		}
+		live := make(map[string]bool)
+		for _, shard := range shards {
+			for _, h := range shard.Hosts {
+				_, err := etcdC.Get(config.HeartbeatKey(c.EtcdBase, h), false, false)
+				if err == nil {
+					live[h.RedisAddr] = true
+					continue
+				}
+				v, ok := err.(*etcd.EtcdError)
+				if !ok || v.Message != "Key not found" {
+					// can't tell, don't count it either way
+					live[h.RedisAddr] = true
+					lg.Errorf("Error checking heartbeat for %s : %s", h.RedisAddr, err)
+				}
+			}
+		}
+		si, hi := config.PickAbandonedHost(shards, live, suspects)
+		if si >= 0 {
+			dead := shards[si].Hosts[hi]
+			me := c.Me
+			me.Group = dead.Group
+			hosts := append([]config.Host(nil), shards[si].Hosts...)
+			hosts[hi] = me
+			shards[si].Hosts = hosts
+			newShards, err := json.Marshal(shards)
+			if err != nil {
+				return nil, err
+			}
+			_, err = etcdC.CompareAndSwap(c.EtcdBase+"/shards", string(newShards), 0, confResp.Node.Value, confResp.Node.ModifiedIndex)
+			if err == nil {
+				lg.Printf("Took the place of %s in shard %d", dead.RedisAddr, shards[si].ShardId)
+				// beat right away so no other spare takes our place before we're up
+				etcdC.Set(config.HeartbeatKey(c.EtcdBase, me), "{}", 30)
+				ret := *c
+				ret.Me = me
+				ret.Shards = shards
+				return &ret, nil
+			}
+			// someone else changed the shards, look again
+			lg.Printf("Lost the race for %s's place : %s", dead.RedisAddr, err)
+			continue
+		}
+		suspects = make(map[string]bool)
+		for _, shard := range shards {
+			for _, h := range shard.Hosts {
+				if !live[h.RedisAddr] {
+					suspects[h.RedisAddr] = true
+				}
+			}
+		}
+		// give etcd a break
+		time.Sleep(sparePoll)
+	}
+}
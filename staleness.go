@@ -0,0 +1,94 @@
+package raftis
+
+import (
+	"fmt"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bounded staleness for reads, set per connection with MAXSTALENESS.
+//   MAXSTALENESS <n>ms  our copy must have heard from the leader within n milliseconds
+//   MAXSTALENESS <n>    our copy must be within n raft entries of the leader's commit
+//   MAXSTALENESS OFF    reads are served from our copy however old it is, the default
+// both bounds can be set at once.  a read we can't serve within bounds waits for our copy
+// to catch up, up to the bound in ms or staleWait, and then goes through the leader like a
+// SYNCMODE read.  entries only count what we've heard of the leader's commit, so a follower
+// cut off from the leader is only caught by the ms bound.
+
+const staleWait = 100 * time.Millisecond
+
+type staleness struct {
+	ms      int64
+	entries uint64
+}
+
+func (b staleness) bounded() bool {
+	return b.ms > 0 || b.entries > 0
+}
+
+func maxStaleness(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'maxstaleness' command")
+	}
+	if c == nil {
+		return redis.NewError("ERR MAXSTALENESS is per connection")
+	}
+	arg := strings.ToLower(string(args[0]))
+	if arg == "off" {
+		c.staleness = staleness{}
+		return &redis.StatusReply{Code: "OK"}
+	}
+	if strings.HasSuffix(arg, "ms") {
+		ms, err := strconv.ParseInt(strings.TrimSuffix(arg, "ms"), 10, 64)
+		if err != nil || ms < 0 {
+			return redis.NewError(fmt.Sprintf("ERR bad staleness %s, need <n>ms, <n> entries or OFF", args[0]))
+		}
+		c.staleness.ms = ms
+		return &redis.StatusReply{Code: "OK"}
+	}
+	entries, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return redis.NewError(fmt.Sprintf("ERR bad staleness %s, need <n>ms, <n> entries or OFF", args[0]))
+	}
+	c.staleness.entries = entries
+	return &redis.StatusReply{Code: "OK"}
+}
+
+// whether our copy is within b of the leader, waiting a little for it to catch up if it isn't
+func (s *Server) fresh(b staleness) bool {
+	if s.flotilla.IsLeader() {
+		return true
+	}
+	commit := s.flotilla.CommitIndex()
+	if b.entries > 0 && commit > b.entries {
+		if s.flotilla.WaitApplied(commit-b.entries, staleWait) < commit-b.entries {
+			return false
+		}
+	}
+	if b.ms > 0 {
+		bound := time.Duration(b.ms) * time.Millisecond
+		if s.flotilla.WaitApplied(commit, bound) < commit {
+			return false
+		}
+		return time.Since(s.flotilla.LastContact()) <= bound
+	}
+	return true
+}
+
+// a read on a connection with MAXSTALENESS set.  not a txnReader, the connection's
+// cached txn could be older than what we check here
+type pendingBoundedRead struct {
+	bound staleness
+	r     pendingRead
+}
+
+func (p pendingBoundedRead) WriteTo(w io.Writer) (int64, error) {
+	if p.r.s.fresh(p.bound) {
+		return p.r.WriteTo(w)
+	}
+	p.r.s.stats.incrNumStaleReads()
+	return pendingSyncRead{p.r.s.linearize(), p.r}.WriteTo(w)
+}
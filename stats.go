@@ -53,6 +53,18 @@ func (s *StatsCounter) incrNumForwards() {
 	s.currInterval.NumForwards = s.currInterval.NumForwards + 1
 }
 
+func (s *StatsCounter) incrNumRedirects() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.currInterval.NumRedirects = s.currInterval.NumRedirects + 1
+}
+
+func (s *StatsCounter) incrNumStaleReads() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.currInterval.NumStaleReads = s.currInterval.NumStaleReads + 1
+}
+
 // resets current interval to new interval and returns the old interval
 func (s *StatsCounter) collectInterval() *config.StatsInterval {
 	//todo: this should write to db, but this is defered for now, we just return current interval
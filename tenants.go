@@ -0,0 +1,440 @@
+package raftis
+
+import (
+	"encoding/json"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tenants, see dbwrap/tenants.go.  usage is tracked inside raft so each shard knows its own
+// exactly, quotas are checked here before proposing against our shard's usage plus what the
+// other shards reported at the last heartbeat.  ops per second are limited on each node.
+
+// write ops that only ever shrink a tenant, let through even when it's over quota
+var shrinkingOps = map[string]bool{
+	"DEL":           true,
+	"HDEL":          true,
+	"EXPIRE":        true,
+	"REWRITEVALUES": true,
+}
+
+// keys a write op may change, so their usage can be tracked
+func writeKeys(name string, args [][]byte) [][]byte {
+	switch name {
+	case "DEL", "REWRITEVALUES", "EVICT":
+		return args
+	case "EVAL":
+		// command, numkeys, key
+		if len(args) > 2 {
+			return args[2:3]
+		}
+		return nil
+	case "INDB":
+		if len(args) > 1 {
+			return writeKeys(strings.ToUpper(string(args[1])), args[2:])
+		}
+		return nil
+	case "MIGRATEDEL":
+		// key, sum pairs
+		keys := make([][]byte, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "PING", "USEKEY", "FLUSHDB", "FLUSHALL", "SWAPDB", "TENANTPUT", "TENANTDROP", "SETSLOT", "CONFIGPUT":
+		return nil
+	}
+	if len(args) > 0 {
+		return args[:1]
+	}
+	return nil
+}
+
+func wrapTenantOps(ops map[string]writeOp) map[string]writeOp {
+	ret := make(map[string]writeOp)
+	for name, op := range ops {
+		ret[name] = tenantWrap(name, op)
+	}
+	return ret
+}
+
+func tenantWrap(name string, op writeOp) writeOp {
+	return func(args [][]byte, txn *dbwrap.Txn) ([]byte, error) {
+		keys := writeKeys(name, args)
+		if len(keys) == 0 {
+			return op(args, txn)
+		}
+		if name == "INDB" {
+			// sizes have to come from the db the op runs against
+			db, err := parseDB(args[0])
+			if err != nil {
+				return op(args, txn)
+			}
+			prevDB := txn.Select(db)
+			err = dbwrap.TrackUsage(txn, keys)
+			txn.Select(prevDB)
+			if err != nil {
+				return redis.WrapStatus(err.Error()), nil
+			}
+			return op(args, txn)
+		}
+		err := dbwrap.TrackUsage(txn, keys)
+		if err != nil {
+			return redis.WrapStatus(err.Error()), nil
+		}
+		return op(args, txn)
+	}
+}
+
+type tenantLimiter struct {
+	l       *sync.Mutex
+	tenants []*dbwrap.Tenant
+	buckets map[string]*opBucket
+	remote  map[string]dbwrap.TenantUsage // summed over the other shards
+}
+
+// token bucket refilling at MaxOps per second, holding up to a second's worth
+type opBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTenantLimiter() *tenantLimiter {
+	return &tenantLimiter{&sync.Mutex{}, nil, make(map[string]*opBucket), make(map[string]dbwrap.TenantUsage)}
+}
+
+// the key route checks quotas against
+func tenantKey(name string, args [][]byte) []byte {
+	if name == "EVAL" {
+		if len(args) > 2 {
+			return args[2]
+		}
+		return nil
+	}
+	if len(args) > 0 {
+		return args[0]
+	}
+	return nil
+}
+
+// error if running name against our shard would put its key's tenant over quota
+func (t *tenantLimiter) check(s *Server, db int, name string, args [][]byte) error {
+	key := tenantKey(name, args)
+	if key == nil {
+		return nil
+	}
+	t.l.Lock()
+	tenant := dbwrap.TenantForKey(t.tenants, key)
+	if tenant == nil {
+		t.l.Unlock()
+		return nil
+	}
+	if !t.takeOp(tenant) {
+		t.l.Unlock()
+		return fmt.Errorf("ERR tenant %s is over its limit of %d ops per second", tenant.Name, tenant.MaxOps)
+	}
+	remote := t.remote[tenant.Name]
+	t.l.Unlock()
+	_, isWrite := writeOps[name]
+	if !isWrite || shrinkingOps[name] || (tenant.MaxKeys == 0 && tenant.MaxBytes == 0) {
+		return nil
+	}
+	if name == "EVAL" && len(args) > 0 && strings.ToUpper(string(args[0])) == "LPOPRANGE" {
+		return nil
+	}
+	rtxn, err := s.flotilla.Read()
+	if err != nil {
+		return err
+	}
+	defer rtxn.Abort()
+	txn := dbwrap.NewTxnInDB(rtxn, db)
+	usage, err := dbwrap.GetTenantUsage(txn, tenant.Name)
+	if err != nil {
+		return err
+	}
+	if tenant.MaxBytes > 0 && usage.Bytes+remote.Bytes >= tenant.MaxBytes {
+		return fmt.Errorf("ERR tenant %s is over its quota of %d bytes", tenant.Name, tenant.MaxBytes)
+	}
+	if tenant.MaxKeys > 0 && usage.Keys+remote.Keys >= tenant.MaxKeys {
+		// updating a key that's already there doesn't add one
+		_, _, err := dbwrap.GetBytes(txn, key, 0)
+		if err == mdb.NotFound {
+			return fmt.Errorf("ERR tenant %s is over its quota of %d keys", tenant.Name, tenant.MaxKeys)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// must hold t.l
+func (t *tenantLimiter) takeOp(tenant *dbwrap.Tenant) bool {
+	if tenant.MaxOps <= 0 {
+		return true
+	}
+	now := time.Now()
+	b, ok := t.buckets[tenant.Name]
+	if !ok {
+		b = &opBucket{float64(tenant.MaxOps), now}
+		t.buckets[tenant.Name] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(tenant.MaxOps)
+	if b.tokens > float64(tenant.MaxOps) {
+		b.tokens = float64(tenant.MaxOps)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reloads tenant definitions from our shard and usage from the others, called every heartbeat
+func (t *tenantLimiter) refresh(s *Server) error {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return err
+	}
+	tenants, err := dbwrap.ListTenants(dbwrap.NewTxn(txn))
+	txn.Abort()
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]dbwrap.TenantUsage)
+	if len(tenants) > 0 {
+		remote, err = s.otherShardsUsage()
+		if err != nil {
+			return err
+		}
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.tenants = tenants
+	t.remote = remote
+	for name := range t.buckets {
+		if !hasTenant(tenants, name) {
+			delete(t.buckets, name)
+		}
+	}
+	return nil
+}
+
+func hasTenant(tenants []*dbwrap.Tenant, name string) bool {
+	for _, t := range tenants {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// usage of every tenant summed across the other shards
+func (s *Server) otherShardsUsage() (map[string]dbwrap.TenantUsage, error) {
+	replies, err := s.cluster.CommandOtherShards("TENANTUSAGELOCAL", emptyArgs)
+	if err != nil {
+		return nil, err
+	}
+	return sumUsage(replies)
+}
+
+// adds up TENANTUSAGELOCAL replies
+func sumUsage(replies [][]byte) (map[string]dbwrap.TenantUsage, error) {
+	ret := make(map[string]dbwrap.TenantUsage)
+	for _, reply := range replies {
+		if len(reply) == 0 || reply[0] != '$' {
+			return nil, fmt.Errorf("Bad usage reply %q", reply)
+		}
+		start := strings.Index(string(reply), "\r\n") + 2
+		var shardUsage map[string]dbwrap.TenantUsage
+		err := json.Unmarshal(reply[start:len(reply)-2], &shardUsage)
+		if err != nil {
+			return nil, err
+		}
+		for name, u := range shardUsage {
+			total := ret[name]
+			total.Keys += u.Keys
+			total.Bytes += u.Bytes
+			ret[name] = total
+		}
+	}
+	return ret, nil
+}
+
+// TENANTUSAGELOCAL
+// json map of tenant name to its usage on our shard
+func tenantUsageLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	rtxn, err := s.flotilla.Read()
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	defer rtxn.Abort()
+	txn := dbwrap.NewTxn(rtxn)
+	tenants, err := dbwrap.ListTenants(txn)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	usage := make(map[string]dbwrap.TenantUsage)
+	for _, t := range tenants {
+		usage[t.Name], err = dbwrap.GetTenantUsage(txn, t.Name)
+		if err != nil {
+			return redis.NewError(err.Error())
+		}
+	}
+	ret, err := json.Marshal(usage)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return &redis.BulkReply{Value: ret}
+}
+
+// TENANTPUTLOCAL tenantJson
+func tenantPutLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	return pendingWrite{s.flotilla.Command("TENANTPUT", args)}
+}
+
+// TENANTDROPLOCAL name
+func tenantDropLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	return pendingWrite{s.flotilla.Command("TENANTDROP", args)}
+}
+
+// TENANT CREATE name prefix [MAXKEYS n] [MAXBYTES n] [MAXOPS n]
+// TENANT SET name [MAXKEYS n] [MAXBYTES n] [MAXOPS n]
+// TENANT INFO name
+// TENANT LIST
+// TENANT DROP name
+// definitions are written to every shard in turn, same as FLUSHALL
+func tenant(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) < 1 {
+		return redis.NewError("ERR wrong number of arguments for 'tenant' command")
+	}
+	sub := strings.ToUpper(string(args[0]))
+	var resp io.WriterTo
+	switch {
+	case sub == "CREATE" && len(args) >= 3:
+		t := &dbwrap.Tenant{Name: string(args[1]), Prefix: string(args[2])}
+		if existing, err := s.getTenant(t.Name); err != nil {
+			return redis.NewError(err.Error())
+		} else if existing != nil {
+			return redis.NewError(fmt.Sprintf("ERR tenant %s already exists", t.Name))
+		}
+		resp = s.putTenant(t, args[3:])
+	case sub == "SET" && len(args) >= 2:
+		t, err := s.getTenant(string(args[1]))
+		if err != nil {
+			return redis.NewError(err.Error())
+		} else if t == nil {
+			return redis.NewError(fmt.Sprintf("ERR no such tenant %s", args[1]))
+		}
+		resp = s.putTenant(t, args[2:])
+	case sub == "DROP" && len(args) == 2:
+		resp = allOK(s.onEveryShard(tenantDropLocal, "TENANTDROPLOCAL", args[1:]))
+	case sub == "INFO" && len(args) == 2:
+		return s.tenantInfo(string(args[1]))
+	case sub == "LIST" && len(args) == 1:
+		return s.tenantList()
+	default:
+		return redis.NewError("ERR syntax error, try TENANT CREATE|SET|INFO|LIST|DROP")
+	}
+	// pick up the change now rather than next heartbeat
+	err := s.tenants.refresh(s)
+	if err != nil {
+		s.lg.Errorf("Error refreshing tenants : %s", err)
+	}
+	return resp
+}
+
+// nil if there's no such tenant
+func (s *Server) getTenant(name string) (*dbwrap.Tenant, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Abort()
+	t, err := dbwrap.GetTenant(dbwrap.NewTxn(txn), name)
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	return t, err
+}
+
+// applies limit args to t and writes it to every shard
+func (s *Server) putTenant(t *dbwrap.Tenant, limits [][]byte) io.WriterTo {
+	if len(limits)%2 != 0 {
+		return redis.NewError("ERR syntax error, limits come in pairs")
+	}
+	for i := 0; i < len(limits); i += 2 {
+		n, err := strconv.ParseInt(string(limits[i+1]), 10, 64)
+		if err != nil || n < 0 {
+			return redis.NewError(fmt.Sprintf("ERR bad limit %s", limits[i+1]))
+		}
+		switch strings.ToUpper(string(limits[i])) {
+		case "MAXKEYS":
+			t.MaxKeys = n
+		case "MAXBYTES":
+			t.MaxBytes = n
+		case "MAXOPS":
+			t.MaxOps = n
+		default:
+			return redis.NewError(fmt.Sprintf("ERR unknown limit %s", limits[i]))
+		}
+	}
+	val, err := json.Marshal(t)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return allOK(s.onEveryShard(tenantPutLocal, "TENANTPUTLOCAL", [][]byte{val}))
+}
+
+// limits and usage summed across the cluster, as name value pairs like CONFIG GET
+func (s *Server) tenantInfo(name string) io.WriterTo {
+	t, err := s.getTenant(name)
+	if err != nil {
+		return redis.NewError(err.Error())
+	} else if t == nil {
+		return redis.NewError(fmt.Sprintf("ERR no such tenant %s", name))
+	}
+	replies, err := s.onEveryShard(tenantUsageLocal, "TENANTUSAGELOCAL", emptyArgs)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	usage, err := sumUsage(replies)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	u := usage[name]
+	return &redis.ArrayReply{Value: [][]byte{
+		[]byte("name"), []byte(t.Name),
+		[]byte("prefix"), []byte(t.Prefix),
+		[]byte("maxkeys"), []byte(strconv.FormatInt(t.MaxKeys, 10)),
+		[]byte("maxbytes"), []byte(strconv.FormatInt(t.MaxBytes, 10)),
+		[]byte("maxops"), []byte(strconv.FormatInt(t.MaxOps, 10)),
+		[]byte("keys"), []byte(strconv.FormatInt(u.Keys, 10)),
+		[]byte("bytes"), []byte(strconv.FormatInt(u.Bytes, 10)),
+	}}
+}
+
+// tenant names
+func (s *Server) tenantList() io.WriterTo {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	defer txn.Abort()
+	tenants, err := dbwrap.ListTenants(dbwrap.NewTxn(txn))
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	names := make([][]byte, len(tenants))
+	for i, t := range tenants {
+		names[i] = []byte(t.Name)
+	}
+	return &redis.ArrayReply{Value: names}
+}
@@ -0,0 +1,63 @@
+package raftis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCDC(t *testing.T) {
+	setupTest()
+
+	conn, err := net.Dial("tcp", testcluster.hosts[0].RedisAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(packCommand("CDC", "$"))
+
+	// keys land on every shard, so some of these go through host 0's raft log
+	for i := 0; i < 20; i++ {
+		err = testcluster.clients[1].Set(fmt.Sprintf("cdc_test_%d", i), "val", 0, 0, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	sawSet := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Never saw a SET for cdc_test_ keys in the CDC stream: %s", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "SET" {
+			sawSet = true
+		} else if sawSet && strings.HasPrefix(line, "cdc_test_") {
+			return
+		}
+	}
+}
+
+func TestCDCBadIndex(t *testing.T) {
+	setupTest()
+
+	conn, err := net.Dial("tcp", testcluster.hosts[0].RedisAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(packCommand("CDC", "notanindex"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "-ERR") {
+		t.Fatalf("Expecting an error for a bad CDC index, got %s", line)
+	}
+}
@@ -0,0 +1,64 @@
+package raftis
+
+import (
+	"fmt"
+	config "github.com/jbooth/raftis/config"
+	"strings"
+	"testing"
+)
+
+func TestClusterSlots(t *testing.T) {
+	setupTest()
+
+	resp, err := testcluster.clients[0].ExecuteCommand("CLUSTER", "SLOTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// none of the test shards' slots are contiguous, so one range per slot
+	if len(resp.Multi) != 10 {
+		t.Fatalf("Expecting 10 slot ranges, got %d", len(resp.Multi))
+	}
+	for _, r := range resp.Multi {
+		if len(r.Multi) != 5 {
+			t.Fatalf("Expecting start, end and 3 nodes, got %d entries", len(r.Multi))
+		}
+		if r.Multi[0].Integer != r.Multi[1].Integer {
+			t.Fatalf("Expecting single slot ranges, got %d-%d", r.Multi[0].Integer, r.Multi[1].Integer)
+		}
+		if len(r.Multi[2].Multi[2].Bulk) != 40 {
+			t.Fatalf("Expecting a 40 char node id, got %s", r.Multi[2].Multi[2].Bulk)
+		}
+	}
+}
+
+func TestMovedRedirect(t *testing.T) {
+	setupTest()
+
+	// a key shard 0 doesn't own
+	key := ""
+	for i := 0; key == ""; i++ {
+		k := fmt.Sprintf("moved%d", i)
+		if config.KeySlot("", 10, []byte(k))%3 != 0 {
+			key = k
+		}
+	}
+	client := testcluster.clients[0]
+	err := client.Set(key, "there", 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ExecuteCommand("CONFIG", "SET", "cluster-redirects", "always")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.ExecuteCommand("CONFIG", "SET", "cluster-redirects", "off")
+	_, err = client.Get(key)
+	if err == nil || !strings.HasPrefix(err.Error(), "MOVED ") {
+		t.Fatalf("Expecting MOVED for %s, got %v", key, err)
+	}
+	// still forwarded for other dbs
+	resp, err := client.ExecuteCommand("INDB", "1", "GET", key)
+	if err != nil || resp.Error != "" {
+		t.Fatalf("Expecting INDB 1 to be forwarded, got %v %v", resp, err)
+	}
+}
@@ -11,7 +11,10 @@ func TestBuildString(t *testing.T) {
 	var inExpiration uint32 = 123
 	inString := []byte("test123")
 
-	packed := dbwrap.BuildString(inExpiration, inString)
+	packed, err := dbwrap.BuildString(inExpiration, inString)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	outExpiration, outString, _ := dbwrap.ParseString(packed)
 
@@ -0,0 +1,55 @@
+package raftis
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	"os"
+	"testing"
+)
+
+func TestKeyEvents(t *testing.T) {
+	dbPath := "/tmp/raftisEventsTest"
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+	env, err := mdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.SetMaxDBs(mdb.DBI(16))
+	err = env.Open(dbPath, 0, uint(0755))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	// committed txn hands out its events
+	mtxn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := dbwrap.NewTxn(mtxn)
+	dbwrap.CollectEvents(txn)
+	dbwrap.Notify(txn, dbwrap.EVENT_STRING, "set", []byte("events_test"))
+	err = dbwrap.Commit(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := dbwrap.TakeEvents(txn)
+	if len(events) != 1 || events[0].Event != "set" || string(events[0].Key) != "events_test" {
+		t.Fatalf("Expecting one set event for events_test, got %+v", events)
+	}
+
+	// aborted txn doesn't
+	mtxn, err = env.BeginTxn(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn = dbwrap.NewTxn(mtxn)
+	dbwrap.CollectEvents(txn)
+	dbwrap.Notify(txn, dbwrap.EVENT_GENERIC, "del", []byte("events_test"))
+	txn.Abort()
+	events = dbwrap.TakeEvents(txn)
+	if events != nil {
+		t.Fatalf("Expecting no events from aborted txn, got %+v", events)
+	}
+}
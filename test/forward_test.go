@@ -0,0 +1,30 @@
+package raftis
+
+import (
+	config "github.com/jbooth/raftis/config"
+	"testing"
+	"time"
+)
+
+func TestForwardBackoff(t *testing.T) {
+	c := &config.ClusterConfig{}
+	if c.ForwardBackoff(1) != time.Second || c.ForwardBackoff(3) != 4*time.Second {
+		t.Fatalf("Expecting default backoffs of 1s and 4s, got %s and %s", c.ForwardBackoff(1), c.ForwardBackoff(3))
+	}
+	if c.ForwardBackoff(1000) != time.Minute {
+		t.Fatalf("Expecting backoff capped at a minute, got %s", c.ForwardBackoff(1000))
+	}
+	if c.ForwardPoolSize() != 4 || c.ForwardTimeout() != 15*time.Second {
+		t.Fatalf("Expecting 4 conns and 15s timeout by default, got %d and %s", c.ForwardPoolSize(), c.ForwardTimeout())
+	}
+	c = &config.ClusterConfig{ForwardConns: 2, ForwardTimeoutMs: 500, ForwardBackoffMs: 100, ForwardMaxBackoffMs: 1000}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, ms := range expected {
+		if b := c.ForwardBackoff(i + 1); b != ms*time.Millisecond {
+			t.Fatalf("Expecting %dms backoff after %d failures, got %s", ms, i+1, b)
+		}
+	}
+	if c.ForwardPoolSize() != 2 || c.ForwardTimeout() != 500*time.Millisecond {
+		t.Fatalf("Expecting 2 conns and 500ms timeout, got %d and %s", c.ForwardPoolSize(), c.ForwardTimeout())
+	}
+}
@@ -0,0 +1,75 @@
+package raftis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublishAcrossNodes(t *testing.T) {
+	setupTest()
+
+	sub, err := testcluster.clients[0].PubSub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = sub.Subscribe("pubsub_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := sub.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(reply, " ") != "subscribe pubsub_test 1" {
+		t.Fatalf("Expecting [subscribe pubsub_test 1], got %s", reply)
+	}
+
+	// publish on a node from another shard, subscriber should still hear it
+	_, err = testcluster.clients[5].Publish("pubsub_test", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err = sub.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(reply, " ") != "message pubsub_test hello" {
+		t.Fatalf("Expecting [message pubsub_test hello], got %s", reply)
+	}
+}
+
+func TestPatternSubscribe(t *testing.T) {
+	setupTest()
+
+	sub, err := testcluster.clients[1].PubSub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = sub.PSubscribe("psub_test.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sub.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := testcluster.clients[1].Publish("psub_test.a", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != 1 {
+		t.Fatalf("Expecting 1 local receiver, got %d", received)
+	}
+	reply, err := sub.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(reply, " ") != "pmessage psub_test.* psub_test.a hi" {
+		t.Fatalf("Expecting [pmessage psub_test.* psub_test.a hi], got %s", reply)
+	}
+}
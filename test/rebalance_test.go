@@ -0,0 +1,71 @@
+package raftis
+
+import (
+	config "github.com/jbooth/raftis/config"
+	"testing"
+)
+
+func slotCounts(shards []config.Shard) map[int]int {
+	ret := make(map[int]int)
+	for _, s := range shards {
+		ret[s.ShardId] = len(s.Slots)
+	}
+	return ret
+}
+
+func TestPlanRebalance(t *testing.T) {
+	shards := config.Shards(30, []config.Host{
+		config.Host{"a:1", "a:2", "g1"},
+		config.Host{"b:1", "b:2", "g2"},
+		config.Host{"c:1", "c:2", "g3"},
+	})
+	even := map[int]config.ShardLoad{}
+	for _, s := range shards {
+		even[s.ShardId] = config.ShardLoad{s.ShardId, 1000, 1 << 20, 50}
+	}
+	if moves := config.PlanRebalance(shards, even, 0.1, 0); len(moves) != 0 {
+		t.Fatalf("Expecting nothing to move for an even cluster, got %v", moves)
+	}
+
+	// a new empty shard takes an even share
+	shards = append(shards, config.Shard{3, nil, []config.Host{config.Host{"d:1", "d:2", "g1"}}})
+	moves := config.PlanRebalance(shards, even, 0.1, 0)
+	after := slotCounts(config.ApplyMoves(shards, moves))
+	if after[3] < 6 || after[3] > 8 {
+		t.Fatalf("Expecting about a quarter of the slots on the new shard, got %v", after)
+	}
+	seen := make(map[uint32]bool)
+	for _, m := range moves {
+		if seen[m.Slot] || m.To != 3 {
+			t.Fatalf("Expecting each slot moved once, to the new shard, got %v", moves)
+		}
+		seen[m.Slot] = true
+	}
+	if limited := config.PlanRebalance(shards, even, 0.1, 2); len(limited) != 2 {
+		t.Fatalf("Expecting 2 moves with a limit of 2, got %v", limited)
+	}
+
+	// a hot shard gives up slots to the coolest
+	hot := map[int]config.ShardLoad{
+		0: config.ShardLoad{0, 3000, 3 << 20, 300},
+		1: config.ShardLoad{1, 1000, 1 << 20, 50},
+		2: config.ShardLoad{2, 1000, 1 << 20, 50},
+	}
+	moves = config.PlanRebalance(shards[:3], hot, 0.1, 0)
+	if len(moves) == 0 {
+		t.Fatalf("Expecting moves off the hot shard")
+	}
+	fromHot := 0
+	for _, m := range moves {
+		if m.From == 0 {
+			fromHot++
+		}
+	}
+	if fromHot < 4 {
+		t.Fatalf("Expecting shard 0 to give up most of the slots, got %v", moves)
+	}
+	after = slotCounts(config.ApplyMoves(shards[:3], moves))
+	if after[0] >= 10 || after[0]+after[1]+after[2] != 30 {
+		t.Fatalf("Expecting shard 0 to shrink and no slots lost, got %v", after)
+	}
+}
@@ -0,0 +1,75 @@
+package raftis
+
+import (
+	"fmt"
+	config "github.com/jbooth/raftis/config"
+	"testing"
+)
+
+func TestIndexToken(t *testing.T) {
+	tok, err := config.ParseIndexToken("2:40,0:17,2:12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok[0] != 17 || tok[2] != 40 || len(tok) != 2 {
+		t.Fatalf("Expecting 0:17 and the higher index for shard 2, got %v", tok)
+	}
+	tok.Merge(config.IndexToken{0: 3, 1: 9})
+	if s := tok.String(); s != "0:17,1:9,2:40" {
+		t.Fatalf("Expecting 0:17,1:9,2:40, got %s", s)
+	}
+	empty, err := config.ParseIndexToken("")
+	if err != nil || len(empty) != 0 || empty.String() != "" {
+		t.Fatalf("Expecting an empty token, got %v %s", empty, err)
+	}
+	for _, bad := range []string{"5", "a:1", "1:b", "1:2,"} {
+		if _, err := config.ParseIndexToken(bad); err == nil {
+			t.Fatalf("Expecting an error parsing %q", bad)
+		}
+	}
+}
+
+func TestWaitIndex(t *testing.T) {
+	setupTest()
+
+	writer := testcluster.clients[0]
+	reader := testcluster.clients[len(testcluster.clients)-1]
+	_, err := writer.ExecuteCommand("CLIENT", "TRACKINDEX", "ON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.ExecuteCommand("CLIENT", "TRACKINDEX", "OFF")
+	// enough keys that some get forwarded
+	for i := 0; i < 10; i++ {
+		err = writer.Set(fmt.Sprintf("waitindex%d", i), "v", 0, 0, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := writer.ExecuteCommand("WRITEINDEX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := config.ParseIndexToken(string(resp.Bulk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tok) < 2 {
+		t.Fatalf("Expecting indexes from more than one shard, got %s", resp.Bulk)
+	}
+
+	_, err = reader.ExecuteCommand("WAITINDEX", string(resp.Bulk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.ExecuteCommand("WAITINDEX", "")
+	for i := 0; i < 10; i++ {
+		v, err := reader.Get(fmt.Sprintf("waitindex%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != "v" {
+			t.Fatalf("Expecting our write on the other node, got %q", v)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package raftis
+
+import (
+	config "github.com/jbooth/raftis/config"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	// values from redis' CLUSTER KEYSLOT
+	for key, slot := range map[string]uint32{
+		"foo":                  12182,
+		"bar":                  5061,
+		"123456789":            12739,
+		"{user1000}.following": 3443,
+		"{user1000}.followers": 3443,
+		"foo{}{bar}":           config.KeySlot(config.SlotHashCRC16, config.RedisClusterSlots, []byte("foo{}{bar}")),
+		"foo{{bar}}zap":        config.KeySlot(config.SlotHashCRC16, config.RedisClusterSlots, []byte("{bar")),
+		"foo{bar}{zap}":        5061,
+	} {
+		if got := config.KeySlot(config.SlotHashCRC16, config.RedisClusterSlots, []byte(key)); got != slot {
+			t.Fatalf("Expecting slot %d for %s, got %d", slot, key, got)
+		}
+	}
+	if config.CRC16([]byte("123456789")) != 0x31c3 {
+		t.Fatalf("Expecting the XMODEM check value, got %x", config.CRC16([]byte("123456789")))
+	}
+	if tag := string(config.HashTag([]byte("foo{}{bar}"))); tag != "foo{}{bar}" {
+		t.Fatalf("Expecting an empty tag to hash the whole key, got %s", tag)
+	}
+	// existing configs keep their layout
+	if got := config.KeySlot("", 100, []byte("foo")); got != config.KeySlot(config.SlotHashLegacy, 100, []byte("foo")) {
+		t.Fatalf("Expecting no slotHash to mean legacy")
+	}
+}
+
+func TestRehashShards(t *testing.T) {
+	shards := config.Shards(10, []config.Host{
+		config.Host{"a:1", "a:2", "g1"},
+		config.Host{"b:1", "b:2", "g1"},
+		config.Host{"c:1", "c:2", "g1"},
+	})
+	rehashed := config.RehashShards(shards, config.RedisClusterSlots)
+	next := uint32(0)
+	for i, s := range rehashed {
+		if s.Hosts[0] != shards[i].Hosts[0] {
+			t.Fatalf("Expecting shard %d to keep its hosts", i)
+		}
+		for _, slot := range s.Slots {
+			if slot != next {
+				t.Fatalf("Expecting contiguous slots, got %d after %d", slot, next)
+			}
+			next++
+		}
+	}
+	if next != config.RedisClusterSlots {
+		t.Fatalf("Expecting every slot assigned, got %d", next)
+	}
+}
@@ -0,0 +1,40 @@
+package raftis
+
+import (
+	config "github.com/jbooth/raftis/config"
+	"testing"
+)
+
+func TestPickAbandonedHost(t *testing.T) {
+	shards := []config.Shard{
+		config.Shard{0, []uint32{0}, []config.Host{
+			config.Host{"a:1", "a:2", "g1"},
+			config.Host{"b:1", "b:2", "g2"},
+			config.Host{"c:1", "c:2", "g3"},
+		}},
+		config.Shard{1, []uint32{1}, []config.Host{
+			config.Host{"d:1", "d:2", "g1"},
+			config.Host{"e:1", "e:2", "g2"},
+			config.Host{"f:1", "f:2", "g3"},
+		}},
+	}
+	allUp := map[string]bool{"a:1": true, "b:1": true, "c:1": true, "d:1": true, "e:1": true, "f:1": true}
+	if si, hi := config.PickAbandonedHost(shards, allUp, nil); si != -1 || hi != -1 {
+		t.Fatalf("Expecting nothing to replace, got %d %d", si, hi)
+	}
+
+	// the first host of a shard counts too
+	live := map[string]bool{"b:1": true, "c:1": true, "d:1": true, "e:1": true, "f:1": true}
+	if si, hi := config.PickAbandonedHost(shards, live, nil); si != -1 {
+		t.Fatalf("Expecting a host down for one poll to be left alone, got %d %d", si, hi)
+	}
+	if si, hi := config.PickAbandonedHost(shards, live, map[string]bool{"a:1": true}); si != 0 || hi != 0 {
+		t.Fatalf("Expecting shard 0 host 0, got %d %d", si, hi)
+	}
+
+	// a shard without a majority up can't swap us in
+	live = map[string]bool{"a:1": true, "b:1": true, "c:1": true, "f:1": true}
+	if si, hi := config.PickAbandonedHost(shards, live, map[string]bool{"d:1": true, "e:1": true}); si != -1 {
+		t.Fatalf("Expecting a shard without quorum to be skipped, got %d %d", si, hi)
+	}
+}
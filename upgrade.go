@@ -0,0 +1,247 @@
+package raftis
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	dbwrap "github.com/jbooth/raftis/dbwrap"
+	redis "github.com/jbooth/raftis/redis"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultUpgradeBatch = 256
+
+// online rewrite of values stored in older format versions or sealed with an old key, one run per shard.
+// we scan our local copy for stale values and push their keys through raft in REWRITEVALUES batches,
+// so every replica rewrites the same keys in the same order while serving traffic.
+// UPGRADEFORMAT and ROTATEKEYS both drive it.
+type formatUpgrade struct {
+	l         *sync.Mutex
+	running   bool
+	done      bool
+	err       error
+	startTime int64
+	total     uint64 // keys in the shard when we started
+	scanned   uint64
+	rewritten uint64
+}
+
+func newFormatUpgrade() *formatUpgrade {
+	return &formatUpgrade{l: &sync.Mutex{}}
+}
+
+// UPGRADEFORMAT [batchSize]
+// starts upgrading this node's shard in the background, progress shows up in STATS
+func upgradeFormat(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	batchSize := defaultUpgradeBatch
+	if len(args) > 0 {
+		var err error
+		batchSize, err = parseBatchSize(args[0])
+		if err != nil {
+			return redis.NewError(err.Error())
+		}
+	}
+	err := s.upgrade.start(s, batchSize)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return &redis.StatusReply{Code: "OK"}
+}
+
+func parseBatchSize(arg []byte) (int, error) {
+	batchSize, err := strconv.Atoi(string(arg))
+	if err != nil || batchSize <= 0 {
+		return 0, fmt.Errorf("ERR invalid batch size %s", string(arg))
+	}
+	return batchSize, nil
+}
+
+// ROTATEKEYS keyId [batchSize]
+// switches the shard to sealing values with keyId, then re-encrypts existing values in the background.
+// keyId has to be in the key file on every replica first, we ask them all before proposing USEKEY.
+func rotateKeys(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) < 1 || len(args) > 2 {
+		return redis.NewError("ERR wrong number of arguments for 'rotatekeys' command")
+	}
+	batchSize := defaultUpgradeBatch
+	if len(args) > 1 {
+		var err error
+		batchSize, err = parseBatchSize(args[1])
+		if err != nil {
+			return redis.NewError(err.Error())
+		}
+	}
+	id, err := strconv.ParseUint(string(args[0]), 10, 32)
+	if err != nil || id == 0 {
+		return redis.NewError("ERR invalid key id " + string(args[0]))
+	}
+	checked := allOK(s.onEveryReplica(keyCheckLocal, "KEYCHECKLOCAL", args[:1]))
+	if _, isErr := checked.(*redis.ErrorReply); isErr {
+		return checked
+	}
+	resp := <-s.flotilla.Command("USEKEY", args[:1])
+	if resp.Err != nil {
+		return redis.NewError("ERR " + resp.Err.Error())
+	}
+	if string(resp.Response) != "+OK\r\n" {
+		// USEKEY failed, its reply says why
+		return redis.NewError(strings.TrimSpace(string(resp.Response[1:])))
+	}
+	err = s.upgrade.start(s, batchSize)
+	if err != nil {
+		return redis.NewError(err.Error())
+	}
+	return &redis.StatusReply{Code: "OK"}
+}
+
+// KEYCHECKLOCAL keyId
+// OK if keyId is in our key file, sent by the node running ROTATEKEYS
+func keyCheckLocal(args [][]byte, c *Conn, s *Server) io.WriterTo {
+	if len(args) != 1 {
+		return redis.NewError("ERR wrong number of arguments for 'keychecklocal' command")
+	}
+	id, err := strconv.ParseUint(string(args[0]), 10, 32)
+	if err != nil || id == 0 {
+		return redis.NewError("ERR invalid key id " + string(args[0]))
+	}
+	err = dbwrap.CheckKey(uint32(id))
+	if err != nil {
+		return redis.NewError(fmt.Sprintf("ERR %s on %s", err, s.cluster.c.Me.RedisAddr))
+	}
+	return &redis.StatusReply{Code: "OK"}
+}
+
+func (u *formatUpgrade) start(s *Server, batchSize int) error {
+	u.l.Lock()
+	defer u.l.Unlock()
+	if u.running {
+		return fmt.Errorf("ERR value rewrite already running")
+	}
+	u.running = true
+	u.done = false
+	u.err = nil
+	u.startTime = time.Now().Unix()
+	u.total = 0
+	u.scanned = 0
+	u.rewritten = 0
+	go u.run(s, batchSize)
+	return nil
+}
+
+// walks every logical db in turn
+func (u *formatUpgrade) run(s *Server, batchSize int) {
+	var from []byte = nil
+	db := 0
+	for {
+		keys, next, scanned, total, err := staleKeys(s, db, from, batchSize)
+		if err == nil && len(keys) > 0 {
+			resp := <-s.command(db, "REWRITEVALUES", keys)
+			err = resp.Err
+			if err == nil {
+				// response is a redis integer reply, ":<n>\r\n", or a status on failure
+				if len(resp.Response) < 3 || resp.Response[0] != ':' {
+					err = fmt.Errorf("REWRITEVALUES failed: %s", string(resp.Response))
+				} else {
+					var rewritten uint64
+					rewritten, err = strconv.ParseUint(string(resp.Response[1:len(resp.Response)-2]), 10, 64)
+					u.l.Lock()
+					u.rewritten += rewritten
+					u.l.Unlock()
+				}
+			}
+		}
+		u.l.Lock()
+		if from == nil {
+			// starting on this db
+			u.total += total
+		}
+		u.scanned += scanned
+		if err == nil && next == nil && db < dbwrap.NumDBs-1 {
+			u.l.Unlock()
+			db++
+			from = nil
+			continue
+		}
+		if err != nil || next == nil {
+			u.running = false
+			u.done = err == nil
+			u.err = err
+			u.l.Unlock()
+			if err != nil {
+				s.lg.Errorf("Value rewrite failed after scanning %d keys: %s", u.scanned, err)
+			} else {
+				s.lg.Printf("Value rewrite finished, rewrote %d of %d keys", u.rewritten, u.scanned)
+			}
+			return
+		}
+		u.l.Unlock()
+		from = next
+	}
+}
+
+// scans up to batchSize keys of db from our local copy starting at from (nil for the beginning),
+// returns the ones in an old format or under an old key, the key to continue from (nil when finished),
+// how many we scanned and how many keys there are in total
+func staleKeys(s *Server, db int, from []byte, batchSize int) ([][]byte, []byte, uint64, uint64, error) {
+	rtxn, err := s.flotilla.Read()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	defer rtxn.Abort()
+	txn := dbwrap.NewTxnInDB(rtxn, db)
+	dbi, err := dbwrap.GetDBI(txn, 0)
+	if err == mdb.NotFound {
+		// nothing's ever been written
+		return nil, nil, 0, 0, nil
+	} else if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	stat, err := txn.Stat(dbi)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	defer c.Close()
+	var k, v []byte
+	if from == nil {
+		k, v, err = c.Get(nil, mdb.FIRST)
+	} else {
+		k, v, err = c.Get(from, mdb.SET_RANGE)
+	}
+	keys := make([][]byte, 0)
+	scanned := uint64(0)
+	for err == nil && scanned < uint64(batchSize) {
+		if dbwrap.NeedsRewrite(v) {
+			keys = append(keys, k)
+		}
+		scanned++
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err == mdb.NotFound {
+		return keys, nil, scanned, stat.Entries, nil
+	} else if err != nil {
+		return nil, nil, scanned, stat.Entries, err
+	}
+	return keys, k, scanned, stat.Entries, nil
+}
+
+func (u *formatUpgrade) String() string {
+	u.l.Lock()
+	defer u.l.Unlock()
+	state := "idle"
+	if u.running {
+		state = "running"
+	} else if u.done {
+		state = "done"
+	} else if u.err != nil {
+		state = "failed: " + u.err.Error()
+	}
+	return fmt.Sprintf("value rewrite: %s, current format %d, current key %d, started %d, scanned %d of %d keys, rewrote %d",
+		state, dbwrap.CURRENT_FORMAT, dbwrap.CurrentKeyID(), u.startTime, u.scanned, u.total, u.rewritten)
+}